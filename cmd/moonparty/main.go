@@ -8,6 +8,7 @@ import (
 	"syscall"
 
 	"github.com/zalo/moonparty/internal/server"
+	"github.com/zalo/moonparty/moonlight-common-go/logging"
 )
 
 func main() {
@@ -17,31 +18,54 @@ func main() {
 	sunshinePort := flag.Int("port", 47989, "Sunshine Moonlight API port (not 47990 web UI)")
 	listenAddr := flag.String("listen", ":8080", "Web server listen address")
 	newIdentity := flag.Bool("new-identity", false, "Generate a new client identity (use if pairing is stuck)")
+	identityDir := flag.String("identity-dir", "", "Directory holding the client identity (default ~/.moonparty)")
 	useLimelight := flag.Bool("limelight", true, "Use moonlight-common-go backend (better FEC/depacketization)")
 	noLimelight := flag.Bool("no-limelight", false, "Use basic streaming backend instead of moonlight-common-go")
+	pureGo := flag.Bool("pure-go", false, "Drive the moonlight-common-go client directly, without the limelight wrapper")
+	mtu := flag.Int("mtu", 0, "MTU of the path from Sunshine, to size video packets for VPNs (default fits most paths)")
+	recordInput := flag.String("record-input", "", "File to record every session's input to, for reproducing input bugs")
+	replayInput := flag.String("replay-input", "", "Input recording to replay into each session once it streams")
+	logLevel := flag.String("log-level", "info", "Log verbosity: debug, info, warn or error")
 	flag.Parse()
 
-	// Create configuration with defaults
-	cfg := &server.Config{
-		ListenAddr:       *listenAddr,
-		SunshineHost:     *sunshineHost,
-		SunshinePort:     *sunshinePort,
-		ConfigPath:       *configPath,
-		ForceNewIdentity: *newIdentity,
-		UseLimelight:     *useLimelight && !*noLimelight,
-		MaxPlayers:       4,
-		ICEServers: []string{
-			"stun:stun.l.google.com:19302",
-			"stun:stun1.l.google.com:19302",
-		},
-		StreamSettings: server.StreamSettings{
-			Width:         1920,
-			Height:        1080,
-			FPS:           60,
-			Bitrate:       20000,
-			Codec:         "h264",
-			AudioChannels: 2,
-		},
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatalf("Invalid -log-level: %v", err)
+	}
+	logging.SetDefault(logging.New(log.Default(), level))
+
+	// Start from the config file, or the defaults without one
+	cfg, err := server.LoadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	cfg.ForceNewIdentity = *newIdentity
+
+	// Flags given on the command line override the file
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "host":
+			cfg.SunshineHost = *sunshineHost
+		case "port":
+			cfg.SunshinePort = *sunshinePort
+		case "listen":
+			cfg.ListenAddr = *listenAddr
+		case "limelight":
+			cfg.UseLimelight = *useLimelight
+		case "pure-go":
+			cfg.UsePureGo = *pureGo
+		case "identity-dir":
+			cfg.IdentityDir = *identityDir
+		case "mtu":
+			cfg.MTU = *mtu
+		case "record-input":
+			cfg.RecordInputPath = *recordInput
+		case "replay-input":
+			cfg.ReplayInputPath = *replayInput
+		}
+	})
+	if *noLimelight {
+		cfg.UseLimelight = false
 	}
 
 	// Create and start server
@@ -56,13 +80,13 @@ func main() {
 
 	go func() {
 		<-sigChan
-		log.Println("Shutting down...")
+		logging.Infof("Shutting down...")
 		srv.Shutdown()
 	}()
 
 	// Start the server
-	log.Printf("Moonparty starting on %s", *listenAddr)
-	log.Printf("Connecting to Sunshine at %s:%d", *sunshineHost, *sunshinePort)
+	logging.Infof("Moonparty starting on %s", cfg.ListenAddr)
+	logging.Infof("Connecting to Sunshine at %s:%d", cfg.SunshineHost, cfg.SunshinePort)
 
 	if err := srv.Run(); err != nil {
 		log.Fatalf("Server error: %v", err)
@@ -8,26 +8,38 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/pem"
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
-	"log"
+	"math"
 	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/zalo/moonparty/moonlight-common-go/control"
+	"github.com/zalo/moonparty/moonlight-common-go/input"
+	"github.com/zalo/moonparty/moonlight-common-go/logging"
+	"github.com/zalo/moonparty/moonlight-common-go/rtsp"
+	"github.com/zalo/moonparty/moonlight-common-go/types"
 )
 
 // Sunshine ports
@@ -44,14 +56,22 @@ type Client struct {
 	httpClient  *http.Client
 	uniqueID    string
 	clientCert  *tls.Certificate
-	certDER     []byte    // Raw certificate bytes for pairing
-	certPEM     []byte    // PEM-encoded certificate for pairing request
+	certDER     []byte // Raw certificate bytes for pairing
+	certPEM     []byte // PEM-encoded certificate for pairing request
 	privateKey  *rsa.PrivateKey
 	paired      bool
 	pairingPIN  string
-	pairingSalt []byte    // Salt used in current pairing session
-	pairingUUID string    // UUID for current pairing session
+	pairingSalt []byte // Salt used in current pairing session
+	pairingUUID string // UUID for current pairing session
 	deviceName  string
+	identityDir string // Where the identity files live; empty uses DefaultIdentityDir
+	serverCert  []byte // Sunshine's certificate (DER), pinned at pairing
+
+	serverVersion [4]int // Sunshine's appversion; zero until testConnectivity
+
+	pairingCallbacks PairingCallbacks // Report pairing progress; nil fields log
+
+	log logging.Logger // Where the client and its streams log
 }
 
 // NewClient creates a new Moonlight client
@@ -65,6 +85,7 @@ func NewClient(host string, port int) *Client {
 		host:       host,
 		port:       port,
 		deviceName: "Moonparty",
+		log:        logging.Default(),
 		httpClient: &http.Client{
 			Timeout: 90 * time.Second, // Long timeout for pairing (matches moonlight-web-stream)
 			Transport: &http.Transport{
@@ -85,59 +106,152 @@ func (c *Client) Connect(ctx context.Context) error {
 	}
 
 	// First, test basic connectivity to Sunshine
-	log.Printf("Testing connectivity to Sunshine at %s:%d...", c.host, c.port)
+	c.log.Infof("Testing connectivity to Sunshine at %s:%d...", c.host, c.port)
 	if err := c.testConnectivity(ctx); err != nil {
 		return fmt.Errorf("connectivity test failed: %w", err)
 	}
-	log.Println("Connectivity OK")
+	c.log.Infof("Connectivity OK")
 
 	// Check if already paired
 	paired, err := c.checkPaired(ctx)
 	if err != nil {
-		log.Printf("Pair check returned error (may need pairing): %v", err)
+		c.log.Warnf("Pair check returned error (may need pairing): %v", err)
+		paired = false
+	}
+
+	if paired && c.serverCert == nil {
+		c.log.Warnf("Paired before Sunshine's certificate was pinned; pairing again.")
 		paired = false
 	}
 
 	c.paired = paired
 	if !paired {
-		log.Println("Not paired with Sunshine.")
-
-		// First, unpair to clear any stuck pairing state
-		log.Println("Clearing any stuck pairing state...")
-		if err := c.Unpair(ctx); err != nil {
-			log.Printf("Unpair returned (this is normal): %v", err)
+		c.log.Infof("Not paired with Sunshine.")
+		if err := c.pair(ctx); err != nil {
+			return err
 		}
+	} else {
+		c.log.Infof("Successfully connected to Sunshine (already paired)")
+	}
 
-		// Generate PIN FIRST and display it BEFORE making the pairing request
-		// This is critical because Sunshine holds the HTTP response open
-		// until the user enters the PIN in the web UI
-		pinBytes := make([]byte, 4)
-		rand.Read(pinBytes)
-		pin := fmt.Sprintf("%04d", (int(pinBytes[0])<<8|int(pinBytes[1]))%10000)
-		c.pairingPIN = pin
-
-		log.Println("")
-		log.Println("============================================")
-		log.Printf("  PAIRING PIN: %s", pin)
-		log.Println("============================================")
-		log.Println("")
-		log.Println("Enter this PIN in Sunshine's web UI NOW:")
-		log.Printf("  https://%s:47990 -> PIN Pairing", c.host)
-		log.Println("")
-		log.Println("The request below will wait until you enter the PIN...")
-		log.Println("")
-
-		// Now start pairing - this will block until user enters PIN in Sunshine
-		if err := c.StartPairing(ctx); err != nil {
-			return fmt.Errorf("pairing error: %w", err)
-		}
+	return nil
+}
+
+// Pair runs the PIN pairing flow on its own, reporting the PIN and progress
+// through the PairingCallbacks. It blocks until the PIN is entered in
+// Sunshine, the pairing fails or ctx ends.
+func (c *Client) Pair(ctx context.Context) error {
+	if err := c.loadOrGenerateIdentity(); err != nil {
+		return fmt.Errorf("identity error: %w", err)
+	}
+
+	c.paired = false
+	return c.pair(ctx)
+}
+
+// Repair pairs again even though Sunshine's HTTP API still reports this
+// client as paired, for when the HTTPS side rejects its certificate (see
+// ErrNeedsRepair). Like Connect, it blocks until the PIN is entered.
+func (c *Client) Repair(ctx context.Context) error {
+	c.log.Warnf("Sunshine rejected our certificate; pairing again.")
+	return c.Pair(ctx)
+}
+
+// Pairing phases reported to PairingCallbacks.OnPhase, in the order they run
+const (
+	PairingPhaseServerCert      = 1 // Waiting for the PIN to be entered in Sunshine
+	PairingPhaseChallenge       = 2 // Exchanging challenges with Sunshine
+	PairingPhaseChallengeResult = 3 // Answering Sunshine's challenge
+	PairingPhaseClientSecret    = 4 // Sending the client's pairing secret
+)
+
+// PairingCallbacks report a pairing's progress, so the PIN can be shown
+// somewhere other than the log. They're called on the pairing goroutine and
+// should return quickly. A nil field keeps the default, which logs.
+type PairingCallbacks struct {
+	// OnPINGenerated receives the PIN to enter in Sunshine's web UI before
+	// the pairing request that waits for it is sent
+	OnPINGenerated func(pin string)
 
-		log.Println("Pairing successful!")
-		c.paired = true
+	// OnPhase receives each PairingPhase as it starts
+	OnPhase func(phase int)
+
+	// OnResult receives the outcome: nil once paired
+	OnResult func(err error)
+}
+
+// SetPairingCallbacks sets the callbacks pairing reports its progress to
+func (c *Client) SetPairingCallbacks(cb PairingCallbacks) {
+	c.pairingCallbacks = cb
+}
+
+// pairingPINGenerated reports the generated PIN, printing it prominently by default
+func (c *Client) pairingPINGenerated(pin string) {
+	if c.pairingCallbacks.OnPINGenerated != nil {
+		c.pairingCallbacks.OnPINGenerated(pin)
+		return
+	}
+
+	c.log.Infof("")
+	c.log.Infof("============================================")
+	c.log.Infof("  PAIRING PIN: %s", pin)
+	c.log.Infof("============================================")
+	c.log.Infof("")
+	c.log.Infof("Enter this PIN in Sunshine's web UI NOW:")
+	c.log.Infof("  https://%s -> PIN Pairing", net.JoinHostPort(c.host, strconv.Itoa(PortWebUI)))
+	c.log.Infof("")
+	c.log.Infof("The request below will wait until you enter the PIN...")
+	c.log.Infof("")
+}
+
+// pairingPhase reports the pairing phase that's starting
+func (c *Client) pairingPhase(phase int) {
+	if c.pairingCallbacks.OnPhase != nil {
+		c.pairingCallbacks.OnPhase(phase)
+		return
+	}
+	c.log.Debugf("Pairing phase %d of %d", phase, PairingPhaseClientSecret)
+}
+
+// pairingResult reports how pairing ended
+func (c *Client) pairingResult(err error) {
+	if c.pairingCallbacks.OnResult != nil {
+		c.pairingCallbacks.OnResult(err)
+		return
+	}
+	if err == nil {
+		c.log.Infof("Pairing successful!")
 	} else {
-		log.Println("Successfully connected to Sunshine (already paired)")
+		c.log.Errorf("Pairing failed: %v", err)
+	}
+}
+
+// pair runs the PIN pairing flow, showing the PIN to enter in Sunshine
+func (c *Client) pair(ctx context.Context) error {
+	// First, unpair to clear any stuck pairing state
+	c.log.Debugf("Clearing any stuck pairing state...")
+	if err := c.Unpair(ctx); err != nil {
+		c.log.Debugf("Unpair returned (this is normal): %v", err)
+	}
+
+	// Generate PIN FIRST and display it BEFORE making the pairing request
+	// This is critical because Sunshine holds the HTTP response open
+	// until the user enters the PIN in the web UI
+	pinBytes := make([]byte, 4)
+	rand.Read(pinBytes)
+	pin := fmt.Sprintf("%04d", (int(pinBytes[0])<<8|int(pinBytes[1]))%10000)
+	c.pairingPIN = pin
+	c.pairingPINGenerated(pin)
+
+	// Now start pairing - this will block until user enters PIN in Sunshine
+	if err := c.StartPairing(ctx); err != nil {
+		err = fmt.Errorf("pairing error: %w", err)
+		c.pairingResult(err)
+		return err
 	}
 
+	c.paired = true
+	c.pairingResult(nil)
 	return nil
 }
 
@@ -156,14 +270,33 @@ func (c *Client) testConnectivity(ctx context.Context) error {
 	}
 	defer resp.Body.Close()
 
+	body, _ := io.ReadAll(resp.Body)
 	if resp.StatusCode != 200 {
-		body, _ := io.ReadAll(resp.Body)
 		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, string(body))
 	}
 
+	// The pairing hash depends on the server generation
+	var info struct {
+		AppVersion string `xml:"appversion"`
+	}
+	if err := xml.Unmarshal(body, &info); err == nil {
+		c.serverVersion = parseAppVersion(info.AppVersion)
+		c.log.Infof("Sunshine appversion %q (major version %d)", info.AppVersion, c.serverVersion[0])
+	}
+
 	return nil
 }
 
+// parseAppVersion splits an appversion such as "7.1.431.-1" into its four
+// numbers; missing or malformed parts are 0
+func parseAppVersion(version string) [4]int {
+	var v [4]int
+	for i, part := range strings.SplitN(version, ".", 4) {
+		v[i], _ = strconv.Atoi(strings.TrimSpace(part))
+	}
+	return v
+}
+
 // Unpair clears the pairing state with Sunshine
 func (c *Client) Unpair(ctx context.Context) error {
 	url := fmt.Sprintf("http://%s:%d/unpair?uniqueid=%s", c.host, c.port, c.uniqueID)
@@ -183,6 +316,14 @@ func (c *Client) Unpair(ctx context.Context) error {
 	return nil
 }
 
+// pinEntryTimeout is how long pairing waits for the PIN to be entered in
+// Sunshine, which holds the getservercert response until it is
+var pinEntryTimeout = 2 * time.Minute
+
+// ErrPINTimeout is returned by pairing when Sunshine was reached but the PIN
+// wasn't entered in its web UI within pinEntryTimeout
+var ErrPINTimeout = errors.New("PIN was not entered in Sunshine in time")
+
 // StartPairing initiates the pairing process (PIN must be set before calling)
 func (c *Client) StartPairing(ctx context.Context) error {
 	if c.pairingPIN == "" {
@@ -190,16 +331,57 @@ func (c *Client) StartPairing(ctx context.Context) error {
 	}
 
 	// Phase 1: Get server certificate (this blocks until user enters PIN in Sunshine!)
+	c.pairingPhase(PairingPhaseServerCert)
 	serverCert, err := c.pairGetServerCert(ctx)
 	if err != nil {
 		return fmt.Errorf("getservercert failed: %w", err)
 	}
 
 	// Phase 2: Send challenge
+	c.pairingPhase(PairingPhaseChallenge)
 	if err := c.pairChallenge(ctx, serverCert); err != nil {
 		return fmt.Errorf("challenge failed: %w", err)
 	}
 
+	if err := c.pinServerCert(serverCert); err != nil {
+		return fmt.Errorf("pin server certificate: %w", err)
+	}
+	return nil
+}
+
+// pinServerCert saves the certificate Sunshine sent while pairing, which its
+// HTTPS port must present from then on
+func (c *Client) pinServerCert(certPEM []byte) error {
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return fmt.Errorf("not a PEM certificate")
+	}
+	if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(filepath.Join(c.certDir(), "server.crt"), certPEM, 0600); err != nil {
+		return err
+	}
+	c.serverCert = block.Bytes
+	return nil
+}
+
+// loadServerCert loads the Sunshine certificate pinned at pairing, if any
+func (c *Client) loadServerCert() error {
+	certPEM, err := os.ReadFile(filepath.Join(c.certDir(), "server.crt"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return fmt.Errorf("server.crt is not a PEM certificate")
+	}
+	c.serverCert = block.Bytes
 	return nil
 }
 
@@ -221,34 +403,57 @@ func (c *Client) pairGetServerCert(ctx context.Context) ([]byte, error) {
 	pairURL := fmt.Sprintf("http://%s:%d/pair?uniqueid=%s&uuid=%s&devicename=%s&updateState=1&phrase=getservercert&salt=%s&clientcert=%s",
 		c.host, c.port, c.uniqueID, c.pairingUUID, c.deviceName, saltHex, certPEMHex)
 
-	log.Printf("Sending getservercert request (URL length: %d bytes)...", len(pairURL))
+	c.log.Debugf("Sending getservercert request (URL length: %d bytes)...", len(pairURL))
+
+	// Sunshine answers once the PIN is entered, which can take longer than
+	// the client's usual timeouts allow, so the wait is bounded by its own
+	// deadline instead. Whether the request got through tells a PIN never
+	// entered apart from a host that can't be reached.
+	pinCtx, cancel := context.WithTimeout(ctx, pinEntryTimeout)
+	defer cancel()
+	var sent atomic.Bool
+	pinCtx = httptrace.WithClientTrace(pinCtx, &httptrace.ClientTrace{
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			sent.Store(info.Err == nil)
+		},
+	})
 
-	req, err := http.NewRequestWithContext(ctx, "GET", pairURL, nil)
+	req, err := http.NewRequestWithContext(pinCtx, "GET", pairURL, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	resp, err := c.httpClient.Do(req)
+	client := c.pinEntryClient()
+	defer client.CloseIdleConnections()
+	resp, err := client.Do(req)
 	if err != nil {
+		switch {
+		case ctx.Err() != nil:
+			return nil, ctx.Err()
+		case !sent.Load():
+			return nil, fmt.Errorf("cannot reach Sunshine: %w", err)
+		case errors.Is(pinCtx.Err(), context.DeadlineExceeded):
+			return nil, ErrPINTimeout
+		}
 		return nil, err
 	}
 	defer resp.Body.Close()
 
-	log.Printf("Got response: status=%d", resp.StatusCode)
+	c.log.Debugf("Got response: status=%d", resp.StatusCode)
 
 	body, _ := io.ReadAll(resp.Body)
 
 	var pairResp struct {
-		Paired      string `xml:"paired"`
-		PlainCert   string `xml:"plaincert"`
-		Status      string `xml:"status_code"`
-		StatusMsg   string `xml:"status_message"`
+		Paired    string `xml:"paired"`
+		PlainCert string `xml:"plaincert"`
+		Status    string `xml:"status_code"`
+		StatusMsg string `xml:"status_message"`
 	}
 	if err := xml.Unmarshal(body, &pairResp); err != nil {
 		return nil, fmt.Errorf("parse error: %w (body: %s)", err, string(body))
 	}
 
-	log.Printf("Parsed response: paired=%s, status=%s, msg=%s, cert_len=%d",
+	c.log.Debugf("Parsed response: paired=%s, status=%s, msg=%s, cert_len=%d",
 		pairResp.Paired, pairResp.Status, pairResp.StatusMsg, len(pairResp.PlainCert))
 
 	if pairResp.Paired != "1" && pairResp.Status != "200" {
@@ -264,10 +469,26 @@ func (c *Client) pairGetServerCert(ctx context.Context) ([]byte, error) {
 	return certBytes, nil
 }
 
+// pinEntryClient returns an HTTP client like the client's own but without
+// its response timeouts, for the request Sunshine holds until the PIN is
+// entered
+func (c *Client) pinEntryClient() *http.Client {
+	client := *c.httpClient
+	client.Timeout = 0
+	if t, ok := client.Transport.(*http.Transport); ok {
+		t = t.Clone()
+		t.ResponseHeaderTimeout = 0
+		client.Transport = t
+	}
+	return &client
+}
+
 // pairChallenge sends the client challenge (Phase 2)
 func (c *Client) pairChallenge(ctx context.Context, serverCertPEM []byte) error {
 	// Use the salt from Phase 1 to derive AES key
 	aesKey := c.generateAESKey(c.pairingSalt)
+	newHash, _ := c.pairingHash()
+	hashSize := newHash().Size()
 
 	// Generate client challenge (16 random bytes)
 	clientChallenge := make([]byte, 16)
@@ -284,7 +505,7 @@ func (c *Client) pairChallenge(ctx context.Context, serverCertPEM []byte) error
 	pairURL := fmt.Sprintf("http://%s:%d/pair?uniqueid=%s&uuid=%s&devicename=%s&updateState=1&clientchallenge=%s",
 		c.host, c.port, c.uniqueID, c.pairingUUID, c.deviceName, challengeHex)
 
-	log.Printf("Sending clientchallenge (Phase 2)...")
+	c.log.Debugf("Sending clientchallenge (Phase 2)...")
 
 	req, err := http.NewRequestWithContext(ctx, "GET", pairURL, nil)
 	if err != nil {
@@ -307,13 +528,13 @@ func (c *Client) pairChallenge(ctx context.Context, serverCertPEM []byte) error
 		return fmt.Errorf("parse challenge response: %w (body: %s)", err, string(body))
 	}
 
-	log.Printf("Phase 2 response: paired=%s, challengeresponse_len=%d", challengeResp.Paired, len(challengeResp.ChallengeResp))
+	c.log.Debugf("Phase 2 response: paired=%s, challengeresponse_len=%d", challengeResp.Paired, len(challengeResp.ChallengeResp))
 
 	if challengeResp.Paired != "1" {
 		return fmt.Errorf("challenge rejected")
 	}
 
-	// Decrypt server's response to get: hash (32 bytes) + server_challenge (16 bytes)
+	// Decrypt server's response to get: hash + server_challenge (16 bytes)
 	encryptedResponse, err := hex.DecodeString(challengeResp.ChallengeResp)
 	if err != nil {
 		return fmt.Errorf("decode challenge response: %w", err)
@@ -324,17 +545,18 @@ func (c *Client) pairChallenge(ctx context.Context, serverCertPEM []byte) error
 		return fmt.Errorf("decrypt challenge response: %w", err)
 	}
 
-	// Response format: hash (SHA256 = 32 bytes) + server_challenge (16 bytes)
-	if len(decryptedResponse) < 48 {
+	// Response format: hash (SHA256 = 32 bytes, SHA1 = 20) + server_challenge (16 bytes)
+	if len(decryptedResponse) < hashSize+16 {
 		return fmt.Errorf("challenge response too short: %d", len(decryptedResponse))
 	}
 
-	serverResponseHash := decryptedResponse[:32]
-	serverChallenge := decryptedResponse[32:48]
+	serverResponseHash := decryptedResponse[:hashSize]
+	serverChallenge := decryptedResponse[hashSize : hashSize+16]
 
-	log.Printf("Decrypted Phase 2: hash_len=%d, server_challenge_len=%d", len(serverResponseHash), len(serverChallenge))
+	c.log.Debugf("Decrypted Phase 2: hash_len=%d, server_challenge_len=%d", len(serverResponseHash), len(serverChallenge))
 
 	// Continue to Phase 3
+	c.pairingPhase(PairingPhaseChallengeResult)
 	return c.pairServerChallengeResponse(ctx, aesKey, serverCertPEM, clientChallenge, serverChallenge, serverResponseHash)
 }
 
@@ -351,8 +573,10 @@ func (c *Client) pairServerChallengeResponse(ctx context.Context, aesKey, server
 	}
 	clientCertSignature := cert.Signature
 
-	// Compute challenge response hash: SHA256(server_challenge + client_cert_signature + client_secret)
-	h := sha256.New()
+	// Compute challenge response hash: H(server_challenge + client_cert_signature + client_secret),
+	// with the same hash as the AES key
+	newHash, _ := c.pairingHash()
+	h := newHash()
 	h.Write(serverChallenge)
 	h.Write(clientCertSignature)
 	h.Write(clientSecret)
@@ -369,7 +593,7 @@ func (c *Client) pairServerChallengeResponse(ctx context.Context, aesKey, server
 	pairURL := fmt.Sprintf("http://%s:%d/pair?uniqueid=%s&uuid=%s&devicename=%s&updateState=1&serverchallengeresp=%s",
 		c.host, c.port, c.uniqueID, c.pairingUUID, c.deviceName, hashHex)
 
-	log.Printf("Sending serverchallengeresp (Phase 3)...")
+	c.log.Debugf("Sending serverchallengeresp (Phase 3)...")
 
 	req, err := http.NewRequestWithContext(ctx, "GET", pairURL, nil)
 	if err != nil {
@@ -392,7 +616,7 @@ func (c *Client) pairServerChallengeResponse(ctx context.Context, aesKey, server
 		return fmt.Errorf("parse server challenge response: %w (body: %s)", err, string(body))
 	}
 
-	log.Printf("Phase 3 response: paired=%s, pairingsecret_len=%d", scResp.Paired, len(scResp.PairingSecret))
+	c.log.Debugf("Phase 3 response: paired=%s, pairingsecret_len=%d", scResp.Paired, len(scResp.PairingSecret))
 
 	if scResp.Paired != "1" {
 		return fmt.Errorf("server challenge response failed")
@@ -412,6 +636,7 @@ func (c *Client) pairServerChallengeResponse(ctx context.Context, aesKey, server
 	// For now, continue to Phase 4
 
 	// Send client pairing secret (Phase 4)
+	c.pairingPhase(PairingPhaseClientSecret)
 	return c.pairClientSecret(ctx, aesKey, clientSecret)
 }
 
@@ -455,7 +680,7 @@ func (c *Client) pairClientSecret(ctx context.Context, aesKey, clientSecret []by
 		return fmt.Errorf("parse secret response: %w (body: %s)", err, string(body))
 	}
 
-	log.Printf("Phase 4 response: paired=%s", secretResp.Paired)
+	c.log.Debugf("Phase 4 response: paired=%s", secretResp.Paired)
 
 	if secretResp.Paired != "1" {
 		return fmt.Errorf("client secret rejected")
@@ -464,37 +689,23 @@ func (c *Client) pairClientSecret(ctx context.Context, aesKey, clientSecret []by
 	return nil
 }
 
-// waitForPairing polls until pairing is complete
-func (c *Client) waitForPairing(ctx context.Context) error {
-	ticker := time.NewTicker(2 * time.Second)
-	defer ticker.Stop()
-
-	timeout := time.After(2 * time.Minute)
-
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-timeout:
-			return fmt.Errorf("pairing timeout - PIN not entered in time")
-		case <-ticker.C:
-			paired, err := c.checkPaired(ctx)
-			if err != nil {
-				log.Printf("Checking pairing status... (waiting for PIN entry)")
-				continue
-			}
-			if paired {
-				return nil
-			}
-		}
+// pairingHash returns the hash pairing uses with this server: SHA256 for
+// Sunshine (server version 7+), SHA1 for GFE and older servers. An unknown
+// version is treated as current.
+func (c *Client) pairingHash() (newHash func() hash.Hash, name string) {
+	if c.serverVersion[0] != 0 && c.serverVersion[0] < 7 {
+		return sha1.New, "SHA1"
 	}
+	return sha256.New, "SHA256"
 }
 
 // generateAESKey derives an AES key from the PIN and salt
 func (c *Client) generateAESKey(salt []byte) []byte {
-	// Key = SHA256(salt + PIN as ASCII bytes)[:16]
-	// Note: Sunshine (server version 7+) uses SHA256, older servers use SHA1
-	h := sha256.New()
+	// Key = H(salt + PIN as ASCII bytes)[:16], H from pairingHash
+	newHash, name := c.pairingHash()
+	c.log.Debugf("Deriving pairing key with %s (server major version %d)", name, c.serverVersion[0])
+
+	h := newHash()
 	h.Write(salt)
 	h.Write([]byte(c.pairingPIN))
 	hash := h.Sum(nil)
@@ -540,28 +751,46 @@ func (c *Client) aesDecrypt(key, data []byte) ([]byte, error) {
 	return decrypted, nil
 }
 
+// DefaultIdentityDir is where the client identity is kept unless
+// SetIdentityDir says otherwise: ~/.moonparty
+func DefaultIdentityDir() string {
+	homeDir, _ := os.UserHomeDir()
+	return filepath.Join(homeDir, ".moonparty")
+}
+
+// certDir is the directory holding the client certificate, key and unique ID
+func (c *Client) certDir() string {
+	if c.identityDir != "" {
+		return c.identityDir
+	}
+	return DefaultIdentityDir()
+}
+
 // DeleteIdentity removes the stored client identity files
 func (c *Client) DeleteIdentity() error {
-	homeDir, _ := os.UserHomeDir()
-	certDir := filepath.Join(homeDir, ".moonparty")
+	certDir := c.certDir()
 
 	certPath := filepath.Join(certDir, "client.crt")
 	keyPath := filepath.Join(certDir, "client.key")
 	idPath := filepath.Join(certDir, "unique_id")
+	serverCertPath := filepath.Join(certDir, "server.crt")
 
 	os.Remove(certPath)
 	os.Remove(keyPath)
 	os.Remove(idPath)
+	os.Remove(serverCertPath)
+	c.serverCert = nil
 
-	log.Println("Deleted existing client identity")
+	c.log.Infof("Deleted existing client identity")
 	return nil
 }
 
 // loadOrGenerateIdentity loads or creates client certificates
 func (c *Client) loadOrGenerateIdentity() error {
-	homeDir, _ := os.UserHomeDir()
-	certDir := filepath.Join(homeDir, ".moonparty")
-	os.MkdirAll(certDir, 0700)
+	certDir := c.certDir()
+	if err := os.MkdirAll(certDir, 0700); err != nil {
+		return fmt.Errorf("failed to create identity directory: %w", err)
+	}
 
 	certPath := filepath.Join(certDir, "client.crt")
 	keyPath := filepath.Join(certDir, "client.key")
@@ -602,7 +831,11 @@ func (c *Client) loadOrGenerateIdentity() error {
 			return err
 		}
 		c.uniqueID = strings.TrimSpace(string(idBytes))
-		log.Printf("Loaded existing client identity: %s", c.uniqueID)
+
+		if err := c.loadServerCert(); err != nil {
+			return err
+		}
+		c.log.Infof("Loaded existing client identity: %s", c.uniqueID)
 		return nil
 	}
 
@@ -660,7 +893,7 @@ func (c *Client) loadOrGenerateIdentity() error {
 	}
 	c.clientCert = &cert
 
-	log.Printf("Generated new client identity: %s", c.uniqueID)
+	c.log.Infof("Generated new client identity: %s", c.uniqueID)
 	return nil
 }
 
@@ -692,14 +925,163 @@ func (c *Client) checkPaired(ctx context.Context) (bool, error) {
 	return serverInfo.PairStatus == "1", nil
 }
 
+// ServerInfo is what Sunshine reports about itself in /serverinfo. The MAC
+// address and host unique ID are left out so it can go into bug reports.
+type ServerInfo struct {
+	Hostname          string `xml:"hostname" json:"hostname"`
+	AppVersion        string `xml:"appversion" json:"app_version"`
+	GfeVersion        string `xml:"GfeVersion" json:"gfe_version"`
+	State             string `xml:"state" json:"state"`
+	PairStatus        string `xml:"PairStatus" json:"pair_status"`
+	CurrentGame       int    `xml:"currentgame" json:"current_game"`
+	CodecModeSupport  int    `xml:"ServerCodecModeSupport" json:"codec_mode_support"`
+	MaxLumaPixelsHEVC int64  `xml:"MaxLumaPixelsHEVC" json:"max_luma_pixels_hevc"`
+	HTTPSPort         int    `xml:"HttpsPort" json:"https_port"`
+	ExternalPort      int    `xml:"ExternalPort" json:"external_port"`
+}
+
+// GetServerInfo fetches Sunshine's /serverinfo as seen by this client
+func (c *Client) GetServerInfo(ctx context.Context) (*ServerInfo, error) {
+	url := fmt.Sprintf("http://%s:%d/serverinfo?uniqueid=%s", c.host, c.port, c.uniqueID)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot reach Sunshine: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var info ServerInfo
+	if err := xml.Unmarshal(body, &info); err != nil {
+		return nil, fmt.Errorf("parse serverinfo: %w", err)
+	}
+	return &info, nil
+}
+
 // Streaming ports (relative to base port 47989)
 const (
+	PortHTTPSOffset   = -5 // 47984
 	PortVideoOffset   = 9  // 47998
 	PortControlOffset = 10 // 47999
 	PortAudioOffset   = 11 // 48000
 	PortRTSPOffset    = 21 // 48010
 )
 
+// Audio quality levels for the x-nv-audio.surround.AudioQuality SDP attribute
+const (
+	AudioQualityNormal = 0 // Sunshine's default ~96 kbps stereo Opus
+	AudioQualityHigh   = 1 // High bitrate Opus
+)
+
+// AudioQualityForBitrate picks the Sunshine audio quality that best matches
+// the Opus bitrate (in kbps) we advertise to browsers; 0 means unset
+func AudioQualityForBitrate(kbps int) int {
+	if kbps > 96 {
+		return AudioQualityHigh
+	}
+	return AudioQualityNormal
+}
+
+// Video packet sizes. Sunshine splits frames into packets of the size
+// asked for, and those plus their headers must fit the path's MTU or they're
+// fragmented or dropped.
+const (
+	DefaultPacketSize = 1024 // Fits most paths, VPNs included
+	MaxPacketSize     = 1392 // Fits a 1500-byte Ethernet MTU
+	minPacketSize     = 256
+
+	// packetOverhead is what carrying a video packet adds: IPv6 (40), UDP
+	// (8), RTP (16 at most) and encryption (28) headers
+	packetOverhead = 92
+)
+
+// PacketSizeForMTU returns the largest video packet size that fits an MTU,
+// between 256 and MaxPacketSize
+func PacketSizeForMTU(mtu int) int {
+	size := (mtu - packetOverhead) &^ 15
+	return min(max(size, minPacketSize), MaxPacketSize)
+}
+
+// StreamOptions are the settings a stream is started with. Each stream
+// takes its own rather than the client holding them for the next one, so
+// streams started at once for different rooms can't launch each other's
+// app or settings.
+type StreamOptions struct {
+	Width   int
+	Height  int
+	FPS     int
+	Bitrate int // Kbps
+
+	AppID  int           // Sunshine app to launch (0 is typically Desktop)
+	Launch LaunchOptions // How Sunshine prepares the host; the zero value leaves it alone
+
+	// Formats requested; zero values are stereo H.264 SDR
+	VideoFormat types.VideoFormat
+	AudioConfig types.AudioConfiguration
+	HDR         bool
+
+	AudioQuality  int // AudioQuality requested in the RTSP ANNOUNCE
+	MinFECPackets int // Minimum FEC packets per block requested; 0 leaves FEC adaptive
+
+	// MTU sizes video packets to fit paths such as VPNs with a smaller MTU
+	// than Ethernet; 0 uses DefaultPacketSize. Sunshine may lower the size
+	// further.
+	MTU int
+
+	// How long the stream waits for its first frame and how long video may
+	// go silent before the connection is dropped. 0 keeps the default for
+	// either; a negative NoVideoTrafficTimeout disables the mid-stream check.
+	FirstFrameTimeout     time.Duration
+	NoVideoTrafficTimeout time.Duration
+
+	// How much audio to discard as the stream starts, and how late an audio
+	// packet may arrive and still be played in order. The native stream
+	// relays Sunshine's audio packets as they come and ignores these.
+	AudioInitialDropMs  int
+	AudioJitterBufferMs int
+}
+
+// videoFormat is the video format asked for, H.264 unless set
+func (o StreamOptions) videoFormat() types.VideoFormat {
+	if o.VideoFormat == 0 {
+		return types.VideoFormatH264
+	}
+	return o.VideoFormat
+}
+
+// packetSize is the video packet size the stream asks for
+func (o StreamOptions) packetSize() int {
+	if o.MTU > 0 {
+		return PacketSizeForMTU(o.MTU)
+	}
+	return DefaultPacketSize
+}
+
+// SetIdentityDir sets the directory the client certificate, key and unique ID
+// are kept in; empty uses DefaultIdentityDir. It must be called before the
+// identity is first loaded.
+func (c *Client) SetIdentityDir(dir string) {
+	c.identityDir = dir
+}
+
+// SetLogger sets the Logger the client and the streams it starts write to,
+// logging.Default() unless set
+func (c *Client) SetLogger(l logging.Logger) {
+	c.log = l
+}
+
 // Stream represents an active game stream
 type Stream struct {
 	client      *Client
@@ -708,8 +1090,16 @@ type Stream struct {
 	inputChan   chan InputPacket
 	ctx         context.Context
 	cancel      context.CancelFunc
-	riKey       []byte  // AES key for stream encryption
-	riKeyID     uint32  // Key ID
+	wg          sync.WaitGroup // Ping and receive goroutines, which use the media sockets
+	closeOnce   sync.Once
+	riKey       []byte // AES key for stream encryption
+	riKeyID     uint32 // Key ID
+
+	// Video packet size asked for, lowered to what Sunshine advertises
+	packetSize int
+
+	// Sunshine extensions advertised in DESCRIBE, types.FF*
+	featureFlags uint32
 
 	// Server ports from RTSP SETUP
 	videoPort   int
@@ -717,26 +1107,40 @@ type Stream struct {
 	controlPort int
 	rtspPort    int
 
+	// Sunshine's address, resolved when the media sockets are opened
+	remoteIP net.IP
+
 	// Local (client) ports - bound when sockets are opened
 	localVideoPort int
 	localAudioPort int
 
 	// UDP connections
-	videoConn   *net.UDPConn
-	audioConn   *net.UDPConn
-	controlConn net.Conn
+	videoConn *net.UDPConn
+	audioConn *net.UDPConn
+
+	// RTP packets counted by the receive loops, for Stats
+	videoPackets rtpCounter
+	audioPackets rtpCounter
+
+	// Control stream, which carries input to Sunshine once PLAY is sent
+	control *control.Stream
+	input   *input.Stream
+
+	gamepads gamepadSlots
+
+	// terminated receives the control stream's report of the host ending
+	// the connection with an error
+	terminated chan error
+	feedback   chan ControllerFeedback
 
 	// RTSP state
 	rtspConn    net.Conn
 	rtspSeqNum  int
 	sessionID   string
 	pingPayload string
+	connectData uint32 // X-SS-Connect-Data, sent in the control stream's connect
 
-	// Stream configuration
-	width   int
-	height  int
-	fps     int
-	bitrate int
+	opts StreamOptions
 }
 
 // InputPacket represents gamepad/keyboard/mouse input
@@ -756,10 +1160,182 @@ const (
 	InputTypeMouseRelative
 	InputTypeGamepad
 	InputTypeTouch
+	InputTypeText          // UTF-8 text typed on the host, e.g. a pasted clipboard
+	InputTypeMotion        // Accelerometer or gyro sample; see ParseMotion
+	InputTypeMouseAbsolute // Pointer position over the video; see ParseMousePosition
+	InputTypeScroll        // Wheel or trackpad scroll on either axis; see ParseScroll
+	InputTypePen           // Pen or stylus over the video; see ParsePen
+)
+
+// motionInputSize is motionType(1) + x(4) + y(4) + z(4), the axes being
+// little-endian float32s in the units Sunshine expects: m/s² for the
+// accelerometer, degrees per second for the gyro
+const motionInputSize = 13
+
+// mouseReferenceMax is the largest reference size passed on to Sunshine
+const mouseReferenceMax = 32767
+
+// ParseMousePosition decodes the Data of an InputTypeMouseAbsolute packet:
+// x(2) + y(2) as little-endian fractions of 0xFFFF across the video, then
+// the width(2) and height(2) of the viewport the pointer was over. It returns
+// the position in that viewport, clamped to it, for SendMousePosition.
+func ParseMousePosition(data []byte) (x, y, refWidth, refHeight int16, ok bool) {
+	if len(data) < 8 {
+		return 0, 0, 0, 0, false
+	}
+	width := min(max(int(binary.LittleEndian.Uint16(data[4:6])), 2), mouseReferenceMax)
+	height := min(max(int(binary.LittleEndian.Uint16(data[6:8])), 2), mouseReferenceMax)
+
+	// Positions run 0 to size-1, matching the size-1 the packet carries
+	scale := func(v uint16, size int) int16 {
+		return int16((int(v)*(size-1) + 0x7FFF) / 0xFFFF)
+	}
+	x = scale(binary.LittleEndian.Uint16(data[0:2]), width)
+	y = scale(binary.LittleEndian.Uint16(data[2:4]), height)
+	return x, y, int16(width), int16(height), true
+}
+
+// Scroll axes carried by InputTypeScroll packets
+const (
+	ScrollAxisVertical   = 0
+	ScrollAxisHorizontal = 1
 )
 
-// StartStream begins streaming from Sunshine
-func (c *Client) StartStream(ctx context.Context, width, height, fps, bitrate int) (*Stream, error) {
+// ParseScroll decodes the Data of an InputTypeScroll packet: axis(1), one of
+// the ScrollAxis constants, then a little-endian int16 amount in wheel units
+// where 120 is one notch. Up and right are positive.
+func ParseScroll(data []byte) (axis uint8, amount int16, ok bool) {
+	if len(data) < 3 {
+		return 0, 0, false
+	}
+	return data[0], int16(binary.LittleEndian.Uint16(data[1:3])), true
+}
+
+// sendScroll sends a scroll packet with the given input stream calls. Hosts
+// without horizontal scrolling (anything but Sunshine) scroll vertically
+// instead.
+func sendScroll(data []byte, vertical, horizontal func(int16) error) error {
+	axis, amount, ok := ParseScroll(data)
+	if !ok || amount == 0 {
+		return nil
+	}
+	if axis == ScrollAxisHorizontal {
+		err := horizontal(amount)
+		if !errors.Is(err, input.ErrUnsupported) {
+			return err
+		}
+	}
+	return vertical(amount)
+}
+
+// ParseMotion decodes the Data of an InputTypeMotion packet into the motion
+// type (types.MotionType) and the sample's axes
+func ParseMotion(data []byte) (motionType uint8, x, y, z float32, ok bool) {
+	if len(data) < motionInputSize {
+		return 0, 0, 0, 0, false
+	}
+	x = math.Float32frombits(binary.LittleEndian.Uint32(data[1:5]))
+	y = math.Float32frombits(binary.LittleEndian.Uint32(data[5:9]))
+	z = math.Float32frombits(binary.LittleEndian.Uint32(data[9:13]))
+	return data[0], x, y, z, true
+}
+
+// penInputSize is eventType(1) + toolType(1) + buttons(1) + x(2) + y(2) +
+// pressure(2) + rotation(2) + tilt(1)
+const penInputSize = 12
+
+// PenEvent is a pen or stylus event as Sunshine takes it. EventType is an
+// input.TouchEvent, ToolType an input.PenTool and Buttons input.PenButton
+// flags for the barrel buttons held. X, Y and Pressure run from 0 to 1.
+// Rotation is the direction the pen leans in degrees clockwise from up and
+// Tilt how far it leans from upright in degrees, or input.PenRotationUnknown
+// and input.PenTiltUnknown.
+type PenEvent struct {
+	EventType uint8
+	ToolType  uint8
+	Buttons   uint8
+	X, Y      float32
+	Pressure  float32
+	Rotation  uint16
+	Tilt      uint8
+}
+
+// Moving reports whether the pen hovers or moves rather than touching down,
+// lifting or being cancelled
+func (e PenEvent) Moving() bool {
+	return e.EventType == input.TouchEventHover || e.EventType == input.TouchEventMove
+}
+
+// ParsePen decodes the Data of an InputTypePen packet: eventType(1),
+// toolType(1) and buttons(1) as in PenEvent, then little-endian x(2), y(2)
+// and pressure(2) as fractions of 0xFFFF, x and y across the video,
+// rotation(2) and tilt(1)
+func ParsePen(data []byte) (PenEvent, bool) {
+	if len(data) < penInputSize {
+		return PenEvent{}, false
+	}
+	fraction := func(b []byte) float32 {
+		return float32(binary.LittleEndian.Uint16(b)) / 0xFFFF
+	}
+	ev := PenEvent{
+		EventType: data[0],
+		ToolType:  data[1],
+		Buttons:   data[2],
+		X:         fraction(data[3:5]),
+		Y:         fraction(data[5:7]),
+		Pressure:  fraction(data[7:9]),
+		Rotation:  binary.LittleEndian.Uint16(data[9:11]),
+		Tilt:      data[11],
+	}
+	if ev.Rotation != input.PenRotationUnknown {
+		ev.Rotation %= 360
+	}
+	if ev.Tilt != input.PenTiltUnknown {
+		ev.Tilt = min(ev.Tilt, 90)
+	}
+	return ev, true
+}
+
+// String names the input type as peers send it
+func (t InputType) String() string {
+	switch t {
+	case InputTypeKeyboard:
+		return "keyboard"
+	case InputTypeMouse:
+		return "mouse"
+	case InputTypeMouseRelative:
+		return "mouse_rel"
+	case InputTypeGamepad:
+		return "gamepad"
+	case InputTypeTouch:
+		return "touch"
+	case InputTypeText:
+		return "text"
+	case InputTypeMotion:
+		return "motion"
+	case InputTypeMouseAbsolute:
+		return "mouse_abs"
+	case InputTypeScroll:
+		return "scroll"
+	case InputTypePen:
+		return "pen"
+	default:
+		return fmt.Sprintf("input(%d)", int(t))
+	}
+}
+
+// ParseInputType returns the InputType whose String is name
+func ParseInputType(name string) (InputType, bool) {
+	for t := InputTypeKeyboard; t <= InputTypePen; t++ {
+		if t.String() == name {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+// StartStream launches opts.AppID and begins streaming it from Sunshine
+func (c *Client) StartStream(ctx context.Context, opts StreamOptions) (*Stream, error) {
 	if !c.paired {
 		return nil, fmt.Errorf("not paired with Sunshine")
 	}
@@ -771,20 +1347,19 @@ func (c *Client) StartStream(ctx context.Context, width, height, fps, bitrate in
 		videoFrames: make(chan []byte, 60),
 		audioFrames: make(chan []byte, 120),
 		inputChan:   make(chan InputPacket, 256),
+		terminated:  make(chan error, 1),
+		feedback:    make(chan ControllerFeedback, 32),
 		ctx:         streamCtx,
 		cancel:      cancel,
-		width:       width,
-		height:      height,
-		fps:         fps,
-		bitrate:     bitrate,
+		opts:        opts,
+		packetSize:  opts.packetSize(),
 		rtspPort:    c.port + PortRTSPOffset,
 		videoPort:   c.port + PortVideoOffset,
 		audioPort:   c.port + PortAudioOffset,
 		controlPort: c.port + PortControlOffset,
 	}
 
-	// Launch the desktop app (app ID 0 is typically Desktop)
-	if err := s.launchApp(ctx, 0, width, height, fps, bitrate); err != nil {
+	if err := s.launchApp(ctx); err != nil {
 		cancel()
 		return nil, err
 	}
@@ -804,7 +1379,16 @@ func (c *Client) StartStream(ctx context.Context, width, height, fps, bitrate in
 	// Start ping threads (after RTSP handshake when we have the ping payload)
 	s.startPingThreads()
 
+	// Sunshine expects the control connection once the stream is playing
+	if err := s.startControlStream(); err != nil {
+		cancel()
+		s.videoConn.Close()
+		s.audioConn.Close()
+		return nil, fmt.Errorf("control stream failed: %w", err)
+	}
+
 	// Start receiving video/audio
+	s.wg.Add(2)
 	go s.receiveVideoLoop()
 	go s.receiveAudioLoop()
 
@@ -812,63 +1396,13 @@ func (c *Client) StartStream(ctx context.Context, width, height, fps, bitrate in
 }
 
 // launchApp starts an application on Sunshine
-func (s *Stream) launchApp(ctx context.Context, appID, width, height, fps, bitrate int) error {
-	// Generate random AES key for stream encryption
-	s.riKey = make([]byte, 16)
-	rand.Read(s.riKey)
-	s.riKeyID = uint32(time.Now().UnixNano() & 0xFFFFFFFF)
-
-	// Build launch URL with parameters (must use HTTPS port 47984)
-	riKeyHex := strings.ToUpper(hex.EncodeToString(s.riKey))
-	params := fmt.Sprintf("uniqueid=%s&appid=%d&mode=%dx%dx%d&additionalStates=1&sops=0&rikey=%s&rikeyid=%d&localAudioPlayMode=0&gcmap=0&gcpersist=0",
-		s.client.uniqueID, appID, width, height, fps, riKeyHex, s.riKeyID)
-
-	// Use HTTPS port 47984 for launch
-	url := fmt.Sprintf("https://%s:47984/launch?%s", s.client.host, params)
-
-	log.Printf("Launching app %d at %dx%d@%dfps...", appID, width, height, fps)
-
-	// Create HTTPS client with client certificate
-	httpsClient := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-				Certificates:       []tls.Certificate{*s.client.clientCert},
-			},
-		},
-		Timeout: 30 * time.Second,
-	}
-
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+func (s *Stream) launchApp(ctx context.Context) error {
+	riKey, riKeyID, err := s.client.launchWithRiKey(ctx, s.opts)
 	if err != nil {
 		return err
 	}
-
-	resp, err := httpsClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("launch request failed: %w", err)
-	}
-	defer resp.Body.Close()
-
-	body, _ := io.ReadAll(resp.Body)
-
-	// Parse response to get stream ports
-	var launchResp struct {
-		SessionURL  string `xml:"sessionUrl0"`
-		GameSession string `xml:"gamesession"`
-		StatusCode  string `xml:"status_code,attr"`
-		StatusMsg   string `xml:"status_message,attr"`
-	}
-	if err := xml.Unmarshal(body, &launchResp); err != nil {
-		log.Printf("Launch response parse error: %v, body: %s", err, string(body))
-		return fmt.Errorf("parse launch response: %w", err)
-	}
-
-	if launchResp.GameSession != "1" {
-		return fmt.Errorf("launch failed: %s (status: %s)", launchResp.StatusMsg, launchResp.StatusCode)
-	}
-
-	log.Printf("Launch successful, RTSP URL: %s", launchResp.SessionURL)
+	s.riKey = riKey
+	s.riKeyID = riKeyID
 	return nil
 }
 
@@ -877,7 +1411,7 @@ func (s *Stream) launchApp(ctx context.Context, appID, width, height, fps, bitra
 // so we need to open a new connection for each request.
 func (s *Stream) performRTSPHandshake(ctx context.Context) error {
 	s.rtspSeqNum = 1
-	log.Printf("Starting RTSP handshake with %s:%d", s.client.host, s.rtspPort)
+	s.client.log.Debugf("Starting RTSP handshake with %s:%d", s.client.host, s.rtspPort)
 
 	// 1. OPTIONS
 	if err := s.rtspOptions(); err != nil {
@@ -914,16 +1448,22 @@ func (s *Stream) performRTSPHandshake(ctx context.Context) error {
 		return fmt.Errorf("PLAY failed: %w", err)
 	}
 
-	log.Println("RTSP handshake complete")
+	s.client.log.Infof("RTSP handshake complete")
 	return nil
 }
 
 // rtspSendRequest sends an RTSP request and returns the response
 // Each request opens a new TCP connection because Sunshine closes after each response
 func (s *Stream) rtspSendRequest(method, target, body string) (map[string]string, string, error) {
+	return s.rtspExchange(method, target, body, 10*time.Second, 15*time.Second)
+}
+
+// rtspExchange sends one RTSP request, giving up on connecting after
+// dialTimeout and on the response after readTimeout
+func (s *Stream) rtspExchange(method, target, body string, dialTimeout, readTimeout time.Duration) (map[string]string, string, error) {
 	// Open a new connection for this request
-	addr := fmt.Sprintf("%s:%d", s.client.host, s.rtspPort)
-	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	addr := net.JoinHostPort(s.client.host, strconv.Itoa(s.rtspPort))
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
 	if err != nil {
 		return nil, "", fmt.Errorf("failed to connect to RTSP: %w", err)
 	}
@@ -953,7 +1493,7 @@ func (s *Stream) rtspSendRequest(method, target, body string) (map[string]string
 	// Debug: log the request being sent
 	reqStr := req.String()
 	if method == "ANNOUNCE" {
-		log.Printf("RTSP ANNOUNCE request (Content-Length should be %d):\n%s", len(body), reqStr[:min(500, len(reqStr))])
+		s.client.log.Debugf("RTSP ANNOUNCE request (Content-Length should be %d):\n%s", len(body), reqStr[:min(500, len(reqStr))])
 	}
 
 	// Send request
@@ -962,7 +1502,7 @@ func (s *Stream) rtspSendRequest(method, target, body string) (map[string]string
 	}
 
 	// Read response
-	conn.SetReadDeadline(time.Now().Add(15 * time.Second))
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
 	buf := make([]byte, 8192)
 	n, err := conn.Read(buf)
 	if err != nil {
@@ -1007,8 +1547,18 @@ func (s *Stream) rtspOptions() error {
 
 func (s *Stream) rtspDescribe() error {
 	target := fmt.Sprintf("rtsp://%s:%d", s.client.host, s.rtspPort)
-	_, _, err := s.rtspSendRequest("DESCRIBE", target, "")
-	return err
+	_, body, err := s.rtspSendRequest("DESCRIBE", target, "")
+	if err != nil {
+		return err
+	}
+
+	sdp := rtsp.ParseSDP(body)
+	if size := rtsp.NegotiatePacketSize(sdp, s.packetSize); size != s.packetSize {
+		s.client.log.Infof("Sunshine supports video packets up to %d bytes, not %d", size, s.packetSize)
+		s.packetSize = size
+	}
+	s.featureFlags = rtsp.ServerFeatureFlags(sdp)
+	return nil
 }
 
 func (s *Stream) rtspSetup(streamID string) error {
@@ -1035,13 +1585,19 @@ func (s *Stream) rtspSetup(streamID string) error {
 	if session, ok := headers["Session"]; ok && s.sessionID == "" {
 		// Session format: "DEADBEEFCAFE;timeout = 90"
 		s.sessionID = strings.Split(session, ";")[0]
-		log.Printf("Got session ID: %s", s.sessionID)
+		s.client.log.Debugf("Got session ID: %s", s.sessionID)
 	}
 
 	// Parse X-SS-Ping-Payload for Sunshine ping protocol
 	if ping, ok := headers["X-SS-Ping-Payload"]; ok {
 		s.pingPayload = ping
-		log.Printf("Got ping payload from %s: %s", streamID, ping)
+		s.client.log.Debugf("Got ping payload from %s: %s", streamID, ping)
+	}
+
+	// The control SETUP gives the value to connect the control stream with
+	if data, ok := headers["X-SS-Connect-Data"]; ok && strings.Contains(streamID, "control") {
+		s.connectData = rtsp.ParseConnectData(data)
+		s.client.log.Debugf("Got control connect data: %#x", s.connectData)
 	}
 
 	// Parse Transport header for server port
@@ -1054,13 +1610,13 @@ func (s *Stream) rtspSetup(streamID string) error {
 				port, _ := strconv.Atoi(portStr)
 				if strings.Contains(streamID, "video") {
 					s.videoPort = port
-					log.Printf("Video server port: %d (client port: %d)", port, clientPort)
+					s.client.log.Debugf("Video server port: %d (client port: %d)", port, clientPort)
 				} else if strings.Contains(streamID, "audio") {
 					s.audioPort = port
-					log.Printf("Audio server port: %d (client port: %d)", port, clientPort)
+					s.client.log.Debugf("Audio server port: %d (client port: %d)", port, clientPort)
 				} else if strings.Contains(streamID, "control") {
 					s.controlPort = port
-					log.Printf("Control server port: %d", port)
+					s.client.log.Debugf("Control server port: %d", port)
 				}
 			}
 		}
@@ -1072,7 +1628,7 @@ func (s *Stream) rtspSetup(streamID string) error {
 // rtspSendRequestWithTransport sends RTSP SETUP with Transport header
 func (s *Stream) rtspSendRequestWithTransport(method, target string, clientPort int) (map[string]string, string, error) {
 	// Open a new connection for this request
-	addr := fmt.Sprintf("%s:%d", s.client.host, s.rtspPort)
+	addr := net.JoinHostPort(s.client.host, strconv.Itoa(s.rtspPort))
 	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
 	if err != nil {
 		return nil, "", fmt.Errorf("failed to connect to RTSP: %w", err)
@@ -1096,7 +1652,7 @@ func (s *Stream) rtspSendRequestWithTransport(method, target string, clientPort
 
 	s.rtspSeqNum++
 
-	log.Printf("RTSP SETUP: %s with client_port=%d", target, clientPort)
+	s.client.log.Debugf("RTSP SETUP: %s with client_port=%d", target, clientPort)
 
 	// Send request
 	if _, err := conn.Write([]byte(req.String())); err != nil {
@@ -1143,43 +1699,49 @@ func (s *Stream) rtspSendRequestWithTransport(method, target string, clientPort
 
 func (s *Stream) rtspAnnounce() error {
 	target := fmt.Sprintf("rtsp://%s:%d", s.client.host, s.rtspPort)
+	_, _, err := s.rtspSendRequest("ANNOUNCE", target, s.announceSDP())
+	return err
+}
 
-	// Build SDP body with stream parameters
+// announceSDP is the ANNOUNCE body describing the stream's own options
+func (s *Stream) announceSDP() string {
 	var sdp strings.Builder
 	sdp.WriteString("v=0\r\n")
 	sdp.WriteString("o=- 0 0 IN IP4 0.0.0.0\r\n")
 	sdp.WriteString("s=NVIDIA Streaming Client\r\n")
-	sdp.WriteString(fmt.Sprintf("a=x-nv-video[0].clientViewportWd:%d\r\n", s.width))
-	sdp.WriteString(fmt.Sprintf("a=x-nv-video[0].clientViewportHt:%d\r\n", s.height))
-	sdp.WriteString(fmt.Sprintf("a=x-nv-video[0].maxFPS:%d\r\n", s.fps))
-	sdp.WriteString(fmt.Sprintf("a=x-nv-vqos[0].bw.maximumBitrateKbps:%d\r\n", s.bitrate))
-	sdp.WriteString("a=x-nv-video[0].packetSize:1024\r\n")
+	sdp.WriteString(fmt.Sprintf("a=x-nv-video[0].clientViewportWd:%d\r\n", s.opts.Width))
+	sdp.WriteString(fmt.Sprintf("a=x-nv-video[0].clientViewportHt:%d\r\n", s.opts.Height))
+	sdp.WriteString(fmt.Sprintf("a=x-nv-video[0].maxFPS:%d\r\n", s.opts.FPS))
+	sdp.WriteString(fmt.Sprintf("a=x-nv-vqos[0].bw.maximumBitrateKbps:%d\r\n", s.opts.Bitrate))
+	sdp.WriteString(fmt.Sprintf("a=x-nv-video[0].packetSize:%d\r\n", s.packetSize))
 	sdp.WriteString("a=x-nv-video[0].rateControlMode:4\r\n")
 	sdp.WriteString("a=x-nv-video[0].timeoutLengthMs:7000\r\n")
 	sdp.WriteString("a=x-nv-video[0].framesWithInvalidRefThreshold:0\r\n")
-	sdp.WriteString("a=x-nv-vqos[0].bitStreamFormat:0\r\n") // 0=H264, 1=HEVC
-	sdp.WriteString("a=x-nv-video[0].encoderCscMode:0\r\n")
+	sdp.WriteString(fmt.Sprintf("a=x-nv-vqos[0].bitStreamFormat:%d\r\n", s.opts.videoFormat().BitStreamFormat()))
+	if s.opts.HDR {
+		// HDR is encoded in Rec. 2020, limited range
+		sdp.WriteString("a=x-nv-video[0].encoderCscMode:4\r\n")
+		sdp.WriteString("a=x-nv-video[0].dynamicRangeMode:1\r\n")
+	} else {
+		sdp.WriteString("a=x-nv-video[0].encoderCscMode:0\r\n")
+	}
 	sdp.WriteString("a=x-nv-video[0].maxNumReferenceFrames:1\r\n")
 	sdp.WriteString("a=x-nv-video[0].videoEncoderSlicesPerFrame:1\r\n")
-	sdp.WriteString("a=x-nv-audio.surround.numChannels:2\r\n")
-	sdp.WriteString("a=x-nv-audio.surround.channelMask:3\r\n")
-	sdp.WriteString("a=x-nv-audio.surround.enable:0\r\n")
-	sdp.WriteString("a=x-nv-audio.surround.AudioQuality:0\r\n")
+	sdp.WriteString(rtsp.SurroundAttributes(s.opts.AudioConfig, s.opts.AudioQuality))
 	sdp.WriteString("a=x-nv-aqos.packetDuration:5\r\n")
 	sdp.WriteString("a=x-nv-general.useReliableUdp:1\r\n")
-	sdp.WriteString("a=x-nv-vqos[0].fec.minRequiredFecPackets:0\r\n")
+	sdp.WriteString(fmt.Sprintf("a=x-nv-vqos[0].fec.minRequiredFecPackets:%d\r\n", s.opts.MinFECPackets))
 	sdp.WriteString("a=x-nv-general.featureFlags:135\r\n")
 	// ML_FF_FEC_STATUS (0x01) | ML_FF_SESSION_ID_V1 (0x02) = 3
-	// ML_FF_SESSION_ID_V1 tells Sunshine we support X-SS-Ping-Payload for session identification
+	// ML_FF_SESSION_ID_V1 tells Sunshine we identify the session with
+	// X-SS-Ping-Payload in pings and X-SS-Connect-Data in the control connect
 	sdp.WriteString("a=x-ml-general.featureFlags:3\r\n")
 	// QOS traffic types for video and audio
 	sdp.WriteString("a=x-nv-vqos[0].qosTrafficType:5\r\n")
 	sdp.WriteString("a=x-nv-aqos.qosTrafficType:4\r\n")
 	// Configured bitrate (0 means use the value from x-nv-vqos[0].bw.maximumBitrateKbps)
 	sdp.WriteString("a=x-ml-video.configuredBitrateKbps:0\r\n")
-
-	_, _, err := s.rtspSendRequest("ANNOUNCE", target, sdp.String())
-	return err
+	return sdp.String()
 }
 
 func (s *Stream) rtspPlay() error {
@@ -1188,25 +1750,46 @@ func (s *Stream) rtspPlay() error {
 	return err
 }
 
+// teardownTimeout bounds each step of the RTSP TEARDOWN sent as a stream
+// closes
+const teardownTimeout = 3 * time.Second
+
+// rtspTeardown ends the RTSP session
+func (s *Stream) rtspTeardown() error {
+	target := fmt.Sprintf("rtsp://%s:%d", s.client.host, s.rtspPort)
+	_, _, err := s.rtspExchange("TEARDOWN", target, "", teardownTimeout, teardownTimeout)
+	return err
+}
+
 // openMediaSockets opens UDP sockets for video and audio
 // Must be called BEFORE RTSP SETUP to get local ports for Transport header
 func (s *Stream) openMediaSockets() error {
-	// Use IPv4 - Sunshine listens on IPv4 only by default
-	networkType := "udp4"
-	log.Printf("Opening media sockets using %s", networkType)
+	// Resolve Sunshine once so the sockets, pings and control stream all
+	// use the same address family
+	serverIP, err := resolveServerIP(s.client.host)
+	if err != nil {
+		return err
+	}
+	s.remoteIP = serverIP
+
+	networkType, bindIP := "udp4", net.IPv4zero
+	if serverIP.To4() == nil {
+		networkType, bindIP = "udp6", net.IPv6zero
+	}
+	s.client.log.Debugf("Opening media sockets using %s for %s", networkType, serverIP)
 
 	// Open UDP socket for video
-	videoAddr := &net.UDPAddr{IP: net.IPv4zero, Port: 0}
+	videoAddr := &net.UDPAddr{IP: bindIP, Port: 0}
 	videoConn, err := net.ListenUDP(networkType, videoAddr)
 	if err != nil {
 		return fmt.Errorf("failed to open video socket: %w", err)
 	}
 	s.videoConn = videoConn
 	s.localVideoPort = videoConn.LocalAddr().(*net.UDPAddr).Port
-	log.Printf("Video UDP socket bound to %s (port %d)", videoConn.LocalAddr(), s.localVideoPort)
+	s.client.log.Debugf("Video UDP socket bound to %s (port %d)", videoConn.LocalAddr(), s.localVideoPort)
 
 	// Open UDP socket for audio
-	audioAddr := &net.UDPAddr{IP: net.IPv4zero, Port: 0}
+	audioAddr := &net.UDPAddr{IP: bindIP, Port: 0}
 	audioConn, err := net.ListenUDP(networkType, audioAddr)
 	if err != nil {
 		videoConn.Close()
@@ -1214,34 +1797,82 @@ func (s *Stream) openMediaSockets() error {
 	}
 	s.audioConn = audioConn
 	s.localAudioPort = audioConn.LocalAddr().(*net.UDPAddr).Port
-	log.Printf("Audio UDP socket bound to %s (port %d)", audioConn.LocalAddr(), s.localAudioPort)
+	s.client.log.Debugf("Audio UDP socket bound to %s (port %d)", audioConn.LocalAddr(), s.localAudioPort)
+
+	return nil
+}
+
+// resolveServerIP resolves Sunshine's host for the media and control
+// streams. IP literals are used as given. A name resolving to both families
+// gets its IPv4 address, since Sunshine listens on IPv4 by default; this is
+// what turns localhost into 127.0.0.1.
+func resolveServerIP(host string) (net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip, nil
+	}
+
+	addrs, err := net.LookupIP(host)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: %w", host, err)
+	}
+	for _, addr := range addrs {
+		if ip4 := addr.To4(); ip4 != nil {
+			return ip4, nil
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("resolve %s: no addresses", host)
+	}
+	return addrs[0], nil
+}
 
+// serverIP is Sunshine's address as resolved when the media sockets opened
+func (s *Stream) serverIP() net.IP {
+	return s.remoteIP
+}
+
+// startControlStream connects the control stream and the input protocol on
+// top of it. Control messages, input included, are encrypted with the riKey
+// from launch on Sunshine versions that expect it.
+func (s *Stream) startControlStream() error {
+	version := s.client.serverVersion
+	if version[0] == 0 {
+		// testConnectivity didn't learn the version; assume a current Sunshine
+		version = defaultServerVersion
+	}
+
+	config := types.StreamConfiguration{
+		Width:                 s.opts.Width,
+		Height:                s.opts.Height,
+		FPS:                   s.opts.FPS,
+		Bitrate:               s.opts.Bitrate,
+		AudioConfiguration:    s.opts.AudioConfig,
+		SupportedVideoFormats: s.opts.videoFormat(),
+		HDREnabled:            s.opts.HDR,
+		RemoteInputAesKey:     s.riKey,
+		RemoteInputAesIV:      make([]byte, 16),
+	}
+	binary.BigEndian.PutUint32(config.RemoteInputAesIV, s.riKeyID)
+
+	s.control = control.NewStream(config, &nativeControlListener{s: s}, version, true)
+	s.control.SetLogger(s.client.log)
+	s.control.SetConnectData(s.connectData)
+	if err := s.control.Start(s.ctx, &net.UDPAddr{IP: s.serverIP()}, s.controlPort); err != nil {
+		return err
+	}
+
+	s.input = input.NewStream(version, true, config.RemoteInputAesKey, config.RemoteInputAesIV, s.control.SendInputPacket)
+	s.client.log.Infof("Control stream connected to port %d (encrypted: %v)", s.controlPort, s.control.IsEncrypted())
 	return nil
 }
 
+// defaultServerVersion is assumed when Sunshine's appversion is unknown
+var defaultServerVersion = [4]int{7, 1, 431, -1}
+
 // startPingThreads starts continuous ping threads for video and audio
 // Must be called AFTER RTSP SETUP (when we have the ping payload)
 func (s *Stream) startPingThreads() {
-	// For localhost, use 127.0.0.1 (IPv4) - Sunshine listens on IPv4 by default
-	host := s.client.host
-	if host == "localhost" {
-		host = "127.0.0.1"
-	}
-
-	// Resolve the server address
-	serverIP := net.ParseIP(host)
-	if serverIP == nil {
-		addrs, _ := net.LookupIP(host)
-		for _, addr := range addrs {
-			if addr.To4() != nil {
-				serverIP = addr
-				break
-			}
-		}
-		if serverIP == nil && len(addrs) > 0 {
-			serverIP = addrs[0]
-		}
-	}
+	serverIP := s.serverIP()
 
 	// Server addresses for video and audio
 	serverVideoAddr := &net.UDPAddr{IP: serverIP, Port: s.videoPort}
@@ -1259,19 +1890,21 @@ func (s *Stream) startPingThreads() {
 		// Do NOT decode the hex - send it as-is!
 		if len(s.pingPayload) == 16 {
 			copy(pingPayload[:], []byte(s.pingPayload))
-			log.Printf("Using Sunshine ping payload as ASCII: %s (16 bytes)", s.pingPayload)
+			s.client.log.Debugf("Using Sunshine ping payload as ASCII: %s (16 bytes)", s.pingPayload)
 		} else {
-			log.Printf("Warning: unexpected ping payload length %d (expected 16)", len(s.pingPayload))
+			s.client.log.Warnf("unexpected ping payload length %d (expected 16)", len(s.pingPayload))
 		}
 	}
 
-	log.Printf("Starting ping threads:")
-	log.Printf("  Video: local %s -> server %s", s.videoConn.LocalAddr(), serverVideoAddr)
-	log.Printf("  Audio: local %s -> server %s", s.audioConn.LocalAddr(), serverAudioAddr)
-	log.Printf("  Ping payload: %s", s.pingPayload)
+	s.client.log.Debugf("Starting ping threads:")
+	s.client.log.Debugf("  Video: local %s -> server %s", s.videoConn.LocalAddr(), serverVideoAddr)
+	s.client.log.Debugf("  Audio: local %s -> server %s", s.audioConn.LocalAddr(), serverAudioAddr)
+	s.client.log.Debugf("  Ping payload: %s", s.pingPayload)
 
 	// Start video ping goroutine (runs until stream closes)
+	s.wg.Add(2)
 	go func() {
+		defer s.wg.Done()
 		var seqNum uint32 = 0
 		pingPacket := make([]byte, 20)
 		copy(pingPacket[:16], pingPayload[:])
@@ -1291,11 +1924,11 @@ func (s *Stream) startPingThreads() {
 			pingPacket[19] = byte(seqNum)
 
 			if _, err := s.videoConn.WriteToUDP(pingPacket, serverVideoAddr); err != nil {
-				log.Printf("Warning: video ping failed: %v", err)
+				s.client.log.Warnf("video ping failed: %v", err)
 			}
 
 			if seqNum <= 3 || seqNum%10 == 0 {
-				log.Printf("Video ping #%d sent to %s (hex: %X)", seqNum, serverVideoAddr, pingPacket)
+				s.client.log.Debugf("Video ping #%d sent to %s (hex: %X)", seqNum, serverVideoAddr, pingPacket)
 			}
 
 			time.Sleep(500 * time.Millisecond)
@@ -1304,6 +1937,7 @@ func (s *Stream) startPingThreads() {
 
 	// Start audio ping goroutine (runs until stream closes)
 	go func() {
+		defer s.wg.Done()
 		var seqNum uint32 = 0
 		pingPacket := make([]byte, 20)
 		copy(pingPacket[:16], pingPayload[:])
@@ -1323,11 +1957,11 @@ func (s *Stream) startPingThreads() {
 			pingPacket[19] = byte(seqNum)
 
 			if _, err := s.audioConn.WriteToUDP(pingPacket, serverAudioAddr); err != nil {
-				log.Printf("Warning: audio ping failed: %v", err)
+				s.client.log.Warnf("audio ping failed: %v", err)
 			}
 
 			if seqNum == 1 {
-				log.Printf("Sent first audio ping (20 bytes) to %s", serverAudioAddr)
+				s.client.log.Debugf("Sent first audio ping (20 bytes) to %s", serverAudioAddr)
 			}
 
 			time.Sleep(500 * time.Millisecond)
@@ -1337,9 +1971,9 @@ func (s *Stream) startPingThreads() {
 
 // receiveVideoLoop receives video RTP packets from Sunshine
 func (s *Stream) receiveVideoLoop() {
-	defer s.videoConn.Close()
+	defer s.wg.Done()
 
-	log.Printf("Video receive loop started, waiting for packets...")
+	s.client.log.Debugf("Video receive loop started, waiting for packets...")
 
 	buf := make([]byte, 65536) // Large buffer for video packets
 	packetsReceived := 0
@@ -1348,7 +1982,7 @@ func (s *Stream) receiveVideoLoop() {
 	for {
 		select {
 		case <-s.ctx.Done():
-			log.Printf("Video receive loop stopped, received %d packets total", packetsReceived)
+			s.client.log.Debugf("Video receive loop stopped, received %d packets total", packetsReceived)
 			return
 		default:
 		}
@@ -1359,12 +1993,16 @@ func (s *Stream) receiveVideoLoop() {
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				// Log every 5 seconds while waiting
 				if time.Since(lastLogTime) > 5*time.Second {
-					log.Printf("Video: still waiting for packets (received %d so far)...", packetsReceived)
+					s.client.log.Debugf("Video: still waiting for packets (received %d so far)...", packetsReceived)
 					lastLogTime = time.Now()
 				}
 				continue
 			}
-			log.Printf("Video receive error: %v", err)
+			if s.ctx.Err() != nil {
+				// Close shut the socket under us
+				continue
+			}
+			s.client.log.Warnf("Video receive error: %v", err)
 			continue
 		}
 
@@ -1373,10 +2011,11 @@ func (s *Stream) receiveVideoLoop() {
 		}
 
 		packetsReceived++
+		s.videoPackets.count(buf[:n])
 		if packetsReceived == 1 {
-			log.Printf("Receiving video packets from Sunshine (first from %s, %d bytes)", addr, n)
+			s.client.log.Infof("Receiving video packets from Sunshine (first from %s, %d bytes)", addr, n)
 		} else if packetsReceived%1000 == 0 {
-			log.Printf("Video: received %d packets", packetsReceived)
+			s.client.log.Debugf("Video: received %d packets", packetsReceived)
 		}
 
 		// Send the complete RTP packet to the channel
@@ -1391,9 +2030,9 @@ func (s *Stream) receiveVideoLoop() {
 
 // receiveAudioLoop receives audio RTP packets from Sunshine
 func (s *Stream) receiveAudioLoop() {
-	defer s.audioConn.Close()
+	defer s.wg.Done()
 
-	log.Printf("Audio receive loop started, waiting for packets...")
+	s.client.log.Debugf("Audio receive loop started, waiting for packets...")
 
 	buf := make([]byte, 4096)
 	packetsReceived := 0
@@ -1402,7 +2041,7 @@ func (s *Stream) receiveAudioLoop() {
 	for {
 		select {
 		case <-s.ctx.Done():
-			log.Printf("Audio receive loop stopped, received %d packets total", packetsReceived)
+			s.client.log.Debugf("Audio receive loop stopped, received %d packets total", packetsReceived)
 			return
 		default:
 		}
@@ -1413,12 +2052,16 @@ func (s *Stream) receiveAudioLoop() {
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				// Log every 5 seconds while waiting
 				if time.Since(lastLogTime) > 5*time.Second {
-					log.Printf("Audio: still waiting for packets (received %d so far)...", packetsReceived)
+					s.client.log.Debugf("Audio: still waiting for packets (received %d so far)...", packetsReceived)
 					lastLogTime = time.Now()
 				}
 				continue
 			}
-			log.Printf("Audio receive error: %v", err)
+			if s.ctx.Err() != nil {
+				// Close shut the socket under us
+				continue
+			}
+			s.client.log.Warnf("Audio receive error: %v", err)
 			continue
 		}
 
@@ -1427,8 +2070,9 @@ func (s *Stream) receiveAudioLoop() {
 		}
 
 		packetsReceived++
+		s.audioPackets.count(buf[:n])
 		if packetsReceived == 1 {
-			log.Printf("Receiving audio packets from Sunshine (first from %s, %d bytes)", addr, n)
+			s.client.log.Infof("Receiving audio packets from Sunshine (first from %s, %d bytes)", addr, n)
 		}
 
 		// Send the complete RTP packet to the channel
@@ -1441,6 +2085,49 @@ func (s *Stream) receiveAudioLoop() {
 	}
 }
 
+// rtpCounter counts the RTP packets a receive loop passes on, and those
+// lost to gaps in their sequence numbers. Only its loop calls count.
+type rtpCounter struct {
+	received atomic.Uint32
+	dropped  atomic.Uint32
+	lastSeq  uint16
+	started  bool
+}
+
+// count records an RTP packet. One arriving late counts as received without
+// taking back the loss its gap was counted as.
+func (c *rtpCounter) count(pkt []byte) {
+	c.received.Add(1)
+
+	seq := binary.BigEndian.Uint16(pkt[2:4])
+	if !c.started {
+		c.started = true
+		c.lastSeq = seq
+		return
+	}
+	if gap := int16(seq - c.lastSeq); gap > 0 {
+		c.dropped.Add(uint32(gap - 1))
+		c.lastSeq = seq
+	}
+}
+
+// Stats returns what the native stream can count in the RTP it passes on:
+// packets received and lost, and the round trip to Sunshine. It doesn't
+// assemble frames or recover packets, so those counters stay 0.
+func (s *Stream) Stats() StreamStats {
+	stats := StreamStats{
+		VideoPacketsReceived: s.videoPackets.received.Load(),
+		VideoPacketsDropped:  s.videoPackets.dropped.Load(),
+		AudioPacketsReceived: s.audioPackets.received.Load(),
+		AudioPacketsDropped:  s.audioPackets.dropped.Load(),
+	}
+	if s.control != nil {
+		rtt, _ := s.control.GetRTTInfo()
+		stats.HostRTTMs = rtt.EstimatedRTT
+	}
+	return stats
+}
+
 // VideoFrames returns the channel for receiving video frames
 func (s *Stream) VideoFrames() <-chan []byte {
 	return s.videoFrames
@@ -1451,108 +2138,219 @@ func (s *Stream) AudioSamples() <-chan []byte {
 	return s.audioFrames
 }
 
-// SendInput sends input to Sunshine
+// SendInput sends input to Sunshine over the control stream
 func (s *Stream) SendInput(input InputPacket) {
-	// TODO: Input should be sent over the control channel (ENet/reliable UDP)
-	// For now, this is a placeholder until control channel is implemented
-	if s.controlConn == nil {
+	if s.input == nil {
 		return
 	}
 
-	// Build and send input packet based on type
-	var packet []byte
-
+	var err error
 	switch input.Type {
 	case InputTypeGamepad:
-		packet = s.buildGamepadPacket(input)
+		pad, ok := ParseGamepad(input.Data)
+		if !ok {
+			return
+		}
+		err = s.input.SendMultiController(int16(input.PlayerSlot), int16(s.gamepads.active(input.PlayerSlot)), pad.Buttons,
+			pad.LeftTrigger, pad.RightTrigger, pad.LeftStickX, pad.LeftStickY, pad.RightStickX, pad.RightStickY)
 	case InputTypeKeyboard:
-		packet = s.buildKeyboardPacket(input)
+		if len(input.Data) < 3 {
+			return
+		}
+		keyCode := int16(input.Data[0]) | int16(input.Data[1])<<8
+		modifiers := uint8(0)
+		if len(input.Data) > 3 {
+			modifiers = input.Data[3]
+		}
+		err = s.input.SendKeyboard(keyCode, input.Data[2], modifiers, 0)
 	case InputTypeMouse:
-		packet = s.buildMousePacket(input)
+		if len(input.Data) < 2 {
+			return
+		}
+		err = s.input.SendMouseButton(input.Data[0], int(input.Data[1]))
+	case InputTypeMouseRelative:
+		if len(input.Data) < 4 {
+			return
+		}
+		deltaX := int16(input.Data[0]) | int16(input.Data[1])<<8
+		deltaY := int16(input.Data[2]) | int16(input.Data[3])<<8
+		err = s.input.SendMouseMove(deltaX, deltaY)
+	case InputTypeMouseAbsolute:
+		x, y, refWidth, refHeight, ok := ParseMousePosition(input.Data)
+		if !ok {
+			return
+		}
+		err = s.input.SendMousePosition(x, y, refWidth, refHeight)
+	case InputTypeScroll:
+		err = sendScroll(input.Data, s.input.SendHighResScroll, s.input.SendHScroll)
+	case InputTypeText:
+		err = s.input.SendUTF8Text(string(input.Data))
+	case InputTypeMotion:
+		motionType, x, y, z, ok := ParseMotion(input.Data)
+		if !ok {
+			return
+		}
+		err = s.input.SendControllerMotion(uint8(input.PlayerSlot), motionType, x, y, z)
+	case InputTypePen:
+		pen, ok := ParsePen(input.Data)
+		if !ok || !s.SupportsPen() {
+			return
+		}
+		err = s.input.SendPen(pen.EventType, pen.ToolType, pen.Buttons, pen.X, pen.Y, pen.Pressure,
+			0, 0, pen.Rotation, pen.Tilt)
+	}
+	if err != nil {
+		s.client.log.Warnf("Input not sent: %v", err)
 	}
+}
 
-	if len(packet) > 0 {
-		s.controlConn.Write(packet)
+// SetActiveGamepads announces controllers that arrived, departed or changed
+// since the last call and sends the new mask with every later gamepad event
+func (s *Stream) SetActiveGamepads(mask uint16, pads []Gamepad) {
+	if s.input == nil {
+		return
 	}
+	s.gamepads.set(mask, pads, gamepadEvents{
+		arrival:   s.input.SendControllerArrival,
+		departure: s.input.SendControllerDeparture,
+		battery:   s.input.SendControllerBattery,
+	})
+}
+
+// Bitrate returns the video bitrate the stream was launched with, in Kbps
+func (s *Stream) Bitrate() int {
+	return s.opts.Bitrate
+}
+
+// SupportsPen reports whether Sunshine advertised pen input in DESCRIBE
+func (s *Stream) SupportsPen() bool {
+	return s.featureFlags&types.FFPenTouchEvents != 0
 }
 
-// buildGamepadPacket creates a gamepad input packet
-func (s *Stream) buildGamepadPacket(input InputPacket) []byte {
-	// Moonlight gamepad packet format:
-	// Type (1 byte) + Controller ID (1 byte) + Button flags (2 bytes) +
-	// Left trigger (1 byte) + Right trigger (1 byte) +
-	// Left stick X (2 bytes) + Left stick Y (2 bytes) +
-	// Right stick X (2 bytes) + Right stick Y (2 bytes)
+// nativeControlListener logs what the control stream reports and passes on
+// the host ending the connection and the controller feedback it sends
+type nativeControlListener struct {
+	types.NopConnectionCallbacks
+	s *Stream
+}
 
-	// Map player slot to controller index
-	controllerID := byte(input.PlayerSlot)
+func (l *nativeControlListener) StageFailed(stage types.Stage, err error) {
+	l.s.client.log.Errorf("Control stream stage %d failed: %v", stage, err)
+}
 
-	buf := bytes.NewBuffer(nil)
-	buf.WriteByte(0x06) // Gamepad packet type
-	buf.WriteByte(controllerID)
-	buf.Write(input.Data) // Pre-formatted gamepad state
+func (l *nativeControlListener) ConnectionTerminated(errorCode int, reason types.TerminateReason) {
+	l.s.client.log.Infof("Control stream terminated: %d (%s)", errorCode, reason)
+	if terminationReported(errorCode, reason) {
+		select {
+		case l.s.terminated <- &StreamTerminatedError{Code: errorCode, Reason: reason}:
+		default:
+		}
+	}
+}
 
-	return buf.Bytes()
+func (l *nativeControlListener) Rumble(controllerNumber, lowFreq, highFreq uint16) {
+	l.s.sendFeedback(ControllerFeedback{
+		Type:             "rumble",
+		ControllerNumber: controllerNumber,
+		Payload:          Rumble{LowFreq: lowFreq, HighFreq: highFreq},
+	})
 }
 
-// buildKeyboardPacket creates a keyboard input packet
-func (s *Stream) buildKeyboardPacket(input InputPacket) []byte {
-	// Moonlight keyboard packet format:
-	// Type (1 byte) + Key code (2 bytes) + Modifiers (1 byte) + Key down (1 byte)
+func (l *nativeControlListener) SetMotionEventState(controllerNumber uint16, motionType types.MotionType, reportRateHz uint16) {
+	l.s.sendFeedback(ControllerFeedback{
+		Type:             "motion_event",
+		ControllerNumber: controllerNumber,
+		Payload:          MotionEvent{MotionType: uint8(motionType), ReportRateHz: reportRateHz},
+	})
+}
 
-	buf := bytes.NewBuffer(nil)
-	buf.WriteByte(0x04) // Keyboard packet type
-	buf.Write(input.Data)
+func (l *nativeControlListener) SetControllerLED(controllerNumber uint16, r, g, b uint8) {
+	l.s.sendFeedback(ControllerFeedback{
+		Type:             "controller_led",
+		ControllerNumber: controllerNumber,
+		Payload:          ControllerLED{R: r, G: g, B: b},
+	})
+}
 
-	return buf.Bytes()
+func (l *nativeControlListener) SetAdaptiveTriggers(controllerNumber uint16, eventFlags, typeLeft, typeRight uint8, left, right []byte) {
+	l.s.sendFeedback(ControllerFeedback{
+		Type:             "adaptive_triggers",
+		ControllerNumber: controllerNumber,
+		Payload: AdaptiveTriggers{
+			EventFlags: eventFlags,
+			TypeLeft:   typeLeft,
+			TypeRight:  typeRight,
+			Left:       left,
+			Right:      right,
+		},
+	})
 }
 
-// buildMousePacket creates a mouse input packet
-func (s *Stream) buildMousePacket(input InputPacket) []byte {
-	// Moonlight mouse packet format varies by type (move, button, scroll)
+// sendFeedback queues controller feedback, dropping it if the relay is behind
+func (s *Stream) sendFeedback(fb ControllerFeedback) {
+	select {
+	case s.feedback <- fb:
+	default:
+	}
+}
 
-	buf := bytes.NewBuffer(nil)
-	buf.WriteByte(0x05) // Mouse packet type
-	buf.Write(input.Data)
+// Feedback returns a channel of controller feedback from the host
+func (s *Stream) Feedback() <-chan ControllerFeedback {
+	return s.feedback
+}
 
-	return buf.Bytes()
+// Terminated returns a channel that receives an error if Sunshine ends the
+// connection with one
+func (s *Stream) Terminated() <-chan error {
+	return s.terminated
 }
 
-// Close terminates the stream
+// Close terminates the stream. It's safe to call more than once.
 func (s *Stream) Close() error {
-	s.cancel()
+	s.closeOnce.Do(s.close)
+	return nil
+}
 
-	// Send quit command to Sunshine
-	quitURL := fmt.Sprintf("http://%s:%d/cancel?uniqueid=%s",
-		s.client.host, s.client.port, s.client.uniqueID)
-	http.Get(quitURL)
+// close stops the stream's goroutines before closing the frame channels
+// they send on, so nothing can send on a closed channel
+func (s *Stream) close() {
+	s.cancel()
 
-	// Close all connections
-	if s.rtspConn != nil {
-		s.rtspConn.Close()
-	}
+	// Closing the sockets wakes the receive loops from their reads; they
+	// then see the cancelled context and return
 	if s.videoConn != nil {
 		s.videoConn.Close()
 	}
 	if s.audioConn != nil {
 		s.audioConn.Close()
 	}
-	if s.controlConn != nil {
-		s.controlConn.Close()
+	if s.input != nil {
+		s.input.Close()
 	}
-
-	// Close channels safely
-	select {
-	case <-s.videoFrames:
-	default:
-		close(s.videoFrames)
+	if s.control != nil {
+		s.control.Stop()
 	}
-	select {
-	case <-s.audioFrames:
-	default:
-		close(s.audioFrames)
+	if s.rtspConn != nil {
+		s.rtspConn.Close()
+	}
+	s.wg.Wait()
+
+	close(s.videoFrames)
+	close(s.audioFrames)
+
+	// End the RTSP session whatever state the connections above were in;
+	// the app keeps running for Quit or the next stream to resume
+	if s.sessionID != "" {
+		if err := s.rtspTeardown(); err != nil {
+			s.client.log.Warnf("RTSP TEARDOWN failed: %v", err)
+		}
 	}
+}
 
+// Quit closes the stream and ends the app on Sunshine
+func (s *Stream) Quit() error {
+	s.Close()
+	s.client.quitApp()
 	return nil
 }
 
@@ -1592,6 +2390,86 @@ func (c *Client) GetApps(ctx context.Context) ([]App, error) {
 	return apps, nil
 }
 
+// ErrNoBoxArt is returned when Sunshine has no artwork for an app
+var ErrNoBoxArt = errors.New("no box art for app")
+
+// GetBoxArt fetches an app's box art over the authenticated HTTPS channel,
+// returning the image bytes and content type
+func (c *Client) GetBoxArt(ctx context.Context, appID int) ([]byte, string, error) {
+	if !c.paired {
+		return nil, "", fmt.Errorf("not paired with Sunshine")
+	}
+
+	// AssetType 2 / AssetIdx 0 is the box art, as requested by Moonlight clients
+	url := fmt.Sprintf("https://%s:%d/appasset?uniqueid=%s&appid=%d&AssetType=2&AssetIdx=0",
+		c.host, c.port+PortHTTPSOffset, c.uniqueID, appID)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	resp, err := c.secureClient().Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("box art request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, "", ErrNoBoxArt
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("box art request failed: %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(data) == 0 {
+		return nil, "", ErrNoBoxArt
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "image/") {
+		contentType = http.DetectContentType(data)
+		if !strings.HasPrefix(contentType, "image/") {
+			return nil, "", ErrNoBoxArt
+		}
+	}
+
+	return data, contentType, nil
+}
+
+// ErrServerCertMismatch is returned by requests to Sunshine's HTTPS port
+// when it presents a certificate other than the one pinned at pairing.
+// Pairing again pins the new one, if Sunshine's certificate was replaced.
+var ErrServerCertMismatch = errors.New("Sunshine's certificate does not match the one pinned at pairing")
+
+// secureClient returns an HTTP client for Sunshine's HTTPS port that
+// presents our paired client certificate and only accepts the server
+// certificate pinned at pairing
+func (c *Client) secureClient() *http.Client {
+	pinned := c.serverCert
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				// Sunshine's certificate is self-signed, so rather than a
+				// chain it is checked against the pinned one below
+				InsecureSkipVerify: true,
+				VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+					if len(rawCerts) == 0 || !bytes.Equal(rawCerts[0], pinned) {
+						return ErrServerCertMismatch
+					}
+					return nil
+				},
+				Certificates: []tls.Certificate{*c.clientCert},
+			},
+		},
+		Timeout: 30 * time.Second,
+	}
+}
+
 // App represents a Sunshine application
 type App struct {
 	ID    int    `json:"id"`
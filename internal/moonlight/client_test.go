@@ -0,0 +1,230 @@
+package moonlight
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zalo/moonparty/moonlight-common-go/input"
+	"github.com/zalo/moonparty/moonlight-common-go/protocol"
+	"github.com/zalo/moonparty/moonlight-common-go/types"
+)
+
+func TestStreamOptionsDefaults(t *testing.T) {
+	var opts StreamOptions
+	if got := opts.videoFormat(); got != types.VideoFormatH264 {
+		t.Errorf("zero VideoFormat = %v, want H.264", got)
+	}
+	if got := opts.packetSize(); got != DefaultPacketSize {
+		t.Errorf("zero MTU packet size = %d, want %d", got, DefaultPacketSize)
+	}
+
+	opts.MTU = 1280
+	if got, want := opts.packetSize(), PacketSizeForMTU(1280); got != want {
+		t.Errorf("MTU 1280 packet size = %d, want %d", got, want)
+	}
+}
+
+func TestPacketSizeForMTU(t *testing.T) {
+	for _, tt := range []struct{ mtu, want int }{
+		{1500, MaxPacketSize}, // Ethernet
+		{9000, MaxPacketSize},
+		{1420, 1328}, // WireGuard
+		{1280, 1184}, // The least IPv6 allows
+		{1000, 896},
+		{100, 256},
+	} {
+		size := PacketSizeForMTU(tt.mtu)
+		if size != tt.want {
+			t.Errorf("PacketSizeForMTU(%d) = %d, want %d", tt.mtu, size, tt.want)
+		}
+		if size%16 != 0 {
+			t.Errorf("PacketSizeForMTU(%d) = %d, not a multiple of 16", tt.mtu, size)
+		}
+		if tt.mtu >= 1280 && size+packetOverhead > tt.mtu {
+			t.Errorf("PacketSizeForMTU(%d) = %d, which doesn't fit with its headers", tt.mtu, size)
+		}
+	}
+}
+
+func TestAnnounceSDPUsesStreamOptions(t *testing.T) {
+	c := NewClient("localhost", 47989)
+	normal := &Stream{client: c, opts: StreamOptions{AudioQuality: AudioQualityNormal, AudioConfig: types.AudioConfigStereo}}
+	high := &Stream{client: c, opts: StreamOptions{AudioQuality: AudioQualityHigh, AudioConfig: types.AudioConfigStereo}}
+
+	// Two streams on one client each announce their own audio quality
+	if sdp := normal.announceSDP(); !strings.Contains(sdp, "AudioQuality:0\r\n") {
+		t.Errorf("normal-quality stream announced:\n%s", sdp)
+	}
+	if sdp := high.announceSDP(); !strings.Contains(sdp, "AudioQuality:1\r\n") {
+		t.Errorf("high-quality stream announced:\n%s", sdp)
+	}
+}
+
+func TestRTPCounter(t *testing.T) {
+	var c rtpCounter
+	for _, seq := range []uint16{65534, 65535, 0, 3, 1, 4} {
+		pkt := make([]byte, 12)
+		binary.BigEndian.PutUint16(pkt[2:4], seq)
+		c.count(pkt)
+	}
+
+	// 1 and 2 went missing across the wrap; 1 turning up late doesn't undo it
+	if got := c.received.Load(); got != 6 {
+		t.Errorf("received = %d, want 6", got)
+	}
+	if got := c.dropped.Load(); got != 2 {
+		t.Errorf("dropped = %d, want 2", got)
+	}
+}
+
+func TestStreamGamepadMask(t *testing.T) {
+	var masks []uint16
+	s := &Stream{client: NewClient("127.0.0.1", 47989)}
+	s.input = input.NewStream([4]int{7, 1, 431, 0}, true, make([]byte, 16), make([]byte, 16),
+		func(_ uint8, _ uint32, data []byte, _ bool) error {
+			// Multi-controller packets hold the active mask at 12
+			if binary.LittleEndian.Uint32(data[4:8]) == protocol.MultiControllerMagicGen5 {
+				masks = append(masks, binary.LittleEndian.Uint16(data[12:14]))
+			}
+			return nil
+		})
+
+	xbox := Gamepad{Type: types.ControllerTypeXbox}
+	s.SetActiveGamepads(0b101, []Gamepad{xbox, {}, xbox})
+
+	tests := []struct {
+		slot int
+		want uint16
+	}{
+		{0, 0b101},
+		{2, 0b101},
+		{1, 0b111}, // Input before the arrival still counts the sender
+	}
+	for _, tt := range tests {
+		masks = nil
+		s.SendInput(InputPacket{Type: InputTypeGamepad, PlayerSlot: tt.slot, Data: make([]byte, 14)})
+		if len(masks) != 1 || masks[0] != tt.want {
+			t.Errorf("slot %d sent masks %b, want [%b]", tt.slot, masks, tt.want)
+		}
+	}
+}
+
+func TestIdentityDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "identity")
+	c := NewClient("localhost", 47989)
+	c.SetIdentityDir(dir)
+	if err := c.loadOrGenerateIdentity(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The directory and everything in it are private to the user
+	if info, err := os.Stat(dir); err != nil || info.Mode().Perm() != 0700 {
+		t.Fatalf("identity directory: %v, %v; want mode 0700", info, err)
+	}
+	for _, name := range []string{"client.crt", "client.key", "unique_id"} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("%s not created: %v", name, err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("%s has mode %v, want 0600", name, info.Mode().Perm())
+		}
+	}
+
+	// Another client pointed at the directory reloads the same identity
+	again := NewClient("localhost", 47989)
+	again.SetIdentityDir(dir)
+	if err := again.loadOrGenerateIdentity(); err != nil {
+		t.Fatal(err)
+	}
+	if again.uniqueID != c.uniqueID || !bytes.Equal(again.certDER, c.certDER) || !again.privateKey.Equal(c.privateKey) {
+		t.Fatalf("reloaded identity %s differs from the one generated, %s", again.uniqueID, c.uniqueID)
+	}
+
+	// And deleting it leaves the next load to generate a new one
+	if err := again.DeleteIdentity(); err != nil {
+		t.Fatal(err)
+	}
+	fresh := NewClient("localhost", 47989)
+	fresh.SetIdentityDir(dir)
+	if err := fresh.loadOrGenerateIdentity(); err != nil {
+		t.Fatal(err)
+	}
+	if fresh.uniqueID == c.uniqueID {
+		t.Fatal("deleted identity was loaded again")
+	}
+}
+
+func TestResolveServerIP(t *testing.T) {
+	for _, host := range []string{"127.0.0.1", "::1", "fd00::10", "192.168.1.20"} {
+		ip, err := resolveServerIP(host)
+		if err != nil || !ip.Equal(net.ParseIP(host)) {
+			t.Errorf("resolveServerIP(%q) = %v, %v; want the literal", host, ip, err)
+		}
+	}
+
+	// localhost stays on loopback, whichever family it resolves to
+	if ip, err := resolveServerIP("localhost"); err != nil || !ip.IsLoopback() {
+		t.Errorf("resolveServerIP(localhost) = %v, %v; want a loopback address", ip, err)
+	}
+}
+
+func TestMediaSocketsIPv6Loopback(t *testing.T) {
+	host, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	defer host.Close()
+	port := host.LocalAddr().(*net.UDPAddr).Port
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Stream{
+		client:      NewClient("::1", 47989),
+		ctx:         ctx,
+		videoPort:   port,
+		audioPort:   port,
+		pingPayload: "0123456789abcdef",
+	}
+	if err := s.openMediaSockets(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cancel()
+		s.wg.Wait()
+		s.videoConn.Close()
+		s.audioConn.Close()
+	}()
+
+	// Both sockets are IPv6, bound to every v6 address
+	for _, conn := range []*net.UDPConn{s.videoConn, s.audioConn} {
+		if addr := conn.LocalAddr().(*net.UDPAddr); !addr.IP.Equal(net.IPv6zero) || addr.IP.To4() != nil {
+			t.Fatalf("media socket bound to %v, want [::]", addr)
+		}
+	}
+	if !s.serverIP().Equal(net.IPv6loopback) {
+		t.Fatalf("server resolved to %v, want ::1", s.serverIP())
+	}
+
+	// And the pings reach Sunshine over v6 from each of them
+	s.startPingThreads()
+	want := map[int]bool{s.localVideoPort: true, s.localAudioPort: true}
+	host.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 64)
+	for len(want) > 0 {
+		n, from, err := host.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("pings from ports %v never arrived: %v", want, err)
+		}
+		if n != 20 || string(buf[:16]) != s.pingPayload {
+			t.Fatalf("ping % x, want the payload and a sequence number", buf[:n])
+		}
+		delete(want, from.Port)
+	}
+}
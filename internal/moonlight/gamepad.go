@@ -0,0 +1,267 @@
+package moonlight
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/zalo/moonparty/moonlight-common-go/types"
+)
+
+// Gamepad describes the controller a player holds, as their browser reports
+// it. Sunshine uses the type to pick the virtual controller games see, so
+// they show the right button prompts.
+type Gamepad struct {
+	Type types.ControllerType
+
+	// Battery is BatteryStateUnknown unless the browser can read the
+	// controller's battery, in which case BatteryPercent is its charge
+	Battery        types.BatteryState
+	BatteryPercent uint8
+}
+
+// capabilities is what the controller is announced as having
+func (g Gamepad) capabilities() uint16 {
+	caps := gamepadCapabilities
+	if g.Battery != types.BatteryStateUnknown {
+		caps |= types.CapBattery
+	}
+	return uint16(caps)
+}
+
+// batteryChanged reports whether other carries a different battery reading
+func (g Gamepad) batteryChanged(other Gamepad) bool {
+	return g.Battery != other.Battery || g.BatteryPercent != other.BatteryPercent
+}
+
+// gamepadInputSize is the length of a gamepad input packet: the buttons,
+// triggers and sticks (see gamepadSticksEnd) and two unused bytes
+const gamepadInputSize = 14
+
+// GamepadInput is a decoded InputTypeGamepad packet
+type GamepadInput struct {
+	Buttons      int // types.Button* flags
+	LeftTrigger  uint8
+	RightTrigger uint8
+	LeftStickX   int16
+	LeftStickY   int16
+	RightStickX  int16
+	RightStickY  int16
+}
+
+// ParseGamepad decodes the Data of an InputTypeGamepad packet:
+// buttons(2) + leftTrigger(1) + rightTrigger(1) + leftStickX(2) +
+// leftStickY(2) + rightStickX(2) + rightStickY(2), all little-endian
+func ParseGamepad(data []byte) (GamepadInput, bool) {
+	if len(data) < gamepadInputSize {
+		return GamepadInput{}, false
+	}
+	return GamepadInput{
+		Buttons:      int(binary.LittleEndian.Uint16(data[0:2])),
+		LeftTrigger:  data[2],
+		RightTrigger: data[3],
+		LeftStickX:   int16(binary.LittleEndian.Uint16(data[4:6])),
+		LeftStickY:   int16(binary.LittleEndian.Uint16(data[6:8])),
+		RightStickX:  int16(binary.LittleEndian.Uint16(data[8:10])),
+		RightStickY:  int16(binary.LittleEndian.Uint16(data[10:12])),
+	}, true
+}
+
+// gamepadSlots are the controllers a stream has announced to Sunshine
+type gamepadSlots struct {
+	mu   sync.RWMutex
+	mask uint16      // Connected controllers, one bit per player slot
+	pads [16]Gamepad // What each controller is, by slot as in the mask
+}
+
+// set records the connected controllers and sends what changed since the
+// last call with events
+func (g *gamepadSlots) set(mask uint16, pads []Gamepad, events gamepadEvents) {
+	g.mu.Lock()
+	old, oldPads := g.mask, g.pads
+	g.mask = mask
+	g.pads = [16]Gamepad{}
+	copy(g.pads[:], pads)
+	newPads := g.pads
+	g.mu.Unlock()
+
+	events.update(old, oldPads, mask, newPads)
+}
+
+// active returns the mask to send with a gamepad event from slot.
+// The sender is always included, in case input beats the arrival.
+func (g *gamepadSlots) active(slot int) uint16 {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.mask | 1<<slot
+}
+
+// USB vendor IDs of the controller makers Sunshine can emulate
+const (
+	vendorMicrosoft = "045e"
+	vendorSony      = "054c"
+	vendorNintendo  = "057e"
+)
+
+// ControllerTypeForGamepadID guesses the kind of controller from the id the
+// browser's Gamepad API gives it. Chrome writes it as "DualSense Wireless
+// Controller (STANDARD GAMEPAD Vendor: 054c Product: 0ce6)" and Firefox as
+// "054c-0ce6-DualSense Wireless Controller", so the vendor is checked first
+// and the name after.
+func ControllerTypeForGamepadID(id string) types.ControllerType {
+	id = strings.ToLower(id)
+
+	switch gamepadVendor(id) {
+	case vendorSony:
+		return types.ControllerTypePS
+	case vendorNintendo:
+		return types.ControllerTypeNintendo
+	case vendorMicrosoft:
+		return types.ControllerTypeXbox
+	}
+
+	switch {
+	case containsAny(id, "dualsense", "dualshock", "playstation"):
+		return types.ControllerTypePS
+	case containsAny(id, "nintendo", "pro controller", "joy-con"):
+		return types.ControllerTypeNintendo
+	case containsAny(id, "xbox", "xinput"):
+		return types.ControllerTypeXbox
+	}
+	return types.ControllerTypeUnknown
+}
+
+// gamepadVendor returns the USB vendor ID in a lowercased Gamepad API id,
+// or "" if it has none
+func gamepadVendor(id string) string {
+	if _, rest, ok := strings.Cut(id, "vendor: "); ok && len(rest) >= 4 {
+		return rest[:4]
+	}
+	if len(id) > 10 && id[4] == '-' && id[9] == '-' {
+		return id[:4]
+	}
+	return ""
+}
+
+func containsAny(s string, substrs ...string) bool {
+	for _, sub := range substrs {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// GamepadBattery converts a battery reading as browsers give them, a level
+// from 0 to 1 and whether it's charging, to what Sunshine is sent
+func GamepadBattery(level float64, charging bool) (types.BatteryState, uint8) {
+	percent := uint8(min(max(level, 0), 1)*100 + 0.5)
+	switch {
+	case charging && percent >= 100:
+		return types.BatteryStateFull, percent
+	case charging:
+		return types.BatteryStateCharging, percent
+	default:
+		return types.BatteryStateDischarging, percent
+	}
+}
+
+// DefaultStickDeadzone is the share of each stick's travel around center
+// ignored unless a player calibrates otherwise. It's enough to hide the
+// drift of a worn stick without making a good one feel sluggish.
+const DefaultStickDeadzone = 0.08
+
+// StickCalibration corrects a player's analog sticks before they reach
+// Sunshine. The deadzone is radial: a stick is centered while its distance
+// from center is within Deadzone, and beyond it the distance is rescaled so
+// the range from Deadzone to Saturation covers all of the stick's travel.
+// Measuring the distance rather than each axis on its own keeps small
+// diagonal movements and doesn't snap the stick to the axes.
+type StickCalibration struct {
+	Deadzone   float64 `json:"deadzone"`   // 0 to 0.9 of full travel
+	Saturation float64 `json:"saturation"` // Travel that counts as full, above Deadzone and up to 1
+
+	InvertLeftX  bool `json:"invert_left_x"`
+	InvertLeftY  bool `json:"invert_left_y"`
+	InvertRightX bool `json:"invert_right_x"`
+	InvertRightY bool `json:"invert_right_y"`
+}
+
+// DefaultStickCalibration is what players start with: DefaultStickDeadzone
+// and nothing inverted
+func DefaultStickCalibration() StickCalibration {
+	return StickCalibration{Deadzone: DefaultStickDeadzone, Saturation: 1}
+}
+
+// Validate checks the deadzone and saturation are in range
+func (c StickCalibration) Validate() error {
+	if c.Deadzone < 0 || c.Deadzone > 0.9 {
+		return fmt.Errorf("deadzone %g must be between 0 and 0.9", c.Deadzone)
+	}
+	if c.Saturation <= c.Deadzone || c.Saturation > 1 {
+		return fmt.Errorf("saturation %g must be above the deadzone and at most 1", c.Saturation)
+	}
+	return nil
+}
+
+// gamepadSticksEnd is where the sticks end in a gamepad input packet, which
+// holds buttons(2), triggers(2), then the left and right sticks' X and Y as
+// little-endian int16s
+const gamepadSticksEnd = 12
+
+// Apply returns a copy of a gamepad input packet with its sticks
+// calibrated. Packets too short to hold the sticks are returned as they are.
+func (c StickCalibration) Apply(data []byte) []byte {
+	if len(data) < gamepadSticksEnd {
+		return data
+	}
+	out := make([]byte, len(data))
+	copy(out, data)
+	c.applyStick(out[4:8], c.InvertLeftX, c.InvertLeftY)
+	c.applyStick(out[8:12], c.InvertRightX, c.InvertRightY)
+	return out
+}
+
+// applyStick calibrates one stick's X and Y in place
+func (c StickCalibration) applyStick(b []byte, invertX, invertY bool) {
+	x := int16(binary.LittleEndian.Uint16(b[0:2]))
+	y := int16(binary.LittleEndian.Uint16(b[2:4]))
+	x, y = c.Stick(x, y)
+	if invertX {
+		x = invertAxis(x)
+	}
+	if invertY {
+		y = invertAxis(y)
+	}
+	binary.LittleEndian.PutUint16(b[0:2], uint16(x))
+	binary.LittleEndian.PutUint16(b[2:4], uint16(y))
+}
+
+// Stick applies the radial deadzone and saturation to a stick's position.
+// Past Saturation the stick is held at full travel in the direction it
+// points.
+func (c StickCalibration) Stick(x, y int16) (int16, int16) {
+	fx, fy := float64(x)/math.MaxInt16, float64(y)/math.MaxInt16
+	distance := math.Hypot(fx, fy)
+	if distance <= c.Deadzone {
+		return 0, 0
+	}
+	scaled := min((distance-c.Deadzone)/(c.Saturation-c.Deadzone), 1)
+	scale := scaled / distance
+	return stickAxis(fx * scale), stickAxis(fy * scale)
+}
+
+// stickAxis converts an axis from -1..1 back to a stick value
+func stickAxis(v float64) int16 {
+	return int16(math.Round(min(max(v, -1), 1) * math.MaxInt16))
+}
+
+// invertAxis flips an axis, keeping -32768 in range
+func invertAxis(v int16) int16 {
+	if v == math.MinInt16 {
+		return math.MaxInt16
+	}
+	return -v
+}
@@ -0,0 +1,143 @@
+package moonlight
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func TestParseGamepad(t *testing.T) {
+	data := []byte{0x01, 0x10, 0x40, 0xFF, 0xFF, 0x7F, 0x00, 0x80, 0x01, 0x00, 0xFF, 0xFF, 0, 0}
+	want := GamepadInput{
+		Buttons:      0x1001,
+		LeftTrigger:  0x40,
+		RightTrigger: 0xFF,
+		LeftStickX:   32767,
+		LeftStickY:   -32768,
+		RightStickX:  1,
+		RightStickY:  -1,
+	}
+	if got, ok := ParseGamepad(data); !ok || got != want {
+		t.Errorf("ParseGamepad = %+v, %v; want %+v", got, ok, want)
+	}
+	if _, ok := ParseGamepad(data[:gamepadInputSize-1]); ok {
+		t.Error("ParseGamepad accepted a short packet")
+	}
+}
+
+func TestStickDeadzone(t *testing.T) {
+	cal := DefaultStickCalibration()
+
+	for _, tt := range []struct {
+		name   string
+		x, y   int16
+		center bool
+	}{
+		{"centered", 0, 0, true},
+		{"drift on one axis", 2000, 0, true},
+		{"drift on both axes", -1500, 1500, true},
+		{"just past the deadzone", 2700, 0, false},
+		// Each axis alone is inside the deadzone but the stick, measured
+		// from center, is past it
+		{"small diagonal", 2300, 2300, false},
+	} {
+		x, y := cal.Stick(tt.x, tt.y)
+		if centered := x == 0 && y == 0; centered != tt.center {
+			t.Errorf("%s: (%d, %d) became (%d, %d)", tt.name, tt.x, tt.y, x, y)
+		}
+	}
+
+	// Past the deadzone the stick still points the same way
+	if x, y := cal.Stick(2300, 2300); x != y {
+		t.Errorf("small diagonal became (%d, %d), off the diagonal", x, y)
+	}
+	x, y := cal.Stick(12000, -16000)
+	if ratio := float64(x) / float64(y); math.Abs(ratio+0.75) > 0.001 {
+		t.Errorf("(12000, -16000) became (%d, %d), a different direction", x, y)
+	}
+}
+
+func TestStickRescale(t *testing.T) {
+	for _, tt := range []struct {
+		name         string
+		cal          StickCalibration
+		x, y         int16
+		wantX, wantY int16
+	}{
+		{"full travel", DefaultStickCalibration(), math.MaxInt16, 0, math.MaxInt16, 0},
+		{"full travel negative", DefaultStickCalibration(), 0, math.MinInt16, 0, -math.MaxInt16},
+		// Halfway between the deadzone and full travel is half travel
+		{"halfway", DefaultStickCalibration(), 17694, 0, 16383, 0},
+		{"no deadzone", StickCalibration{Saturation: 1}, 100, -100, 100, -100},
+		{"at saturation", StickCalibration{Saturation: 0.8}, 26214, 0, math.MaxInt16, 0},
+		{"past saturation", StickCalibration{Saturation: 0.8}, 0, -30000, 0, -math.MaxInt16},
+		{"diagonal past saturation", StickCalibration{Saturation: 0.8}, 20000, 20000, 23170, 23170},
+	} {
+		x, y := tt.cal.Stick(tt.x, tt.y)
+		if abs(int(x)-int(tt.wantX)) > 1 || abs(int(y)-int(tt.wantY)) > 1 {
+			t.Errorf("%s: (%d, %d) became (%d, %d), want (%d, %d)", tt.name, tt.x, tt.y, x, y, tt.wantX, tt.wantY)
+		}
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func TestStickCalibrationApply(t *testing.T) {
+	cal := StickCalibration{Saturation: 1, InvertLeftY: true, InvertRightX: true}
+
+	// Buttons, triggers, left stick, right stick, then what follows them
+	data := make([]byte, 14)
+	binary.LittleEndian.PutUint16(data[0:2], 0x1234)
+	data[2], data[3] = 200, 100
+	for i, v := range []int16{-20000, 1000, 30000, -5000} {
+		binary.LittleEndian.PutUint16(data[4+2*i:], uint16(v))
+	}
+	data[12], data[13] = 0xaa, 0xbb
+	orig := bytes.Clone(data)
+
+	out := cal.Apply(data)
+	if !bytes.Equal(data, orig) {
+		t.Fatal("Apply changed the packet it was given")
+	}
+	if !bytes.Equal(out[:4], orig[:4]) || !bytes.Equal(out[12:], orig[12:]) {
+		t.Fatalf("Apply changed more than the sticks: % x", out)
+	}
+	want := []int16{-20000, -1000, -30000, -5000}
+	for i, w := range want {
+		if got := int16(binary.LittleEndian.Uint16(out[4+2*i:])); got != w {
+			t.Errorf("axis %d = %d, want %d", i, got, w)
+		}
+	}
+
+	if short := []byte{1, 2, 3}; !bytes.Equal(cal.Apply(short), short) {
+		t.Error("Apply changed a packet too short to hold the sticks")
+	}
+	if got := invertAxis(math.MinInt16); got != math.MaxInt16 {
+		t.Errorf("inverting %d = %d, want %d", math.MinInt16, got, math.MaxInt16)
+	}
+}
+
+func TestStickCalibrationValidate(t *testing.T) {
+	for _, tt := range []struct {
+		cal StickCalibration
+		ok  bool
+	}{
+		{DefaultStickCalibration(), true},
+		{StickCalibration{Deadzone: 0, Saturation: 1}, true},
+		{StickCalibration{Deadzone: 0.9, Saturation: 1}, true},
+		{StickCalibration{Deadzone: -0.1, Saturation: 1}, false},
+		{StickCalibration{Deadzone: 0.95, Saturation: 1}, false},
+		{StickCalibration{Deadzone: 0.5, Saturation: 0.5}, false},
+		{StickCalibration{Deadzone: 0.1, Saturation: 1.1}, false},
+	} {
+		if err := tt.cal.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%+v: Validate() = %v", tt.cal, err)
+		}
+	}
+}
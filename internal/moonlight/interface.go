@@ -1,5 +1,11 @@
 package moonlight
 
+import (
+	"fmt"
+
+	"github.com/zalo/moonparty/moonlight-common-go/types"
+)
+
 // Streamer is the interface for a video/audio stream from Sunshine
 type Streamer interface {
 	// VideoFrames returns a channel for receiving video frame data
@@ -11,10 +17,287 @@ type Streamer interface {
 	// SendInput sends an input packet to Sunshine
 	SendInput(input InputPacket)
 
-	// Close terminates the stream
+	// Close terminates the stream, leaving the app running on Sunshine so
+	// another stream can resume it
 	Close() error
+
+	// Quit closes the stream and ends the app on Sunshine
+	Quit() error
+}
+
+// ControllerFeedback is a host-to-controller event (e.g. trigger effects)
+// that the server routes to the peer occupying the controller's player slot
+type ControllerFeedback struct {
+	// Type identifies the feedback, e.g. "adaptive_triggers"
+	Type string `json:"type"`
+
+	// ControllerNumber is the Sunshine controller, equal to the player slot
+	ControllerNumber uint16 `json:"controller"`
+
+	// Payload is the type-specific data, encoded as JSON for the browser
+	Payload interface{} `json:"payload"`
+}
+
+// AdaptiveTriggers is the payload of an "adaptive_triggers" feedback event.
+// Left and Right are the raw DualSense effect parameter blocks, which a
+// WebHID client writes into its output report for each trigger.
+type AdaptiveTriggers struct {
+	EventFlags uint8  `json:"event_flags"`
+	TypeLeft   uint8  `json:"type_left"`
+	TypeRight  uint8  `json:"type_right"`
+	Left       []byte `json:"left"`
+	Right      []byte `json:"right"`
+}
+
+// Rumble is the payload of a "rumble" feedback event: the motor speeds the
+// controller should run at until the next event, zero stopping it
+type Rumble struct {
+	LowFreq  uint16 `json:"low_freq"`
+	HighFreq uint16 `json:"high_freq"`
+}
+
+// MotionEvent is the payload of a "motion_event" feedback event: the host
+// wants the motion sensor of MotionType reported at ReportRateHz, or no
+// longer reported when the rate is 0
+type MotionEvent struct {
+	MotionType   uint8  `json:"motion_type"`
+	ReportRateHz uint16 `json:"report_rate_hz"`
+}
+
+// ControllerLED is the payload of a "controller_led" feedback event: the
+// color the controller's light bar should show
+type ControllerLED struct {
+	R uint8 `json:"r"`
+	G uint8 `json:"g"`
+	B uint8 `json:"b"`
+}
+
+// FeedbackSource is implemented by streams that relay controller feedback
+type FeedbackSource interface {
+	// Feedback returns a channel of host-to-controller events
+	Feedback() <-chan ControllerFeedback
+}
+
+// IDRRequester is implemented by streams that can ask Sunshine for a keyframe
+type IDRRequester interface {
+	// RequestIDR asks the host to send an IDR frame
+	RequestIDR()
+}
+
+// StreamTerminatedError reports that the connection to Sunshine ended with an
+// error code, e.g. types.ErrNoVideoTraffic when video stopped arriving, and
+// the reason Sunshine gave if any
+type StreamTerminatedError struct {
+	Code   int
+	Reason types.TerminateReason
+}
+
+func (e *StreamTerminatedError) Error() string {
+	if e.Reason != types.TerminateReasonUnknown {
+		return fmt.Sprintf("stream terminated with error %d (%s)", e.Code, e.Reason)
+	}
+	return fmt.Sprintf("stream terminated with error %d", e.Code)
+}
+
+// Recoverable reports whether starting the stream again may help. Protected
+// content stays protected however often it's retried, an app that exited
+// isn't ours to relaunch, and a stream another client took over would only
+// be taken back from it.
+func (e *StreamTerminatedError) Recoverable() bool {
+	switch e.Reason {
+	case types.TerminateReasonAppExited, types.TerminateReasonTakenOver:
+		return false
+	}
+	return e.Code != types.ErrProtectedContent
+}
+
+// terminationReported reports whether a connection ending with errorCode
+// and reason should be reported as a StreamTerminatedError: it failed, or
+// Sunshine said why it ended
+func terminationReported(errorCode int, reason types.TerminateReason) bool {
+	return errorCode != 0 || reason != types.TerminateReasonUnknown
+}
+
+// TerminationSource is implemented by streams that notice Sunshine ending them
+type TerminationSource interface {
+	// Terminated returns a channel that receives a *StreamTerminatedError
+	// if the connection ends with an error. Ending it with Close doesn't.
+	Terminated() <-chan error
+}
+
+// ConnectionQuality is how well the stream from Sunshine is arriving: the
+// share of video frames lost over the last few seconds, and whether that's
+// enough to call the connection poor
+type ConnectionQuality struct {
+	Poor        bool `json:"poor"`
+	LossPercent int  `json:"loss_percent"`
+}
+
+// ConnectionQualitySource is implemented by streams that notice their
+// connection to Sunshine turning poor and recovering
+type ConnectionQualitySource interface {
+	// ConnectionQuality returns a channel that receives each change
+	ConnectionQuality() <-chan ConnectionQuality
+}
+
+// sendQuality queues a quality change, replacing one nobody read yet since
+// only the latest matters
+func sendQuality(ch chan ConnectionQuality, q ConnectionQuality) {
+	for {
+		select {
+		case ch <- q:
+			return
+		default:
+		}
+		select {
+		case <-ch:
+		default:
+		}
+	}
+}
+
+// GamepadTracker is implemented by streams that announce controllers to Sunshine.
+// Games enumerate controllers from the active gamepad mask, so it must cover
+// every seated player rather than just the one sending input.
+type GamepadTracker interface {
+	// SetActiveGamepads updates the connected controllers, one bit per player
+	// slot and pads[slot] describing each, sending an arrival or departure
+	// for each slot that changed and any new controller type or battery
+	SetActiveGamepads(mask uint16, pads []Gamepad)
+}
+
+// StreamStats summarizes what a stream has received from Sunshine
+type StreamStats struct {
+	VideoPacketsReceived  uint32 `json:"video_packets_received"`
+	VideoPacketsDropped   uint32 `json:"video_packets_dropped"`
+	VideoPacketsRecovered uint32 `json:"video_packets_recovered"` // Rebuilt from FEC parity
+	FramesSubmitted       uint32 `json:"frames_submitted"`
+	FramesDropped         uint32 `json:"frames_dropped"`
+	IDRRequests           uint32 `json:"idr_requests"`
+	RefInvalidations      uint32 `json:"ref_invalidations"`
+
+	AudioPacketsReceived  uint32 `json:"audio_packets_received"`
+	AudioPacketsDropped   uint32 `json:"audio_packets_dropped"`
+	AudioPacketsRecovered uint32 `json:"audio_packets_recovered"`
+
+	// HostRTTMs is the smoothed round-trip time to Sunshine over the
+	// control stream, 0 until one is measured
+	HostRTTMs uint32 `json:"host_rtt_ms"`
+}
+
+// StatsSource is implemented by streams that report receive statistics
+type StatsSource interface {
+	// Stats returns the stream's counters so far
+	Stats() StreamStats
+}
+
+// AudioFormat is the Opus audio a stream negotiated with Sunshine
+type AudioFormat struct {
+	SampleRate      int  `json:"sample_rate"`
+	Channels        int  `json:"channels"`
+	Streams         int  `json:"streams"`         // Opus multistream streams
+	CoupledStreams  int  `json:"coupled_streams"` // Of Streams, those carrying two channels
+	SamplesPerFrame int  `json:"samples_per_frame"`
+	Encrypted       bool `json:"encrypted"`
+}
+
+// newAudioFormat describes a negotiated Opus layout
+func newAudioFormat(config types.OpusConfig, encrypted bool) AudioFormat {
+	return AudioFormat{
+		SampleRate:      config.SampleRate,
+		Channels:        config.ChannelCount,
+		Streams:         config.Streams,
+		CoupledStreams:  config.CoupledStreams,
+		SamplesPerFrame: config.SamplesPerFrame,
+		Encrypted:       encrypted,
+	}
+}
+
+// AudioFormatSource is implemented by streams that know the audio format
+// they negotiated
+type AudioFormatSource interface {
+	// AudioFormat returns the negotiated audio, or false until it's known
+	AudioFormat() (AudioFormat, bool)
+}
+
+// BitrateSource is implemented by streams that know the video bitrate they
+// asked Sunshine for. Sunshine fixes it at launch.
+type BitrateSource interface {
+	// Bitrate returns the stream's video bitrate in Kbps
+	Bitrate() int
+}
+
+// PenInputSource is implemented by streams that can tell whether the host
+// takes InputTypePen. Only Sunshine does, and only when it advertises
+// types.FFPenTouchEvents; pen input to any other host is dropped.
+type PenInputSource interface {
+	// SupportsPen reports whether pen input reaches the host
+	SupportsPen() bool
+}
+
+// StreamDiagnostics describes what a stream negotiated with Sunshine, for
+// bug reports. It never includes key material.
+type StreamDiagnostics struct {
+	Backend       string `json:"backend"`
+	ServerVersion string `json:"server_version"`
+	Sunshine      bool   `json:"sunshine"`
+
+	VideoCodec    string `json:"video_codec"`
+	Width         int    `json:"width"`
+	Height        int    `json:"height"`
+	FPS           int    `json:"fps"`
+	BitrateKbps   int    `json:"bitrate_kbps"`
+	AudioChannels int    `json:"audio_channels"`
+	AudioPacketMs int    `json:"audio_packet_ms"`
+
+	RTSPPort    int `json:"rtsp_port"`
+	VideoPort   int `json:"video_port"`
+	AudioPort   int `json:"audio_port"`
+	ControlPort int `json:"control_port"`
+
+	VideoEncrypted   bool `json:"video_encrypted"`
+	AudioEncrypted   bool `json:"audio_encrypted"`
+	ControlEncrypted bool `json:"control_encrypted"`
+
+	Stats StreamStats `json:"stats"`
+}
+
+// DiagnosticsSource is implemented by streams that can describe their connection
+type DiagnosticsSource interface {
+	// Diagnostics returns the stream's negotiated settings and counters
+	Diagnostics() StreamDiagnostics
 }
 
 // Verify that both implementations satisfy the interface
 var _ Streamer = (*Stream)(nil)
 var _ Streamer = (*LimelightStream)(nil)
+var _ Streamer = (*PureGoStream)(nil)
+
+var _ TerminationSource = (*Stream)(nil)
+var _ FeedbackSource = (*Stream)(nil)
+var _ PenInputSource = (*Stream)(nil)
+var _ StatsSource = (*Stream)(nil)
+var _ GamepadTracker = (*Stream)(nil)
+var _ BitrateSource = (*Stream)(nil)
+
+var _ FeedbackSource = (*LimelightStream)(nil)
+var _ IDRRequester = (*LimelightStream)(nil)
+var _ StatsSource = (*LimelightStream)(nil)
+var _ GamepadTracker = (*LimelightStream)(nil)
+var _ DiagnosticsSource = (*LimelightStream)(nil)
+var _ AudioFormatSource = (*LimelightStream)(nil)
+var _ TerminationSource = (*LimelightStream)(nil)
+var _ ConnectionQualitySource = (*LimelightStream)(nil)
+var _ PenInputSource = (*LimelightStream)(nil)
+var _ BitrateSource = (*LimelightStream)(nil)
+
+var _ FeedbackSource = (*PureGoStream)(nil)
+var _ IDRRequester = (*PureGoStream)(nil)
+var _ StatsSource = (*PureGoStream)(nil)
+var _ GamepadTracker = (*PureGoStream)(nil)
+var _ DiagnosticsSource = (*PureGoStream)(nil)
+var _ AudioFormatSource = (*PureGoStream)(nil)
+var _ TerminationSource = (*PureGoStream)(nil)
+var _ ConnectionQualitySource = (*PureGoStream)(nil)
+var _ PenInputSource = (*PureGoStream)(nil)
+var _ BitrateSource = (*PureGoStream)(nil)
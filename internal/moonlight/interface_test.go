@@ -0,0 +1,24 @@
+package moonlight
+
+import (
+	"testing"
+
+	"github.com/zalo/moonparty/moonlight-common-go/types"
+)
+
+func TestStreamTerminatedRecoverable(t *testing.T) {
+	for _, tt := range []struct {
+		err  StreamTerminatedError
+		want bool
+	}{
+		{StreamTerminatedError{Code: types.ErrNoVideoTraffic}, true},
+		{StreamTerminatedError{Code: -1, Reason: types.TerminateReasonTimeout}, true},
+		{StreamTerminatedError{Code: types.ErrProtectedContent}, false},
+		{StreamTerminatedError{Reason: types.TerminateReasonAppExited}, false},
+		{StreamTerminatedError{Code: -1, Reason: types.TerminateReasonTakenOver}, false},
+	} {
+		if got := tt.err.Recoverable(); got != tt.want {
+			t.Errorf("%v: Recoverable() = %v, want %v", &tt.err, got, tt.want)
+		}
+	}
+}
@@ -5,19 +5,20 @@ package limelight
 import (
 	"context"
 	"fmt"
-	"log"
 	"sync"
+	"time"
 
 	common "github.com/zalo/moonparty/moonlight-common-go/limelight"
+	"github.com/zalo/moonparty/moonlight-common-go/logging"
 )
 
 // Video format constants
 const (
 	VideoFormatH264       = int(common.VideoFormatH264)
 	VideoFormatH265       = int(common.VideoFormatH265)
-	VideoFormatH265Main10 = int(common.VideoFormatH265)
-	VideoFormatAV1Main8   = int(common.VideoFormatAV1)
-	VideoFormatAV1Main10  = int(common.VideoFormatAV1)
+	VideoFormatH265Main10 = int(common.VideoFormatH265Main10)
+	VideoFormatAV1Main8   = int(common.VideoFormatAV1Main8)
+	VideoFormatAV1Main10  = int(common.VideoFormatAV1Main10)
 )
 
 // Audio configuration constants
@@ -36,8 +37,16 @@ const (
 
 // Decoder return codes
 const (
-	DrOk      = 0
-	DrNeedIDR = -1
+	DrOk      = common.DrOk
+	DrNeedIDR = common.DrNeedIDR
+)
+
+// Frame types reported in DecodeUnit.FrameType
+const (
+	FrameTypeUnknown        = int(common.FrameTypeUnknown)
+	FrameTypeIDR            = int(common.FrameTypeIDR)
+	FrameTypePFrame         = int(common.FrameTypePFrames)
+	FrameTypeRefInvalidated = int(common.FrameTypeRefInvalidated)
 )
 
 // Button flags for controller input
@@ -121,6 +130,22 @@ type OpusConfig struct {
 	Mapping         [8]byte
 }
 
+// GetLimelightVersion returns the version of the moonlight-common-go library
+func GetLimelightVersion() string {
+	return common.Version
+}
+
+// GetLimelightCapabilities returns the video codecs the library can stream,
+// when the host can encode them
+func GetLimelightCapabilities() []string {
+	return []string{"h264", "h265", "av1"}
+}
+
+// GetLimelightFeatures returns the optional input features the library can send
+func GetLimelightFeatures() []string {
+	return []string{"touch", "pen", "gyro"}
+}
+
 // Callbacks holds the Go callback functions
 type Callbacks struct {
 	// Video decoder callbacks
@@ -138,13 +163,17 @@ type Callbacks struct {
 	OnAudioSample  func(data []byte)
 
 	// Connection callbacks
-	OnStageStarting        func(stage int)
-	OnStageComplete        func(stage int)
-	OnStageFailed          func(stage, errorCode int)
-	OnConnectionStarted    func()
-	OnConnectionTerminated func(errorCode int)
-	OnLogMessage           func(msg string)
-	OnRumble               func(controllerNumber, lowFreq, highFreq uint16)
+	OnStageStarting          func(stage int)
+	OnStageComplete          func(stage int)
+	OnStageFailed            func(stage, errorCode int)
+	OnConnectionStarted      func()
+	OnConnectionTerminated   func(errorCode, reason int) // reason is a common.TerminateReason
+	OnConnectionStatusUpdate func(poor bool, lossPercent int)
+	OnLogMessage             func(msg string)
+	OnRumble                 func(controllerNumber, lowFreq, highFreq uint16)
+	OnAdaptiveTriggers       func(controllerNumber uint16, eventFlags, typeLeft, typeRight uint8, left, right []byte)
+	OnMotionEventState       func(controllerNumber uint16, motionType uint8, reportRateHz uint16)
+	OnControllerLED          func(controllerNumber uint16, r, g, b uint8)
 }
 
 var (
@@ -173,6 +202,13 @@ type StreamConfig struct {
 	StreamingRemotely     int
 	AudioConfiguration    int
 	SupportedVideoFormats int
+	HDREnabled            bool
+	AudioQuality          int
+	MinFECPackets         int
+	FirstFrameTimeout     time.Duration
+	NoVideoTrafficTimeout time.Duration
+	AudioInitialDropMs    int
+	AudioJitterBufferMs   int
 	RiKey                 []byte
 	RiKeyID               int
 }
@@ -197,7 +233,7 @@ func (a *callbackAdapter) StageStarting(stage common.Stage) {
 	if cbs != nil && cbs.OnStageStarting != nil {
 		cbs.OnStageStarting(int(stage))
 	}
-	log.Printf("Connection stage starting: %s", GetStageName(int(stage)))
+	logging.Debugf("Connection stage starting: %s", GetStageName(int(stage)))
 }
 
 func (a *callbackAdapter) StageComplete(stage common.Stage) {
@@ -208,7 +244,7 @@ func (a *callbackAdapter) StageComplete(stage common.Stage) {
 	if cbs != nil && cbs.OnStageComplete != nil {
 		cbs.OnStageComplete(int(stage))
 	}
-	log.Printf("Connection stage complete: %s", GetStageName(int(stage)))
+	logging.Debugf("Connection stage complete: %s", GetStageName(int(stage)))
 }
 
 func (a *callbackAdapter) StageFailed(stage common.Stage, err error) {
@@ -220,7 +256,7 @@ func (a *callbackAdapter) StageFailed(stage common.Stage, err error) {
 	if cbs != nil && cbs.OnStageFailed != nil {
 		cbs.OnStageFailed(int(stage), errorCode)
 	}
-	log.Printf("Connection stage failed: %s (error: %v)", GetStageName(int(stage)), err)
+	logging.Errorf("Connection stage failed: %s (error: %v)", GetStageName(int(stage)), err)
 }
 
 func (a *callbackAdapter) ConnectionStarted() {
@@ -231,27 +267,34 @@ func (a *callbackAdapter) ConnectionStarted() {
 	if cbs != nil && cbs.OnConnectionStarted != nil {
 		cbs.OnConnectionStarted()
 	}
-	log.Println("Connection started")
+	logging.Infof("Connection started")
 }
 
-func (a *callbackAdapter) ConnectionTerminated(errorCode int) {
+func (a *callbackAdapter) ConnectionTerminated(errorCode int, reason common.TerminateReason) {
 	callbackMutex.RLock()
 	cbs := globalCallbacks
 	callbackMutex.RUnlock()
 
 	if cbs != nil && cbs.OnConnectionTerminated != nil {
-		cbs.OnConnectionTerminated(errorCode)
+		cbs.OnConnectionTerminated(errorCode, int(reason))
 	}
-	log.Printf("Connection terminated (error %d)", errorCode)
+	logging.Infof("Connection terminated (error %d, %s)", errorCode, reason)
 }
 
 func (a *callbackAdapter) ConnectionStatusUpdate(status common.ConnectionStatus) {
-	// Log status updates
-	log.Printf("Connection status: %v", status)
+	callbackMutex.RLock()
+	cbs := globalCallbacks
+	callbackMutex.RUnlock()
+
+	lossPercent := GetFrameLossPercent()
+	if cbs != nil && cbs.OnConnectionStatusUpdate != nil {
+		cbs.OnConnectionStatusUpdate(status == common.ConnStatusPoor, lossPercent)
+	}
+	logging.Infof("Connection status: %v (%d%% frame loss)", status, lossPercent)
 }
 
 func (a *callbackAdapter) SetHDRMode(enabled bool) {
-	log.Printf("HDR mode: %v", enabled)
+	logging.Infof("HDR mode: %v", enabled)
 }
 
 func (a *callbackAdapter) Rumble(controllerNumber, lowFreq, highFreq uint16) {
@@ -269,11 +312,33 @@ func (a *callbackAdapter) RumbleTriggers(controllerNumber, leftTrigger, rightTri
 }
 
 func (a *callbackAdapter) SetMotionEventState(controllerNumber uint16, motionType common.MotionType, reportRateHz uint16) {
-	// Motion events not exposed in old API
+	callbackMutex.RLock()
+	cbs := globalCallbacks
+	callbackMutex.RUnlock()
+
+	if cbs != nil && cbs.OnMotionEventState != nil {
+		cbs.OnMotionEventState(controllerNumber, uint8(motionType), reportRateHz)
+	}
 }
 
 func (a *callbackAdapter) SetControllerLED(controllerNumber uint16, r, g, b uint8) {
-	// LED control not exposed in old API
+	callbackMutex.RLock()
+	cbs := globalCallbacks
+	callbackMutex.RUnlock()
+
+	if cbs != nil && cbs.OnControllerLED != nil {
+		cbs.OnControllerLED(controllerNumber, r, g, b)
+	}
+}
+
+func (a *callbackAdapter) SetAdaptiveTriggers(controllerNumber uint16, eventFlags, typeLeft, typeRight uint8, left, right []byte) {
+	callbackMutex.RLock()
+	cbs := globalCallbacks
+	callbackMutex.RUnlock()
+
+	if cbs != nil && cbs.OnAdaptiveTriggers != nil {
+		cbs.OnAdaptiveTriggers(controllerNumber, eventFlags, typeLeft, typeRight, left, right)
+	}
 }
 
 // decoderAdapter implements the common.DecoderCallbacks interface
@@ -449,6 +514,13 @@ func StartConnection(serverInfo *ServerInfo, streamConfig *StreamConfig) error {
 		StreamingRemotely:     streamConfig.StreamingRemotely,
 		AudioConfiguration:    common.AudioConfiguration(streamConfig.AudioConfiguration),
 		SupportedVideoFormats: common.VideoFormat(streamConfig.SupportedVideoFormats),
+		HDREnabled:            streamConfig.HDREnabled,
+		AudioQuality:          streamConfig.AudioQuality,
+		MinFECPackets:         streamConfig.MinFECPackets,
+		FirstFrameTimeout:     streamConfig.FirstFrameTimeout,
+		NoVideoTrafficTimeout: streamConfig.NoVideoTrafficTimeout,
+		AudioInitialDropMs:    streamConfig.AudioInitialDropMs,
+		AudioJitterBufferMs:   streamConfig.AudioJitterBufferMs,
 	}
 
 	// Set encryption keys
@@ -466,9 +538,9 @@ func StartConnection(serverInfo *ServerInfo, streamConfig *StreamConfig) error {
 
 	// Build server info
 	srvInfo := common.ServerInformation{
-		Address:                  serverInfo.Address,
-		ServerCodecModeSupport:   uint32(serverInfo.ServerCodecModeSupport),
-		ServerInfoAppVersion:     serverInfo.AppVersion,
+		Address:                serverInfo.Address,
+		ServerCodecModeSupport: uint32(serverInfo.ServerCodecModeSupport),
+		ServerInfoAppVersion:   serverInfo.AppVersion,
 	}
 
 	// Create client with adapters
@@ -591,6 +663,31 @@ func SendScrollEvent(scrollClicks int8) error {
 	return client.SendScroll(int16(scrollClicks) * 120) // Convert to wheel delta
 }
 
+// SendHighResScrollEvent sends a vertical scroll in wheel units, 120 per notch
+func SendHighResScrollEvent(amount int16) error {
+	clientMutex.Lock()
+	client := activeClient
+	clientMutex.Unlock()
+
+	if client == nil {
+		return fmt.Errorf("not connected")
+	}
+	return client.SendHighResScroll(amount)
+}
+
+// SendHScrollEvent sends a horizontal scroll in wheel units, 120 per notch.
+// Hosts other than Sunshine return input.ErrUnsupported.
+func SendHScrollEvent(amount int16) error {
+	clientMutex.Lock()
+	client := activeClient
+	clientMutex.Unlock()
+
+	if client == nil {
+		return fmt.Errorf("not connected")
+	}
+	return client.SendHScroll(amount)
+}
+
 // SendKeyboardEvent sends a keyboard key event
 func SendKeyboardEvent(keyCode int16, keyAction int8, modifiers int8) error {
 	clientMutex.Lock()
@@ -627,6 +724,87 @@ func SendMultiControllerEvent(controllerNumber int16, activeGamepadMask int16, b
 	return client.SendMultiController(controllerNumber, activeGamepadMask, buttonFlags, leftTrigger, rightTrigger, leftStickX, leftStickY, rightStickX, rightStickY)
 }
 
+// SendUTF8TextEvent types text on the host, e.g. pasted from a client's clipboard
+func SendUTF8TextEvent(text string) error {
+	clientMutex.Lock()
+	client := activeClient
+	clientMutex.Unlock()
+
+	if client == nil {
+		return fmt.Errorf("not connected")
+	}
+	return client.SendUTF8Text(text)
+}
+
+// SendControllerMotionEvent sends a motion sensor sample for a controller
+func SendControllerMotionEvent(controllerNumber, motionType uint8, x, y, z float32) error {
+	clientMutex.Lock()
+	client := activeClient
+	clientMutex.Unlock()
+
+	if client == nil {
+		return fmt.Errorf("not connected")
+	}
+	return client.SendControllerMotion(controllerNumber, motionType, x, y, z)
+}
+
+// SendPenEvent sends a pen event, at a position and pressure from 0 to 1
+func SendPenEvent(eventType, toolType, penButtons uint8, x, y, pressure, contactMajor, contactMinor float32, rotation uint16, tilt uint8) error {
+	clientMutex.Lock()
+	client := activeClient
+	clientMutex.Unlock()
+
+	if client == nil {
+		return fmt.Errorf("not connected")
+	}
+	return client.SendPen(eventType, toolType, penButtons, x, y, pressure, contactMajor, contactMinor, rotation, tilt)
+}
+
+// SupportsPen reports whether the active connection's host takes pen input
+func SupportsPen() bool {
+	clientMutex.Lock()
+	client := activeClient
+	clientMutex.Unlock()
+
+	return client != nil && client.SupportsPen()
+}
+
+// SendControllerArrivalEvent announces a newly connected controller
+func SendControllerArrivalEvent(controllerNumber uint8, activeGamepadMask uint16, controllerType uint8, supportedButtons uint32, capabilities uint16) error {
+	clientMutex.Lock()
+	client := activeClient
+	clientMutex.Unlock()
+
+	if client == nil {
+		return fmt.Errorf("not connected")
+	}
+	return client.SendControllerArrival(controllerNumber, activeGamepadMask, controllerType, supportedButtons, capabilities)
+}
+
+// SendControllerDepartureEvent announces that a controller was disconnected
+func SendControllerDepartureEvent(controllerNumber uint8, activeGamepadMask uint16) error {
+	clientMutex.Lock()
+	client := activeClient
+	clientMutex.Unlock()
+
+	if client == nil {
+		return fmt.Errorf("not connected")
+	}
+	return client.SendControllerDeparture(controllerNumber, activeGamepadMask)
+}
+
+// SendControllerBatteryEvent reports a controller's battery state and charge
+func SendControllerBatteryEvent(controllerNumber, batteryState, percentage uint8) error {
+	clientMutex.Lock()
+	client := activeClient
+	clientMutex.Unlock()
+
+	if client == nil {
+		return fmt.Errorf("not connected")
+	}
+	return client.SendControllerBattery(controllerNumber, batteryState, percentage)
+}
+
 // RequestIDRFrame requests an IDR (keyframe) from the server
 func RequestIDRFrame() {
 	clientMutex.Lock()
@@ -637,3 +815,102 @@ func RequestIDRFrame() {
 		client.RequestIDRFrame()
 	}
 }
+
+// VideoStats is a snapshot of the active connection's video counters
+type VideoStats struct {
+	PacketsReceived  uint32
+	PacketsDropped   uint32
+	PacketsRecovered uint32
+	FramesSubmitted  uint32
+	FramesDropped    uint32
+	IDRRequests      uint32
+	// Reference frame invalidations sent in place of IDR requests
+	RefInvalidations uint32
+}
+
+// GetVideoStats returns the video counters of the active connection
+func GetVideoStats() VideoStats {
+	clientMutex.Lock()
+	client := activeClient
+	clientMutex.Unlock()
+
+	if client == nil {
+		return VideoStats{}
+	}
+	stats := client.GetVideoStats()
+	return VideoStats{
+		PacketsReceived:  stats.ReceivedPackets,
+		PacketsDropped:   stats.DroppedPackets,
+		PacketsRecovered: stats.RecoveredPackets,
+		FramesSubmitted:  stats.SubmittedFrames,
+		FramesDropped:    stats.DroppedFrames,
+		IDRRequests:      stats.RequestedIDRFrames,
+		RefInvalidations: stats.RefInvalidationRequests,
+	}
+}
+
+// GetAudioStats returns the audio counters of the active connection
+func GetAudioStats() common.RTPAudioStats {
+	clientMutex.Lock()
+	client := activeClient
+	clientMutex.Unlock()
+
+	if client == nil {
+		return common.RTPAudioStats{}
+	}
+	return client.GetAudioStats()
+}
+
+// GetAudioConfig returns the active connection's negotiated Opus layout and
+// whether its audio is encrypted, or false when there is no connection or
+// nothing is negotiated yet
+func GetAudioConfig() (common.OpusConfig, bool, bool) {
+	clientMutex.Lock()
+	client := activeClient
+	clientMutex.Unlock()
+
+	if client == nil {
+		return common.OpusConfig{}, false, false
+	}
+	config, ok := client.GetAudioConfig()
+	return config, client.IsAudioEncrypted(), ok
+}
+
+// GetRTTInfo returns the active connection's round-trip time to the host,
+// or false when there is no connection or no estimate yet
+func GetRTTInfo() (common.RTTInfo, bool) {
+	clientMutex.Lock()
+	client := activeClient
+	clientMutex.Unlock()
+
+	if client == nil {
+		return common.RTTInfo{}, false
+	}
+	return client.GetRTTInfo()
+}
+
+// GetFrameLossPercent returns the share of video frames the active
+// connection lost over the last few seconds, 0 when there is no connection
+func GetFrameLossPercent() int {
+	clientMutex.Lock()
+	client := activeClient
+	clientMutex.Unlock()
+
+	if client == nil {
+		return 0
+	}
+	return client.GetFrameLossPercent()
+}
+
+// GetConnectionInfo returns the negotiated settings of the active connection,
+// or false when there is none
+func GetConnectionInfo() (common.ConnectionInfo, bool) {
+	clientMutex.Lock()
+	client := activeClient
+	clientMutex.Unlock()
+
+	if client == nil {
+		return common.ConnectionInfo{}, false
+	}
+	return client.GetConnectionInfo(), true
+}
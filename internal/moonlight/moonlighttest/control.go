@@ -0,0 +1,108 @@
+package moonlighttest
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// The control stream runs over ENet. The fake host answers just enough of
+// it for a client to connect and have its reliable messages acknowledged;
+// the messages themselves are discarded. Connects must carry the connect
+// data the control SETUP gave out.
+const (
+	enetAcknowledge   = 1
+	enetConnect       = 2
+	enetVerifyConnect = 3
+	enetCommandMask   = 0x0F
+	enetFlagAck       = 1 << 7
+
+	enetHeaderSentTime = 1 << 15
+)
+
+// enetCommandSizes is each ENet command's size including its header; data
+// follows the send commands
+var enetCommandSizes = [...]int{0, 8, 48, 44, 8, 4, 6, 8, 24, 8, 12, 16, 24}
+
+// enetDataLengthOffset is where each send command keeps its data length
+var enetDataLengthOffset = map[byte]int{6: 4, 7: 6, 8: 6, 9: 6, 12: 6}
+
+// controlLoop answers the client's ENet traffic on the control socket
+func (s *Server) controlLoop() {
+	defer s.wg.Done()
+
+	start := time.Now()
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := s.controlConn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		data := buf[:n]
+		if len(data) < 2 {
+			continue
+		}
+		header := binary.BigEndian.Uint16(data[0:2])
+		data = data[2:]
+		var sentTime uint16
+		if header&enetHeaderSentTime != 0 {
+			if len(data) < 2 {
+				continue
+			}
+			sentTime = binary.BigEndian.Uint16(data[0:2])
+			data = data[2:]
+		}
+
+		var reply []byte
+		for len(data) >= 4 {
+			command := data[0] & enetCommandMask
+			if command == 0 || int(command) >= len(enetCommandSizes) || len(data) < enetCommandSizes[command] {
+				break
+			}
+			size := enetCommandSizes[command]
+			if off, ok := enetDataLengthOffset[command]; ok {
+				size += int(binary.BigEndian.Uint16(data[off : off+2]))
+			}
+			if len(data) < size {
+				break
+			}
+
+			switch {
+			case command == enetConnect && binary.BigEndian.Uint32(data[44:48]) != s.connectData:
+				// Not the session's connect data; Sunshine drops these
+			case command == enetConnect:
+				// Accept as peer 0, sessions 0, echoing the client's settings
+				verify := make([]byte, enetCommandSizes[enetVerifyConnect])
+				verify[0] = enetVerifyConnect | enetFlagAck
+				verify[1] = 0xFF
+				binary.BigEndian.PutUint16(verify[2:4], 1)
+				copy(verify[8:44], data[8:44])
+				reply = append(reply, verify...)
+			case data[0]&enetFlagAck != 0:
+				ack := make([]byte, enetCommandSizes[enetAcknowledge])
+				ack[0] = enetAcknowledge
+				ack[1] = data[1]
+				copy(ack[2:4], data[2:4])
+				copy(ack[4:6], data[2:4])
+				binary.BigEndian.PutUint16(ack[6:8], sentTime)
+				reply = append(reply, ack...)
+			}
+			data = data[size:]
+		}
+
+		if len(reply) == 0 {
+			continue
+		}
+		// Replies go to peer 0 in session 0, which the client was told to use
+		datagram := binary.BigEndian.AppendUint16(nil, enetHeaderSentTime)
+		datagram = binary.BigEndian.AppendUint16(datagram, uint16(time.Since(start).Milliseconds()))
+		datagram = append(datagram, reply...)
+		s.mu.Lock()
+		delay := s.controlDelay
+		s.mu.Unlock()
+		if delay > 0 {
+			time.AfterFunc(delay, func() { s.controlConn.WriteToUDP(datagram, addr) })
+			continue
+		}
+		s.controlConn.WriteToUDP(datagram, addr)
+	}
+}
@@ -0,0 +1,409 @@
+package moonlighttest
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// pairingState is a client's progress through the four pairing phases
+type pairingState struct {
+	aesKey          []byte
+	clientCert      *x509.Certificate
+	serverChallenge []byte
+	serverSecret    []byte
+	clientHash      []byte // Phase 3 hash, checked once the client reveals its secret
+}
+
+// httpHandler serves Sunshine's plain HTTP API
+func (s *Server) httpHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/serverinfo", s.handleServerInfo)
+	mux.HandleFunc("/pair", s.handlePair)
+	mux.HandleFunc("/unpair", s.handleUnpair)
+	mux.HandleFunc("/applist", s.handleAppList)
+	return mux
+}
+
+// httpsHandler serves the API that requires a paired client certificate
+func (s *Server) httpsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/serverinfo", s.handleServerInfo)
+	mux.HandleFunc("/applist", s.handleAppList)
+	mux.HandleFunc("/launch", s.handleLaunch)
+	mux.HandleFunc("/resume", s.handleResume)
+	mux.HandleFunc("/cancel", s.handleCancel)
+	return mux
+}
+
+// writeXML writes a Sunshine-style <root> response around body
+func writeXML(w http.ResponseWriter, status int, msg, body string) {
+	var escaped strings.Builder
+	xml.EscapeText(&escaped, []byte(msg))
+
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>`+
+		`<root status_code="%d" status_message="%s">%s</root>`, status, escaped.String(), body)
+}
+
+// handleServerInfo reports the host and whether the asking client is paired
+func (s *Server) handleServerInfo(w http.ResponseWriter, r *http.Request) {
+	pairStatus := 0
+	if s.IsPaired(r.URL.Query().Get("uniqueid")) {
+		pairStatus = 1
+	}
+
+	writeXML(w, 200, "OK", fmt.Sprintf(
+		"<hostname>moonlighttest</hostname>"+
+			"<appversion>%s</appversion>"+
+			"<GfeVersion>3.23.0.74</GfeVersion>"+
+			"<HttpsPort>%d</HttpsPort>"+
+			"<ExternalPort>%d</ExternalPort>"+
+			"<ServerCodecModeSupport>1</ServerCodecModeSupport>"+
+			"<PairStatus>%d</PairStatus>"+
+			"<currentgame>0</currentgame>"+
+			"<state>SUNSHINE_SERVER_FREE</state>",
+		AppVersion, s.Port+portHTTPSOffset, s.Port, pairStatus))
+}
+
+// handleAppList serves Apps
+func (s *Server) handleAppList(w http.ResponseWriter, r *http.Request) {
+	var body strings.Builder
+	for _, app := range s.Apps {
+		var title strings.Builder
+		xml.EscapeText(&title, []byte(app.Title))
+		fmt.Fprintf(&body, "<App><IsHdrSupported>0</IsHdrSupported><AppTitle>%s</AppTitle><ID>%d</ID></App>",
+			title.String(), app.ID)
+	}
+	writeXML(w, 200, "OK", body.String())
+}
+
+// handleUnpair forgets a client
+func (s *Server) handleUnpair(w http.ResponseWriter, r *http.Request) {
+	uniqueID := r.URL.Query().Get("uniqueid")
+
+	s.mu.Lock()
+	delete(s.paired, uniqueID)
+	delete(s.pairing, uniqueID)
+	s.mu.Unlock()
+
+	writeXML(w, 200, "OK", "")
+}
+
+// handlePair runs whichever pairing phase the query carries
+func (s *Server) handlePair(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	uniqueID := q.Get("uniqueid")
+
+	var body string
+	var err error
+	switch {
+	case q.Get("phrase") == "getservercert":
+		body, err = s.pairGetServerCert(r, uniqueID, q.Get("salt"), q.Get("clientcert"))
+	case q.Has("clientchallenge"):
+		body, err = s.pairClientChallenge(uniqueID, q.Get("clientchallenge"))
+	case q.Has("serverchallengeresp"):
+		body, err = s.pairServerChallengeResp(uniqueID, q.Get("serverchallengeresp"))
+	case q.Has("clientpairingsecret"):
+		body, err = s.pairClientSecret(uniqueID, q.Get("clientpairingsecret"))
+	default:
+		err = errors.New("unknown pairing phase")
+	}
+
+	if err != nil {
+		s.mu.Lock()
+		delete(s.pairing, uniqueID)
+		s.mu.Unlock()
+		writeXML(w, 400, err.Error(), "<paired>0</paired>")
+		return
+	}
+	writeXML(w, 200, "OK", "<paired>1</paired>"+body)
+}
+
+// pairGetServerCert is phase 1: it waits for the PIN, as Sunshine holds the
+// request open until the user enters it, and returns the host certificate
+func (s *Server) pairGetServerCert(r *http.Request, uniqueID, saltHex, certHex string) (string, error) {
+	salt, err := hex.DecodeString(saltHex)
+	if err != nil || len(salt) != 16 {
+		return "", errors.New("bad salt")
+	}
+	certPEM, err := hex.DecodeString(certHex)
+	if err != nil {
+		return "", errors.New("bad client certificate")
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return "", errors.New("bad client certificate")
+	}
+	clientCert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("bad client certificate: %w", err)
+	}
+
+	var pin string
+	select {
+	case pin = <-s.pins:
+	case <-r.Context().Done():
+		return "", r.Context().Err()
+	case <-s.closed:
+		return "", errors.New("server closed")
+	}
+
+	key := sha256.Sum256(append(salt, pin...))
+
+	s.mu.Lock()
+	s.pairing[uniqueID] = &pairingState{
+		aesKey:     key[:16],
+		clientCert: clientCert,
+	}
+	s.mu.Unlock()
+
+	return fmt.Sprintf("<plaincert>%X</plaincert>", s.certPEM), nil
+}
+
+// pairClientChallenge is phase 2: it answers the client's challenge and
+// poses the server's own
+func (s *Server) pairClientChallenge(uniqueID, challengeHex string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, err := s.pairingLocked(uniqueID)
+	if err != nil {
+		return "", err
+	}
+
+	challenge, err := decodeECB(st.aesKey, challengeHex, 16)
+	if err != nil {
+		return "", err
+	}
+
+	st.serverChallenge = make([]byte, 16)
+	st.serverSecret = make([]byte, 16)
+	rand.Read(st.serverChallenge)
+	rand.Read(st.serverSecret)
+
+	// SHA256(client challenge + server cert signature + server secret) + server challenge
+	h := sha256.New()
+	h.Write(challenge)
+	h.Write(s.cert.Signature)
+	h.Write(st.serverSecret)
+	resp, err := ecb(st.aesKey, append(h.Sum(nil), st.serverChallenge...), true)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("<challengeresponse>%X</challengeresponse>", resp), nil
+}
+
+// pairServerChallengeResp is phase 3: it stores the client's answer and
+// reveals the server secret, signed
+func (s *Server) pairServerChallengeResp(uniqueID, respHex string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, err := s.pairingLocked(uniqueID)
+	if err != nil {
+		return "", err
+	}
+	if st.serverSecret == nil {
+		return "", errors.New("no server challenge")
+	}
+
+	st.clientHash, err = decodeECB(st.aesKey, respHex, 32)
+	if err != nil {
+		return "", err
+	}
+
+	digest := sha256.Sum256(st.serverSecret)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("<pairingsecret>%X</pairingsecret>", append(st.serverSecret, sig...)), nil
+}
+
+// pairClientSecret is phase 4: the client's secret and signature prove it
+// knew the PIN and holds the certificate it sent, completing the pairing
+func (s *Server) pairClientSecret(uniqueID, secretHex string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, err := s.pairingLocked(uniqueID)
+	if err != nil {
+		return "", err
+	}
+	if st.clientHash == nil {
+		return "", errors.New("no challenge response")
+	}
+
+	raw, err := hex.DecodeString(secretHex)
+	if err != nil || len(raw) <= 16 {
+		return "", errors.New("bad pairing secret")
+	}
+	secret, sig := raw[:16], raw[16:]
+
+	// A wrong PIN garbles the phase 3 hash, so it won't match
+	h := sha256.New()
+	h.Write(st.serverChallenge)
+	h.Write(st.clientCert.Signature)
+	h.Write(secret)
+	if subtle.ConstantTimeCompare(h.Sum(nil), st.clientHash) != 1 {
+		return "", errors.New("challenge mismatch (wrong PIN?)")
+	}
+
+	pub, ok := st.clientCert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return "", errors.New("client key is not RSA")
+	}
+	digest := sha256.Sum256(secret)
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+		return "", fmt.Errorf("client signature: %w", err)
+	}
+
+	s.paired[uniqueID] = st.clientCert
+	delete(s.pairing, uniqueID)
+	return "", nil
+}
+
+// pairingLocked returns the pairing in progress for a client. Called with
+// the server lock held.
+func (s *Server) pairingLocked(uniqueID string) (*pairingState, error) {
+	st, ok := s.pairing[uniqueID]
+	if !ok {
+		return nil, errors.New("no pairing in progress")
+	}
+	return st, nil
+}
+
+// handleLaunch records the launch parameters of a paired client and points
+// it at the RTSP port. Like Sunshine, it refuses while an app is running.
+func (s *Server) handleLaunch(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	uniqueID := q.Get("uniqueid")
+	if !s.authorized(r, uniqueID) {
+		writeXML(w, 401, "The client is not authorized. Certificate verification failed.", "")
+		return
+	}
+	if s.Running() {
+		writeXML(w, 400, "An app is already running on this host", "")
+		return
+	}
+
+	launch := parseLaunch(q)
+	launch.AppID, _ = strconv.Atoi(q.Get("appid"))
+
+	s.mu.Lock()
+	s.launch = launch
+	s.cancelled = false
+	s.mu.Unlock()
+
+	writeXML(w, 200, "OK", fmt.Sprintf("<sessionUrl0>rtsp://%s:%d</sessionUrl0><gamesession>1</gamesession>",
+		s.Host, s.Port+portRTSPOffset))
+}
+
+// handleResume streams the running app again, with the new launch
+// parameters, for a paired client
+func (s *Server) handleResume(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if !s.authorized(r, q.Get("uniqueid")) {
+		writeXML(w, 401, "The client is not authorized. Certificate verification failed.", "")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.launch == nil || s.cancelled {
+		writeXML(w, 503, "No running app to resume", "")
+		return
+	}
+	launch := parseLaunch(q)
+	launch.AppID = s.launch.AppID
+	launch.Resumed = true
+	s.launch = launch
+
+	writeXML(w, 200, "OK", fmt.Sprintf("<sessionUrl0>rtsp://%s:%d</sessionUrl0><resume>1</resume>",
+		s.Host, s.Port+portRTSPOffset))
+}
+
+// parseLaunch reads the parameters /launch and /resume share
+func parseLaunch(q url.Values) *Launch {
+	launch := &Launch{UniqueID: q.Get("uniqueid")}
+	fmt.Sscanf(q.Get("mode"), "%dx%dx%d", &launch.Width, &launch.Height, &launch.FPS)
+	launch.RiKey, _ = hex.DecodeString(q.Get("rikey"))
+	riKeyID, _ := strconv.ParseUint(q.Get("rikeyid"), 10, 32)
+	launch.RiKeyID = uint32(riKeyID)
+	return launch
+}
+
+// handleCancel ends the launched app for a paired client
+func (s *Server) handleCancel(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r, r.URL.Query().Get("uniqueid")) {
+		writeXML(w, 401, "The client is not authorized. Certificate verification failed.", "")
+		return
+	}
+
+	s.mu.Lock()
+	s.cancelled = true
+	s.mu.Unlock()
+
+	writeXML(w, 200, "OK", "<cancel>1</cancel>")
+}
+
+// authorized reports whether r comes with the certificate uniqueID paired with
+func (s *Server) authorized(r *http.Request, uniqueID string) bool {
+	s.mu.Lock()
+	cert, ok := s.paired[uniqueID]
+	s.mu.Unlock()
+	return ok && r.TLS != nil && len(r.TLS.PeerCertificates) > 0 && cert.Equal(r.TLS.PeerCertificates[0])
+}
+
+// decodeECB hex-decodes and decrypts a pairing value, keeping its first n bytes
+func decodeECB(key []byte, valueHex string, n int) ([]byte, error) {
+	data, err := hex.DecodeString(valueHex)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := ecb(key, data, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(plain) < n {
+		return nil, fmt.Errorf("pairing value too short: %d bytes", len(plain))
+	}
+	return plain[:n], nil
+}
+
+// ecb runs AES-128-ECB without padding, as the pairing protocol uses
+func ecb(key, data []byte, encrypt bool) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("data length %d is not a multiple of the block size", len(data))
+	}
+
+	out := make([]byte, len(data))
+	for i := 0; i < len(data); i += aes.BlockSize {
+		if encrypt {
+			block.Encrypt(out[i:], data[i:])
+		} else {
+			block.Decrypt(out[i:], data[i:])
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,216 @@
+package moonlighttest
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/zalo/moonparty/moonlight-common-go/fec"
+)
+
+// Frame types carried in Sunshine's video frame header
+const (
+	FrameTypeP              = 1
+	FrameTypeIDR            = 2
+	FrameTypeRefInvalidated = 5
+)
+
+// Video packetization, matching what the client asks for in its ANNOUNCE
+const (
+	videoPacketSize = 1024
+	rtpHeaderSize   = 12
+	nvHeaderSize    = 16
+	frameHeaderSize = 8
+
+	// NV_VIDEO_PACKET flags
+	flagContainsPicData = 0x1
+	flagEOF             = 0x2
+	flagSOF             = 0x4
+)
+
+// RTP payload types Sunshine uses
+const (
+	videoPayloadType = 0
+	audioPayloadType = 97
+)
+
+// ErrNoClient is returned when media is sent before the client has pinged
+// the media port, so there's nowhere to send it
+var ErrNoClient = errors.New("client has not pinged the media port yet")
+
+// mediaState is where and how media goes out
+type mediaState struct {
+	videoClient *net.UDPAddr
+	audioClient *net.UDPAddr
+	videoPing   chan struct{} // Closed on the first video ping
+
+	videoSeq       uint16
+	audioSeq       uint16
+	audioTimestamp uint32 // Milliseconds, as Sunshine counts audio time
+}
+
+// videoPingLoop learns the client's video address from its pings
+func (s *Server) videoPingLoop() {
+	defer s.wg.Done()
+
+	buf := make([]byte, 64)
+	for {
+		_, addr, err := s.videoConn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.media.videoClient == nil {
+			close(s.media.videoPing)
+		}
+		s.media.videoClient = addr
+		s.mu.Unlock()
+	}
+}
+
+// drainLoop reads and discards what the client sends to a socket. Audio
+// pings are remembered so audio can be sent back.
+func (s *Server) drainLoop(conn *net.UDPConn) {
+	defer s.wg.Done()
+
+	buf := make([]byte, 2048)
+	for {
+		_, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if conn == s.audioConn {
+			s.mu.Lock()
+			s.media.audioClient = addr
+			s.mu.Unlock()
+		}
+	}
+}
+
+// WaitForVideoPing blocks until the client pings the video port, after which
+// SendVideoFrame can reach it
+func (s *Server) WaitForVideoPing(ctx context.Context) error {
+	select {
+	case <-s.media.videoPing:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.closed:
+		return errors.New("server closed")
+	}
+}
+
+// SendVideoFrame packetizes one frame the way Sunshine does, unencrypted and
+// without FEC shards, and sends it to the client. frameType is one of the
+// FrameType constants; data is the encoded bitstream.
+func (s *Server) SendVideoFrame(frameIndex uint32, frameType byte, data []byte) error {
+	return s.sendVideoFrame(frameIndex, frameType, data, 0, nil)
+}
+
+// SendVideoFrameFEC is SendVideoFrame with Reed-Solomon parity shards added
+// at fecPercentage, as Sunshine sends them. Shards whose index is in drop
+// are left out, as if lost on the way.
+func (s *Server) SendVideoFrameFEC(frameIndex uint32, frameType byte, data []byte, fecPercentage int, drop ...int) error {
+	return s.sendVideoFrame(frameIndex, frameType, data, fecPercentage, drop)
+}
+
+func (s *Server) sendVideoFrame(frameIndex uint32, frameType byte, data []byte, fecPercentage int, drop []int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.media.videoClient == nil {
+		return ErrNoClient
+	}
+
+	// The first packet carries the short frame header ahead of the bitstream
+	header := make([]byte, frameHeaderSize)
+	header[0] = 0x01
+	header[3] = frameType
+	payload := append(header, data...)
+
+	chunk := videoPacketSize - nvHeaderSize
+	packets := (len(payload) + chunk - 1) / chunk
+	timestamp := frameIndex * 90000 / 60
+
+	shards := make([][]byte, packets)
+	for i := range shards {
+		shards[i] = payload[i*chunk : min((i+1)*chunk, len(payload))]
+	}
+	if fecPercentage > 0 {
+		parity := (packets*fecPercentage + 99) / 100
+		rs, err := fec.New(packets, parity)
+		if err != nil {
+			return err
+		}
+		// Every shard is coded at full size, so the last one is padded
+		last := make([]byte, chunk)
+		copy(last, shards[packets-1])
+		shards[packets-1] = last
+		for i := 0; i < parity; i++ {
+			shards = append(shards, make([]byte, chunk))
+		}
+		if err := rs.Encode(shards); err != nil {
+			return err
+		}
+	}
+
+	for i, piece := range shards {
+		if slices.Contains(drop, i) {
+			s.media.videoSeq++
+			continue
+		}
+
+		pkt := make([]byte, rtpHeaderSize+nvHeaderSize+len(piece))
+		pkt[0] = 0x80
+		pkt[1] = videoPayloadType
+		binary.BigEndian.PutUint16(pkt[2:4], s.media.videoSeq)
+		binary.BigEndian.PutUint32(pkt[4:8], timestamp)
+
+		nv := pkt[rtpHeaderSize:]
+		binary.LittleEndian.PutUint32(nv[0:4], uint32(s.media.videoSeq)<<8)
+		binary.LittleEndian.PutUint32(nv[4:8], frameIndex)
+		flags := byte(flagContainsPicData)
+		if i == 0 {
+			flags |= flagSOF
+		}
+		if i == packets-1 {
+			flags |= flagEOF
+		}
+		nv[8] = flags
+		// Shard i of a single FEC block
+		binary.LittleEndian.PutUint32(nv[12:16], uint32(i)<<12|uint32(packets)<<22|uint32(fecPercentage)<<4)
+		copy(nv[nvHeaderSize:], piece)
+
+		s.media.videoSeq++
+		if _, err := s.videoConn.WriteToUDP(pkt, s.media.videoClient); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SendAudioPacket sends one RTP audio packet carrying an Opus frame
+func (s *Server) SendAudioPacket(opus []byte, duration time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.media.audioClient == nil {
+		return ErrNoClient
+	}
+
+	pkt := make([]byte, rtpHeaderSize+len(opus))
+	pkt[0] = 0x80
+	pkt[1] = audioPayloadType
+	binary.BigEndian.PutUint16(pkt[2:4], s.media.audioSeq)
+	binary.BigEndian.PutUint32(pkt[4:8], s.media.audioTimestamp)
+	copy(pkt[rtpHeaderSize:], opus)
+
+	s.media.audioSeq++
+	s.media.audioTimestamp += uint32(duration.Milliseconds())
+	_, err := s.audioConn.WriteToUDP(pkt, s.media.audioClient)
+	return err
+}
@@ -0,0 +1,147 @@
+package moonlighttest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// rtspSessionID is handed out in every SETUP response
+const rtspSessionID = "DEADBEEFCAFE"
+
+// rtspRequest is a parsed RTSP request
+type rtspRequest struct {
+	method  string
+	target  string
+	headers textproto.MIMEHeader
+	body    string
+}
+
+// rtspLoop accepts RTSP connections. Sunshine closes the connection after
+// each response; this keeps it open so clients that reuse one work too.
+func (s *Server) rtspLoop() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.rtsp.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go s.serveRTSP(conn)
+	}
+}
+
+// serveRTSP answers requests on one connection until the client hangs up
+func (s *Server) serveRTSP(conn net.Conn) {
+	defer s.wg.Done()
+	defer conn.Close()
+
+	go func() {
+		<-s.closed
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	for {
+		req, err := readRTSPRequest(r)
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(s.handleRTSP(req)); err != nil {
+			return
+		}
+	}
+}
+
+// readRTSPRequest reads a request line, headers and any body
+func readRTSPRequest(r *bufio.Reader) (*rtspRequest, error) {
+	tp := textproto.NewReader(r)
+
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Fields(line)
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "RTSP/") {
+		return nil, fmt.Errorf("bad RTSP request line: %q", line)
+	}
+
+	headers, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	req := &rtspRequest{method: parts[0], target: parts[1], headers: headers}
+
+	// Clients send "Content-length"; MIME header keys are canonicalized
+	if n, _ := strconv.Atoi(headers.Get("Content-Length")); n > 0 {
+		body := make([]byte, n)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, err
+		}
+		req.body = string(body)
+	}
+	return req, nil
+}
+
+// handleRTSP builds the response to one request
+func (s *Server) handleRTSP(req *rtspRequest) []byte {
+	var extra strings.Builder
+	var body string
+
+	switch req.method {
+	case "OPTIONS", "PLAY":
+	case "TEARDOWN":
+		s.mu.Lock()
+		s.tornDown = true
+		s.mu.Unlock()
+	case "DESCRIBE":
+		body = "a=x-ss-general.featureFlags:0\r\n"
+		if s.MaxPacketSize > 0 {
+			body += fmt.Sprintf("a=x-nv-video[0].packetSize:%d\r\n", s.MaxPacketSize)
+		}
+	case "SETUP":
+		var port int
+		switch {
+		case strings.Contains(req.target, "audio"):
+			port = udpPort(s.audioConn)
+		case strings.Contains(req.target, "video"):
+			port = udpPort(s.videoConn)
+		case strings.Contains(req.target, "control"):
+			port = udpPort(s.controlConn)
+			fmt.Fprintf(&extra, "X-SS-Connect-Data: %d\r\n", s.connectData)
+		default:
+			return rtspResponse(req, "404 Not Found", "", "")
+		}
+		fmt.Fprintf(&extra, "Session: %s;timeout = 90\r\n", rtspSessionID)
+		fmt.Fprintf(&extra, "Transport: server_port=%d\r\n", port)
+		fmt.Fprintf(&extra, "X-SS-Ping-Payload: %s\r\n", s.pingPayload)
+	case "ANNOUNCE":
+		s.mu.Lock()
+		s.announce = req.body
+		s.mu.Unlock()
+	default:
+		return rtspResponse(req, "501 Not Implemented", "", "")
+	}
+
+	return rtspResponse(req, "200 OK", extra.String(), body)
+}
+
+// rtspResponse formats a response echoing the request's CSeq
+func rtspResponse(req *rtspRequest, status, headers, body string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "RTSP/1.0 %s\r\n", status)
+	fmt.Fprintf(&b, "CSeq: %s\r\n", req.headers.Get("CSeq"))
+	b.WriteString(headers)
+	if body != "" {
+		fmt.Fprintf(&b, "Content-Length: %d\r\n", len(body))
+	}
+	b.WriteString("\r\n")
+	b.WriteString(body)
+	return []byte(b.String())
+}
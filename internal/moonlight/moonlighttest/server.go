@@ -0,0 +1,339 @@
+// Package moonlighttest provides a minimal fake Sunshine host, so the
+// Moonlight client and protocol packages can be exercised end-to-end without
+// a real one. It serves the HTTP API (serverinfo, pair, applist, launch),
+// answers the RTSP handshake, and sends video and audio over UDP.
+package moonlighttest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Ports relative to the base HTTP port, matching Sunshine's layout
+const (
+	portHTTPSOffset = -5 // 47984
+	portRTSPOffset  = 21 // 48010
+)
+
+// portAttempts is how many random base ports are tried before giving up
+const portAttempts = 20
+
+// AppVersion is the Sunshine version reported in serverinfo
+const AppVersion = "7.1.431.-1"
+
+// App is an entry in the fake host's app list
+type App struct {
+	ID    int
+	Title string
+}
+
+// Launch records a /launch or /resume request
+type Launch struct {
+	UniqueID string
+	AppID    int
+	Width    int
+	Height   int
+	FPS      int
+	RiKey    []byte
+	RiKeyID  uint32
+	Resumed  bool // Came in by /resume, streaming the app already running
+}
+
+// Server is a fake Sunshine host on the loopback interface
+type Server struct {
+	// Host and Port are the address to hand to moonlight.NewClient. Port is
+	// the base HTTP port; HTTPS and RTSP sit at Sunshine's usual offsets.
+	Host string
+	Port int
+
+	// Apps is served by /applist; set it before the client asks
+	Apps []App
+
+	// MaxPacketSize, if set, is the largest video packet size advertised in
+	// the RTSP DESCRIBE; set it before the client starts a stream
+	MaxPacketSize int
+
+	cert    *x509.Certificate
+	certPEM []byte
+	key     *rsa.PrivateKey
+
+	httpServer  *http.Server
+	httpsServer *http.Server
+	rtsp        net.Listener
+
+	// Media sockets whose ports are handed out in RTSP SETUP
+	videoConn   *net.UDPConn
+	audioConn   *net.UDPConn
+	controlConn *net.UDPConn
+
+	pins   chan string
+	closed chan struct{}
+	wg     sync.WaitGroup
+
+	mu          sync.Mutex
+	pairing     map[string]*pairingState
+	paired      map[string]*x509.Certificate
+	launch      *Launch
+	cancelled   bool // The launched app was ended with /cancel
+	announce    string
+	tornDown    bool
+	pingPayload string
+	connectData uint32 // Sent in the control SETUP; connects must carry it
+	media       mediaState
+
+	controlDelay time.Duration // See SetControlDelay
+}
+
+// NewServer starts a fake Sunshine host. Call Close when done with it.
+func NewServer() (*Server, error) {
+	s := &Server{
+		Host:    "127.0.0.1",
+		Apps:    []App{{ID: 1, Title: "Desktop"}},
+		pins:    make(chan string),
+		closed:  make(chan struct{}),
+		pairing: make(map[string]*pairingState),
+		paired:  make(map[string]*x509.Certificate),
+	}
+	s.media.videoPing = make(chan struct{})
+
+	if err := s.generateIdentity(); err != nil {
+		return nil, fmt.Errorf("server identity: %w", err)
+	}
+
+	payload := make([]byte, 8)
+	rand.Read(payload)
+	s.pingPayload = fmt.Sprintf("%X", payload)
+	s.connectData = binary.BigEndian.Uint32(payload[:4])
+
+	httpLn, httpsLn, rtspLn, err := s.listenTCP()
+	if err != nil {
+		return nil, err
+	}
+	s.rtsp = rtspLn
+
+	if err := s.listenUDP(); err != nil {
+		httpLn.Close()
+		httpsLn.Close()
+		rtspLn.Close()
+		return nil, err
+	}
+
+	s.httpServer = &http.Server{Handler: s.httpHandler()}
+	s.httpsServer = &http.Server{
+		Handler: s.httpsHandler(),
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{{
+				Certificate: [][]byte{s.cert.Raw},
+				PrivateKey:  s.key,
+			}},
+			// Sunshine identifies clients by the certificate they paired with
+			ClientAuth: tls.RequireAnyClientCert,
+		},
+	}
+
+	s.wg.Add(6)
+	go func() {
+		defer s.wg.Done()
+		s.httpServer.Serve(httpLn)
+	}()
+	go func() {
+		defer s.wg.Done()
+		s.httpsServer.ServeTLS(httpsLn, "", "")
+	}()
+	go s.rtspLoop()
+	go s.videoPingLoop()
+	go s.drainLoop(s.audioConn)
+	go s.controlLoop()
+
+	return s, nil
+}
+
+// Close stops every listener and waits for the server's goroutines
+func (s *Server) Close() {
+	select {
+	case <-s.closed:
+		return
+	default:
+	}
+	close(s.closed)
+
+	s.httpServer.Close()
+	s.httpsServer.Close()
+	s.rtsp.Close()
+	s.videoConn.Close()
+	s.audioConn.Close()
+	s.controlConn.Close()
+	s.wg.Wait()
+}
+
+// EnterPIN completes the PIN step of a pending pairing, as a user typing the
+// client's PIN into Sunshine's web UI would. It blocks until a pairing
+// request is waiting for it or the server closes.
+func (s *Server) EnterPIN(pin string) {
+	select {
+	case s.pins <- pin:
+	case <-s.closed:
+	}
+}
+
+// IsPaired returns whether the client with this unique ID has paired
+func (s *Server) IsPaired(uniqueID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.paired[uniqueID]
+	return ok
+}
+
+// RejectCertificate keeps reporting a paired client as paired over HTTP but
+// refuses its certificate on HTTPS, as Sunshine can after a restart. Pairing
+// again clears it.
+func (s *Server) RejectCertificate(uniqueID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.paired[uniqueID]; ok {
+		// Our own certificate never matches the one the client presents
+		s.paired[uniqueID] = s.cert
+	}
+}
+
+// LastLaunch returns the most recent /launch or /resume request, or nil
+func (s *Server) LastLaunch() *Launch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.launch
+}
+
+// Running reports whether a launched app is still running, i.e. no paired
+// client has sent /cancel since the last /launch
+func (s *Server) Running() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.launch != nil && !s.cancelled
+}
+
+// TornDown reports whether a client sent an RTSP TEARDOWN
+func (s *Server) TornDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tornDown
+}
+
+// ControlConnectData returns the X-SS-Connect-Data the control SETUP is
+// answered with. Like Sunshine, the host only accepts control connections
+// that present it.
+func (s *Server) ControlConnectData() uint32 {
+	return s.connectData
+}
+
+// SetControlDelay holds back each reply on the control stream by d,
+// standing in for the network's round trip
+func (s *Server) SetControlDelay(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.controlDelay = d
+}
+
+// Announce returns the SDP the client sent in its RTSP ANNOUNCE
+func (s *Server) Announce() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.announce
+}
+
+// generateIdentity creates the self-signed certificate Sunshine pairs with
+// and serves HTTPS under
+func (s *Server) generateIdentity() error {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Sunshine Gamestream Host"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+
+	s.key = key
+	s.cert = cert
+	s.certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return nil
+}
+
+// listenTCP finds a base port whose HTTP, HTTPS and RTSP ports are all free
+func (s *Server) listenTCP() (httpLn, httpsLn, rtspLn net.Listener, err error) {
+	for i := 0; i < portAttempts; i++ {
+		httpLn, err = net.Listen("tcp", net.JoinHostPort(s.Host, "0"))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		port := httpLn.Addr().(*net.TCPAddr).Port
+		if port+portHTTPSOffset <= 0 || port+portRTSPOffset > 65535 {
+			httpLn.Close()
+			continue
+		}
+
+		httpsLn, err = net.Listen("tcp", net.JoinHostPort(s.Host, strconv.Itoa(port+portHTTPSOffset)))
+		if err != nil {
+			httpLn.Close()
+			continue
+		}
+		rtspLn, err = net.Listen("tcp", net.JoinHostPort(s.Host, strconv.Itoa(port+portRTSPOffset)))
+		if err != nil {
+			httpLn.Close()
+			httpsLn.Close()
+			continue
+		}
+
+		s.Port = port
+		return httpLn, httpsLn, rtspLn, nil
+	}
+	return nil, nil, nil, errors.New("no free base port for the fake host")
+}
+
+// listenUDP opens the video, audio and control sockets
+func (s *Server) listenUDP() error {
+	conns := make([]*net.UDPConn, 0, 3)
+	for i := 0; i < 3; i++ {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP(s.Host)})
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return fmt.Errorf("media socket: %w", err)
+		}
+		conns = append(conns, conn)
+	}
+
+	s.videoConn, s.audioConn, s.controlConn = conns[0], conns[1], conns[2]
+	return nil
+}
+
+// udpPort returns the local port of a media socket
+func udpPort(conn *net.UDPConn) int {
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
@@ -0,0 +1,492 @@
+package moonlight
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/zalo/moonparty/internal/moonlight/limelight"
+	common "github.com/zalo/moonparty/moonlight-common-go/limelight"
+)
+
+// PureGoStream drives a moonlight-common-go client directly. Unlike
+// LimelightStream it keeps no package-level state: the client's decoder,
+// audio and connection callbacks belong to this stream and push straight into
+// its channels, which the server fans out to peers.
+type PureGoStream struct {
+	client *Client
+	ctx    context.Context
+	cancel context.CancelFunc
+	conn   *common.Client
+
+	videoFrames chan []byte
+	audioFrames chan []byte
+	feedback    chan ControllerFeedback
+	terminated  chan error
+	quality     chan ConnectionQuality
+
+	mu        sync.RWMutex
+	connected bool
+	closeOnce sync.Once
+
+	gamepads gamepadSlots
+}
+
+// StartStreamPureGo launches opts.AppID and connects to it with the
+// moonlight-common-go client, without the limelight wrapper's global state
+func (c *Client) StartStreamPureGo(ctx context.Context, opts StreamOptions) (*PureGoStream, error) {
+	if !c.paired {
+		return nil, fmt.Errorf("not paired with Sunshine")
+	}
+
+	streamCtx, cancel := context.WithCancel(ctx)
+
+	s := &PureGoStream{
+		client:      c,
+		ctx:         streamCtx,
+		cancel:      cancel,
+		videoFrames: make(chan []byte, 60),
+		audioFrames: make(chan []byte, 120),
+		feedback:    make(chan ControllerFeedback, 32),
+		terminated:  make(chan error, 1),
+		quality:     make(chan ConnectionQuality, 1),
+	}
+
+	riKey, riKeyID, err := c.launchWithRiKey(ctx, opts)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	config := common.StreamConfiguration{
+		Width:                 opts.Width,
+		Height:                opts.Height,
+		FPS:                   opts.FPS,
+		Bitrate:               opts.Bitrate,
+		PacketSize:            opts.packetSize(),
+		StreamingRemotely:     limelight.StreamingAuto,
+		AudioConfiguration:    common.AudioConfigStereo,
+		SupportedVideoFormats: opts.videoFormat(),
+		HDREnabled:            opts.HDR,
+		AudioQuality:          opts.AudioQuality,
+		MinFECPackets:         opts.MinFECPackets,
+		FirstFrameTimeout:     opts.FirstFrameTimeout,
+		NoVideoTrafficTimeout: opts.NoVideoTrafficTimeout,
+		AudioInitialDropMs:    opts.AudioInitialDropMs,
+		AudioJitterBufferMs:   opts.AudioJitterBufferMs,
+		RemoteInputAesKey:     riKey,
+		RemoteInputAesIV:      make([]byte, 16),
+	}
+	config.RemoteInputAesIV[0] = byte(riKeyID >> 24)
+	config.RemoteInputAesIV[1] = byte(riKeyID >> 16)
+	config.RemoteInputAesIV[2] = byte(riKeyID >> 8)
+	config.RemoteInputAesIV[3] = byte(riKeyID)
+
+	serverInfo := common.ServerInformation{
+		Address:                net.JoinHostPort(c.host, strconv.Itoa(c.port)),
+		ServerCodecModeSupport: uint32(c.serverCodecModes(streamCtx, opts.videoFormat())),
+		ServerInfoAppVersion:   "7.0.0.0", // Sunshine Gen 7 protocol
+	}
+
+	s.conn = common.NewClient(config, serverInfo,
+		&pureGoDecoder{s: s}, &pureGoAudio{s: s}, &pureGoListener{s: s})
+	s.conn.SetLogger(c.log)
+
+	if err := s.conn.Start(streamCtx); err != nil {
+		cancel()
+		return nil, fmt.Errorf("pure-Go connection failed: %w", err)
+	}
+
+	return s, nil
+}
+
+// VideoFrames returns the channel for receiving video frames
+func (s *PureGoStream) VideoFrames() <-chan []byte {
+	return s.videoFrames
+}
+
+// AudioSamples returns the channel for receiving audio samples
+func (s *PureGoStream) AudioSamples() <-chan []byte {
+	return s.audioFrames
+}
+
+// Feedback returns the channel for controller feedback from the host
+func (s *PureGoStream) Feedback() <-chan ControllerFeedback {
+	return s.feedback
+}
+
+// Terminated returns a channel that receives an error if Sunshine ends the
+// connection with one
+func (s *PureGoStream) Terminated() <-chan error {
+	return s.terminated
+}
+
+// ConnectionQuality returns a channel that receives each change in how
+// well the stream arrives
+func (s *PureGoStream) ConnectionQuality() <-chan ConnectionQuality {
+	return s.quality
+}
+
+// SendInput sends input to Sunshine over the client's input stream
+func (s *PureGoStream) SendInput(input InputPacket) {
+	switch input.Type {
+	case InputTypeGamepad:
+		pad, ok := ParseGamepad(input.Data)
+		if !ok {
+			return
+		}
+		s.conn.SendMultiController(int16(input.PlayerSlot), int16(s.gamepads.active(input.PlayerSlot)), pad.Buttons,
+			pad.LeftTrigger, pad.RightTrigger, pad.LeftStickX, pad.LeftStickY, pad.RightStickX, pad.RightStickY)
+	case InputTypeKeyboard:
+		if len(input.Data) < 3 {
+			return
+		}
+		keyCode := int16(input.Data[0]) | int16(input.Data[1])<<8
+		modifiers := uint8(0)
+		if len(input.Data) > 3 {
+			modifiers = input.Data[3]
+		}
+		s.conn.SendKeyboard(keyCode, input.Data[2], modifiers)
+	case InputTypeMouse:
+		if len(input.Data) < 2 {
+			return
+		}
+		s.conn.SendMouseButton(input.Data[0], int(input.Data[1]))
+	case InputTypeMouseRelative:
+		if len(input.Data) < 4 {
+			return
+		}
+		deltaX := int16(input.Data[0]) | int16(input.Data[1])<<8
+		deltaY := int16(input.Data[2]) | int16(input.Data[3])<<8
+		s.conn.SendMouseMove(deltaX, deltaY)
+	case InputTypeMouseAbsolute:
+		x, y, refWidth, refHeight, ok := ParseMousePosition(input.Data)
+		if !ok {
+			return
+		}
+		s.conn.SendMousePosition(x, y, refWidth, refHeight)
+	case InputTypeScroll:
+		sendScroll(input.Data, s.conn.SendHighResScroll, s.conn.SendHScroll)
+	case InputTypeText:
+		if err := s.conn.SendUTF8Text(string(input.Data)); err != nil {
+			s.client.log.Warnf("Text input not sent: %v", err)
+		}
+	case InputTypeMotion:
+		motionType, x, y, z, ok := ParseMotion(input.Data)
+		if !ok {
+			return
+		}
+		s.conn.SendControllerMotion(uint8(input.PlayerSlot), motionType, x, y, z)
+	case InputTypePen:
+		pen, ok := ParsePen(input.Data)
+		if !ok {
+			return
+		}
+		s.conn.SendPen(pen.EventType, pen.ToolType, pen.Buttons, pen.X, pen.Y, pen.Pressure,
+			0, 0, pen.Rotation, pen.Tilt)
+	}
+}
+
+// SupportsPen reports whether the host takes pen input
+func (s *PureGoStream) SupportsPen() bool {
+	return s.conn.SupportsPen()
+}
+
+// SetActiveGamepads announces controllers that arrived, departed or changed
+// since the last call and sends the new mask with every later gamepad event
+func (s *PureGoStream) SetActiveGamepads(mask uint16, pads []Gamepad) {
+	s.gamepads.set(mask, pads, gamepadEvents{
+		arrival:   s.conn.SendControllerArrival,
+		departure: s.conn.SendControllerDeparture,
+		battery:   s.conn.SendControllerBattery,
+	})
+}
+
+// RequestIDR requests an IDR frame (keyframe)
+func (s *PureGoStream) RequestIDR() {
+	s.conn.RequestIDRFrame()
+}
+
+// Stats returns the client's video and audio counters
+func (s *PureGoStream) Stats() StreamStats {
+	video := s.conn.GetVideoStats()
+	audio := s.conn.GetAudioStats()
+	rtt, _ := s.conn.GetRTTInfo()
+	return StreamStats{
+		VideoPacketsReceived:  video.ReceivedPackets,
+		VideoPacketsDropped:   video.DroppedPackets,
+		VideoPacketsRecovered: video.RecoveredPackets,
+		FramesSubmitted:       video.SubmittedFrames,
+		FramesDropped:         video.DroppedFrames,
+		IDRRequests:           video.RequestedIDRFrames,
+		RefInvalidations:      video.RefInvalidationRequests,
+		AudioPacketsReceived:  audio.ReceivedPackets,
+		AudioPacketsDropped:   audio.DroppedPackets,
+		AudioPacketsRecovered: audio.RecoveredPackets,
+		HostRTTMs:             rtt.EstimatedRTT,
+	}
+}
+
+// Diagnostics describes the client's connection to Sunshine
+func (s *PureGoStream) Diagnostics() StreamDiagnostics {
+	return newStreamDiagnostics("pure-go", s.conn.GetConnectionInfo(), s.Stats())
+}
+
+// Bitrate returns the video bitrate the stream was launched with, in Kbps
+func (s *PureGoStream) Bitrate() int {
+	return s.conn.Config.Bitrate
+}
+
+// AudioFormat returns the audio the client negotiated
+func (s *PureGoStream) AudioFormat() (AudioFormat, bool) {
+	config, ok := s.conn.GetAudioConfig()
+	if !ok {
+		return AudioFormat{}, false
+	}
+	return newAudioFormat(config, s.conn.IsAudioEncrypted()), true
+}
+
+// newStreamDiagnostics fills StreamDiagnostics from a client's negotiated settings
+func newStreamDiagnostics(backend string, info common.ConnectionInfo, stats StreamStats) StreamDiagnostics {
+	return StreamDiagnostics{
+		Backend:          backend,
+		ServerVersion:    info.ServerAppVersion,
+		Sunshine:         info.IsSunshine,
+		VideoCodec:       videoCodecName(info.VideoFormat),
+		Width:            info.Width,
+		Height:           info.Height,
+		FPS:              info.FPS,
+		BitrateKbps:      info.Bitrate,
+		AudioChannels:    info.AudioChannels,
+		AudioPacketMs:    info.AudioPacketDuration,
+		RTSPPort:         info.RTSPPort,
+		VideoPort:        info.VideoPort,
+		AudioPort:        info.AudioPort,
+		ControlPort:      info.ControlPort,
+		VideoEncrypted:   info.VideoEncrypted,
+		AudioEncrypted:   info.AudioEncrypted,
+		ControlEncrypted: info.ControlEncrypted,
+		Stats:            stats,
+	}
+}
+
+// videoCodecName names a negotiated video format the way browsers are told it
+func videoCodecName(format common.VideoFormat) string {
+	switch {
+	case format&common.VideoFormatMaskAV1 != 0:
+		return "av1"
+	case format&common.VideoFormatMaskH265 != 0:
+		return "h265"
+	case format&common.VideoFormatMaskH264 != 0:
+		return "h264"
+	default:
+		return ""
+	}
+}
+
+// VideoFormatsForCodec returns the video formats to ask Sunshine for to
+// stream codec, named as videoCodecName names it, with the 10-bit profiles
+// added when hdr is set. Formats the host can't encode fall back to H.264.
+func VideoFormatsForCodec(codec string, hdr bool) common.VideoFormat {
+	switch codec {
+	case "h265":
+		if hdr {
+			return common.VideoFormatH265Main10 | common.VideoFormatH265
+		}
+		return common.VideoFormatH265
+	case "av1":
+		if hdr {
+			return common.VideoFormatAV1Main10 | common.VideoFormatAV1Main8
+		}
+		return common.VideoFormatAV1Main8
+	default:
+		return common.VideoFormatH264
+	}
+}
+
+// IsConnected returns whether the stream is currently connected
+func (s *PureGoStream) IsConnected() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.connected
+}
+
+// Close terminates the stream. The frame channels are left open; readers
+// stop on their own context.
+func (s *PureGoStream) Close() error {
+	s.closeOnce.Do(func() {
+		s.cancel()
+		s.conn.Stop()
+	})
+	return nil
+}
+
+// Quit closes the stream and ends the app on Sunshine
+func (s *PureGoStream) Quit() error {
+	s.Close()
+	s.client.quitApp()
+	return nil
+}
+
+// pureGoDecoder hands assembled frames to the stream's video channel
+type pureGoDecoder struct {
+	s *PureGoStream
+}
+
+func (d *pureGoDecoder) Setup(format common.VideoFormat, width, height, fps int, context interface{}, flags int) error {
+	d.s.client.log.Infof("Video decoder setup: format=%d, %dx%d @ %dHz", format, width, height, fps)
+	return nil
+}
+
+func (d *pureGoDecoder) Start()   {}
+func (d *pureGoDecoder) Stop()    {}
+func (d *pureGoDecoder) Cleanup() {}
+
+func (d *pureGoDecoder) SubmitDecodeUnit(unit *common.DecodeUnit) int {
+	totalLen := 0
+	for _, buf := range unit.BufferList {
+		totalLen += buf.Length
+	}
+	data := make([]byte, 0, totalLen)
+	for _, buf := range unit.BufferList {
+		data = append(data, buf.Data[buf.Offset:buf.Offset+buf.Length]...)
+	}
+
+	select {
+	case d.s.videoFrames <- data:
+		return common.DrOk
+	default:
+		// Channel full; skip to the next keyframe
+		return common.DrNeedIDR
+	}
+}
+
+func (d *pureGoDecoder) Capabilities() int {
+	return 0
+}
+
+// pureGoAudio hands Opus packets to the stream's audio channel
+type pureGoAudio struct {
+	s *PureGoStream
+}
+
+func (a *pureGoAudio) Init(audioConfig common.AudioConfiguration, opusConfig *common.OpusConfig, context interface{}, flags int) error {
+	a.s.client.log.Infof("Audio init: config=%d, sampleRate=%d, channels=%d",
+		audioConfig, opusConfig.SampleRate, opusConfig.ChannelCount)
+	return nil
+}
+
+func (a *pureGoAudio) Start()   {}
+func (a *pureGoAudio) Stop()    {}
+func (a *pureGoAudio) Cleanup() {}
+
+func (a *pureGoAudio) DecodeAndPlaySample(data []byte) {
+	if data == nil {
+		return // Lost packet; browsers conceal loss themselves
+	}
+	select {
+	case a.s.audioFrames <- data:
+	default:
+		// Channel full, drop sample
+	}
+}
+
+func (a *pureGoAudio) Capabilities() int {
+	return 0
+}
+
+// pureGoListener tracks connection state and relays controller feedback
+type pureGoListener struct {
+	s *PureGoStream
+}
+
+func (l *pureGoListener) StageStarting(stage common.Stage) {}
+func (l *pureGoListener) StageComplete(stage common.Stage) {}
+
+func (l *pureGoListener) StageFailed(stage common.Stage, err error) {
+	l.s.client.log.Errorf("Connection stage %d failed: %v", stage, err)
+}
+
+func (l *pureGoListener) ConnectionStarted() {
+	l.s.mu.Lock()
+	l.s.connected = true
+	l.s.mu.Unlock()
+	l.s.client.log.Infof("Streaming connection established (pure Go)")
+}
+
+func (l *pureGoListener) ConnectionTerminated(errorCode int, reason common.TerminateReason) {
+	l.s.mu.Lock()
+	l.s.connected = false
+	l.s.mu.Unlock()
+	l.s.client.log.Infof("Connection terminated: %d (%s)", errorCode, reason)
+	if terminationReported(errorCode, reason) {
+		select {
+		case l.s.terminated <- &StreamTerminatedError{Code: errorCode, Reason: reason}:
+		default:
+		}
+	}
+}
+
+func (l *pureGoListener) ConnectionStatusUpdate(status common.ConnectionStatus) {
+	lossPercent := l.s.conn.GetFrameLossPercent()
+	l.s.client.log.Infof("Connection status: %v (%d%% frame loss)", status, lossPercent)
+	sendQuality(l.s.quality, ConnectionQuality{Poor: status == common.ConnStatusPoor, LossPercent: lossPercent})
+}
+
+// HDR events aren't relayed to browsers yet
+
+func (l *pureGoListener) SetHDRMode(enabled bool) {}
+
+func (l *pureGoListener) Rumble(controllerNumber, lowFreq, highFreq uint16) {
+	select {
+	case l.s.feedback <- ControllerFeedback{
+		Type:             "rumble",
+		ControllerNumber: controllerNumber,
+		Payload:          Rumble{LowFreq: lowFreq, HighFreq: highFreq},
+	}:
+	default:
+	}
+}
+
+func (l *pureGoListener) RumbleTriggers(controllerNumber, leftTrigger, rightTrigger uint16) {}
+
+func (l *pureGoListener) SetMotionEventState(controllerNumber uint16, motionType common.MotionType, reportRateHz uint16) {
+	select {
+	case l.s.feedback <- ControllerFeedback{
+		Type:             "motion_event",
+		ControllerNumber: controllerNumber,
+		Payload:          MotionEvent{MotionType: uint8(motionType), ReportRateHz: reportRateHz},
+	}:
+	default:
+	}
+}
+
+func (l *pureGoListener) SetControllerLED(controllerNumber uint16, r, g, b uint8) {
+	select {
+	case l.s.feedback <- ControllerFeedback{
+		Type:             "controller_led",
+		ControllerNumber: controllerNumber,
+		Payload:          ControllerLED{R: r, G: g, B: b},
+	}:
+	default:
+	}
+}
+
+func (l *pureGoListener) SetAdaptiveTriggers(controllerNumber uint16, eventFlags, typeLeft, typeRight uint8, left, right []byte) {
+	select {
+	case l.s.feedback <- ControllerFeedback{
+		Type:             "adaptive_triggers",
+		ControllerNumber: controllerNumber,
+		Payload: AdaptiveTriggers{
+			EventFlags: eventFlags,
+			TypeLeft:   typeLeft,
+			TypeRight:  typeRight,
+			Left:       left,
+			Right:      right,
+		},
+	}:
+	default:
+	}
+}
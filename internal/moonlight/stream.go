@@ -6,15 +6,19 @@ import (
 	"crypto/tls"
 	"encoding/hex"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/zalo/moonparty/internal/moonlight/limelight"
+	"github.com/zalo/moonparty/moonlight-common-go/logging"
+	"github.com/zalo/moonparty/moonlight-common-go/types"
 )
 
 // LimelightStream uses moonlight-common-go for streaming
@@ -27,12 +31,11 @@ type LimelightStream struct {
 	videoFrames chan []byte
 	audioFrames chan []byte
 	inputChan   chan InputPacket
+	feedback    chan ControllerFeedback
+	terminated  chan error
+	quality     chan ConnectionQuality
 
-	// Stream configuration
-	width   int
-	height  int
-	fps     int
-	bitrate int
+	opts StreamOptions
 
 	// Encryption keys (from launch response)
 	riKey   []byte
@@ -41,10 +44,13 @@ type LimelightStream struct {
 	// State
 	connected bool
 	mu        sync.RWMutex
+
+	gamepads gamepadSlots
 }
 
-// StartStreamWithLimelight begins streaming using moonlight-common-c
-func (c *Client) StartStreamWithLimelight(ctx context.Context, width, height, fps, bitrate int) (*LimelightStream, error) {
+// StartStreamWithLimelight launches opts.AppID and begins streaming it
+// through the limelight wrapper
+func (c *Client) StartStreamWithLimelight(ctx context.Context, opts StreamOptions) (*LimelightStream, error) {
 	if !c.paired {
 		return nil, fmt.Errorf("not paired with Sunshine")
 	}
@@ -58,17 +64,16 @@ func (c *Client) StartStreamWithLimelight(ctx context.Context, width, height, fp
 		videoFrames: make(chan []byte, 60),
 		audioFrames: make(chan []byte, 120),
 		inputChan:   make(chan InputPacket, 256),
-		width:       width,
-		height:      height,
-		fps:         fps,
-		bitrate:     bitrate,
+		feedback:    make(chan ControllerFeedback, 32),
+		terminated:  make(chan error, 1),
+		quality:     make(chan ConnectionQuality, 1),
+		opts:        opts,
 	}
 
 	// Set up limelight callbacks that push to our channels
 	s.setupCallbacks()
 
-	// Launch the desktop app (app ID 0 is typically Desktop)
-	if err := s.launchApp(ctx, 0, width, height, fps, bitrate); err != nil {
+	if err := s.launchApp(ctx); err != nil {
 		cancel()
 		return nil, err
 	}
@@ -86,39 +91,41 @@ func (c *Client) StartStreamWithLimelight(ctx context.Context, width, height, fp
 func (s *LimelightStream) setupCallbacks() {
 	limelight.SetCallbacks(&limelight.Callbacks{
 		OnDecoderSetup: func(videoFormat, width, height, redrawRate int) {
-			log.Printf("Video decoder setup: format=%d, %dx%d @ %dHz", videoFormat, width, height, redrawRate)
+			s.client.log.Infof("Video decoder setup: format=%d, %dx%d @ %dHz", videoFormat, width, height, redrawRate)
 		},
 		OnDecoderStart: func() {
-			log.Println("Video decoder started")
+			s.client.log.Debugf("Video decoder started")
 		},
 		OnDecoderStop: func() {
-			log.Println("Video decoder stopped")
+			s.client.log.Debugf("Video decoder stopped")
 		},
 		OnDecoderCleanup: func() {
-			log.Println("Video decoder cleanup")
+			s.client.log.Debugf("Video decoder cleanup")
 		},
 		OnDecodeUnit: func(unit *limelight.DecodeUnit) int {
 			// Send video frame data to channel
 			select {
 			case s.videoFrames <- unit.Data:
 			default:
-				// Channel full, drop frame
+				// Channel full, drop frame. The P-frames after it can't be
+				// decoded, so ask for frames to be skipped up to a new IDR.
+				return limelight.DrNeedIDR
 			}
 			return limelight.DrOk
 		},
 		OnAudioInit: func(audioConfig int, opusConfig *limelight.OpusConfig) int {
-			log.Printf("Audio init: config=%d, sampleRate=%d, channels=%d",
+			s.client.log.Infof("Audio init: config=%d, sampleRate=%d, channels=%d",
 				audioConfig, opusConfig.SampleRate, opusConfig.ChannelCount)
 			return 0
 		},
 		OnAudioStart: func() {
-			log.Println("Audio started")
+			s.client.log.Debugf("Audio started")
 		},
 		OnAudioStop: func() {
-			log.Println("Audio stopped")
+			s.client.log.Debugf("Audio stopped")
 		},
 		OnAudioCleanup: func() {
-			log.Println("Audio cleanup")
+			s.client.log.Debugf("Audio cleanup")
 		},
 		OnAudioSample: func(data []byte) {
 			// Send audio sample to channel
@@ -132,114 +139,418 @@ func (s *LimelightStream) setupCallbacks() {
 			s.mu.Lock()
 			s.connected = true
 			s.mu.Unlock()
-			log.Println("Streaming connection established")
+			s.client.log.Infof("Streaming connection established")
 		},
-		OnConnectionTerminated: func(errorCode int) {
+		OnConnectionTerminated: func(errorCode, reason int) {
 			s.mu.Lock()
 			s.connected = false
 			s.mu.Unlock()
-			if errorCode != 0 {
-				log.Printf("Connection terminated with error: %d", errorCode)
+			if terminationReported(errorCode, types.TerminateReason(reason)) {
+				s.client.log.Warnf("Connection terminated with error: %d (%s)", errorCode, types.TerminateReason(reason))
+				s.terminate(errorCode, types.TerminateReason(reason))
 			} else {
-				log.Println("Connection terminated gracefully")
+				s.client.log.Infof("Connection terminated gracefully")
 			}
 		},
+		OnConnectionStatusUpdate: func(poor bool, lossPercent int) {
+			sendQuality(s.quality, ConnectionQuality{Poor: poor, LossPercent: lossPercent})
+		},
 		OnRumble: func(controllerNumber, lowFreq, highFreq uint16) {
-			// TODO: Forward rumble events to WebRTC clients
-			log.Printf("Rumble: controller=%d, low=%d, high=%d", controllerNumber, lowFreq, highFreq)
+			s.sendFeedback(ControllerFeedback{
+				Type:             "rumble",
+				ControllerNumber: controllerNumber,
+				Payload:          Rumble{LowFreq: lowFreq, HighFreq: highFreq},
+			})
+		},
+		OnAdaptiveTriggers: func(controllerNumber uint16, eventFlags, typeLeft, typeRight uint8, left, right []byte) {
+			s.sendFeedback(ControllerFeedback{
+				Type:             "adaptive_triggers",
+				ControllerNumber: controllerNumber,
+				Payload: AdaptiveTriggers{
+					EventFlags: eventFlags,
+					TypeLeft:   typeLeft,
+					TypeRight:  typeRight,
+					Left:       left,
+					Right:      right,
+				},
+			})
+		},
+		OnMotionEventState: func(controllerNumber uint16, motionType uint8, reportRateHz uint16) {
+			s.sendFeedback(ControllerFeedback{
+				Type:             "motion_event",
+				ControllerNumber: controllerNumber,
+				Payload:          MotionEvent{MotionType: motionType, ReportRateHz: reportRateHz},
+			})
+		},
+		OnControllerLED: func(controllerNumber uint16, r, g, b uint8) {
+			s.sendFeedback(ControllerFeedback{
+				Type:             "controller_led",
+				ControllerNumber: controllerNumber,
+				Payload:          ControllerLED{R: r, G: g, B: b},
+			})
 		},
 	})
 }
 
 // launchApp starts an application on Sunshine (same as before, but stores riKey)
-func (s *LimelightStream) launchApp(ctx context.Context, appID, width, height, fps, bitrate int) error {
-	// Generate random AES key for stream encryption
-	s.riKey = make([]byte, 16)
-	if _, err := rand.Read(s.riKey); err != nil {
+func (s *LimelightStream) launchApp(ctx context.Context) error {
+	riKey, riKeyID, err := s.client.launchWithRiKey(ctx, s.opts)
+	if err != nil {
 		return err
 	}
-	s.riKeyID = uint32(time.Now().UnixNano() & 0xFFFFFFFF)
+	s.riKey = riKey
+	s.riKeyID = riKeyID
+	return nil
+}
 
-	// Build launch URL with parameters (must use HTTPS port 47984)
-	riKeyHex := strings.ToUpper(hex.EncodeToString(s.riKey))
+// LaunchOptions are the host settings a stream is launched with
+type LaunchOptions struct {
+	// OptimizeGameSettings (Sunshine's sops) lets Sunshine switch the host's
+	// display to the stream's resolution and refresh rate for the session
+	OptimizeGameSettings bool
+
+	// GamepadMask (gcmap) has one bit per controller attached when the app
+	// starts. Bit n is the controller SendMultiController calls number n,
+	// which moonparty makes the player slot, so launching with the session's
+	// active-gamepad mask gives each seated player their own host controller
+	// from the first frame. Controllers outside the mask are still attached
+	// when their first input or arrival event comes in.
+	GamepadMask uint16
+
+	// PersistGamepads (gcpersist) keeps the host's virtual controllers
+	// after the stream ends, so games don't see them unplugged
+	PersistGamepads bool
+
+	// OnSessionConflict is what a launch does when Sunshine is busy with
+	// another session
+	OnSessionConflict SessionConflict
+
+	// Resume streams the app already running, with /resume, keeping the
+	// game where it was; a stream that closed without quitting leaves it
+	// running. If nothing is running to resume, the app is launched.
+	Resume bool
+}
 
-	params := fmt.Sprintf("uniqueid=%s&appid=%d&mode=%dx%dx%d&additionalStates=1&sops=0&rikey=%s&rikeyid=%d&localAudioPlayMode=0&gcmap=0&gcpersist=0",
-		s.client.uniqueID, appID, width, height, fps, riKeyHex, s.riKeyID)
+// SessionConflict is what a launch does when Sunshine refuses it because
+// another session is in progress, such as one a previous moonparty left
+// behind
+type SessionConflict int
+
+const (
+	// SessionConflictError fails the launch with ErrSessionInProgress
+	SessionConflictError SessionConflict = iota
+	// SessionConflictCancel ends the other session with /cancel and
+	// launches again, once
+	SessionConflictCancel
+	// SessionConflictResume streams the app that's already running, with
+	// /resume, instead of launching another
+	SessionConflictResume
+)
 
-	// Use HTTPS port 47984 for launch
-	url := fmt.Sprintf("https://%s:47984/launch?%s", s.client.host, params)
+func (p SessionConflict) String() string {
+	switch p {
+	case SessionConflictCancel:
+		return "cancel"
+	case SessionConflictResume:
+		return "resume"
+	default:
+		return "error"
+	}
+}
 
-	log.Printf("Launching app %d at %dx%d@%dfps...", appID, width, height, fps)
+// ParseSessionConflict parses a SessionConflict name: error, cancel or
+// resume. An empty name is error.
+func ParseSessionConflict(name string) (SessionConflict, error) {
+	switch strings.ToLower(name) {
+	case "", "error":
+		return SessionConflictError, nil
+	case "cancel":
+		return SessionConflictCancel, nil
+	case "resume":
+		return SessionConflictResume, nil
+	}
+	return SessionConflictError, fmt.Errorf("unknown session conflict handling %q", name)
+}
 
-	// Create HTTPS client with client certificate
-	httpsClient := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-				Certificates:       []tls.Certificate{*s.client.clientCert},
-			},
-		},
-		Timeout: 30 * time.Second,
+// query returns the options as /launch parameters
+func (o LaunchOptions) query() string {
+	return fmt.Sprintf("sops=%d&gcmap=%d&gcpersist=%d",
+		boolParam(o.OptimizeGameSettings), o.GamepadMask, boolParam(o.PersistGamepads))
+}
+
+func boolParam(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// launchWithRiKey launches a stream's app on Sunshine with a fresh stream
+// encryption key and returns the key and its ID for the connection
+func (c *Client) launchWithRiKey(ctx context.Context, opts StreamOptions) ([]byte, uint32, error) {
+	// Generate random AES key for stream encryption
+	riKey := make([]byte, 16)
+	if _, err := rand.Read(riKey); err != nil {
+		return nil, 0, err
+	}
+	riKeyID := uint32(time.Now().UnixNano() & 0xFFFFFFFF)
+
+	// Build the launch parameters, of which /resume takes the key ones
+	riKeyHex := strings.ToUpper(hex.EncodeToString(riKey))
+
+	keyParams := fmt.Sprintf("uniqueid=%s&rikey=%s&rikeyid=%d&localAudioPlayMode=0",
+		c.uniqueID, riKeyHex, riKeyID)
+	params := fmt.Sprintf("%s&appid=%d&mode=%dx%dx%d&additionalStates=1&%s",
+		keyParams, opts.AppID, opts.Width, opts.Height, opts.FPS, opts.Launch.query())
+	if opts.HDR && opts.videoFormat().Is10Bit() {
+		// Switches the host's display to HDR for the session
+		params += "&hdrMode=1"
+	}
+
+	c.log.Infof("Launching app %d at %dx%d@%dfps...", opts.AppID, opts.Width, opts.Height, opts.FPS)
+
+	endpoint := "launch"
+	if opts.Launch.Resume {
+		endpoint = "resume"
+	}
+	launchResp, err := c.requestLaunch(ctx, endpoint, params)
+	if opts.Launch.Resume && err != nil && !errors.Is(err, ErrNeedsRepair) {
+		// Nothing is running to resume, e.g. the game was quit on the host
+		c.log.Infof("Resuming app %d failed (%v); launching it", opts.AppID, err)
+		launchResp, err = c.requestLaunch(ctx, "launch", params)
+	}
+	if errors.Is(err, ErrSessionInProgress) {
+		switch opts.Launch.OnSessionConflict {
+		case SessionConflictCancel:
+			c.log.Warnf("%v; ending it and launching again", err)
+			if cancelErr := c.cancelApp(ctx); cancelErr != nil {
+				return nil, 0, fmt.Errorf("%w (ending it failed: %v)", err, cancelErr)
+			}
+			launchResp, err = c.requestLaunch(ctx, "launch", params)
+		case SessionConflictResume:
+			c.log.Warnf("%v; resuming the running app instead", err)
+			launchResp, err = c.requestLaunch(ctx, "resume", keyParams)
+		}
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	c.log.Infof("Launch successful, RTSP URL: %s", launchResp.SessionURL)
+	return riKey, riKeyID, nil
+}
+
+// requestLaunch sends /launch or /resume, which Sunshine only serves on its
+// HTTPS port, and checks the reply
+func (c *Client) requestLaunch(ctx context.Context, endpoint, params string) (*launchResponse, error) {
+	url := fmt.Sprintf("https://%s:%d/%s?%s", c.host, c.port+PortHTTPSOffset, endpoint, params)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.secureClient().Do(req)
+	if err != nil {
+		if isCertRejected(err) {
+			c.paired = false
+			return nil, fmt.Errorf("%w: %v", ErrNeedsRepair, err)
+		}
+		return nil, fmt.Errorf("%s request failed: %w", endpoint, err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+
+	launchResp, err := parseLaunchResponse(resp.StatusCode, body)
+	if errors.Is(err, ErrNeedsRepair) {
+		c.paired = false
 	}
+	return launchResp, err
+}
 
+// cancelTimeout bounds the /cancel request sent as a stream quits, so an
+// unreachable host can't hold up shutdown
+const cancelTimeout = 5 * time.Second
+
+// cancelApp asks Sunshine to end the running app and its session, freeing it
+// for the next launch. Sunshine only serves /cancel on its HTTPS port, to a
+// paired client certificate.
+func (c *Client) cancelApp(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, cancelTimeout)
+	defer cancel()
+
+	url := fmt.Sprintf("https://%s:%d/cancel?uniqueid=%s", c.host, c.port+PortHTTPSOffset, c.uniqueID)
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return err
 	}
 
-	resp, err := httpsClient.Do(req)
+	resp, err := c.secureClient().Do(req)
 	if err != nil {
-		return fmt.Errorf("launch request failed: %w", err)
+		return fmt.Errorf("cancel request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	body, _ := io.ReadAll(resp.Body)
+	var result struct {
+		StatusCode string `xml:"status_code,attr"`
+		StatusMsg  string `xml:"status_message,attr"`
+	}
+	xml.Unmarshal(body, &result)
 
-	// Parse response
-	var launchResp struct {
-		SessionURL  string `xml:"sessionUrl0"`
-		GameSession string `xml:"gamesession"`
-		StatusCode  string `xml:"status_code,attr"`
-		StatusMsg   string `xml:"status_message,attr"`
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cancel failed: HTTP %d", resp.StatusCode)
 	}
-	if err := xml.Unmarshal(body, &launchResp); err != nil {
-		log.Printf("Launch response parse error: %v, body: %s", err, string(body))
-		return fmt.Errorf("parse launch response: %w", err)
+	if result.StatusCode != "" && result.StatusCode != "200" {
+		return fmt.Errorf("cancel failed: %s (status: %s)", result.StatusMsg, result.StatusCode)
 	}
+	return nil
+}
 
-	if launchResp.GameSession != "1" {
-		return fmt.Errorf("launch failed: %s (status: %s)", launchResp.StatusMsg, launchResp.StatusCode)
+// quitApp cancels the app on Sunshine as a stream quits. A failure is only
+// logged: the stream is going away regardless.
+func (c *Client) quitApp() {
+	if err := c.cancelApp(context.Background()); err != nil {
+		c.log.Warnf("Failed to end the session on Sunshine: %v", err)
 	}
+}
 
-	log.Printf("Launch successful, RTSP URL: %s", launchResp.SessionURL)
-	return nil
+// ErrNeedsRepair is returned by a launch when Sunshine no longer accepts the
+// client's certificate on its HTTPS port even though pairing looks fine over
+// HTTP, which is common after a Sunshine restart. Client.Repair fixes it.
+var ErrNeedsRepair = errors.New("Sunshine rejected the client certificate; re-pair required")
+
+// ErrSessionInProgress is returned by a launch when Sunshine is busy with
+// another session: another app is running, or it's streaming as many
+// sessions as it allows. LaunchOptions.OnSessionConflict can handle it.
+var ErrSessionInProgress = errors.New("another session is in progress on Sunshine")
+
+// launchResponse is Sunshine's reply to /launch or /resume
+type launchResponse struct {
+	SessionURL  string `xml:"sessionUrl0"`
+	GameSession string `xml:"gamesession"`
+	Resume      string `xml:"resume"`
+
+	// Errors come back either as attributes on the root element (Sunshine)
+	// or as child elements (GFE and older Sunshine builds)
+	StatusCode     string `xml:"status_code,attr"`
+	StatusMsg      string `xml:"status_message,attr"`
+	StatusCodeElem string `xml:"status_code"`
+	StatusMsgElem  string `xml:"status_message"`
+}
+
+// parseLaunchResponse checks a /launch or /resume reply, returning
+// ErrNeedsRepair when Sunshine answered 401 for our certificate and
+// ErrSessionInProgress when it's busy with another session
+func parseLaunchResponse(httpStatus int, body []byte) (*launchResponse, error) {
+	var launchResp launchResponse
+	parseErr := xml.Unmarshal(body, &launchResp)
+
+	code, msg := launchResp.StatusCode, launchResp.StatusMsg
+	if code == "" {
+		code, msg = launchResp.StatusCodeElem, launchResp.StatusMsgElem
+	}
+
+	if httpStatus == http.StatusUnauthorized || code == "401" {
+		if msg == "" {
+			msg = http.StatusText(http.StatusUnauthorized)
+		}
+		return nil, fmt.Errorf("%w: %s", ErrNeedsRepair, msg)
+	}
+	if parseErr != nil {
+		logging.Warnf("Launch response parse error: %v, body: %s", parseErr, string(body))
+		if httpStatus != http.StatusOK {
+			return nil, fmt.Errorf("launch failed: HTTP %d", httpStatus)
+		}
+		return nil, fmt.Errorf("parse launch response: %w", parseErr)
+	}
+
+	if launchResp.GameSession != "1" && launchResp.Resume != "1" {
+		if isSessionConflict(code, msg) {
+			return nil, fmt.Errorf("%w: %s", ErrSessionInProgress, msg)
+		}
+		return nil, fmt.Errorf("launch failed: %s (status: %s)", msg, code)
+	}
+	return &launchResp, nil
 }
 
+// isSessionConflict reports whether a launch failure status means another
+// session is in the way: Sunshine answers 400 "An app is already running on
+// this host" for a different app, and 503 once it streams as many sessions
+// as its channels setting allows
+func isSessionConflict(code, msg string) bool {
+	return code == "503" || (code == "400" && strings.Contains(strings.ToLower(msg), "already running"))
+}
+
+// isCertRejected reports whether a TLS handshake failed because the server
+// refused our client certificate
+func isCertRejected(err error) bool {
+	var alert tls.AlertError
+	if !errors.As(err, &alert) {
+		return false
+	}
+	switch alert {
+	case tlsAlertBadCertificate, tlsAlertUnknownCA, tlsAlertCertificateRequired:
+		return true
+	}
+	return false
+}
+
+// TLS alerts a server sends when it rejects the client certificate
+const (
+	tlsAlertBadCertificate      tls.AlertError = 42
+	tlsAlertUnknownCA           tls.AlertError = 48
+	tlsAlertCertificateRequired tls.AlertError = 116
+)
+
 // startLimelightConnection starts the moonlight-common-c connection
 func (s *LimelightStream) startLimelightConnection() error {
 	serverInfo := &limelight.ServerInfo{
-		Address:              s.client.host,
-		RtspSessionUrl:       "", // Let moonlight-common-c use default
-		ServerCodecModeSupport: 0x0001, // H.264 support
-		AppVersion:           "7.0.0.0", // Sunshine Gen 7 protocol
+		Address:                net.JoinHostPort(s.client.host, strconv.Itoa(s.client.port)),
+		RtspSessionUrl:         "", // Let moonlight-common-c use default
+		ServerCodecModeSupport: s.client.serverCodecModes(s.ctx, s.opts.videoFormat()),
+		AppVersion:             "7.0.0.0", // Sunshine Gen 7 protocol
 	}
 
 	streamConfig := &limelight.StreamConfig{
-		Width:                s.width,
-		Height:               s.height,
-		FPS:                  s.fps,
-		Bitrate:              s.bitrate,
-		PacketSize:           1024,
-		StreamingRemotely:    limelight.StreamingAuto,
-		AudioConfiguration:   limelight.AudioConfigStereo,
-		SupportedVideoFormats: limelight.VideoFormatH264,
-		RiKey:                s.riKey,
-		RiKeyID:              int(s.riKeyID),
+		Width:                 s.opts.Width,
+		Height:                s.opts.Height,
+		FPS:                   s.opts.FPS,
+		Bitrate:               s.opts.Bitrate,
+		PacketSize:            s.opts.packetSize(),
+		StreamingRemotely:     limelight.StreamingAuto,
+		AudioConfiguration:    limelight.AudioConfigStereo,
+		SupportedVideoFormats: int(s.opts.videoFormat()),
+		HDREnabled:            s.opts.HDR,
+		AudioQuality:          s.opts.AudioQuality,
+		MinFECPackets:         s.opts.MinFECPackets,
+		FirstFrameTimeout:     s.opts.FirstFrameTimeout,
+		NoVideoTrafficTimeout: s.opts.NoVideoTrafficTimeout,
+		AudioInitialDropMs:    s.opts.AudioInitialDropMs,
+		AudioJitterBufferMs:   s.opts.AudioJitterBufferMs,
+		RiKey:                 s.riKey,
+		RiKeyID:               int(s.riKeyID),
 	}
 
 	return limelight.StartConnection(serverInfo, streamConfig)
 }
 
+// serverCodecModes asks Sunshine which video formats it can encode, so
+// anything beyond H.264 is only negotiated if the host supports it. If
+// Sunshine can't be asked, only H.264 is assumed and the stream still starts.
+func (c *Client) serverCodecModes(ctx context.Context, format types.VideoFormat) int {
+	if format&^types.VideoFormatH264 == 0 {
+		return types.ServerCodecModeH264
+	}
+	info, err := c.GetServerInfo(ctx)
+	if err != nil {
+		c.log.Warnf("Can't read codec support, streaming H.264: %v", err)
+		return types.ServerCodecModeH264
+	}
+	return info.CodecModeSupport
+}
+
 // VideoFrames returns the channel for receiving video frames
 func (s *LimelightStream) VideoFrames() <-chan []byte {
 	return s.videoFrames
@@ -250,6 +561,40 @@ func (s *LimelightStream) AudioSamples() <-chan []byte {
 	return s.audioFrames
 }
 
+// Feedback returns the channel for controller feedback from the host
+func (s *LimelightStream) Feedback() <-chan ControllerFeedback {
+	return s.feedback
+}
+
+// Terminated returns a channel that receives an error if Sunshine ends the
+// connection with one
+func (s *LimelightStream) Terminated() <-chan error {
+	return s.terminated
+}
+
+// ConnectionQuality returns a channel that receives each change in how
+// well the stream arrives
+func (s *LimelightStream) ConnectionQuality() <-chan ConnectionQuality {
+	return s.quality
+}
+
+// terminate reports the connection ending with errorCode and reason; only
+// the first report is kept
+func (s *LimelightStream) terminate(errorCode int, reason types.TerminateReason) {
+	select {
+	case s.terminated <- &StreamTerminatedError{Code: errorCode, Reason: reason}:
+	default:
+	}
+}
+
+// sendFeedback queues a controller feedback event, dropping it if nobody keeps up
+func (s *LimelightStream) sendFeedback(fb ControllerFeedback) {
+	select {
+	case s.feedback <- fb:
+	default:
+	}
+}
+
 // SendInput sends input to Sunshine via moonlight-common-c
 func (s *LimelightStream) SendInput(input InputPacket) {
 	switch input.Type {
@@ -261,40 +606,127 @@ func (s *LimelightStream) SendInput(input InputPacket) {
 		s.sendMouseInput(input)
 	case InputTypeMouseRelative:
 		s.sendMouseRelativeInput(input)
+	case InputTypeMouseAbsolute:
+		s.sendMousePositionInput(input)
+	case InputTypeScroll:
+		sendScroll(input.Data, limelight.SendHighResScrollEvent, limelight.SendHScrollEvent)
+	case InputTypeText:
+		if err := limelight.SendUTF8TextEvent(string(input.Data)); err != nil {
+			s.client.log.Warnf("Text input not sent: %v", err)
+		}
+	case InputTypeMotion:
+		motionType, x, y, z, ok := ParseMotion(input.Data)
+		if !ok {
+			return
+		}
+		limelight.SendControllerMotionEvent(uint8(input.PlayerSlot), motionType, x, y, z)
+	case InputTypePen:
+		pen, ok := ParsePen(input.Data)
+		if !ok {
+			return
+		}
+		limelight.SendPenEvent(pen.EventType, pen.ToolType, pen.Buttons, pen.X, pen.Y, pen.Pressure,
+			0, 0, pen.Rotation, pen.Tilt)
 	}
 }
 
+// SupportsPen reports whether the host takes pen input
+func (s *LimelightStream) SupportsPen() bool {
+	return limelight.SupportsPen()
+}
+
 func (s *LimelightStream) sendGamepadInput(input InputPacket) {
-	if len(input.Data) < 14 {
+	pad, ok := ParseGamepad(input.Data)
+	if !ok {
 		return
 	}
 
-	// Parse gamepad state from input.Data
-	// Expected format: buttonFlags(2) + leftTrigger(1) + rightTrigger(1) +
-	//                  leftStickX(2) + leftStickY(2) + rightStickX(2) + rightStickY(2)
-	buttonFlags := int(input.Data[0]) | int(input.Data[1])<<8
-	leftTrigger := input.Data[2]
-	rightTrigger := input.Data[3]
-	leftStickX := int16(input.Data[4]) | int16(input.Data[5])<<8
-	leftStickY := int16(input.Data[6]) | int16(input.Data[7])<<8
-	rightStickX := int16(input.Data[8]) | int16(input.Data[9])<<8
-	rightStickY := int16(input.Data[10]) | int16(input.Data[11])<<8
-
 	// Multi-controller support
 	controllerNum := int16(input.PlayerSlot)
-	activeGamepadMask := int16(1 << input.PlayerSlot)
+	activeGamepadMask := int16(s.gamepads.active(input.PlayerSlot))
 
 	limelight.SendMultiControllerEvent(
 		controllerNum,
 		activeGamepadMask,
-		buttonFlags,
-		leftTrigger,
-		rightTrigger,
-		leftStickX, leftStickY,
-		rightStickX, rightStickY,
+		pad.Buttons,
+		pad.LeftTrigger,
+		pad.RightTrigger,
+		pad.LeftStickX, pad.LeftStickY,
+		pad.RightStickX, pad.RightStickY,
 	)
 }
 
+// Browser gamepads use the standard (Xbox-style) mapping, so each one is
+// announced with that button set, analog triggers and rumble
+const (
+	gamepadSupportedButtons = types.ButtonA | types.ButtonB | types.ButtonX | types.ButtonY |
+		types.ButtonUp | types.ButtonDown | types.ButtonLeft | types.ButtonRight |
+		types.ButtonLeftBumper | types.ButtonRightBumper | types.ButtonLeftStick | types.ButtonRightStick |
+		types.ButtonBack | types.ButtonStart | types.ButtonHome
+	gamepadCapabilities = types.CapAnalogTriggers | types.CapRumble
+)
+
+// SetActiveGamepads announces controllers that arrived, departed or changed
+// since the last call and sends the new mask with every later gamepad event
+func (s *LimelightStream) SetActiveGamepads(mask uint16, pads []Gamepad) {
+	s.gamepads.set(mask, pads, limelightGamepadEvents)
+}
+
+// limelightGamepadEvents tells Sunshine about controllers through the
+// limelight wrapper
+var limelightGamepadEvents = gamepadEvents{
+	arrival:   limelight.SendControllerArrivalEvent,
+	departure: limelight.SendControllerDepartureEvent,
+	battery:   limelight.SendControllerBatteryEvent,
+}
+
+// gamepadEvents are a stream's ways of telling Sunshine about controllers
+type gamepadEvents struct {
+	arrival   func(slot uint8, mask uint16, controllerType uint8, supportedButtons uint32, capabilities uint16) error
+	departure func(slot uint8, mask uint16) error
+	battery   func(slot, batteryState, percentage uint8) error
+}
+
+// update sends what changed between two sets of controllers: an arrival or
+// departure for each slot whose bit differs between the masks, a departure
+// and arrival for a controller whose type changed, as Sunshine only reads
+// the type on arrival, and any new battery reading
+func (e gamepadEvents) update(oldMask uint16, oldPads [16]Gamepad, mask uint16, pads [16]Gamepad) {
+	for slot := uint8(0); slot < 16; slot++ {
+		bit := uint16(1) << slot
+		pad, old := pads[slot], oldPads[slot]
+
+		var err error
+		switch {
+		case mask&bit == 0 && oldMask&bit != 0:
+			err = e.departure(slot, mask)
+		case mask&bit == 0:
+			continue
+		case oldMask&bit == 0:
+			err = e.announce(slot, mask, pad)
+		case pad.Type != old.Type:
+			if err = e.departure(slot, mask&^bit); err == nil {
+				err = e.announce(slot, mask, pad)
+			}
+		case pad.batteryChanged(old) && pad.Battery != types.BatteryStateUnknown:
+			err = e.battery(slot, uint8(pad.Battery), pad.BatteryPercent)
+		}
+		if err != nil {
+			logging.Warnf("Controller %d change not sent: %v", slot, err)
+		}
+	}
+}
+
+// announce sends the arrival of the controller in slot, then its battery
+// if known
+func (e gamepadEvents) announce(slot uint8, mask uint16, pad Gamepad) error {
+	err := e.arrival(slot, mask, uint8(pad.Type), gamepadSupportedButtons, pad.capabilities())
+	if err != nil || pad.Battery == types.BatteryStateUnknown {
+		return err
+	}
+	return e.battery(slot, uint8(pad.Battery), pad.BatteryPercent)
+}
+
 func (s *LimelightStream) sendKeyboardInput(input InputPacket) {
 	if len(input.Data) < 3 {
 		return
@@ -332,21 +764,67 @@ func (s *LimelightStream) sendMouseRelativeInput(input InputPacket) {
 	limelight.SendMouseMoveEvent(deltaX, deltaY)
 }
 
+// sendMousePositionInput moves the pointer to where it is over the peer's
+// video, for touchscreens and unlocked pointers
+func (s *LimelightStream) sendMousePositionInput(input InputPacket) {
+	x, y, refWidth, refHeight, ok := ParseMousePosition(input.Data)
+	if !ok {
+		return
+	}
+
+	limelight.SendMousePositionEvent(x, y, refWidth, refHeight)
+}
+
 // RequestIDR requests an IDR frame (keyframe)
 func (s *LimelightStream) RequestIDR() {
 	limelight.RequestIDRFrame()
 }
 
+// Stats returns the video counters of the limelight connection
+func (s *LimelightStream) Stats() StreamStats {
+	video := limelight.GetVideoStats()
+	audio := limelight.GetAudioStats()
+	rtt, _ := limelight.GetRTTInfo()
+	return StreamStats{
+		VideoPacketsReceived:  video.PacketsReceived,
+		VideoPacketsDropped:   video.PacketsDropped,
+		VideoPacketsRecovered: video.PacketsRecovered,
+		FramesSubmitted:       video.FramesSubmitted,
+		FramesDropped:         video.FramesDropped,
+		IDRRequests:           video.IDRRequests,
+		RefInvalidations:      video.RefInvalidations,
+		AudioPacketsReceived:  audio.ReceivedPackets,
+		AudioPacketsDropped:   audio.DroppedPackets,
+		AudioPacketsRecovered: audio.RecoveredPackets,
+		HostRTTMs:             rtt.EstimatedRTT,
+	}
+}
+
+// Diagnostics describes the limelight connection to Sunshine
+func (s *LimelightStream) Diagnostics() StreamDiagnostics {
+	info, _ := limelight.GetConnectionInfo()
+	return newStreamDiagnostics("limelight", info, s.Stats())
+}
+
+// Bitrate returns the video bitrate the stream was launched with, in Kbps
+func (s *LimelightStream) Bitrate() int {
+	return s.opts.Bitrate
+}
+
+// AudioFormat returns the audio the limelight connection negotiated
+func (s *LimelightStream) AudioFormat() (AudioFormat, bool) {
+	config, encrypted, ok := limelight.GetAudioConfig()
+	if !ok {
+		return AudioFormat{}, false
+	}
+	return newAudioFormat(config, encrypted), true
+}
+
 // Close terminates the stream
 func (s *LimelightStream) Close() error {
 	s.cancel()
 	limelight.StopConnection()
 
-	// Send quit command to Sunshine
-	quitURL := fmt.Sprintf("http://%s:%d/cancel?uniqueid=%s",
-		s.client.host, s.client.port, s.client.uniqueID)
-	s.client.httpClient.Get(quitURL)
-
 	// Close channels safely
 	close(s.videoFrames)
 	close(s.audioFrames)
@@ -354,6 +832,13 @@ func (s *LimelightStream) Close() error {
 	return nil
 }
 
+// Quit closes the stream and ends the app on Sunshine
+func (s *LimelightStream) Quit() error {
+	s.Close()
+	s.client.quitApp()
+	return nil
+}
+
 // IsConnected returns whether the stream is currently connected
 func (s *LimelightStream) IsConnected() bool {
 	s.mu.RLock()
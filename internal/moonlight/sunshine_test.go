@@ -0,0 +1,453 @@
+package moonlight
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zalo/moonparty/internal/moonlight/moonlighttest"
+)
+
+// newPairedClient starts a fake Sunshine host and pairs a client with it
+func newPairedClient(t *testing.T) (*Client, *moonlighttest.Server) {
+	t.Helper()
+
+	srv, err := moonlighttest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+
+	c := NewClient(srv.Host, srv.Port)
+	c.SetIdentityDir(t.TempDir())
+	c.SetPairingCallbacks(PairingCallbacks{
+		OnPINGenerated: func(pin string) { go srv.EnterPIN(pin) },
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := c.Connect(ctx); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	return c, srv
+}
+
+func TestPairing(t *testing.T) {
+	c, srv := newPairedClient(t)
+
+	if !c.IsPaired() || !srv.IsPaired(c.GetUniqueID()) {
+		t.Fatalf("client paired %v, host paired %v", c.IsPaired(), srv.IsPaired(c.GetUniqueID()))
+	}
+
+	// A second client with the same identity is already paired
+	again := NewClient(srv.Host, srv.Port)
+	again.SetIdentityDir(c.identityDir)
+	again.SetPairingCallbacks(PairingCallbacks{
+		OnPINGenerated: func(string) { t.Error("paired again with a saved identity") },
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := again.Connect(ctx); err != nil {
+		t.Fatalf("Connect with saved identity: %v", err)
+	}
+}
+
+func TestPairingWrongPIN(t *testing.T) {
+	srv, err := moonlighttest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	c := NewClient(srv.Host, srv.Port)
+	c.SetIdentityDir(t.TempDir())
+	c.SetPairingCallbacks(PairingCallbacks{
+		OnPINGenerated: func(pin string) { go srv.EnterPIN(wrongPIN(pin)) },
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := c.Connect(ctx); err == nil {
+		t.Fatal("paired with the wrong PIN")
+	}
+	if srv.IsPaired(c.GetUniqueID()) {
+		t.Fatal("host paired a client that entered the wrong PIN")
+	}
+}
+
+func TestPairingPINTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { pinEntryTimeout = timeout }(pinEntryTimeout)
+	pinEntryTimeout = 300 * time.Millisecond
+
+	srv, err := moonlighttest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	// Nobody enters the PIN, so the host never answers getservercert
+	c := NewClient(srv.Host, srv.Port)
+	c.SetIdentityDir(t.TempDir())
+	c.SetPairingCallbacks(PairingCallbacks{OnPINGenerated: func(string) {}})
+
+	// The client's usual timeouts are shorter here but don't cut the wait short
+	c.httpClient.Timeout = 50 * time.Millisecond
+	c.httpClient.Transport.(*http.Transport).ResponseHeaderTimeout = 50 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := c.Connect(ctx); !errors.Is(err, ErrPINTimeout) {
+		t.Fatalf("Connect = %v, want ErrPINTimeout", err)
+	}
+	if waited := time.Since(start); waited < pinEntryTimeout {
+		t.Fatalf("gave up after %v, before the PIN entry timeout", waited)
+	}
+}
+
+func TestPairingSunshineUnreachable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	c := NewClient("127.0.0.1", port)
+	c.pairingPIN = "1234"
+	err = c.StartPairing(context.Background())
+	if err == nil || errors.Is(err, ErrPINTimeout) {
+		t.Fatalf("StartPairing with nothing listening = %v, want it unreachable", err)
+	}
+	if !strings.Contains(err.Error(), "cannot reach Sunshine") {
+		t.Fatalf("StartPairing with nothing listening = %v, want it to say Sunshine can't be reached", err)
+	}
+}
+
+// wrongPIN returns a PIN that differs from pin in its first digit
+func wrongPIN(pin string) string {
+	return string('0'+(pin[0]-'0'+1)%10) + pin[1:]
+}
+
+func TestPinnedServerCert(t *testing.T) {
+	c, _ := newPairedClient(t)
+	if c.serverCert == nil {
+		t.Fatal("pairing pinned no server certificate")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.cancelApp(ctx); err != nil {
+		t.Fatalf("cancel with the pinned certificate: %v", err)
+	}
+
+	// A host presenting any other certificate is refused before the request
+	// goes out
+	c.serverCert = c.certDER
+	if err := c.cancelApp(ctx); !errors.Is(err, ErrServerCertMismatch) {
+		t.Fatalf("cancel with a different pinned certificate = %v, want ErrServerCertMismatch", err)
+	}
+}
+
+func TestCloseResumeQuit(t *testing.T) {
+	c, srv := newPairedClient(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	opts := StreamOptions{Width: 1280, Height: 720, FPS: 60, Bitrate: 10000, AppID: 1}
+	stream, err := c.StartStream(ctx, opts)
+	if err != nil {
+		t.Fatalf("StartStream: %v", err)
+	}
+
+	// Closing, as a stream restart does, leaves the game running
+	stream.Close()
+	if !srv.TornDown() || !srv.Running() {
+		t.Fatalf("after Close: torn down %v, app running %v; want both", srv.TornDown(), srv.Running())
+	}
+	if _, err := c.StartStream(ctx, opts); err == nil {
+		t.Fatal("launched over the running app")
+	}
+
+	// The next stream resumes it, with its own settings
+	opts.Width, opts.Height = 1920, 1080
+	opts.Launch.Resume = true
+	stream, err = c.StartStream(ctx, opts)
+	if err != nil {
+		t.Fatalf("StartStream resuming: %v", err)
+	}
+	if launch := srv.LastLaunch(); !launch.Resumed || launch.AppID != 1 || launch.Width != 1920 {
+		t.Fatalf("launch = %+v, want app 1 resumed at 1920x1080", launch)
+	}
+
+	// Quitting, as the session ends, ends the game
+	stream.Quit()
+	if srv.Running() {
+		t.Fatal("the app is still running after Quit")
+	}
+
+	// With nothing to resume, the app is launched
+	stream, err = c.StartStream(ctx, opts)
+	if err != nil {
+		t.Fatalf("StartStream resuming with nothing running: %v", err)
+	}
+	defer stream.Quit()
+	if launch := srv.LastLaunch(); launch.Resumed {
+		t.Fatal("resumed with nothing running")
+	}
+}
+
+func TestLaunchRejectedCertificate(t *testing.T) {
+	for _, resume := range []bool{false, true} {
+		t.Run(fmt.Sprintf("resume=%v", resume), func(t *testing.T) {
+			c, srv := newPairedClient(t)
+			srv.RejectCertificate(c.GetUniqueID())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			opts := StreamOptions{Width: 1280, Height: 720, FPS: 60, Bitrate: 10000, AppID: 1}
+			opts.Launch.Resume = resume
+
+			// A resume isn't retried as a launch, which would fail the same way
+			if _, err := c.StartStream(ctx, opts); !errors.Is(err, ErrNeedsRepair) {
+				t.Fatalf("StartStream with a rejected certificate: %v, want ErrNeedsRepair", err)
+			}
+			if c.IsPaired() {
+				t.Fatal("client still considers itself paired")
+			}
+			if srv.LastLaunch() != nil {
+				t.Fatalf("host recorded launch %+v", srv.LastLaunch())
+			}
+
+			// Pairing again fixes it
+			if err := c.Repair(ctx); err != nil {
+				t.Fatalf("Repair: %v", err)
+			}
+			stream, err := c.StartStream(ctx, opts)
+			if err != nil {
+				t.Fatalf("StartStream after Repair: %v", err)
+			}
+			stream.Quit()
+		})
+	}
+}
+
+func TestParseLaunchResponse(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		status  int
+		body    string
+		wantErr error // nil for success
+	}{
+		{"launched", 200, `<root status_code="200"><sessionUrl0>rtsp://host:48010</sessionUrl0><gamesession>1</gamesession></root>`, nil},
+		{"resumed", 200, `<root status_code="200"><sessionUrl0>rtsp://host:48010</sessionUrl0><resume>1</resume></root>`, nil},
+		{"401 attribute", 200, `<root status_code="401" status_message="The client is not authorized. Certificate verification failed."/>`, ErrNeedsRepair},
+		{"401 element", 200, `<root><status_code>401</status_code><status_message>Unauthorized</status_message></root>`, ErrNeedsRepair},
+		{"HTTP 401 without a body", 401, ``, ErrNeedsRepair},
+		{"HTTP 401 with a 200 body", 401, `<root status_code="200"><gamesession>1</gamesession></root>`, ErrNeedsRepair},
+		{"app running attribute", 200, `<root status_code="400" status_message="An app is already running on this host"/>`, ErrSessionInProgress},
+		{"sessions full element", 200, `<root><status_code>503</status_code><status_message>Busy</status_message></root>`, ErrSessionInProgress},
+		{"other failure", 200, `<root status_code="500" status_message="Failed to start the app"/>`, errAny},
+		{"not XML", 200, `oops`, errAny},
+		{"not XML, HTTP error", 500, `oops`, errAny},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := parseLaunchResponse(tt.status, []byte(tt.body))
+			switch {
+			case tt.wantErr == nil:
+				if err != nil || resp == nil {
+					t.Fatalf("parseLaunchResponse = %v, %v; want a response", resp, err)
+				}
+			case tt.wantErr == errAny:
+				if err == nil || errors.Is(err, ErrNeedsRepair) || errors.Is(err, ErrSessionInProgress) {
+					t.Fatalf("parseLaunchResponse error = %v; want a plain launch failure", err)
+				}
+			default:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("parseLaunchResponse error = %v; want %v", err, tt.wantErr)
+				}
+			}
+		})
+	}
+}
+
+// errAny stands for a launch error that's neither of the typed ones
+var errAny = errors.New("any other error")
+
+func TestStreamPacketSizeNegotiated(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		mtu       int
+		serverMax int
+		want      int
+	}{
+		{"default", 0, 0, DefaultPacketSize},
+		{"fits the MTU", 1280, 0, 1184},
+		{"lowered to what Sunshine takes", 1500, 1024, 1024},
+		{"Sunshine takes more", 1280, 1392, 1184},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c, srv := newPairedClient(t)
+			srv.MaxPacketSize = tt.serverMax
+
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			stream, err := c.StartStream(ctx, StreamOptions{
+				Width: 1280, Height: 720, FPS: 60, Bitrate: 10000,
+				AppID: 1,
+				MTU:   tt.mtu,
+			})
+			if err != nil {
+				t.Fatalf("StartStream: %v", err)
+			}
+			defer stream.Close()
+
+			want := fmt.Sprintf("a=x-nv-video[0].packetSize:%d\r\n", tt.want)
+			if announce := srv.Announce(); !strings.Contains(announce, want) {
+				t.Fatalf("ANNOUNCE asked for a different packet size than %d:\n%s", tt.want, announce)
+			}
+		})
+	}
+}
+
+func TestStreamHandshakeAndMedia(t *testing.T) {
+	c, srv := newPairedClient(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	stream, err := c.StartStream(ctx, StreamOptions{
+		Width: 1280, Height: 720, FPS: 60, Bitrate: 10000,
+		AppID:        1,
+		AudioQuality: AudioQualityHigh,
+	})
+	if err != nil {
+		t.Fatalf("StartStream: %v", err)
+	}
+	defer stream.Close()
+
+	// The fake host, like Sunshine, only accepts a control connection that
+	// presents the connect data from the control SETUP
+	if stream.connectData != srv.ControlConnectData() {
+		t.Errorf("control stream connected with %#x, want %#x", stream.connectData, srv.ControlConnectData())
+	}
+
+	launch := srv.LastLaunch()
+	if launch == nil || launch.AppID != 1 || launch.Width != 1280 || launch.Height != 720 || launch.FPS != 60 {
+		t.Fatalf("launch = %+v, want app 1 at 1280x720@60", launch)
+	}
+	if len(launch.RiKey) != 16 {
+		t.Errorf("launch sent a %d-byte rikey", len(launch.RiKey))
+	}
+
+	announce := srv.Announce()
+	for _, want := range []string{
+		"clientViewportWd:1280\r\n",
+		"clientViewportHt:720\r\n",
+		"maxFPS:60\r\n",
+		"maximumBitrateKbps:10000\r\n",
+		"AudioQuality:1\r\n",
+	} {
+		if !strings.Contains(announce, want) {
+			t.Errorf("ANNOUNCE is missing %q", strings.TrimSpace(want))
+		}
+	}
+
+	if err := srv.WaitForVideoPing(ctx); err != nil {
+		t.Fatalf("waiting for the video ping: %v", err)
+	}
+
+	// The native stream passes on Sunshine's RTP packets; a frame bigger
+	// than one packet arrives whole across them
+	frame := bytes.Repeat([]byte{0, 0, 0, 1, 0x65, 0xAB}, 500)
+	if err := srv.SendVideoFrame(1, moonlighttest.FrameTypeIDR, frame); err != nil {
+		t.Fatal(err)
+	}
+	var got []byte
+	packets := 0
+	for eof := false; !eof; {
+		select {
+		case pkt := <-stream.VideoFrames():
+			packets++
+			// RTP header (12 bytes), then the NV video header (16)
+			if len(pkt) < 28 {
+				t.Fatalf("received a %d-byte video packet", len(pkt))
+			}
+			eof = pkt[12+8]&0x2 != 0
+			got = append(got, pkt[28:]...)
+		case <-ctx.Done():
+			t.Fatalf("received %d bytes of the frame before timing out", len(got))
+		}
+	}
+	// The frame's first 8 bytes are Sunshine's frame header
+	if len(got) < 8 || !bytes.Equal(got[8:], frame) {
+		t.Fatalf("received a %d-byte frame, want the %d bytes sent", len(got)-8, len(frame))
+	}
+
+	// Audio goes out once the client has pinged the audio port
+	opus := []byte{0xFC, 0xFF, 0xFE}
+	for {
+		err := srv.SendAudioPacket(opus, 5*time.Millisecond)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, moonlighttest.ErrNoClient) || ctx.Err() != nil {
+			t.Fatalf("sending audio: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case pkt := <-stream.AudioSamples():
+		if len(pkt) < 12 || !bytes.Equal(pkt[12:], opus) {
+			t.Fatalf("received audio packet % x, want an RTP header and % x", pkt, opus)
+		}
+	case <-ctx.Done():
+		t.Fatal("no audio packet received")
+	}
+
+	stats := stream.Stats()
+	if stats.VideoPacketsReceived != uint32(packets) || stats.AudioPacketsReceived == 0 ||
+		stats.VideoPacketsDropped != 0 || stats.AudioPacketsDropped != 0 {
+		t.Errorf("stats = %+v, want %d video packets and some audio, none dropped", stats, packets)
+	}
+
+	stream.Close()
+	if !srv.TornDown() {
+		t.Error("closing the stream sent no RTSP TEARDOWN")
+	}
+}
+
+func TestHostRTTFromAcknowledgements(t *testing.T) {
+	c, srv := newPairedClient(t)
+	srv.SetControlDelay(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	stream, err := c.StartStream(ctx, StreamOptions{
+		Width: 1280, Height: 720, FPS: 60, Bitrate: 10000,
+		AppID: 1,
+	})
+	if err != nil {
+		t.Fatalf("StartStream: %v", err)
+	}
+	defer stream.Close()
+
+	// The fake host, like Sunshine, never answers pings; the round trip
+	// comes from how long it takes to acknowledge them
+	deadline := time.Now().Add(5 * time.Second)
+	for stream.Stats().HostRTTMs == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no round-trip time measured")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if rtt := stream.Stats().HostRTTMs; rtt < 50 || rtt > 250 {
+		t.Fatalf("round-trip time %d ms, want about 50", rtt)
+	}
+}
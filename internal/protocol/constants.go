@@ -1,6 +1,8 @@
 // Package protocol implements the Moonlight streaming protocol
 package protocol
 
+import common "github.com/zalo/moonparty/moonlight-common-go/protocol"
+
 // Stream configuration constants
 const (
 	StreamCfgLocal  = 0
@@ -190,16 +192,17 @@ const (
 	FeatureFlagControllerTouch = 0x02
 )
 
-// ENet control channels
+// ENet control channels, defined once in moonlight-common-go/protocol,
+// which the control stream sends on
 const (
-	CtrlChannelGeneric     = 0x00
-	CtrlChannelUrgent      = 0x01
-	CtrlChannelKeyboard    = 0x02
-	CtrlChannelMouse       = 0x03
-	CtrlChannelPen         = 0x04 // Sunshine only
-	CtrlChannelTouch       = 0x05 // Sunshine only
-	CtrlChannelUTF8        = 0x06
-	CtrlChannelGamepadBase = 0x10 // 0x10-0x1F for controllers 0-15
-	CtrlChannelSensorBase  = 0x20 // 0x20-0x2F for sensors 0-15
-	CtrlChannelCount       = 0x30
+	CtrlChannelGeneric     = common.CtrlChannelGeneric
+	CtrlChannelUrgent      = common.CtrlChannelUrgent
+	CtrlChannelKeyboard    = common.CtrlChannelKeyboard
+	CtrlChannelMouse       = common.CtrlChannelMouse
+	CtrlChannelPen         = common.CtrlChannelPen   // Sunshine only
+	CtrlChannelTouch       = common.CtrlChannelTouch // Sunshine only
+	CtrlChannelUTF8        = common.CtrlChannelUTF8
+	CtrlChannelGamepadBase = common.CtrlChannelGamepadBase
+	CtrlChannelSensorBase  = common.CtrlChannelSensorBase
+	CtrlChannelCount       = common.CtrlChannelCount
 )
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// AuthRole is what an authenticated caller may do
+type AuthRole string
+
+const (
+	// AuthRoleHost may use host-only endpoints (promote, keyboard, settings)
+	AuthRoleHost AuthRole = "host"
+	// AuthRoleGuest may join and play but not manage the session
+	AuthRoleGuest AuthRole = "guest"
+)
+
+// ErrUnauthorized is returned when a request carries no valid credentials
+var ErrUnauthorized = errors.New("unauthorized")
+
+// Authenticator resolves the user behind a request. Implementations can
+// front SSO, OAuth or JWT; the identity is attached to the peer so events
+// and moderation can refer to real users.
+type Authenticator interface {
+	Authenticate(r *http.Request) (identity string, role AuthRole, err error)
+}
+
+// noAuth lets everyone in as host, matching an open deployment
+type noAuth struct{}
+
+func (noAuth) Authenticate(r *http.Request) (string, AuthRole, error) {
+	return "", AuthRoleHost, nil
+}
+
+// sharedSecretAuth admits callers presenting a shared token, as a bearer
+// token or a "token" query parameter (browsers can't set WebSocket headers).
+// A separate host token grants the host role.
+type sharedSecretAuth struct {
+	guestToken string
+	hostToken  string
+}
+
+func (a *sharedSecretAuth) Authenticate(r *http.Request) (string, AuthRole, error) {
+	token := r.URL.Query().Get("token")
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimPrefix(h, "Bearer ")
+	}
+	if token == "" {
+		return "", "", ErrUnauthorized
+	}
+
+	if a.hostToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.hostToken)) == 1 {
+		return "host", AuthRoleHost, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(a.guestToken)) == 1 {
+		return "guest", AuthRoleGuest, nil
+	}
+	return "", "", ErrUnauthorized
+}
+
+// newAuthenticator builds the authenticator selected by the config
+func newAuthenticator(cfg *Config) (Authenticator, error) {
+	switch cfg.AuthMode {
+	case "", "none":
+		return noAuth{}, nil
+	case "shared_secret":
+		if cfg.AuthSecret == "" {
+			return nil, errors.New("auth_mode shared_secret requires auth_secret")
+		}
+		return &sharedSecretAuth{guestToken: cfg.AuthSecret, hostToken: cfg.AuthHostSecret}, nil
+	default:
+		return nil, errors.New("unknown auth_mode: " + cfg.AuthMode)
+	}
+}
+
+// authenticate resolves the caller, answering 401 if that fails
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) (string, AuthRole, bool) {
+	identity, role, err := s.auth.Authenticate(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return "", "", false
+	}
+	return identity, role, true
+}
+
+// requireHost authenticates the caller and checks it may manage the session
+func (s *Server) requireHost(w http.ResponseWriter, r *http.Request) bool {
+	_, role, ok := s.authenticate(w, r)
+	if !ok {
+		return false
+	}
+	if role != AuthRoleHost {
+		http.Error(w, "Host only", http.StatusForbidden)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/zalo/moonparty/internal/moonlight"
+	"github.com/zalo/moonparty/internal/session"
+	"github.com/zalo/moonparty/moonlight-common-go/logging"
+)
+
+// Clipboard text is sent over the "clipboard" data channel as JSON chunks so
+// it isn't bound by the data channel message size. Browsers paste into the
+// host this way; nothing depends on the direction, so the host's clipboard
+// can go back to peers the same way once Sunshine reports its changes.
+type clipboardChunk struct {
+	ID    uint32 `json:"id"`    // Identifies one transfer
+	Seq   int    `json:"seq"`   // Position of this chunk, from 0
+	Total int    `json:"total"` // Number of chunks in the transfer
+	Text  string `json:"text"`
+}
+
+// maxClipboardBytes bounds the text of one transfer
+const maxClipboardBytes = 64 * 1024
+
+var (
+	errClipboardTooLarge = errors.New("clipboard text too large")
+	errClipboardChunk    = errors.New("clipboard chunk out of order")
+)
+
+// clipboardAssembler joins one peer's chunks back into clipboard text. The
+// channel is ordered, so a transfer's chunks arrive in sequence; a chunk for
+// a new ID abandons whatever was in progress.
+type clipboardAssembler struct {
+	id    uint32
+	next  int
+	total int
+	text  strings.Builder
+}
+
+// add takes the next chunk and returns the text once the transfer completes
+func (a *clipboardAssembler) add(chunk clipboardChunk) (string, bool, error) {
+	if chunk.Seq == 0 {
+		a.id = chunk.ID
+		a.next = 0
+		a.total = chunk.Total
+		a.text.Reset()
+	}
+	if chunk.ID != a.id || chunk.Seq != a.next || chunk.Total != a.total || a.total < 1 {
+		a.next = -1
+		return "", false, errClipboardChunk
+	}
+	if a.text.Len()+len(chunk.Text) > maxClipboardBytes {
+		a.next = -1
+		return "", false, errClipboardTooLarge
+	}
+
+	a.text.WriteString(chunk.Text)
+	a.next++
+	if a.next < a.total {
+		return "", false, nil
+	}
+
+	text := a.text.String()
+	a.text.Reset()
+	a.next = -1
+	return text, true, nil
+}
+
+// handleClipboard assembles clipboard chunks from a peer and types the text
+// on the host. Only peers allowed to use the keyboard may paste.
+func (s *Server) handleClipboard(sess *session.Session, peer *session.Peer, a *clipboardAssembler, data []byte) {
+	var chunk clipboardChunk
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return
+	}
+
+	text, done, err := a.add(chunk)
+	if err != nil {
+		logging.Warnf("Dropping clipboard from peer %s: %v", peer.ID, err)
+		return
+	}
+	if !done || text == "" || !utf8.ValidString(text) {
+		return
+	}
+
+	if !sess.CanSendInput(peer.ID, moonlight.InputTypeText) {
+		return
+	}
+	sess.SendInput(moonlight.InputPacket{
+		Type:       moonlight.InputTypeText,
+		PeerID:     peer.ID,
+		PlayerSlot: sess.GetPlayerSlot(peer.ID),
+		Data:       []byte(text),
+	})
+}
@@ -1,5 +1,16 @@
 package server
 
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"github.com/zalo/moonparty/internal/moonlight"
+	"github.com/zalo/moonparty/moonlight-common-go/logging"
+)
+
 // Config holds the server configuration
 type Config struct {
 	// ListenAddr is the address to listen on (e.g., ":8080")
@@ -15,6 +26,10 @@ type Config struct {
 	// ConfigPath is the path to the config file
 	ConfigPath string `json:"config_path"`
 
+	// IdentityDir is where the client certificate, key and unique ID paired
+	// with Sunshine are kept; empty uses ~/.moonparty
+	IdentityDir string `json:"identity_dir,omitempty"`
+
 	// ForceNewIdentity forces regeneration of the client identity
 	ForceNewIdentity bool `json:"-"`
 
@@ -22,6 +37,11 @@ type Config struct {
 	// This provides proper Moonlight protocol support with FEC, depacketization, and input handling
 	UseLimelight bool `json:"use_limelight"`
 
+	// UsePureGo drives the moonlight-common-go client directly, with
+	// per-stream callbacks instead of the limelight wrapper's global state.
+	// Takes precedence over UseLimelight.
+	UsePureGo bool `json:"use_pure_go"`
+
 	// ICEServers is a list of STUN/TURN server URLs
 	ICEServers []string `json:"ice_servers"`
 
@@ -31,9 +51,137 @@ type Config struct {
 	// TURNCredential for TURN authentication (optional)
 	TURNCredential string `json:"turn_credential,omitempty"`
 
+	// TURNSecret is the TURN server's shared secret (coturn's
+	// static-auth-secret). When set, short-lived TURN credentials are issued
+	// per request instead of TURNUsername and TURNCredential.
+	TURNSecret string `json:"turn_secret,omitempty"`
+
+	// TURNCredentialTTLSec is how long issued TURN credentials last
+	// (default 24 hours)
+	TURNCredentialTTLSec int `json:"turn_credential_ttl_sec,omitempty"`
+
 	// MaxPlayers is the maximum number of active players (default 4)
 	MaxPlayers int `json:"max_players"`
 
+	// MaxSpectators is the most spectators a session admits, or 0 for no
+	// limit (default). Anyone joining past it waits for a spectator to leave.
+	MaxSpectators int `json:"max_spectators"`
+
+	// SpectatorVideo re-encodes the video at a lower resolution and bitrate
+	// for spectators while players get the full stream
+	SpectatorVideo SpectatorVideoSettings `json:"spectator_video"`
+
+	// ReconnectGraceSeconds is how long a disconnected peer's role and player
+	// slot are held for it to reclaim by presenting its fingerprint, before
+	// being freed for the queue. Once freed, the peer can still come back
+	// within as long again, to its old slot if nobody took it or else as a
+	// spectator. 0 frees them immediately and disables reconnecting.
+	// It replaces reconnect_window_sec, which older configs may still set.
+	ReconnectGraceSeconds int `json:"reconnect_grace_seconds"`
+
+	// SSEEnabled exposes the /api/events server-sent events stream (default true)
+	SSEEnabled bool `json:"sse_enabled"`
+
+	// AuthMode selects how callers are authenticated: "none" (default) or
+	// "shared_secret", which requires AuthSecret as a bearer token or "token" query
+	AuthMode string `json:"auth_mode"`
+
+	// AuthSecret is the token guests present in shared_secret mode
+	AuthSecret string `json:"auth_secret,omitempty"`
+
+	// AuthHostSecret is the token that grants the host role in shared_secret
+	// mode; when empty, nobody can use host-only endpoints
+	AuthHostSecret string `json:"auth_host_secret,omitempty"`
+
+	// CSPNonce adds a per-request nonce to the Content-Security-Policy so
+	// inline scripts carrying it are allowed
+	CSPNonce bool `json:"csp_nonce"`
+
+	// AutoLaunchAppID launches this Sunshine app as soon as pairing succeeds,
+	// so the first client doesn't wait on the launch; -1 disables
+	AutoLaunchAppID int `json:"auto_launch_app_id"`
+
+	// PreloadTimeoutMin closes an auto-launched stream if no client connects
+	// within this many minutes; 0 keeps it open indefinitely
+	PreloadTimeoutMin int `json:"preload_timeout_min"`
+
+	// TLSCertFile and TLSKeyFile serve HTTPS directly from a certificate on disk
+	TLSCertFile string `json:"tls_cert_file,omitempty"`
+	TLSKeyFile  string `json:"tls_key_file,omitempty"`
+
+	// AutocertDomains obtains certificates from Let's Encrypt for these
+	// hostnames; takes precedence over TLSCertFile/TLSKeyFile
+	AutocertDomains []string `json:"autocert_domains,omitempty"`
+
+	// AutocertCacheDir stores issued certificates (default "autocert-cache")
+	AutocertCacheDir string `json:"autocert_cache_dir,omitempty"`
+
+	// HTTPRedirectAddr listens for plain HTTP and redirects to HTTPS when TLS
+	// is enabled (e.g. ":80", required for autocert); empty disables
+	HTTPRedirectAddr string `json:"http_redirect_addr,omitempty"`
+
+	// AllowRenegotiation lets a codec change in StreamSettings switch
+	// connected browsers over with a server-initiated offer instead of
+	// requiring them to reconnect
+	AllowRenegotiation bool `json:"allow_renegotiation"`
+
+	// MinFECPackets is the minimum number of FEC packets Sunshine sends per
+	// video block (fec.minRequiredFecPackets). 0 keeps FEC adaptive: Sunshine
+	// scales it with reported loss. A non-zero value (e.g. 2 on known lossy
+	// WiFi) always sends that much redundancy, which hides bursts of loss
+	// without waiting for the host to react but costs bandwidth on every frame.
+	MinFECPackets int `json:"min_fec_packets"`
+
+	// MTU is the smallest MTU on the path from Sunshine, e.g. 1420 over
+	// WireGuard. Video packets are sized to fit it; 0 uses a size that fits
+	// most paths. Sunshine may ask for smaller packets still.
+	MTU int `json:"mtu,omitempty"`
+
+	// FirstFrameTimeoutSec is types.StreamConfiguration.FirstFrameTimeout in seconds
+	FirstFrameTimeoutSec int `json:"first_frame_timeout_sec,omitempty"`
+
+	// VideoTrafficTimeoutSec is types.StreamConfiguration.NoVideoTrafficTimeout in seconds
+	VideoTrafficTimeoutSec int `json:"video_traffic_timeout_sec,omitempty"`
+
+	// AudioInitialDropMs discards this much of Sunshine's audio as the
+	// stream starts, skipping the burst it may send at first (default 0, for
+	// the lowest latency; 500 plays steadier from the start)
+	AudioInitialDropMs int `json:"audio_initial_drop_ms,omitempty"`
+
+	// AudioJitterBufferMs is how late an audio packet from Sunshine may
+	// arrive and still be played in order rather than concealed (default 0;
+	// 20-40 suits WiFi). It adds latency only while a packet is late. The
+	// native backend relays audio untouched and ignores both audio settings.
+	AudioJitterBufferMs int `json:"audio_jitter_buffer_ms,omitempty"`
+
+	// StreamRestartAttempts is how many times a stream Sunshine drops with an
+	// error is started again, with backoff, before its session is closed
+	// (default 3; 0 closes the session straight away). Peers stay connected
+	// while it restarts.
+	StreamRestartAttempts int `json:"stream_restart_attempts"`
+
+	// OptimizeGameSettings lets Sunshine switch the host's display to the
+	// stream's resolution and refresh rate while it streams
+	OptimizeGameSettings bool `json:"optimize_game_settings"`
+
+	// PersistGamepads keeps the host's virtual controllers plugged in after
+	// a stream ends, so games don't pause when it restarts
+	PersistGamepads bool `json:"persist_gamepads"`
+
+	// OnSessionConflict is what a launch does when Sunshine is busy with
+	// another session, such as one a previous moonparty left running:
+	// "error" (default) fails it, "cancel" ends the other session and
+	// launches again, "resume" streams the app already running instead
+	OnSessionConflict string `json:"on_session_conflict,omitempty"`
+
+	// RecordInputPath, if set, is a file every session's input is recorded
+	// to, a line of JSON per packet, for reproducing input bugs
+	RecordInputPath string `json:"record_input,omitempty"`
+
+	// ReplayInputPath, if set, is an input recording replayed into every
+	// session once its stream starts
+	ReplayInputPath string `json:"replay_input,omitempty"`
+
 	// StreamSettings holds default streaming quality settings
 	StreamSettings StreamSettings `json:"stream_settings"`
 }
@@ -55,19 +203,136 @@ type StreamSettings struct {
 	// Codec preference: "h264", "h265", "av1"
 	Codec string `json:"codec"`
 
+	// HDR asks Sunshine for a 10-bit HDR stream (HEVC Main10, or AV1 Main10
+	// with codec "av1"). A host that can't encode it streams SDR instead.
+	HDR bool `json:"hdr"`
+
 	// AudioChannels: 2 for stereo, 6 for 5.1
 	AudioChannels int `json:"audio_channels"`
+
+	// AudioBitrate is the Opus target bitrate in kbps offered to browsers;
+	// 0 leaves it to the browser. Above 96 requests high quality audio from Sunshine.
+	// Read at startup, so changes need a restart.
+	AudioBitrate int `json:"audio_bitrate"`
+
+	// AudioFEC enables Opus in-band FEC, useful for lossy (e.g. cellular) links
+	AudioFEC bool `json:"audio_fec"`
+}
+
+// SpectatorVideoSettings is the reduced video spectators are sent. It needs
+// an H.264 stream and moonparty built with -tags ffmpeg, with ffmpeg on the
+// PATH; otherwise spectators get the full video. It is experimental.
+type SpectatorVideoSettings struct {
+	Enabled bool `json:"enabled"`
+	Height  int  `json:"height"`  // Width follows the stream's aspect ratio (default 720)
+	Bitrate int  `json:"bitrate"` // In kbps (default 2500)
+}
+
+// Validate checks the reduced video's size and bitrate
+func (s SpectatorVideoSettings) Validate() error {
+	if err := checkRange("height", s.Height, minStreamDimension, maxStreamDimension); err != nil {
+		return err
+	}
+	return checkRange("bitrate", s.Bitrate, minStreamBitrate, maxStreamBitrate)
+}
+
+// Ranges of the stream settings Sunshine can sensibly encode
+const (
+	minStreamDimension = 256
+	maxStreamDimension = 7680 // 8K
+	minStreamFPS       = 15
+	maxStreamFPS       = 240
+	minStreamBitrate   = 500 // kbps
+	maxStreamBitrate   = 150000
+)
+
+// Validate checks that Sunshine could stream with the settings. The error
+// names the offending field.
+func (s StreamSettings) Validate() error {
+	if err := checkRange("width", s.Width, minStreamDimension, maxStreamDimension); err != nil {
+		return err
+	}
+	if err := checkRange("height", s.Height, minStreamDimension, maxStreamDimension); err != nil {
+		return err
+	}
+	if err := checkRange("fps", s.FPS, minStreamFPS, maxStreamFPS); err != nil {
+		return err
+	}
+	if err := checkRange("bitrate", s.Bitrate, minStreamBitrate, maxStreamBitrate); err != nil {
+		return err
+	}
+	switch s.Codec {
+	case "h264", "h265", "av1":
+	default:
+		return fmt.Errorf("unsupported codec %q", s.Codec)
+	}
+	if s.HDR && s.Codec == "h264" {
+		return fmt.Errorf("hdr needs codec h265 or av1")
+	}
+	if s.AudioBitrate < 0 {
+		return fmt.Errorf("audio bitrate must not be negative, got %d", s.AudioBitrate)
+	}
+	return nil
+}
+
+// migrateReconnectWindow carries a reconnect_window_sec from an older config
+// over to reconnect_grace_seconds, unless the config sets that too. A
+// window of 0 disabled reconnecting, so it still does.
+func migrateReconnectWindow(cfg *Config, data []byte) error {
+	var legacy struct {
+		ReconnectWindowSec    *int `json:"reconnect_window_sec"`
+		ReconnectGraceSeconds *int `json:"reconnect_grace_seconds"`
+	}
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return err
+	}
+	if legacy.ReconnectWindowSec == nil {
+		return nil
+	}
+
+	window := max(*legacy.ReconnectWindowSec, 0)
+	if legacy.ReconnectGraceSeconds == nil || window == 0 {
+		cfg.ReconnectGraceSeconds = window
+	}
+	logging.Warnf("reconnect_window_sec is deprecated; using reconnect_grace_seconds = %d", cfg.ReconnectGraceSeconds)
+	return nil
+}
+
+func checkRange(field string, value, lo, hi int) error {
+	if value < lo || value > hi {
+		return fmt.Errorf("%s must be between %d and %d, got %d", field, lo, hi, value)
+	}
+	return nil
+}
+
+// needsRelaunch reports whether moving from s to next changes what Sunshine
+// encodes, which it only reads at launch. The bitrate alone doesn't: it
+// applies live to the bandwidth checks and reaches Sunshine at the next launch.
+func (s StreamSettings) needsRelaunch(next StreamSettings) bool {
+	return s.Width != next.Width || s.Height != next.Height ||
+		s.FPS != next.FPS || s.Codec != next.Codec || s.HDR != next.HDR
 }
 
 // DefaultConfig returns a configuration with sensible defaults
 func DefaultConfig() *Config {
 	return &Config{
-		ListenAddr:   ":8080",
-		SunshineHost: "localhost",
-		SunshinePort: 47989,
-		MaxPlayers:   4,
+		ListenAddr:            ":8080",
+		SunshineHost:          "localhost",
+		SunshinePort:          47989,
+		UseLimelight:          true,
+		MaxPlayers:            4,
+		SSEEnabled:            true,
+		ReconnectGraceSeconds: 30,
+		AutoLaunchAppID:       -1,
+		PreloadTimeoutMin:     10,
+		StreamRestartAttempts: 3,
+		SpectatorVideo: SpectatorVideoSettings{
+			Height:  720,
+			Bitrate: 2500,
+		},
 		ICEServers: []string{
 			"stun:stun.l.google.com:19302",
+			"stun:stun1.l.google.com:19302",
 		},
 		StreamSettings: StreamSettings{
 			Width:         1920,
@@ -76,6 +341,43 @@ func DefaultConfig() *Config {
 			Bitrate:       20000,
 			Codec:         "h264",
 			AudioChannels: 2,
+			AudioFEC:      true,
 		},
 	}
 }
+
+// LoadConfig reads a JSON config file over the defaults, so settings the
+// file leaves out keep their default values. A missing file isn't an error;
+// the defaults are used as they are.
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+	cfg.ConfigPath = path
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if err := migrateReconnectWindow(cfg, data); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if err := cfg.StreamSettings.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: stream_settings: %w", path, err)
+	}
+	if cfg.SpectatorVideo.Enabled {
+		if err := cfg.SpectatorVideo.Validate(); err != nil {
+			return nil, fmt.Errorf("%s: spectator_video: %w", path, err)
+		}
+	}
+	if _, err := moonlight.ParseSessionConflict(cfg.OnSessionConflict); err != nil {
+		return nil, fmt.Errorf("%s: on_session_conflict: %w", path, err)
+	}
+	cfg.ConfigPath = path
+	return cfg, nil
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigMigratesReconnectWindow(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		json string
+		want int
+	}{
+		{"default", `{}`, 30},
+		{"grace only", `{"reconnect_grace_seconds": 45}`, 45},
+		{"legacy window", `{"reconnect_window_sec": 90}`, 90},
+		{"grace wins over window", `{"reconnect_window_sec": 90, "reconnect_grace_seconds": 20}`, 20},
+		{"legacy window disables", `{"reconnect_window_sec": 0, "reconnect_grace_seconds": 20}`, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(path, []byte(tt.json), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := LoadConfig(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.ReconnectGraceSeconds != tt.want {
+				t.Fatalf("ReconnectGraceSeconds = %d, want %d", cfg.ReconnectGraceSeconds, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigRoundTrip(t *testing.T) {
+	want := DefaultConfig()
+	want.ListenAddr = ":9090"
+	want.SunshineHost = "gaming-pc.lan"
+	want.SunshinePort = 48989
+	want.ICEServers = []string{"stun:stun.example.com:3478", "turn:turn.example.com:3478"}
+	want.TURNUsername = "moonparty"
+	want.TURNCredential = "hunter2"
+	want.MaxPlayers = 2
+	want.StreamSettings.Width = 1280
+	want.StreamSettings.Height = 720
+	want.StreamSettings.FPS = 30
+	want.StreamSettings.Bitrate = 8000
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	want.ConfigPath = path
+	data, err := json.MarshalIndent(want, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("loaded\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	dir := t.TempDir()
+
+	// A missing file is the defaults
+	missing := filepath.Join(dir, "missing.json")
+	got, err := LoadConfig(missing)
+	if err != nil {
+		t.Fatalf("missing file: %v", err)
+	}
+	want := DefaultConfig()
+	want.ConfigPath = missing
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("missing file loaded\n%+v\nwant the defaults", got)
+	}
+
+	// Settings a file leaves out, nested ones too, keep their defaults
+	partial := filepath.Join(dir, "partial.json")
+	if err := os.WriteFile(partial, []byte(`{"max_players": 2, "stream_settings": {"fps": 30}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	got, err = LoadConfig(partial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want.ConfigPath = partial
+	want.MaxPlayers = 2
+	want.StreamSettings.FPS = 30
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("partial file loaded\n%+v\nwant\n%+v", got, want)
+	}
+
+	// A file that isn't JSON is an error, not the defaults
+	broken := filepath.Join(dir, "broken.json")
+	if err := os.WriteFile(broken, []byte(`{"max_players": `), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(broken); err == nil {
+		t.Fatal("loaded a malformed config")
+	}
+}
+
+func TestStreamSettingsValidate(t *testing.T) {
+	tests := []struct {
+		field string
+		set   func(*StreamSettings, int)
+		lo    int
+		hi    int
+	}{
+		{"width", func(s *StreamSettings, v int) { s.Width = v }, 256, 7680},
+		{"height", func(s *StreamSettings, v int) { s.Height = v }, 256, 7680},
+		{"fps", func(s *StreamSettings, v int) { s.FPS = v }, 15, 240},
+		{"bitrate", func(s *StreamSettings, v int) { s.Bitrate = v }, 500, 150000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.field, func(t *testing.T) {
+			for _, v := range []int{tt.lo, tt.hi} {
+				settings := DefaultConfig().StreamSettings
+				tt.set(&settings, v)
+				if err := settings.Validate(); err != nil {
+					t.Errorf("%s %d rejected: %v", tt.field, v, err)
+				}
+			}
+			for _, v := range []int{-1, 0, tt.lo - 1, tt.hi + 1} {
+				settings := DefaultConfig().StreamSettings
+				tt.set(&settings, v)
+				err := settings.Validate()
+				if err == nil {
+					t.Errorf("%s %d accepted", tt.field, v)
+				} else if !strings.HasPrefix(err.Error(), tt.field+" ") {
+					t.Errorf("%s %d rejected with %q, which doesn't name the field", tt.field, v, err)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConfigRejectsInvalidStreamSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"stream_settings": {"width": 0}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(path); err == nil || !strings.Contains(err.Error(), "width") {
+		t.Fatalf("LoadConfig with width 0 = %v, want an error naming width", err)
+	}
+}
+
+func TestStreamSettingsNeedsRelaunch(t *testing.T) {
+	tests := []struct {
+		name string
+		set  func(*StreamSettings)
+		want bool
+	}{
+		{"unchanged", func(*StreamSettings) {}, false},
+		{"width", func(s *StreamSettings) { s.Width = 1280 }, true},
+		{"fps", func(s *StreamSettings) { s.FPS = 30 }, true},
+		{"codec", func(s *StreamSettings) { s.Codec = "av1" }, true},
+		{"hdr", func(s *StreamSettings) { s.HDR = !s.HDR }, true},
+		{"bitrate", func(s *StreamSettings) { s.Bitrate = 5000 }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prev := DefaultConfig().StreamSettings
+			next := prev
+			tt.set(&next)
+			if got := prev.needsRelaunch(next); got != tt.want {
+				t.Errorf("needsRelaunch = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
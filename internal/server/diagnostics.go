@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/zalo/moonparty/internal/moonlight"
+	"github.com/zalo/moonparty/internal/moonlight/limelight"
+	"github.com/zalo/moonparty/internal/webrtc"
+)
+
+// diagnosticsServerInfoTimeout bounds the /serverinfo query made for a report
+const diagnosticsServerInfoTimeout = 5 * time.Second
+
+// redacted replaces secrets in the diagnostics report
+const redacted = "[redacted]"
+
+// handleDiagnostics returns everything a bug report needs in one JSON blob:
+// Sunshine's server info and pairing, and for each session its stream's
+// negotiated settings and counters and every peer's WebRTC state. Secrets
+// are redacted.
+func (s *Server) handleDiagnostics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireHost(w, r) {
+		return
+	}
+
+	sunshine := map[string]interface{}{
+		"host":   s.config.SunshineHost,
+		"port":   s.config.SunshinePort,
+		"paired": s.moonlight.IsPaired(),
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), diagnosticsServerInfoTimeout)
+	defer cancel()
+	if info, err := s.moonlight.GetServerInfo(ctx); err != nil {
+		sunshine["server_info_error"] = err.Error()
+	} else {
+		sunshine["server_info"] = info
+	}
+
+	sessions := make([]map[string]interface{}, 0)
+	for _, sess := range s.sessions.ListSessions() {
+		peers := make([]map[string]interface{}, 0)
+		for _, peer := range sess.GetAllPeers() {
+			var state *webrtc.State
+			if pc := s.webrtc.GetPeerConnection(peer.ID); pc != nil {
+				st := pc.State()
+				state = &st
+			}
+			peers = append(peers, map[string]interface{}{
+				"id":           peer.ID,
+				"role":         peer.Role,
+				"player_slot":  peer.PlayerSlot,
+				"input_only":   peer.InputOnly,
+				"reconnecting": peer.Reconnecting,
+				"webrtc":       state,
+			})
+		}
+		var stream interface{}
+		if d, ok := sess.Stream().(moonlight.DiagnosticsSource); ok {
+			stream = d.Diagnostics()
+		}
+		sessions = append(sessions, map[string]interface{}{
+			"id":                     sess.ID,
+			"room":                   sess.Room,
+			"paused":                 sess.IsPaused(),
+			"stream_restarting":      sess.IsStreamRestarting(),
+			"stream":                 stream,
+			"peers":                  peers,
+			"inputs_dropped":         sess.InputDrops(),
+			"players_bandwidth_kbps": s.playersBandwidth(sess),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(map[string]interface{}{
+		"generated_at":      time.Now().UTC(),
+		"go_version":        runtime.Version(),
+		"limelight_version": limelight.GetLimelightVersion(),
+		"backend":           s.backendName(),
+		"config":            s.redactedConfig(),
+		"sunshine":          sunshine,
+		"sessions":          sessions,
+	})
+}
+
+// backendName names the streaming backend openStream picks
+func (s *Server) backendName() string {
+	switch {
+	case s.config.UsePureGo:
+		return "pure-go"
+	case s.config.UseLimelight:
+		return "limelight"
+	default:
+		return "native"
+	}
+}
+
+// redactedConfig returns a copy of the config safe to paste into a bug report
+func (s *Server) redactedConfig() Config {
+	cfg := *s.config
+	for _, secret := range []*string{&cfg.TURNCredential, &cfg.TURNSecret, &cfg.AuthSecret, &cfg.AuthHostSecret} {
+		if *secret != "" {
+			*secret = redacted
+		}
+	}
+	return cfg
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/zalo/moonparty/moonlight-common-go/logging"
+)
+
+// Server-sent event types
+const (
+	EventSessionCreated    = "session_created"
+	EventPeerJoined        = "peer_joined"
+	EventPeerLeft          = "peer_left"
+	EventStreamStarted     = "stream_started"
+	EventStreamStopped     = "stream_stopped"
+	EventConnectionQuality = "connection_quality"
+	EventPairingState      = "pairing_state"
+	EventSessionPaused     = "session_paused"
+	EventStreamRestarting  = "stream_restarting"
+)
+
+// sseMaxEventsPerSec limits how fast events are written to a single SSE client
+const sseMaxEventsPerSec = 10
+
+// sseClient is a connected server-sent events subscriber
+type sseClient struct {
+	send chan []byte
+}
+
+// handleEvents streams server events to status-only clients as text/event-stream
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// The stream is long-lived, so lift the server-wide write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	client := &sseClient{send: make(chan []byte, 64)}
+	s.addSSEClient(client)
+	defer s.removeSSEClient(client)
+
+	limiter := time.NewTicker(time.Second / sseMaxEventsPerSec)
+	defer limiter.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.ctx.Done():
+			return
+		case event, ok := <-client.send:
+			if !ok {
+				return
+			}
+			if _, err := w.Write(event); err != nil {
+				return
+			}
+			flusher.Flush()
+
+			// Pace writes to the per-client rate limit
+			select {
+			case <-limiter.C:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) addSSEClient(client *sseClient) {
+	s.sseMu.Lock()
+	defer s.sseMu.Unlock()
+
+	s.sseClients = append(s.sseClients, client)
+}
+
+func (s *Server) removeSSEClient(client *sseClient) {
+	s.sseMu.Lock()
+	defer s.sseMu.Unlock()
+
+	for i, c := range s.sseClients {
+		if c == client {
+			s.sseClients = append(s.sseClients[:i], s.sseClients[i+1:]...)
+			return
+		}
+	}
+}
+
+// publishEvent fans an event out to all SSE clients
+func (s *Server) publishEvent(eventType string, data interface{}) {
+	if !s.config.SSEEnabled {
+		return
+	}
+
+	payload, err := json.Marshal(data)
+	if err != nil {
+		logging.Errorf("Failed to encode %s event: %v", eventType, err)
+		return
+	}
+	event := []byte(fmt.Sprintf("event: %s\ndata: %s\n\n", eventType, payload))
+
+	s.sseMu.Lock()
+	defer s.sseMu.Unlock()
+
+	for _, client := range s.sseClients {
+		select {
+		case client.send <- event:
+		default:
+			// Client is too slow, drop the event
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+)
+
+// fingerprintSigner issues and verifies HMAC-signed client fingerprints.
+// A fingerprint binds a browser to the peer ID it was given on first connect
+// so a page refresh can reclaim that peer instead of joining as a stranger.
+type fingerprintSigner struct {
+	key []byte
+}
+
+// newFingerprintSigner creates a signer with a random per-process key
+func newFingerprintSigner() (*fingerprintSigner, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return &fingerprintSigner{key: key}, nil
+}
+
+// Issue returns a signed fingerprint for a peer ID
+func (f *fingerprintSigner) Issue(peerID string) string {
+	id := base64.RawURLEncoding.EncodeToString([]byte(peerID))
+	sig := base64.RawURLEncoding.EncodeToString(f.sign(peerID))
+	return id + "." + sig
+}
+
+// Verify checks a fingerprint and returns the peer ID it was issued for
+func (f *fingerprintSigner) Verify(value string) (string, bool) {
+	id, sig, ok := strings.Cut(value, ".")
+	if !ok {
+		return "", false
+	}
+
+	peerID, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil {
+		return "", false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return "", false
+	}
+
+	if !hmac.Equal(mac, f.sign(string(peerID))) {
+		return "", false
+	}
+	return string(peerID), true
+}
+
+func (f *fingerprintSigner) sign(peerID string) []byte {
+	mac := hmac.New(sha256.New, f.key)
+	mac.Write([]byte(peerID))
+	return mac.Sum(nil)
+}
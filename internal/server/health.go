@@ -0,0 +1,57 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// readiness is the body of /readyz. It's built from state the server
+// already holds, so probes never reach Sunshine.
+type readiness struct {
+	Ready        bool   `json:"ready"`
+	SunshineHost string `json:"sunshine_host"`
+	SunshinePort int    `json:"sunshine_port"`
+	Paired       bool   `json:"paired"`
+	Pairing      bool   `json:"pairing,omitempty"`
+	PairingError string `json:"pairing_error,omitempty"`
+}
+
+// handleHealthz answers liveness probes: 200 for as long as the server is
+// serving
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz answers readiness probes: 200 once paired with Sunshine, so
+// sessions can stream, and 503 until then
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.pairingMu.Lock()
+	status := s.pairing
+	s.pairingMu.Unlock()
+
+	ready := readiness{
+		SunshineHost: s.config.SunshineHost,
+		SunshinePort: s.config.SunshinePort,
+		Paired:       s.moonlight.IsPaired(),
+		Pairing:      status.Pairing,
+		PairingError: status.Error,
+	}
+	ready.Ready = ready.Paired
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !ready.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(ready)
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/zalo/moonparty/internal/moonlight"
+	"github.com/zalo/moonparty/moonlight-common-go/logging"
+)
+
+// pairingStatus is what the host is shown of pairing with Sunshine. The PIN
+// is only served to the host, never in events.
+type pairingStatus struct {
+	Paired  bool   `json:"paired"`
+	Pairing bool   `json:"pairing"`
+	PIN     string `json:"pin,omitempty"`
+	Phase   int    `json:"phase,omitempty"`
+	Error   string `json:"error,omitempty"`
+
+	// PINTimeout is set when pairing failed because the PIN wasn't entered
+	// in Sunshine in time, rather than because Sunshine couldn't be reached
+	PINTimeout bool `json:"pin_timeout,omitempty"`
+}
+
+// pairingCallbacks follow the Moonlight client's pairing so the host can
+// be shown the PIN in the browser instead of reading it from the log
+func (s *Server) pairingCallbacks() moonlight.PairingCallbacks {
+	return moonlight.PairingCallbacks{
+		OnPINGenerated: func(pin string) {
+			logging.Infof("Pairing with Sunshine: enter PIN %s in Sunshine's web UI", pin)
+			s.setPairingStatus(pairingStatus{Pairing: true, PIN: pin})
+		},
+		OnPhase: func(phase int) {
+			s.pairingMu.Lock()
+			s.pairing.Phase = phase
+			s.pairingMu.Unlock()
+			s.publishEvent(EventPairingState, map[string]interface{}{
+				"paired":  false,
+				"pairing": true,
+				"phase":   phase,
+			})
+		},
+		OnResult: func(err error) {
+			status := pairingStatus{}
+			if err != nil {
+				status.Error = err.Error()
+				status.PINTimeout = errors.Is(err, moonlight.ErrPINTimeout)
+			} else {
+				logging.Infof("Paired with Sunshine")
+			}
+			s.setPairingStatus(status)
+		},
+	}
+}
+
+// setPairingStatus records the pairing's progress
+func (s *Server) setPairingStatus(status pairingStatus) {
+	s.pairingMu.Lock()
+	defer s.pairingMu.Unlock()
+	s.pairing = status
+}
+
+// handlePairing shows the host the state of pairing with Sunshine,
+// including the PIN to enter while one is waiting
+func (s *Server) handlePairing(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireHost(w, r) {
+		return
+	}
+
+	s.pairingMu.Lock()
+	status := s.pairing
+	s.pairingMu.Unlock()
+	status.Paired = s.moonlight.IsPaired()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleStreamError reacts to a stream that failed to open. A certificate
+// Sunshine no longer accepts starts a re-pair instead of leaving the host
+// with a launch error.
+func (s *Server) handleStreamError(err error) {
+	if !errors.Is(err, moonlight.ErrNeedsRepair) {
+		return
+	}
+	s.publishEvent(EventPairingState, map[string]interface{}{
+		"paired":       false,
+		"needs_repair": true,
+		"error":        err.Error(),
+	})
+	s.startRepair()
+}
+
+// startRepair pairs with Sunshine again in the background, reporting the
+// outcome as a pairing_state event. It returns false if a re-pair is
+// already waiting for its PIN.
+func (s *Server) startRepair() bool {
+	if !s.repairing.CompareAndSwap(false, true) {
+		return false
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer s.repairing.Store(false)
+
+		if err := s.moonlight.Repair(s.ctx); err != nil {
+			logging.Errorf("Re-pairing with Sunshine failed: %v", err)
+			s.publishEvent(EventPairingState, map[string]interface{}{
+				"paired":       false,
+				"needs_repair": true,
+				"error":        err.Error(),
+			})
+			return
+		}
+		s.publishEvent(EventPairingState, map[string]interface{}{
+			"paired": true,
+		})
+	}()
+	return true
+}
+
+// handleRepair lets the host start a re-pair, e.g. from a "re-pair required" prompt
+func (s *Server) handleRepair(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireHost(w, r) {
+		return
+	}
+
+	if !s.startRepair() {
+		http.Error(w, "Pairing already in progress", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "pairing",
+	})
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/zalo/moonparty/internal/moonlight"
+	"github.com/zalo/moonparty/moonlight-common-go/logging"
+)
+
+// preloader holds the stream auto-launched before any client connects (see
+// AutoLaunchAppID) until the first default-room session claims it.
+//
+// The launch and that first session are serialized so the app is never
+// launched twice: a session starting while the launch is in flight waits
+// for its stream, and a launch that would begin after a session has started
+// is skipped.
+type preloader struct {
+	mu        sync.Mutex
+	stream    moonlight.Streamer
+	timer     *time.Timer
+	launching chan struct{} // Closed once the launch in flight finishes
+	claimed   bool          // A session has started; too late to launch
+}
+
+// launch opens the stream with open, unless a session has already started
+// or a launch already ran. A stream nobody claims within timeout is closed;
+// 0 keeps it until claimed.
+func (p *preloader) launch(open func() (moonlight.Streamer, error), timeout time.Duration) error {
+	p.mu.Lock()
+	if p.claimed || p.launching != nil {
+		p.mu.Unlock()
+		return nil
+	}
+	done := make(chan struct{})
+	p.launching = done
+	p.mu.Unlock()
+	defer close(done)
+
+	stream, err := open()
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.stream = stream
+	if timeout > 0 {
+		p.timer = time.AfterFunc(timeout, func() {
+			if stream := p.take(); stream != nil {
+				logging.Infof("No client connected within %v, quitting preloaded app", timeout)
+				stream.Quit()
+			}
+		})
+	}
+	return nil
+}
+
+// claim waits for a launch in flight to finish and hands over its stream,
+// or nil if there is none. No launch starts after a claim.
+func (p *preloader) claim(ctx context.Context) (moonlight.Streamer, error) {
+	p.mu.Lock()
+	p.claimed = true
+	done := p.launching
+	p.mu.Unlock()
+
+	if done != nil {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return p.take(), nil
+}
+
+// pending reports whether a preloaded stream is launching or waiting for
+// the default room
+func (p *preloader) pending() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.stream != nil {
+		return true
+	}
+	if p.launching == nil {
+		return false
+	}
+	select {
+	case <-p.launching:
+		return false
+	default:
+		return true
+	}
+}
+
+// take hands over the preloaded stream, if any, exactly once
+func (p *preloader) take() moonlight.Streamer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stream := p.stream
+	p.stream = nil
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	return stream
+}
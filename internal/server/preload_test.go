@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zalo/moonparty/internal/moonlight"
+)
+
+// fakeStream is a stream that only records being closed
+type fakeStream struct {
+	closed atomic.Bool
+}
+
+func (f *fakeStream) VideoFrames() <-chan []byte      { return nil }
+func (f *fakeStream) AudioSamples() <-chan []byte     { return nil }
+func (f *fakeStream) SendInput(moonlight.InputPacket) {}
+func (f *fakeStream) Close() error                    { f.closed.Store(true); return nil }
+func (f *fakeStream) Quit() error                     { return f.Close() }
+
+func TestPreloadClaimWaitsForLaunch(t *testing.T) {
+	var p preloader
+	stream := &fakeStream{}
+	var opens atomic.Int32
+	release := make(chan struct{})
+
+	launched := make(chan error, 1)
+	go func() {
+		launched <- p.launch(func() (moonlight.Streamer, error) {
+			opens.Add(1)
+			<-release
+			return stream, nil
+		}, 0)
+	}()
+	for opens.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// A session starting mid-launch waits for the launch's stream
+	claimed := make(chan moonlight.Streamer, 1)
+	go func() {
+		got, err := p.claim(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		claimed <- got
+	}()
+	select {
+	case <-claimed:
+		t.Fatal("claim returned while the launch was in flight")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if !p.pending() {
+		t.Error("launch in flight not reported as pending")
+	}
+
+	close(release)
+	if err := <-launched; err != nil {
+		t.Fatal(err)
+	}
+	if got := <-claimed; got != stream {
+		t.Fatalf("claimed %v, want the launched stream", got)
+	}
+
+	// Nothing launches again
+	p.launch(func() (moonlight.Streamer, error) {
+		opens.Add(1)
+		return &fakeStream{}, nil
+	}, 0)
+	if n := opens.Load(); n != 1 {
+		t.Fatalf("launched %d times, want 1", n)
+	}
+}
+
+func TestPreloadSkippedAfterClaim(t *testing.T) {
+	var p preloader
+	if got, err := p.claim(context.Background()); got != nil || err != nil {
+		t.Fatalf("claim with nothing preloaded = %v, %v", got, err)
+	}
+
+	err := p.launch(func() (moonlight.Streamer, error) {
+		t.Error("launched after a session started")
+		return &fakeStream{}, nil
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.pending() {
+		t.Error("pending after a skipped launch")
+	}
+}
+
+func TestPreloadClaimCanceled(t *testing.T) {
+	var p preloader
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	go p.launch(func() (moonlight.Streamer, error) {
+		close(started)
+		<-release
+		return &fakeStream{}, nil
+	}, 0)
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := p.claim(ctx); err != context.Canceled {
+		t.Fatalf("claim with a canceled context = %v, want context.Canceled", err)
+	}
+}
+
+func TestPreloadTimeout(t *testing.T) {
+	var p preloader
+	stream := &fakeStream{}
+	if err := p.launch(func() (moonlight.Streamer, error) { return stream, nil }, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !stream.closed.Load() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !stream.closed.Load() {
+		t.Fatal("unclaimed preloaded stream not closed after its timeout")
+	}
+	if got := p.take(); got != nil {
+		t.Fatalf("took %v after the timeout, want nil", got)
+	}
+}
@@ -3,28 +3,62 @@ package server
 import (
 	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/zalo/moonparty/internal/middleware"
 	"github.com/zalo/moonparty/internal/moonlight"
+	"github.com/zalo/moonparty/internal/moonlight/limelight"
 	"github.com/zalo/moonparty/internal/session"
 	"github.com/zalo/moonparty/internal/webrtc"
+	"github.com/zalo/moonparty/moonlight-common-go/logging"
+	"github.com/zalo/moonparty/moonlight-common-go/types"
 )
 
 // Server is the main Moonparty server
 type Server struct {
 	config     *Config
+	settingsMu sync.RWMutex // Guards config.StreamSettings; see streamSettings
 	httpServer *http.Server
-	sessions   *session.Manager
-	webrtc     *webrtc.Manager
-	moonlight  *moonlight.Client
-	ctx        context.Context
-	cancel     context.CancelFunc
-	wg         sync.WaitGroup
+	// Plain-HTTP listener redirecting to HTTPS (nil unless TLS is enabled)
+	redirectServer *http.Server
+	sessions       *session.Manager
+	webrtc         *webrtc.Manager
+	moonlight      *moonlight.Client
+	fingerprints   *fingerprintSigner
+	auth           Authenticator
+	ctx            context.Context
+	cancel         context.CancelFunc
+	wg             sync.WaitGroup
+
+	// repairing is set while a re-pair waits for its PIN
+	repairing atomic.Bool
+
+	// Progress of the current or last pairing with Sunshine
+	pairingMu sync.Mutex
+	pairing   pairingStatus
+
+	sseMu      sync.Mutex
+	sseClients []*sseClient
+
+	// Connected WebSocket clients, by peer ID
+	wsMu      sync.Mutex
+	wsClients map[string]*wsClient
+
+	// Stream launched ahead of the first client (see AutoLaunchAppID)
+	preload preloader
+
+	// Recording of session input (nil unless RecordInputPath is set)
+	inputRecorder *session.InputRecorder
 }
 
 // New creates a new Moonparty server
@@ -33,32 +67,67 @@ func New(cfg *Config) (*Server, error) {
 
 	// Initialize Moonlight client
 	mlClient := moonlight.NewClient(cfg.SunshineHost, cfg.SunshinePort)
+	mlClient.SetIdentityDir(cfg.IdentityDir)
 
 	// Delete existing identity if requested (useful when pairing is stuck)
 	if cfg.ForceNewIdentity {
-		log.Println("Forcing new client identity generation...")
+		logging.Infof("Forcing new client identity generation...")
 		mlClient.DeleteIdentity()
 	}
 
 	// Initialize WebRTC manager
-	webrtcMgr, err := webrtc.NewManager(cfg.ICEServers, cfg.TURNUsername, cfg.TURNCredential)
+	webrtcMgr, err := webrtc.NewManager(iceConfig(cfg),
+		cfg.StreamSettings.Bitrate,
+		webrtc.AudioConfig{
+			BitrateKbps: cfg.StreamSettings.AudioBitrate,
+			FEC:         cfg.StreamSettings.AudioFEC,
+		})
 	if err != nil {
 		cancel()
 		return nil, err
 	}
 
 	// Initialize session manager
-	sessionMgr := session.NewManager(cfg.MaxPlayers)
+	sessionMgr := session.NewManager(cfg.MaxPlayers, cfg.MaxSpectators)
+
+	fingerprints, err := newFingerprintSigner()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	auth, err := newAuthenticator(cfg)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	var recorder *session.InputRecorder
+	if cfg.RecordInputPath != "" {
+		recorder, err = session.CreateInputRecorder(cfg.RecordInputPath)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		sessionMgr.SetInputRecorder(recorder)
+		logging.Infof("Recording input to %s", cfg.RecordInputPath)
+	}
 
 	s := &Server{
-		config:    cfg,
-		sessions:  sessionMgr,
-		webrtc:    webrtcMgr,
-		moonlight: mlClient,
-		ctx:       ctx,
-		cancel:    cancel,
+		config:        cfg,
+		sessions:      sessionMgr,
+		webrtc:        webrtcMgr,
+		moonlight:     mlClient,
+		fingerprints:  fingerprints,
+		auth:          auth,
+		wsClients:     make(map[string]*wsClient),
+		inputRecorder: recorder,
+		ctx:           ctx,
+		cancel:        cancel,
 	}
 
+	mlClient.SetPairingCallbacks(s.pairingCallbacks())
+
 	// Setup HTTP routes
 	mux := http.NewServeMux()
 	s.setupRoutes(mux)
@@ -80,18 +149,34 @@ func (s *Server) setupRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("/api/session/join", s.handleJoinSession)
 	mux.HandleFunc("/api/session/status", s.handleSessionStatus)
 	mux.HandleFunc("/api/session/leave", s.handleLeaveSession)
+	mux.HandleFunc("/api/sessions/history", s.handleSessionHistory)
+	mux.HandleFunc("/api/peers", s.handlePeers)
 	mux.HandleFunc("/api/player/promote", s.handlePromotePlayer)
 	mux.HandleFunc("/api/player/keyboard", s.handleToggleKeyboard)
+	mux.HandleFunc("/api/player/kick", s.handleKickPlayer)
 	mux.HandleFunc("/api/settings", s.handleSettings)
+	mux.HandleFunc("/api/stream/config", s.handleStreamConfig)
 	mux.HandleFunc("/api/ice-servers", s.handleICEServers)
+	mux.HandleFunc("/api/apps", s.handleApps)
+	mux.HandleFunc("/api/apps/{id}/boxart", s.handleBoxArt)
+	mux.HandleFunc("/api/capabilities", s.handleCapabilities)
+	mux.HandleFunc("/api/stats", s.handleStats)
+	mux.HandleFunc("/api/diagnostics", s.handleDiagnostics)
+	mux.HandleFunc("/api/sunshine/repair", s.handleRepair)
+	mux.HandleFunc("/api/sunshine/pairing", s.handlePairing)
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	if s.config.SSEEnabled {
+		mux.HandleFunc("/api/events", s.handleEvents)
+	}
 
 	// WebSocket for WebRTC signaling
 	mux.HandleFunc("/ws", s.handleWebSocket)
 
 	// Serve static files from filesystem
 	staticDir := findStaticDir()
-	log.Printf("Serving static files from: %s", staticDir)
-	mux.Handle("/", http.FileServer(http.Dir(staticDir)))
+	logging.Infof("Serving static files from: %s", staticDir)
+	mux.Handle("/", middleware.SecurityHeaders(http.FileServer(http.Dir(staticDir)), s.config.CSPNonce))
 }
 
 // findStaticDir locates the web/static directory
@@ -129,13 +214,56 @@ func (s *Server) Run() error {
 	go func() {
 		defer s.wg.Done()
 		if err := s.moonlight.Connect(s.ctx); err != nil {
-			log.Printf("Warning: Could not connect to Sunshine: %v", err)
-			log.Println("You may need to pair with Sunshine first")
+			logging.Warnf("Could not connect to Sunshine: %v", err)
+			logging.Infof("You may need to pair with Sunshine first")
+			s.setPairingStatus(pairingStatus{Error: err.Error()})
+			s.publishEvent(EventPairingState, map[string]interface{}{
+				"paired": false,
+				"error":  err.Error(),
+			})
+			return
+		}
+		s.publishEvent(EventPairingState, map[string]interface{}{
+			"paired": s.moonlight.IsPaired(),
+		})
+
+		if s.config.AutoLaunchAppID >= 0 && s.moonlight.IsPaired() {
+			s.preloadStream()
 		}
 	}()
 
-	log.Printf("Server listening on %s", s.config.ListenAddr)
-	return s.httpServer.ListenAndServe()
+	s.wg.Add(1)
+	go s.sweepDeparted()
+
+	return s.listenAndServe()
+}
+
+// departedSweepInterval is how often peers gone past the reconnect window
+// are forgotten
+const departedSweepInterval = time.Minute
+
+// sweepDeparted forgets peers that left longer ago than the reconnect
+// grace window, so long sessions don't keep every peer that ever left. Held peers
+// expire on their own when their grace window ends.
+func (s *Server) sweepDeparted() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(departedSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			window := time.Duration(s.config.ReconnectGraceSeconds) * time.Second
+			for _, sess := range s.sessions.ListSessions() {
+				if n := sess.ExpireDeparted(window); n > 0 {
+					logging.Infof("Session %s: forgot %d departed peers", sess.ID, n)
+				}
+			}
+		}
+	}
 }
 
 // Shutdown gracefully shuts down the server
@@ -146,12 +274,27 @@ func (s *Server) Shutdown() {
 	defer cancel()
 
 	if err := s.httpServer.Shutdown(ctx); err != nil {
-		log.Printf("HTTP server shutdown error: %v", err)
+		logging.Errorf("HTTP server shutdown error: %v", err)
+	}
+	if s.redirectServer != nil {
+		if err := s.redirectServer.Shutdown(ctx); err != nil {
+			logging.Errorf("HTTP redirect server shutdown error: %v", err)
+		}
 	}
 
+	// The launch in flight, if any, ends with s.ctx
+	if stream, _ := s.preload.claim(ctx); stream != nil {
+		stream.Quit()
+	}
 	s.sessions.CloseAll()
 	s.webrtc.CloseAll()
 	s.wg.Wait()
+
+	if s.inputRecorder != nil {
+		if err := s.inputRecorder.Close(); err != nil {
+			logging.Errorf("Input recording close error: %v", err)
+		}
+	}
 }
 
 // API Handlers
@@ -161,14 +304,37 @@ func (s *Server) handleStartSession(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	// Starting a session launches an app on the host, which only the host may do
+	if !s.requireHost(w, r) {
+		return
+	}
+
+	// The body is optional; without an app_id the default app launches,
+	// and without a room the session runs in the default room
+	var req struct {
+		AppID *int   `json:"app_id"`
+		Room  string `json:"room"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	appID := -1
+	if req.AppID != nil {
+		if *req.AppID < 0 {
+			http.Error(w, "Invalid app ID", http.StatusBadRequest)
+			return
+		}
+		appID = *req.AppID
+	}
 
-	// Check if there's already an active session
-	if s.sessions.HasActiveSession() {
+	// Check if there's already an active session in the room
+	if sess := s.sessions.GetActiveSession(req.Room); sess != nil {
 		// Return existing session info for joining
-		sess := s.sessions.GetActiveSession()
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"status":     "existing",
 			"session_id": sess.ID,
+			"room":       sess.Room,
 			"players":    sess.GetPlayerCount(),
 			"spectators": sess.GetSpectatorCount(),
 		})
@@ -176,29 +342,63 @@ func (s *Server) handleStartSession(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Start a new streaming session
-	sess, err := s.sessions.CreateSession()
+	sess, err := s.startSession(req.Room, appID)
+	if errors.Is(err, session.ErrInvalidRoom) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":     "created",
+		"session_id": sess.ID,
+		"room":       sess.Room,
+	})
+}
+
+// startSession creates a session in a room and starts streaming appID to it
+// (see startStreaming). Only the native backend can stream to several rooms
+// at once: the limelight backend's callbacks are process-wide, and the
+// pure-Go client binds fixed UDP ports for its media.
+func (s *Server) startSession(room string, appID int) (*session.Session, error) {
+	if s.backendName() != "native" && (len(s.sessions.ListSessions()) > 0 || room != session.DefaultRoom && s.preload.pending()) {
+		return nil, fmt.Errorf("the %s backend streams one session at a time; use the native backend for several rooms", s.backendName())
+	}
+
+	sess, err := s.sessions.CreateSession(room)
+	if err != nil {
+		return nil, err
+	}
+
 	// Start streaming from Sunshine
 	streamCtx, streamCancel := context.WithCancel(s.ctx)
 	sess.SetCancelFunc(streamCancel)
 
+	s.watchSession(sess)
+	s.publishEvent(EventSessionCreated, map[string]interface{}{
+		"session_id": sess.ID,
+		"room":       sess.Room,
+	})
+
 	s.wg.Add(1)
 	go func() {
 		defer s.wg.Done()
-		if err := s.startStreaming(streamCtx, sess); err != nil {
-			log.Printf("Streaming error: %v", err)
+		if err := s.startStreaming(streamCtx, sess, appID); err != nil {
+			logging.Errorf("Streaming error: %v", err)
+			s.handleStreamError(err)
 		}
 	}()
+	return sess, nil
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status":     "created",
-		"session_id": sess.ID,
-	})
+// requestRoom returns the room a request names in its "room" query
+// parameter, or the default room
+func requestRoom(r *http.Request) string {
+	return r.URL.Query().Get("room")
 }
 
 func (s *Server) handleJoinSession(w http.ResponseWriter, r *http.Request) {
@@ -207,7 +407,12 @@ func (s *Server) handleJoinSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sess := s.sessions.GetActiveSession()
+	identity, _, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	sess := s.sessions.GetActiveSession(requestRoom(r))
 	if sess == nil {
 		http.Error(w, "No active session", http.StatusNotFound)
 		return
@@ -224,10 +429,24 @@ func (s *Server) handleJoinSession(w http.ResponseWriter, r *http.Request) {
 
 	// Add as spectator by default
 	peer, err := sess.AddSpectator(req.Name)
+	var full *session.SpectatorsFullError
+	if errors.As(err, &full) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":          "full",
+			"code":            "session_full",
+			"spectators":      full.Spectators,
+			"max_spectators":  full.MaxSpectators,
+			"retry_after_sec": int(waitingRoomPollInterval / time.Second),
+		})
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	sess.SetPeerIdentity(peer.ID, identity)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -241,7 +460,7 @@ func (s *Server) handleJoinSession(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleSessionStatus(w http.ResponseWriter, r *http.Request) {
-	sess := s.sessions.GetActiveSession()
+	sess := s.sessions.GetActiveSession(requestRoom(r))
 	if sess == nil {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
@@ -254,6 +473,7 @@ func (s *Server) handleSessionStatus(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"active":     true,
 		"session_id": sess.ID,
+		"room":       sess.Room,
 		"players":    sess.GetPlayers(),
 		"spectators": sess.GetSpectatorCount(),
 		"host":       sess.GetHost(),
@@ -274,19 +494,15 @@ func (s *Server) handleLeaveSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sess := s.sessions.GetActiveSession()
+	sess := s.sessions.GetActiveSession(requestRoom(r))
 	if sess == nil {
 		http.Error(w, "No active session", http.StatusNotFound)
 		return
 	}
 
+	// If the host left, OnHostLost closes the session
 	sess.RemovePeer(req.PeerID)
 
-	// If host left, close the session
-	if sess.GetHost() == nil || sess.GetHost().ID == req.PeerID {
-		s.sessions.CloseSession(sess.ID)
-	}
-
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"status": "left",
@@ -298,6 +514,9 @@ func (s *Server) handlePromotePlayer(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	if !s.requireHost(w, r) {
+		return
+	}
 
 	var req struct {
 		PeerID string `json:"peer_id"`
@@ -307,13 +526,26 @@ func (s *Server) handlePromotePlayer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sess := s.sessions.GetActiveSession()
+	sess := s.sessions.GetActiveSession(requestRoom(r))
 	if sess == nil {
 		http.Error(w, "No active session", http.StatusNotFound)
 		return
 	}
 
 	slot, err := sess.PromoteToPlayer(req.PeerID)
+	var full *session.SlotsFullError
+	if errors.As(err, &full) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":         "queued",
+			"code":           "slots_full",
+			"players":        full.Players,
+			"max_players":    full.MaxPlayers,
+			"queue_position": full.QueuePosition,
+		})
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -332,6 +564,9 @@ func (s *Server) handleToggleKeyboard(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	if !s.requireHost(w, r) {
+		return
+	}
 
 	var req struct {
 		PeerID  string `json:"peer_id"`
@@ -342,7 +577,7 @@ func (s *Server) handleToggleKeyboard(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sess := s.sessions.GetActiveSession()
+	sess := s.sessions.GetActiveSession(requestRoom(r))
 	if sess == nil {
 		http.Error(w, "No active session", http.StatusNotFound)
 		return
@@ -350,6 +585,11 @@ func (s *Server) handleToggleKeyboard(w http.ResponseWriter, r *http.Request) {
 
 	sess.SetKeyboardEnabled(req.PeerID, req.Enabled)
 
+	// Taking the keyboard from its owner hands it back to the host
+	if peer := sess.GetPeer(req.PeerID); peer != nil {
+		s.broadcastSessionUpdate(sess, WSMsgSessionInfo, peer)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"status":  "updated",
@@ -357,32 +597,284 @@ func (s *Server) handleToggleKeyboard(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func (s *Server) handleKickPlayer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.requireHost(w, r) {
+		return
+	}
+
+	var req struct {
+		RequesterID string `json:"requester_id"`
+		PeerID      string `json:"peer_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	sess := s.sessions.GetActiveSession(requestRoom(r))
+	if sess == nil {
+		http.Error(w, "No active session", http.StatusNotFound)
+		return
+	}
+
+	err := s.kickPeer(sess, req.RequesterID, req.PeerID)
+	if errors.Is(err, session.ErrNotHost) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":  "kicked",
+		"peer_id": req.PeerID,
+	})
+}
+
+// streamSettings returns a snapshot of the stream settings, which
+// handleSettings may replace at any time
+func (s *Server) streamSettings() StreamSettings {
+	s.settingsMu.RLock()
+	defer s.settingsMu.RUnlock()
+	return s.config.StreamSettings
+}
+
+// handleSettings reads or changes the stream settings. Settings a POST
+// leaves out keep their current values. Sunshine reads resolution and frame
+// rate only at launch, so changing either relaunches each running stream:
+// peers keep their WebRTC connections, see the stream restarting, and pick
+// the new stream up at its first keyframe, which browsers decode at whatever
+// resolution it carries. A bitrate change reaches Sunshine, and the players'
+// bandwidth checks, at each stream's next launch. A codec change
+// renegotiates peers' video tracks instead.
 func (s *Server) handleSettings(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(s.config.StreamSettings)
+		json.NewEncoder(w).Encode(s.streamSettings())
 	case http.MethodPost:
-		var settings StreamSettings
+		if !s.requireHost(w, r) {
+			return
+		}
+		s.settingsMu.Lock()
+		prev := s.config.StreamSettings
+		settings := prev
 		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			s.settingsMu.Unlock()
 			http.Error(w, "Invalid settings", http.StatusBadRequest)
 			return
 		}
+		if err := settings.Validate(); err != nil {
+			s.settingsMu.Unlock()
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		s.config.StreamSettings = settings
+		s.settingsMu.Unlock()
+
+		if settings.Codec != prev.Codec && s.config.AllowRenegotiation {
+			logging.Infof("Video codec changed from %s to %s, renegotiating peers", prev.Codec, settings.Codec)
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.webrtc.RenegotiateVideo(webrtc.VideoFormat(settings.Codec))
+			}()
+		}
+
+		relaunching := 0
+		if prev.needsRelaunch(settings) {
+			for _, sess := range s.sessions.ListSessions() {
+				if sess.Stream() != nil {
+					sess.RequestRelaunch()
+					relaunching++
+				}
+			}
+			logging.Infof("Stream settings changed to %dx%d@%dfps %d kbps, relaunching %d streams",
+				settings.Width, settings.Height, settings.FPS, settings.Bitrate, relaunching)
+		} else if settings.Bitrate != prev.Bitrate {
+			logging.Infof("Stream bitrate changed from %d to %d kbps for the next launch", prev.Bitrate, settings.Bitrate)
+		}
+
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"status": "updated"})
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":      "updated",
+			"relaunching": relaunching,
+		})
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
+func (s *Server) handlePeers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sess := s.sessions.GetActiveSession(requestRoom(r))
+	if sess == nil {
+		http.Error(w, "No active session", http.StatusNotFound)
+		return
+	}
+
+	peers := make([]map[string]interface{}, 0)
+	for _, peer := range sess.GetAllPeers() {
+		videoPaused := false
+		if pc := s.webrtc.GetPeerConnection(peer.ID); pc != nil {
+			videoPaused = pc.VideoPaused()
+		}
+		peers = append(peers, map[string]interface{}{
+			"id":           peer.ID,
+			"name":         peer.Name,
+			"role":         peer.Role,
+			"player_slot":  peer.PlayerSlot,
+			"input_only":   peer.InputOnly,
+			"reconnecting": peer.Reconnecting,
+			"video_paused": videoPaused,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"session_id": sess.ID,
+		"peers":      peers,
+	})
+}
+
+func (s *Server) handleSessionHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.sessions.History())
+}
+
+func (s *Server) handleStreamConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fecMode := "adaptive"
+	if s.config.MinFECPackets > 0 {
+		fecMode = "fixed"
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"stream_settings": s.streamSettings(),
+		"use_limelight":   s.config.UseLimelight,
+		"fec_mode":        fecMode,
+		"min_fec_packets": s.config.MinFECPackets,
+	})
+}
+
+func (s *Server) handleApps(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	apps, err := s.moonlight.GetApps(r.Context())
+	if err != nil {
+		logging.Warnf("App list: %v", err)
+		http.Error(w, "Failed to fetch app list", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"apps": apps,
+	})
+}
+
+func (s *Server) handleBoxArt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	appID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid app ID", http.StatusBadRequest)
+		return
+	}
+
+	data, contentType, err := s.moonlight.GetBoxArt(r.Context(), appID)
+	if errors.Is(err, moonlight.ErrNoBoxArt) {
+		http.Error(w, "No box art", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logging.Warnf("Box art for app %d: %v", appID, err)
+		http.Error(w, "Failed to fetch box art", http.StatusBadGateway)
+		return
+	}
+
+	// Artwork rarely changes, so let browsers hold on to it
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(data)
+}
+
+func (s *Server) handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"limelight_version": limelight.GetLimelightVersion(),
+		"go_version":        runtime.Version(),
+		"video_codecs":      limelight.GetLimelightCapabilities(),
+		"audio_codecs":      []string{"opus"},
+		"features":          limelight.GetLimelightFeatures(),
+	})
+}
+
+// iceConfig gathers the config's STUN/TURN settings
+func iceConfig(cfg *Config) webrtc.ICEConfig {
+	return webrtc.ICEConfig{
+		URLs:       cfg.ICEServers,
+		Username:   cfg.TURNUsername,
+		Credential: cfg.TURNCredential,
+		Secret:     cfg.TURNSecret,
+		TTL:        time.Duration(cfg.TURNCredentialTTLSec) * time.Second,
+	}
+}
+
+// handleICEServers gives the browser its STUN/TURN servers. With a TURN
+// secret configured the credentials are issued for this caller and expire,
+// so only callers who may join get them.
 func (s *Server) handleICEServers(w http.ResponseWriter, r *http.Request) {
+	user := "moonparty"
+	if s.config.TURNSecret != "" {
+		identity, _, ok := s.authenticate(w, r)
+		if !ok {
+			return
+		}
+		if identity != "" {
+			user = identity
+		}
+	}
+
 	servers := make([]map[string]interface{}, 0)
-	for _, url := range s.config.ICEServers {
-		server := map[string]interface{}{"urls": url}
-		if s.config.TURNUsername != "" {
-			server["username"] = s.config.TURNUsername
-			server["credential"] = s.config.TURNCredential
+	for _, ice := range iceConfig(s.config).Servers(user) {
+		server := map[string]interface{}{"urls": ice.URLs[0]}
+		if ice.Username != "" {
+			server["username"] = ice.Username
+			server["credential"] = ice.Credential
 		}
 		servers = append(servers, server)
 	}
@@ -391,32 +883,401 @@ func (s *Server) handleICEServers(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(servers)
 }
 
-// startStreaming initiates the video stream from Sunshine
-func (s *Server) startStreaming(ctx context.Context, sess *session.Session) error {
-	var stream moonlight.Streamer
-	var err error
+// watchSession hooks session events that need to reach peers
+func (s *Server) watchSession(sess *session.Session) {
+	// Peers waiting in the player queue are promoted when a slot frees up;
+	// tell them over their control channel since they didn't ask just now
+	sess.OnRoleChanged(func(peer *session.Peer, role session.Role) {
+		s.broadcastSessionUpdate(sess, WSMsgSessionInfo, peer)
+		if role != session.RolePlayer {
+			return
+		}
+		pc := s.webrtc.GetPeerConnection(peer.ID)
+		if pc == nil {
+			return
+		}
+		data, err := json.Marshal(map[string]interface{}{
+			"type": "player_slot",
+			"slot": peer.PlayerSlot,
+		})
+		if err != nil {
+			return
+		}
+		pc.SendControl(data)
+	})
+
+	// A host disconnect pauses input rather than ending everyone's session;
+	// tell peers so they can show it
+	sess.OnPausedChanged(func(paused bool) {
+		data, err := json.Marshal(map[string]interface{}{
+			"type":   "session_paused",
+			"paused": paused,
+		})
+		if err != nil {
+			return
+		}
+		for _, peer := range sess.GetAllPeers() {
+			if pc := s.webrtc.GetPeerConnection(peer.ID); pc != nil {
+				pc.SendControl(data)
+			}
+		}
+
+		s.publishEvent(EventSessionPaused, map[string]interface{}{
+			"session_id": sess.ID,
+			"paused":     paused,
+		})
+	})
+
+	// A stream Sunshine dropped is restarted behind the peers' backs; tell
+	// them so they can show why the picture froze
+	sess.OnStreamRestarting(func(restarting bool) {
+		data, err := json.Marshal(map[string]interface{}{
+			"type":       "stream_restarting",
+			"restarting": restarting,
+		})
+		if err != nil {
+			return
+		}
+		for _, peer := range sess.GetAllPeers() {
+			if pc := s.webrtc.GetPeerConnection(peer.ID); pc != nil {
+				pc.SendControl(data)
+			}
+		}
+
+		s.publishEvent(EventStreamRestarting, map[string]interface{}{
+			"session_id": sess.ID,
+			"restarting": restarting,
+		})
+	})
+
+	// Keep everyone's roster current as peers come and go
+	sess.OnPeerJoined(func(peer *session.Peer) {
+		s.broadcastSessionUpdate(sess, WSMsgPeerJoined, peer)
+	})
+	sess.OnPeerLeft(func(peer *session.Peer) {
+		s.broadcastSessionUpdate(sess, WSMsgPeerLeft, peer)
+	})
+
+	sess.OnHostLost(func() {
+		logging.Infof("Host left session %s, closing it", sess.ID)
+		s.sessions.CloseSession(sess.ID)
+	})
+}
+
+// openStream launches the app on Sunshine and starts receiving its stream.
+// gamepadMask is the player slots whose controllers the host attaches as
+// the app starts. With resume the app a closed stream left running is
+// streamed again instead, if it still runs.
+func (s *Server) openStream(ctx context.Context, appID int, gamepadMask uint16, resume bool) (moonlight.Streamer, error) {
+	// LoadConfig has checked it
+	onConflict, _ := moonlight.ParseSessionConflict(s.config.OnSessionConflict)
+	settings := s.streamSettings()
+	opts := moonlight.StreamOptions{
+		Width:   settings.Width,
+		Height:  settings.Height,
+		FPS:     settings.FPS,
+		Bitrate: settings.Bitrate,
+		AppID:   appID,
+		Launch: moonlight.LaunchOptions{
+			OptimizeGameSettings: s.config.OptimizeGameSettings,
+			GamepadMask:          gamepadMask,
+			PersistGamepads:      s.config.PersistGamepads,
+			OnSessionConflict:    onConflict,
+			Resume:               resume,
+		},
+		// Ask Sunshine for video in the codec browsers are sent, as frames
+		// are passed through, and audio that matches what we advertise
+		VideoFormat:           moonlight.VideoFormatsForCodec(settings.Codec, settings.HDR),
+		AudioConfig:           types.AudioConfigStereo,
+		HDR:                   settings.HDR,
+		AudioQuality:          moonlight.AudioQualityForBitrate(settings.AudioBitrate),
+		MinFECPackets:         s.config.MinFECPackets,
+		MTU:                   s.config.MTU,
+		FirstFrameTimeout:     time.Duration(s.config.FirstFrameTimeoutSec) * time.Second,
+		NoVideoTrafficTimeout: time.Duration(s.config.VideoTrafficTimeoutSec) * time.Second,
+		AudioInitialDropMs:    s.config.AudioInitialDropMs,
+		AudioJitterBufferMs:   s.config.AudioJitterBufferMs,
+	}
 
 	// Choose streaming backend
+	if s.config.UsePureGo {
+		logging.Infof("Using pure-Go moonlight-common-go client for streaming")
+		return s.moonlight.StartStreamPureGo(ctx, opts)
+	}
 	if s.config.UseLimelight {
-		log.Println("Using moonlight-common-go backend for streaming")
-		stream, err = s.moonlight.StartStreamWithLimelight(ctx,
-			s.config.StreamSettings.Width,
-			s.config.StreamSettings.Height,
-			s.config.StreamSettings.FPS,
-			s.config.StreamSettings.Bitrate)
-	} else {
-		log.Println("Using native Go streaming backend")
-		stream, err = s.moonlight.StartStream(ctx,
-			s.config.StreamSettings.Width,
-			s.config.StreamSettings.Height,
-			s.config.StreamSettings.FPS,
-			s.config.StreamSettings.Bitrate)
+		logging.Infof("Using moonlight-common-go backend for streaming")
+		return s.moonlight.StartStreamWithLimelight(ctx, opts)
 	}
 
+	logging.Infof("Using native Go streaming backend")
+	return s.moonlight.StartStream(ctx, opts)
+}
+
+// preloadStream launches AutoLaunchAppID before any client connects, so the
+// first session can start without waiting on the launch
+func (s *Server) preloadStream() {
+	err := s.preload.launch(func() (moonlight.Streamer, error) {
+		logging.Infof("Auto-launching app %d", s.config.AutoLaunchAppID)
+		return s.openStream(s.ctx, s.config.AutoLaunchAppID, 0, false)
+	}, time.Duration(s.config.PreloadTimeoutMin)*time.Minute)
 	if err != nil {
-		return err
+		logging.Errorf("Auto-launch failed: %v", err)
+		s.handleStreamError(err)
+	}
+}
+
+// defaultAppID is launched when a session doesn't pick an app (0 is
+// typically Desktop)
+const defaultAppID = 0
+
+// startStreaming initiates the video stream from Sunshine, launching appID.
+// A negative appID takes the preloaded stream if there is one, and
+// otherwise launches defaultAppID. Only the default room uses the preloaded
+// stream, waiting for it if it is still launching.
+func (s *Server) startStreaming(ctx context.Context, sess *session.Session, appID int) error {
+	var stream moonlight.Streamer
+	if sess.Room == session.DefaultRoom {
+		var err error
+		if stream, err = s.preload.claim(ctx); err != nil {
+			return err
+		}
+	}
+	if stream != nil && appID >= 0 && appID != s.config.AutoLaunchAppID {
+		logging.Infof("Quitting preloaded app %d to launch app %d", s.config.AutoLaunchAppID, appID)
+		stream.Quit()
+		stream = nil
 	}
-	defer stream.Close()
+	if stream != nil {
+		logging.Infof("Using preloaded stream")
+		appID = s.config.AutoLaunchAppID
+	} else {
+		if appID < 0 {
+			appID = defaultAppID
+		}
+		var err error
+		stream, err = s.openStream(ctx, appID, sess.ActiveGamepadMask(), false)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.config.ReplayInputPath != "" {
+		go s.replayInput(ctx, sess)
+	}
+
+	// Relay the stream until it ends. A stream Sunshine drops is started
+	// again for the same peers, resuming the app; otherwise the session is
+	// over and the app is quit.
+	for {
+		err := s.relayStream(ctx, sess, stream)
+		var terminated *moonlight.StreamTerminatedError
+		if errors.Is(err, errStreamRelaunch) || (errors.As(err, &terminated) && terminated.Recoverable()) {
+			stream.Close()
+		} else {
+			stream.Quit()
+		}
+
+		if errors.Is(err, errStreamRelaunch) {
+			stream, err = s.relaunchStream(ctx, sess, appID)
+			if err != nil {
+				logging.Warnf("Closing session %s: %v", sess.ID, err)
+				s.sessions.CloseSession(sess.ID)
+				return err
+			}
+			continue
+		}
+
+		if !errors.As(err, &terminated) {
+			return err
+		}
+		if !terminated.Recoverable() {
+			logging.Warnf("Closing session %s: %v", sess.ID, err)
+			s.sessions.CloseSession(sess.ID)
+			return err
+		}
+
+		stream, err = s.restartStream(ctx, sess, appID)
+		if err != nil {
+			logging.Warnf("Closing session %s: %v", sess.ID, err)
+			s.sessions.CloseSession(sess.ID)
+			return err
+		}
+	}
+}
+
+// replayInput replays the input recording at ReplayInputPath into sess
+func (s *Server) replayInput(ctx context.Context, sess *session.Session) {
+	logging.Infof("Session %s: replaying input from %s", sess.ID, s.config.ReplayInputPath)
+	if err := sess.ReplayInput(ctx, s.config.ReplayInputPath); err != nil {
+		if ctx.Err() == nil {
+			logging.Warnf("Session %s: input replay failed: %v", sess.ID, err)
+		}
+		return
+	}
+	logging.Infof("Session %s: input replay finished", sess.ID)
+}
+
+// streamRestartBackoff is the wait before the first attempt to start a
+// dropped stream again; it doubles with each failure up to
+// streamRestartMaxBackoff
+const (
+	streamRestartBackoff    = time.Second
+	streamRestartMaxBackoff = 10 * time.Second
+)
+
+// restartStream resumes appID after Sunshine dropped the session's stream,
+// making up to StreamRestartAttempts attempts with backoff. Peers keep their
+// WebRTC connections and are told the stream is restarting.
+func (s *Server) restartStream(ctx context.Context, sess *session.Session, appID int) (moonlight.Streamer, error) {
+	attempts := s.config.StreamRestartAttempts
+	if attempts <= 0 {
+		return nil, errors.New("stream restarts are disabled")
+	}
+
+	sess.SetStreamRestarting(true)
+	defer sess.SetStreamRestarting(false)
+
+	delay := streamRestartBackoff
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		logging.Warnf("Restarting stream for session %s in %v (attempt %d of %d)", sess.ID, delay, attempt, attempts)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+
+		var stream moonlight.Streamer
+		stream, err = s.openStream(ctx, appID, sess.ActiveGamepadMask(), true)
+		if err == nil {
+			// Browsers need a keyframe to pick the new stream up
+			sess.RequestIDR()
+			return stream, nil
+		}
+		if errors.Is(err, moonlight.ErrNeedsRepair) {
+			return nil, err
+		}
+		logging.Errorf("Restarting stream failed: %v", err)
+		delay = min(delay*2, streamRestartMaxBackoff)
+	}
+	return nil, fmt.Errorf("stream not restarted after %d attempts: %w", attempts, err)
+}
+
+// errStreamRelaunch ends a relay whose stream is to be launched again with
+// changed settings
+var errStreamRelaunch = errors.New("stream relaunch requested")
+
+// relaunchStream resumes appID with the current stream settings, keeping
+// the game where it was. Peers keep their WebRTC connections and are told
+// the stream is restarting; if it fails it's retried as after a drop.
+func (s *Server) relaunchStream(ctx context.Context, sess *session.Session, appID int) (moonlight.Streamer, error) {
+	sess.SetStreamRestarting(true)
+	defer sess.SetStreamRestarting(false)
+
+	logging.Infof("Relaunching stream for session %s with new settings", sess.ID)
+	stream, err := s.openStream(ctx, appID, sess.ActiveGamepadMask(), true)
+	if err == nil {
+		sess.RequestIDR()
+		return stream, nil
+	}
+	if errors.Is(err, moonlight.ErrNeedsRepair) {
+		return nil, err
+	}
+	logging.Errorf("Relaunching stream failed: %v", err)
+	return s.restartStream(ctx, sess, appID)
+}
+
+// relayStream fans one stream from Sunshine out to the session's peers and
+// forwards their input, until ctx ends or Sunshine terminates the stream
+func (s *Server) relayStream(ctx context.Context, sess *session.Session, stream moonlight.Streamer) error {
+	sess.SetStream(stream)
+	defer sess.SetStream(nil)
+
+	s.publishEvent(EventStreamStarted, map[string]interface{}{
+		"session_id": sess.ID,
+	})
+	defer s.publishEvent(EventStreamStopped, map[string]interface{}{
+		"session_id": sess.ID,
+	})
+
+	// Browsers are offered stereo Opus, which Sunshine's surround layouts,
+	// multistream Opus, aren't
+	if src, ok := stream.(moonlight.AudioFormatSource); ok {
+		if format, ok := src.AudioFormat(); ok && format.Channels != 2 {
+			logging.Warnf("Session %s: Sunshine negotiated %d-channel audio, which browsers can't play as stereo Opus",
+				sess.ID, format.Channels)
+		}
+	}
+
+	// Spectators get a reduced copy of the video if one is configured and
+	// can be made
+	var spectatorVideo webrtc.VideoTranscoder
+	var reducedFrames <-chan []byte
+	if sv := s.config.SpectatorVideo; sv.Enabled {
+		logging.Warnf("Session %s: spectator video transcoding is experimental", sess.ID)
+		settings := s.streamSettings()
+		t, err := webrtc.NewVideoTranscoder(webrtc.VideoFormat(settings.Codec), webrtc.TranscodeSettings{
+			Height:      sv.Height,
+			BitrateKbps: sv.Bitrate,
+			FPS:         settings.FPS,
+		})
+		if err != nil {
+			logging.Warnf("Session %s: spectators get the full video: %v", sess.ID, err)
+		} else {
+			defer t.Close()
+			spectatorVideo = t
+			reducedFrames = t.Frames()
+		}
+	}
+
+	// Controller feedback is optional; a nil channel never fires
+	var feedback <-chan moonlight.ControllerFeedback
+	if fs, ok := stream.(moonlight.FeedbackSource); ok {
+		feedback = fs.Feedback()
+	}
+
+	// Announce every seated player's controller up front, then follow the
+	// session as players are promoted, demoted or leave
+	var gamepads moonlight.GamepadTracker
+	var gamepadsChanged <-chan struct{}
+	if gt, ok := stream.(moonlight.GamepadTracker); ok {
+		gamepads = gt
+		gamepadsChanged = sess.GamepadsChanged()
+		s.updateGamepads(sess, gamepads)
+	}
+
+	// Sample stream counters for the session history
+	var stats moonlight.StatsSource
+	var statsTick <-chan time.Time
+	if ss, ok := stream.(moonlight.StatsSource); ok {
+		stats = ss
+		ticker := time.NewTicker(streamStatsInterval)
+		defer ticker.Stop()
+		statsTick = ticker.C
+	}
+
+	// Warn peers when the stream from Sunshine arrives poorly
+	var quality <-chan moonlight.ConnectionQuality
+	if qs, ok := stream.(moonlight.ConnectionQualitySource); ok {
+		quality = qs.ConnectionQuality()
+	}
+
+	// Streams that notice Sunshine ending them end the relay
+	var terminated <-chan error
+	if ts, ok := stream.(moonlight.TerminationSource); ok {
+		terminated = ts.Terminated()
+	}
+
+	// Watch whether the players' links can carry the bitrate this stream
+	// was launched with
+	bitrate := s.streamSettings().Bitrate
+	if bs, ok := stream.(moonlight.BitrateSource); ok {
+		bitrate = bs.Bitrate()
+	}
+	sess.SetStreamBitrate(bitrate)
+	bandwidthTicker := time.NewTicker(bandwidthCheckInterval)
+	defer bandwidthTicker.Stop()
+	constrained := false
 
 	// Fan out video/audio to all connected peers
 	for {
@@ -425,21 +1286,164 @@ func (s *Server) startStreaming(ctx context.Context, sess *session.Session) erro
 			return ctx.Err()
 		case frame := <-stream.VideoFrames():
 			// Broadcast video frame to all peers
-			s.broadcastVideo(sess, frame)
+			s.broadcastVideo(sess, frame, spectatorVideo)
+		case frame, ok := <-reducedFrames:
+			if !ok {
+				logging.Warnf("Session %s: spectator video transcoder stopped, spectators get the full video", sess.ID)
+				spectatorVideo, reducedFrames = nil, nil
+				continue
+			}
+			s.broadcastReducedVideo(sess, frame)
 		case sample := <-stream.AudioSamples():
 			// Broadcast audio sample to all peers
 			s.broadcastAudio(sess, sample)
 		case input := <-sess.InputChannel():
 			// Forward input to Sunshine
 			stream.SendInput(input)
+		case <-gamepadsChanged:
+			s.updateGamepads(sess, gamepads)
+		case fb := <-feedback:
+			// Route controller feedback to the peer holding that slot
+			s.sendFeedback(sess, fb)
+		case q := <-quality:
+			s.broadcastConnectionQuality(sess, q)
+		case <-sess.IDRRequests():
+			if r, ok := stream.(moonlight.IDRRequester); ok {
+				r.RequestIDR()
+			}
+		case <-sess.RelaunchRequests():
+			return errStreamRelaunch
+		case <-statsTick:
+			sess.SetStreamStats(stats.Stats())
+		case <-bandwidthTicker.C:
+			constrained = s.checkBandwidth(sess, constrained)
+		case err := <-terminated:
+			return err
+		}
+	}
+}
+
+// streamStatsInterval is how often stream counters are copied to the session
+const streamStatsInterval = 2 * time.Second
+
+// bandwidthCheckInterval is how often the players' bandwidth estimates are
+// compared with the stream's bitrate
+const bandwidthCheckInterval = 5 * time.Second
+
+// playersBandwidth returns the lowest bandwidth estimate among the session's
+// host and players in kbps, or 0 if none has one. Spectators are left out:
+// everyone shares one encoded stream, and a spectator on a poor link
+// shouldn't cost the people playing picture quality. A spectator who can't
+// keep up drops frames and asks for keyframes instead.
+func (s *Server) playersBandwidth(sess *session.Session) int {
+	lowest := 0
+	for _, peer := range sess.GetAllPeers() {
+		if peer.InputOnly || peer.Role == session.RoleSpectator {
+			continue
+		}
+		pc := s.webrtc.GetPeerConnection(peer.ID)
+		if pc == nil {
+			continue
 		}
+		if kbps := pc.EstimatedBitrate(); kbps > 0 && (lowest == 0 || kbps < lowest) {
+			lowest = kbps
+		}
+	}
+	return lowest
+}
+
+// checkBandwidth logs when the players' bandwidth falls below the bitrate
+// of the session's stream or recovers, returning whether it's below now.
+// Sunshine fixes the bitrate at launch, so a shortfall is reported rather
+// than acted on.
+func (s *Server) checkBandwidth(sess *session.Session, wasConstrained bool) bool {
+	kbps := s.playersBandwidth(sess)
+	bitrate := sess.StreamBitrate()
+	if kbps == 0 || bitrate == 0 {
+		return wasConstrained
+	}
+	constrained := kbps < bitrate
+
+	if constrained && !wasConstrained {
+		logging.Warnf("Players' estimated bandwidth %d kbps is below the stream's %d kbps", kbps, bitrate)
+	} else if !constrained && wasConstrained {
+		logging.Infof("Players' estimated bandwidth recovered to %d kbps", kbps)
 	}
+	return constrained
 }
 
-func (s *Server) broadcastVideo(sess *session.Session, frame []byte) {
+// keyframeRequestInterval is the least time between IDR requests made on
+// behalf of browsers, which send a PLI per spectator when frames are lost
+const keyframeRequestInterval = 500 * time.Millisecond
+
+// updateGamepads tells the stream which player slots are seated and what
+// controller each player holds
+func (s *Server) updateGamepads(sess *session.Session, gamepads moonlight.GamepadTracker) {
+	pads := sess.SlotGamepads()
+	gamepads.SetActiveGamepads(sess.ActiveGamepadMask(), pads[:])
+}
+
+// sendFeedback delivers a controller feedback event to the peer holding the
+// controller's slot: rumble over its rumble channel, the rest over control
+func (s *Server) sendFeedback(sess *session.Session, fb moonlight.ControllerFeedback) {
+	// Motion input is only accepted once Sunshine has asked for it
+	if m, ok := fb.Payload.(moonlight.MotionEvent); ok {
+		sess.SetMotionReporting(int(fb.ControllerNumber), m.MotionType, m.ReportRateHz > 0)
+	}
+
+	peer := sess.GetPeerBySlot(int(fb.ControllerNumber))
+	if peer == nil {
+		return
+	}
+	pc := s.webrtc.GetPeerConnection(peer.ID)
+	if pc == nil {
+		return
+	}
+
+	if r, ok := fb.Payload.(moonlight.Rumble); ok {
+		pc.SendRumble(fb.ControllerNumber, r.LowFreq, r.HighFreq)
+		return
+	}
+
+	data, err := json.Marshal(fb)
+	if err != nil {
+		return
+	}
+	pc.SendControl(data)
+}
+
+// broadcastVideo queues a frame for every peer that receives video. Queuing
+// never blocks: each peer's own goroutine writes its queue to its track,
+// and a peer that falls behind drops frames and waits for a keyframe
+// without holding up the others. With spectatorVideo, spectators are
+// switched to the reduced video it makes from the frame instead.
+func (s *Server) broadcastVideo(sess *session.Session, frame []byte, spectatorVideo webrtc.VideoTranscoder) {
+	if spectatorVideo != nil {
+		spectatorVideo.Write(frame)
+	}
+
 	peers := sess.GetAllPeers()
 	for _, peer := range peers {
-		if pc := s.webrtc.GetPeerConnection(peer.ID); pc != nil {
+		if peer.InputOnly {
+			continue
+		}
+		pc := s.webrtc.GetPeerConnection(peer.ID)
+		if pc == nil {
+			continue
+		}
+		reduced := spectatorVideo != nil && peer.Role == session.RoleSpectator
+		pc.SetVideoReduced(reduced)
+		if !reduced {
+			pc.SendVideo(frame)
+		}
+	}
+}
+
+// broadcastReducedVideo queues a transcoded frame for the peers switched to
+// the reduced video
+func (s *Server) broadcastReducedVideo(sess *session.Session, frame []byte) {
+	for _, peer := range sess.GetAllPeers() {
+		if pc := s.webrtc.GetPeerConnection(peer.ID); pc != nil && pc.VideoReduced() {
 			pc.SendVideo(frame)
 		}
 	}
@@ -448,6 +1452,9 @@ func (s *Server) broadcastVideo(sess *session.Session, frame []byte) {
 func (s *Server) broadcastAudio(sess *session.Session, sample []byte) {
 	peers := sess.GetAllPeers()
 	for _, peer := range peers {
+		if peer.InputOnly {
+			continue
+		}
 		if pc := s.webrtc.GetPeerConnection(peer.ID); pc != nil {
 			pc.SendAudio(sample)
 		}
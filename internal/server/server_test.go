@@ -0,0 +1,76 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHandleSettingsRejectsInvalid(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	prev := s.config.StreamSettings
+
+	for _, tt := range []struct {
+		body  string
+		field string
+	}{
+		{`{"width": 0}`, "width"},
+		{`{"height": 10000}`, "height"},
+		{`{"fps": 500}`, "fps"},
+		{`{"bitrate": -1}`, "bitrate"},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/api/settings", strings.NewReader(tt.body))
+		w := httptest.NewRecorder()
+		s.handleSettings(w, r)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("POST %s answered %d, want 400", tt.body, w.Code)
+		}
+		if !strings.Contains(w.Body.String(), tt.field) {
+			t.Errorf("POST %s answered %q, which doesn't name %s", tt.body, w.Body.String(), tt.field)
+		}
+	}
+	if s.config.StreamSettings != prev {
+		t.Fatalf("rejected settings were stored: %+v", s.config.StreamSettings)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/settings", strings.NewReader(`{"bitrate": 30000}`))
+	w := httptest.NewRecorder()
+	s.handleSettings(w, r)
+	if w.Code != http.StatusOK || s.config.StreamSettings.Bitrate != 30000 {
+		t.Fatalf("valid POST answered %d and stored bitrate %d", w.Code, s.config.StreamSettings.Bitrate)
+	}
+}
+
+func TestHandleSettingsConcurrentReads(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+
+	// Relay loops read the settings while the host changes them
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				s.handleSettings(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/settings", nil))
+				s.streamSettings()
+			}
+		}()
+	}
+	for _, bitrate := range []int{10000, 20000, 30000} {
+		r := httptest.NewRequest(http.MethodPost, "/api/settings", strings.NewReader(fmt.Sprintf(`{"bitrate": %d}`, bitrate)))
+		w := httptest.NewRecorder()
+		s.handleSettings(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("POST bitrate %d answered %d", bitrate, w.Code)
+		}
+	}
+	wg.Wait()
+
+	if got := s.streamSettings().Bitrate; got != 30000 {
+		t.Fatalf("bitrate %d, want 30000", got)
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/zalo/moonparty/internal/moonlight"
+	"github.com/zalo/moonparty/internal/webrtc"
+)
+
+// handleStats reports how the room's stream is doing end to end: what
+// arrives from Sunshine (packets, frames, keyframe requests, audio loss,
+// latency) and each peer's WebRTC connection to the server
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, _, ok := s.authenticate(w, r); !ok {
+		return
+	}
+
+	sess := s.sessions.GetActiveSession(requestRoom(r))
+	if sess == nil {
+		http.Error(w, "No active session", http.StatusNotFound)
+		return
+	}
+
+	stream := sess.Stream()
+	var stats *moonlight.StreamStats
+	if src, ok := stream.(moonlight.StatsSource); ok {
+		st := src.Stats()
+		stats = &st
+	}
+	var videoCodec string
+	if d, ok := stream.(moonlight.DiagnosticsSource); ok {
+		videoCodec = d.Diagnostics().VideoCodec
+	}
+	var audio *moonlight.AudioFormat
+	if src, ok := stream.(moonlight.AudioFormatSource); ok {
+		if format, ok := src.AudioFormat(); ok {
+			audio = &format
+		}
+	}
+
+	peers := make([]map[string]interface{}, 0)
+	for _, peer := range sess.GetAllPeers() {
+		var state *webrtc.State
+		if pc := s.webrtc.GetPeerConnection(peer.ID); pc != nil {
+			st := pc.State()
+			state = &st
+		}
+		peers = append(peers, map[string]interface{}{
+			"id":     peer.ID,
+			"name":   peer.Name,
+			"role":   peer.Role,
+			"webrtc": state,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"session_id":        sess.ID,
+		"room":              sess.Room,
+		"streaming":         stream != nil,
+		"stream_restarting": sess.IsStreamRestarting(),
+		"video_codec":       videoCodec,
+		"audio":             audio,
+		"stream":            stats,
+		"peers":             peers,
+	})
+}
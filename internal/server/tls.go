@@ -0,0 +1,101 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/zalo/moonparty/moonlight-common-go/logging"
+)
+
+// tlsEnabled reports whether the server should terminate TLS itself
+func (c *Config) tlsEnabled() bool {
+	return (c.TLSCertFile != "" && c.TLSKeyFile != "") || len(c.AutocertDomains) > 0
+}
+
+// listenAndServe starts the HTTP(S) listener and, when TLS is enabled, the
+// plain-HTTP redirect listener
+func (s *Server) listenAndServe() error {
+	if !s.config.tlsEnabled() {
+		logging.Infof("Server listening on %s", s.config.ListenAddr)
+		return s.httpServer.ListenAndServe()
+	}
+
+	var redirect http.Handler = http.HandlerFunc(s.redirectToHTTPS)
+	if len(s.config.AutocertDomains) > 0 {
+		cacheDir := s.config.AutocertCacheDir
+		if cacheDir == "" {
+			cacheDir = "autocert-cache"
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(s.config.AutocertDomains...),
+			Cache:      autocert.DirCache(cacheDir),
+		}
+		s.httpServer.TLSConfig = m.TLSConfig()
+		// The ACME HTTP-01 challenge is answered on the redirect listener
+		redirect = m.HTTPHandler(redirect)
+		logging.Infof("Using Let's Encrypt certificates for %s", strings.Join(s.config.AutocertDomains, ", "))
+	} else {
+		s.httpServer.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+
+	if s.config.HTTPRedirectAddr != "" {
+		s.redirectServer = &http.Server{
+			Addr:         s.config.HTTPRedirectAddr,
+			Handler:      redirect,
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 5 * time.Second,
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			logging.Infof("Redirecting HTTP on %s to HTTPS", s.config.HTTPRedirectAddr)
+			if err := s.redirectServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logging.Errorf("HTTP redirect server error: %v", err)
+			}
+		}()
+	}
+
+	logging.Infof("Server listening on %s (TLS)", s.config.ListenAddr)
+	// With autocert the certificate comes from TLSConfig.GetCertificate
+	return s.httpServer.ListenAndServeTLS(s.config.TLSCertFile, s.config.TLSKeyFile)
+}
+
+// redirectToHTTPS sends plain-HTTP requests to the same path on the TLS listener
+func (s *Server) redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if _, port, err := net.SplitHostPort(s.config.ListenAddr); err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+
+	target := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+	http.Redirect(w, r, target.String(), http.StatusMovedPermanently)
+}
+
+// checkOrigin decides whether a WebSocket upgrade may proceed. Over plain HTTP
+// any origin is allowed; once the server is exposed with TLS only same-host
+// HTTPS pages may open the signaling socket.
+func (s *Server) checkOrigin(r *http.Request) bool {
+	if !s.config.tlsEnabled() {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true // Non-browser clients
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return u.Scheme == "https" && strings.EqualFold(u.Host, r.Host)
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"github.com/zalo/moonparty/internal/session"
+	mwebrtc "github.com/zalo/moonparty/internal/webrtc"
+	"github.com/zalo/moonparty/moonlight-common-go/logging"
+)
+
+// forwardVoice sends a speaker's microphone to every other peer in the
+// session receiving media. Each forward renegotiates that peer's
+// connection, so they run side by side.
+func (s *Server) forwardVoice(sess *session.Session, speakerID string, speaker *mwebrtc.PeerConnection) {
+	for _, peer := range sess.GetAllPeers() {
+		if peer.ID == speakerID || peer.InputOnly {
+			continue
+		}
+		pc := s.webrtc.GetPeerConnection(peer.ID)
+		if pc == nil {
+			continue
+		}
+		go func() {
+			if err := pc.AddVoice(speaker); err != nil {
+				logging.Warnf("Peer %s: failed to forward voice of %s: %v", peer.ID, speakerID, err)
+			}
+		}()
+	}
+}
+
+// joinVoice sends a peer the microphones of everyone in the session who is
+// already talking
+func (s *Server) joinVoice(sess *session.Session, peerID string, pc *mwebrtc.PeerConnection) {
+	for _, peer := range sess.GetAllPeers() {
+		if peer.ID == peerID {
+			continue
+		}
+		speaker := s.webrtc.GetPeerConnection(peer.ID)
+		if speaker == nil || !speaker.HasVoice() {
+			continue
+		}
+		if err := pc.AddVoice(speaker); err != nil {
+			logging.Warnf("Peer %s: failed to forward voice of %s: %v", peerID, peer.ID, err)
+		}
+	}
+}
@@ -2,19 +2,22 @@ package server
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
 	"net/http"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/zalo/moonparty/internal/moonlight"
 	"github.com/zalo/moonparty/internal/session"
 	mwebrtc "github.com/zalo/moonparty/internal/webrtc"
+	"github.com/zalo/moonparty/moonlight-common-go/logging"
 )
 
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins for simplicity
+		return true // Origins are vetted by Server.checkOrigin before upgrading
 	},
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
@@ -25,22 +28,36 @@ type WSMessageType string
 
 const (
 	// Client -> Server
-	WSMsgOffer        WSMessageType = "offer"
-	WSMsgAnswer       WSMessageType = "answer"
-	WSMsgCandidate    WSMessageType = "candidate"
-	WSMsgInput        WSMessageType = "input"
-	WSMsgJoinAsPlayer WSMessageType = "join_as_player"
-	WSMsgLeave        WSMessageType = "leave"
+	WSMsgOffer         WSMessageType = "offer"
+	WSMsgAnswer        WSMessageType = "answer"
+	WSMsgCandidate     WSMessageType = "candidate"
+	WSMsgInput         WSMessageType = "input"
+	WSMsgJoinAsPlayer  WSMessageType = "join_as_player"
+	WSMsgLeave         WSMessageType = "leave"
+	WSMsgPauseVideo    WSMessageType = "pause_video"
+	WSMsgResumeVideo   WSMessageType = "resume_video"
+	WSMsgKick          WSMessageType = "kick"
+	WSMsgVoiceToggle   WSMessageType = "voice_toggle"
+	WSMsgSetInputOwner WSMessageType = "set_input_owner"
+	WSMsgGamepadInfo   WSMessageType = "gamepad_info"
+	WSMsgCalibrate     WSMessageType = "calibrate"
 
 	// Server -> Client
-	WSMsgSessionInfo  WSMessageType = "session_info"
-	WSMsgPlayerSlot   WSMessageType = "player_slot"
-	WSMsgPeerJoined   WSMessageType = "peer_joined"
-	WSMsgPeerLeft     WSMessageType = "peer_left"
-	WSMsgError        WSMessageType = "error"
-	WSMsgICECandidate WSMessageType = "ice_candidate"
+	WSMsgSessionInfo       WSMessageType = "session_info"
+	WSMsgPlayerSlot        WSMessageType = "player_slot"
+	WSMsgPeerJoined        WSMessageType = "peer_joined"
+	WSMsgPeerLeft          WSMessageType = "peer_left"
+	WSMsgError             WSMessageType = "error"
+	WSMsgSessionFull       WSMessageType = "session_full"
+	WSMsgICECandidate      WSMessageType = "ice_candidate"
+	WSMsgFingerprint       WSMessageType = "fingerprint"
+	WSMsgConnectionQuality WSMessageType = "connection_quality"
 )
 
+// waitingRoomPollInterval is how often a client turned away from a full
+// session tries to join again
+const waitingRoomPollInterval = 5 * time.Second
+
 // WSMessage is the WebSocket message envelope
 type WSMessage struct {
 	Type    WSMessageType   `json:"type"`
@@ -49,44 +66,59 @@ type WSMessage struct {
 
 // InputPayload represents input data from the client
 type InputPayload struct {
-	InputType string `json:"input_type"` // "keyboard", "mouse", "mouse_rel", "gamepad"
-	Data      []byte `json:"data"`
+	InputType string `json:"input_type"` // "keyboard", "mouse", "mouse_rel", "mouse_abs", "scroll", "gamepad", "motion"
+	Data      []byte `json:"data"`       // For "motion", motionType(1) + x, y, z as little-endian float32s
 }
 
 // wsClient represents a connected WebSocket client
 type wsClient struct {
-	conn    *websocket.Conn
-	peerID  string
-	send    chan []byte
-	server  *Server
-	mu      sync.Mutex
-	closed  bool
+	conn   *websocket.Conn
+	peerID string
+	send   chan []byte
+	server *Server
+	mu     sync.Mutex
+	closed bool
 }
 
 func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	identity, role, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	if !s.checkOrigin(r) {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("WebSocket upgrade error: %v", err)
+		logging.Warnf("WebSocket upgrade error: %v", err)
 		return
 	}
 
-	// Get or create session
-	sess := s.sessions.GetActiveSession()
+	// Get or create the session in the room asked for with ?room=
+	room := requestRoom(r)
+	sess := s.sessions.GetActiveSession(room)
 	if sess == nil {
-		// No active session - this client will be the host
-		sess, err = s.sessions.CreateSession()
+		// No active session - this client will be the host. Only the host
+		// may launch, so anyone else waits for one.
+		if role != AuthRoleHost {
+			conn.WriteJSON(WSMessage{Type: WSMsgError, Payload: jsonRaw(map[string]string{"error": "the host hasn't started a session yet"})})
+			conn.Close()
+			return
+		}
+		// Start streaming the app the host asked for, if any
+		appID := -1
+		if id, err := strconv.Atoi(r.URL.Query().Get("app_id")); err == nil && id >= 0 {
+			appID = id
+		}
+		sess, err = s.startSession(room, appID)
 		if err != nil {
 			conn.WriteJSON(WSMessage{Type: WSMsgError, Payload: jsonRaw(map[string]string{"error": err.Error()})})
 			conn.Close()
 			return
 		}
-
-		// Start streaming
-		go func() {
-			if err := s.startStreaming(s.ctx, sess); err != nil {
-				log.Printf("Streaming error: %v", err)
-			}
-		}()
 	}
 
 	// Determine if this is a new player or joining existing session
@@ -96,18 +128,55 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		name = "Player"
 	}
 
-	host := sess.GetHost()
-	if host != nil {
-		// Subsequent connections are spectators
+	// A returning browser can reclaim its previous peer by fingerprint
+	if fp := clientFingerprint(r); fp != "" && s.config.ReconnectGraceSeconds > 0 {
+		if peerID, ok := s.fingerprints.Verify(fp); ok {
+			window := time.Duration(s.config.ReconnectGraceSeconds) * time.Second
+			if restored, err := sess.Reconnect(peerID, window); err == nil {
+				logging.Infof("Peer %s reconnected as %s", restored.ID, restored.Role)
+				peer = restored
+			}
+		}
+	}
+
+	// Input-only clients attach straight into a player slot on the running stream
+	inputOnly := r.URL.Query().Get("mode") == "input"
+	if peer == nil && inputOnly {
+		peer, err = sess.AttachInput(name)
+		if err != nil {
+			conn.WriteJSON(WSMessage{Type: WSMsgError, Payload: jsonRaw(map[string]string{"error": err.Error()})})
+			conn.Close()
+			return
+		}
+	}
+
+	// The first connection with the host role is the host (already added by
+	// CreateSession); guests can't claim it
+	if peer == nil && role == AuthRoleHost {
+		if host, ok := sess.ClaimHost(name); ok {
+			peer = host
+		}
+	}
+
+	if peer == nil {
+		// Everyone else spectates. Past the limit they're told to wait and
+		// try again; the client polls its way in.
 		peer, err = sess.AddSpectator(name)
+		var full *session.SpectatorsFullError
+		if errors.As(err, &full) {
+			conn.WriteJSON(WSMessage{Type: WSMsgSessionFull, Payload: jsonRaw(map[string]interface{}{
+				"spectators":      full.Spectators,
+				"max_spectators":  full.MaxSpectators,
+				"retry_after_sec": int(waitingRoomPollInterval / time.Second),
+			})})
+			conn.Close()
+			return
+		}
 		if err != nil {
 			conn.WriteJSON(WSMessage{Type: WSMsgError, Payload: jsonRaw(map[string]string{"error": err.Error()})})
 			conn.Close()
 			return
 		}
-	} else {
-		// First connection is the host (already added by CreateSession)
-		peer = sess.GetHost()
 	}
 
 	if peer == nil {
@@ -116,6 +185,10 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if identity != "" {
+		sess.SetPeerIdentity(peer.ID, identity)
+	}
+
 	client := &wsClient{
 		conn:   conn,
 		peerID: peer.ID,
@@ -126,45 +199,123 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	// Create WebRTC peer connection
 	pc, err := s.webrtc.CreatePeerConnection(peer.ID)
 	if err != nil {
-		log.Printf("Failed to create peer connection: %v", err)
+		logging.Errorf("Failed to create peer connection: %v", err)
 		conn.Close()
 		return
 	}
 
-	// Setup tracks and data channels
-	if err := pc.SetupTracks(); err != nil {
-		log.Printf("Failed to setup tracks: %v", err)
-		conn.Close()
-		return
+	// Setup tracks and data channels; input-only peers get no media
+	if !peer.InputOnly {
+		if err := pc.SetupTracks(mwebrtc.VideoFormat(s.streamSettings().Codec)); err != nil {
+			logging.Errorf("Failed to setup tracks: %v", err)
+			conn.Close()
+			return
+		}
 	}
 
 	if err := pc.SetupDataChannels(); err != nil {
-		log.Printf("Failed to setup data channels: %v", err)
+		logging.Errorf("Failed to setup data channels: %v", err)
 		conn.Close()
 		return
 	}
 
+	// A joining peer can only start decoding at a keyframe. It waits for
+	// the next one and asks for one if none comes soon, as it does whenever
+	// its decoder loses track; requests from every peer are limited to one
+	// IDR per keyframeRequestInterval. It hears whoever is already talking
+	// once connected.
+	if !peer.InputOnly {
+		pc.OnConnected(func() {
+			s.joinVoice(sess, peer.ID, pc)
+		})
+		pc.OnKeyframeRequest(func() {
+			sess.RequestIDRAtMost(keyframeRequestInterval)
+		})
+
+		// A peer's microphone goes out to the rest of the session once it
+		// starts arriving
+		pc.OnVoice(func() {
+			s.forwardVoice(sess, peer.ID, pc)
+		})
+	}
+
+	// Server-initiated offers (codec renegotiation) go out over this socket
+	pc.OnRenegotiationOffer(func(offerSDP string) {
+		client.sendJSON(WSMessage{
+			Type:    WSMsgOffer,
+			Payload: jsonRaw(map[string]string{"sdp": offerSDP}),
+		})
+	})
+
 	// Handle input from this peer
+	clipboard := &clipboardAssembler{}
 	pc.OnInput = func(channelID string, data []byte) {
-		s.handlePeerInput(peer.ID, channelID, data)
+		switch channelID {
+		case "chat":
+			s.relayChat(sess, peer, data)
+			return
+		case "clipboard":
+			s.handleClipboard(sess, peer, clipboard, data)
+			return
+		}
+		s.handlePeerInput(sess, peer.ID, channelID, data)
 	}
 
-	// Note: We don't send separate ICE candidates because we wait for gathering
-	// to complete before sending the SDP answer (all candidates are in the SDP)
+	// Report connection health to the peer over its control channel
+	pc.OnStatsUpdate(func(stats mwebrtc.Stats) {
+		// Latency to Sunshine adds to the peer's own
+		var hostRTT uint32
+		if src, ok := sess.Stream().(moonlight.StatsSource); ok {
+			hostRTT = src.Stats().HostRTTMs
+		}
+		data, err := json.Marshal(map[string]interface{}{
+			"type":        "stats",
+			"stats":       stats,
+			"host_rtt_ms": hostRTT,
+		})
+		if err != nil {
+			return
+		}
+		pc.SendControl(data)
+
+		s.publishEvent(EventConnectionQuality, map[string]interface{}{
+			"peer_id": peer.ID,
+			"stats":   stats,
+		})
+	})
+
+	// Trickle our ICE candidates to the browser as they're gathered rather
+	// than holding the answer until gathering completes. An empty candidate
+	// marks the end of candidates.
+	pc.OnICECandidate(func(candidate string) {
+		client.sendJSON(WSMessage{
+			Type:    WSMsgICECandidate,
+			Payload: jsonRaw(map[string]string{"candidate": candidate}),
+		})
+	})
+
+	s.publishEvent(EventPeerJoined, map[string]interface{}{
+		"session_id": sess.ID,
+		"peer_id":    peer.ID,
+		"name":       peer.Name,
+		"role":       peer.Role,
+		"identity":   identity,
+	})
+
+	// Issue a fingerprint so this browser can reclaim the peer after a refresh
+	client.sendJSON(WSMessage{
+		Type:    WSMsgFingerprint,
+		Payload: jsonRaw(map[string]string{"value": s.fingerprints.Issue(peer.ID)}),
+	})
 
 	// Send session info to client
 	client.sendJSON(WSMessage{
-		Type: WSMsgSessionInfo,
-		Payload: jsonRaw(map[string]interface{}{
-			"session_id": sess.ID,
-			"peer_id":    peer.ID,
-			"role":       peer.Role,
-			"slot":       peer.PlayerSlot,
-			"players":    sess.GetPlayers(),
-			"is_host":    peer.Role == session.RoleHost,
-		}),
+		Type:    WSMsgSessionInfo,
+		Payload: jsonRaw(sessionInfo(sess, peer)),
 	})
 
+	s.addWSClient(client)
+
 	// Start client handlers
 	go client.writePump()
 	go client.readPump(sess, peer, pc)
@@ -172,25 +323,40 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 func (c *wsClient) readPump(sess *session.Session, peer *session.Peer, pc *mwebrtc.PeerConnection) {
 	defer func() {
-		if activeSess := c.server.sessions.GetActiveSession(); activeSess != nil {
-			activeSess.RemovePeer(c.peerID)
+		// Let writePump exit
+		c.close()
+		c.server.removeWSClient(c)
+
+		if c.server.sessions.GetSession(sess.ID) != nil {
+			// Hold the peer's slot so a refresh can reclaim it
+			grace := time.Duration(c.server.config.ReconnectGraceSeconds) * time.Second
+			sess.HoldPeer(c.peerID, grace)
+			if held := sess.GetPeer(c.peerID); held != nil {
+				// Others see the peer as reconnecting until it's back or gone
+				c.server.broadcastSessionUpdate(sess, WSMsgSessionInfo, held)
+			}
 		}
 		c.server.webrtc.RemovePeerConnection(c.peerID)
 		c.conn.Close()
+
+		c.server.publishEvent(EventPeerLeft, map[string]interface{}{
+			"session_id": sess.ID,
+			"peer_id":    c.peerID,
+		})
 	}()
 
 	for {
 		_, message, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("WebSocket error: %v", err)
+				logging.Warnf("WebSocket error: %v", err)
 			}
 			break
 		}
 
 		var msg WSMessage
 		if err := json.Unmarshal(message, &msg); err != nil {
-			log.Printf("Invalid message: %v", err)
+			logging.Warnf("Invalid message: %v", err)
 			continue
 		}
 
@@ -206,6 +372,8 @@ func (c *wsClient) handleMessage(msg WSMessage, sess *session.Session, peer *ses
 		}
 		json.Unmarshal(msg.Payload, &payload)
 
+		// The answer goes out before gathering finishes; our candidates
+		// follow it as ice_candidate messages
 		answer, err := pc.HandleOffer(payload.SDP)
 		if err != nil {
 			c.sendJSON(WSMessage{Type: WSMsgError, Payload: jsonRaw(map[string]string{"error": err.Error()})})
@@ -234,17 +402,28 @@ func (c *wsClient) handleMessage(msg WSMessage, sess *session.Session, peer *ses
 		json.Unmarshal(msg.Payload, &payload)
 
 		if err := pc.AddICECandidate(payload.Candidate); err != nil {
-			log.Printf("Failed to add ICE candidate: %v", err)
+			logging.Warnf("Failed to add ICE candidate: %v", err)
 		}
 
 	case WSMsgInput:
 		var payload InputPayload
 		json.Unmarshal(msg.Payload, &payload)
 
-		c.server.handlePeerInput(peer.ID, payload.InputType, payload.Data)
+		c.server.handlePeerInput(sess, peer.ID, payload.InputType, payload.Data)
 
 	case WSMsgJoinAsPlayer:
 		slot, err := sess.PromoteToPlayer(peer.ID)
+		var full *session.SlotsFullError
+		if errors.As(err, &full) {
+			c.sendJSON(WSMessage{Type: WSMsgError, Payload: jsonRaw(map[string]interface{}{
+				"error":          err.Error(),
+				"code":           "slots_full",
+				"players":        full.Players,
+				"max_players":    full.MaxPlayers,
+				"queue_position": full.QueuePosition,
+			})})
+			return
+		}
 		if err != nil {
 			c.sendJSON(WSMessage{Type: WSMsgError, Payload: jsonRaw(map[string]string{"error": err.Error()})})
 			return
@@ -255,15 +434,144 @@ func (c *wsClient) handleMessage(msg WSMessage, sess *session.Session, peer *ses
 			Payload: jsonRaw(map[string]int{"slot": slot}),
 		})
 
-		// Broadcast to others
-		c.server.broadcastSessionUpdate(sess)
+	case WSMsgPauseVideo:
+		pc.SetVideoPaused(true)
+		logging.Infof("Peer %s paused video", peer.ID)
+
+	case WSMsgResumeVideo:
+		if pc.VideoPaused() {
+			pc.SetVideoPaused(false)
+			// The peer missed reference frames while paused and waits
+			// for a keyframe, asking for one like a joining peer
+			logging.Infof("Peer %s resumed video", peer.ID)
+		}
+
+	case WSMsgVoiceToggle:
+		var payload struct {
+			Muted bool `json:"muted"`
+		}
+		json.Unmarshal(msg.Payload, &payload)
+
+		pc.SetVoiceMuted(payload.Muted)
+		logging.Infof("Peer %s voice muted: %v", peer.ID, payload.Muted)
+
+	case WSMsgGamepadInfo:
+		// The browser's gamepad, kept with the peer so its player slot is
+		// announced to Sunshine as the right kind of controller
+		var payload struct {
+			ID      string `json:"id"`
+			Battery *struct {
+				Level    float64 `json:"level"`
+				Charging bool    `json:"charging"`
+			} `json:"battery"`
+		}
+		json.Unmarshal(msg.Payload, &payload)
+
+		pad := moonlight.Gamepad{Type: moonlight.ControllerTypeForGamepadID(payload.ID)}
+		if payload.Battery != nil {
+			pad.Battery, pad.BatteryPercent = moonlight.GamepadBattery(payload.Battery.Level, payload.Battery.Charging)
+		}
+		sess.SetPeerGamepad(peer.ID, pad)
+
+	case WSMsgCalibrate:
+		// Deadzone, saturation and inversion for the peer's sticks. Fields
+		// left out keep the defaults.
+		cal := moonlight.DefaultStickCalibration()
+		if err := json.Unmarshal(msg.Payload, &cal); err != nil {
+			c.sendJSON(WSMessage{Type: WSMsgError, Payload: jsonRaw(map[string]string{"error": "invalid calibration"})})
+			return
+		}
+		if err := cal.Validate(); err != nil {
+			c.sendJSON(WSMessage{Type: WSMsgError, Payload: jsonRaw(map[string]string{"error": err.Error()})})
+			return
+		}
+		sess.SetPeerCalibration(peer.ID, cal)
+
+	case WSMsgSetInputOwner:
+		var payload struct {
+			PeerID string `json:"peer_id"`
+		}
+		json.Unmarshal(msg.Payload, &payload)
+
+		if err := c.server.setInputOwner(sess, peer.ID, payload.PeerID); err != nil {
+			c.sendJSON(WSMessage{Type: WSMsgError, Payload: jsonRaw(map[string]string{"error": err.Error()})})
+		}
+
+	case WSMsgKick:
+		var payload struct {
+			PeerID string `json:"peer_id"`
+		}
+		json.Unmarshal(msg.Payload, &payload)
+
+		if err := c.server.kickPeer(sess, peer.ID, payload.PeerID); err != nil {
+			c.sendJSON(WSMessage{Type: WSMsgError, Payload: jsonRaw(map[string]string{"error": err.Error()})})
+		}
 
 	case WSMsgLeave:
 		sess.RemovePeer(peer.ID)
-		c.server.broadcastSessionUpdate(sess)
 	}
 }
 
+// addWSClient registers a client so messages can reach it by peer ID. A
+// reconnecting peer replaces its stale socket.
+func (s *Server) addWSClient(c *wsClient) {
+	s.wsMu.Lock()
+	defer s.wsMu.Unlock()
+	s.wsClients[c.peerID] = c
+}
+
+// removeWSClient unregisters a client unless its peer has reconnected since
+func (s *Server) removeWSClient(c *wsClient) {
+	s.wsMu.Lock()
+	defer s.wsMu.Unlock()
+	if s.wsClients[c.peerID] == c {
+		delete(s.wsClients, c.peerID)
+	}
+}
+
+// wsClient returns the socket connected for a peer, or nil
+func (s *Server) wsClient(peerID string) *wsClient {
+	s.wsMu.Lock()
+	defer s.wsMu.Unlock()
+	return s.wsClients[peerID]
+}
+
+// setInputOwner hands the keyboard and mouse to a peer at the host's
+// request and tells everyone in the session who holds them now
+func (s *Server) setInputOwner(sess *session.Session, requesterID, ownerID string) error {
+	if host := sess.GetHost(); host == nil || host.ID != requesterID {
+		return session.ErrNotHost
+	}
+	if err := sess.SetInputOwner(ownerID); err != nil {
+		return err
+	}
+	logging.Infof("Host gave keyboard and mouse to peer %s in session %s", ownerID, sess.ID)
+
+	if owner := sess.GetPeer(ownerID); owner != nil {
+		s.broadcastSessionUpdate(sess, WSMsgSessionInfo, owner)
+	}
+	return nil
+}
+
+// kickPeer removes a peer at the host's request: the peer is told why and
+// disconnected, and everyone left in the session hears it left through the
+// session's OnPeerLeft
+func (s *Server) kickPeer(sess *session.Session, requesterID, targetID string) error {
+	if err := sess.KickPeer(requesterID, targetID); err != nil {
+		return err
+	}
+	logging.Infof("Host kicked peer %s from session %s", targetID, sess.ID)
+
+	if c := s.wsClient(targetID); c != nil {
+		c.closeWith(WSMessage{Type: WSMsgError, Payload: jsonRaw(map[string]string{
+			"error": "you were removed from the session by the host",
+			"code":  "kicked",
+		})})
+	}
+	s.webrtc.RemovePeerConnection(targetID)
+	return nil
+}
+
 func (c *wsClient) writePump() {
 	defer c.conn.Close()
 
@@ -282,6 +590,38 @@ func (c *wsClient) writePump() {
 	}
 }
 
+// closeWriteTimeout bounds the last write to a socket being closed, so a
+// stalled client can't hold up its removal
+const closeWriteTimeout = time.Second
+
+// closeWith writes a last message ahead of anything still queued, then
+// closes the socket, which ends readPump and its cleanup
+func (c *wsClient) closeWith(msg WSMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		close(c.send)
+		c.conn.SetWriteDeadline(time.Now().Add(closeWriteTimeout))
+		c.conn.WriteJSON(msg)
+		c.conn.WriteMessage(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "removed by host"))
+	}
+	c.conn.Close()
+}
+
+// close stops further sends and ends writePump
+func (c *wsClient) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		close(c.send)
+	}
+}
+
 func (c *wsClient) sendJSON(msg WSMessage) {
 	data, err := json.Marshal(msg)
 	if err != nil {
@@ -304,12 +644,7 @@ func (c *wsClient) sendJSON(msg WSMessage) {
 	}
 }
 
-func (s *Server) handlePeerInput(peerID, inputType string, data []byte) {
-	sess := s.sessions.GetActiveSession()
-	if sess == nil {
-		return
-	}
-
+func (s *Server) handlePeerInput(sess *session.Session, peerID, inputType string, data []byte) {
 	// Determine input type
 	var iType moonlight.InputType
 	switch inputType {
@@ -319,8 +654,16 @@ func (s *Server) handlePeerInput(peerID, inputType string, data []byte) {
 		iType = moonlight.InputTypeMouse
 	case "mouse_rel":
 		iType = moonlight.InputTypeMouseRelative
+	case "mouse_abs":
+		iType = moonlight.InputTypeMouseAbsolute
+	case "scroll":
+		iType = moonlight.InputTypeScroll
 	case "gamepad", "input":
 		iType = moonlight.InputTypeGamepad
+	case "motion":
+		iType = moonlight.InputTypeMotion
+	case "pen":
+		iType = moonlight.InputTypePen
 	default:
 		return
 	}
@@ -330,12 +673,31 @@ func (s *Server) handlePeerInput(peerID, inputType string, data []byte) {
 		return
 	}
 
+	// Only Sunshine takes pen input, and only when it says so
+	if iType == moonlight.InputTypePen {
+		if src, ok := sess.Stream().(moonlight.PenInputSource); !ok || !src.SupportsPen() {
+			return
+		}
+	}
+
+	// Sunshine only takes the motion types it asked for
+	if iType == moonlight.InputTypeMotion {
+		motionType, _, _, _, ok := moonlight.ParseMotion(data)
+		if !ok || !sess.WantsMotion(peerID, motionType) {
+			return
+		}
+	}
+
 	// Get player slot for gamepad mapping
 	slot := sess.GetPlayerSlot(peerID)
 	if slot < 0 {
 		return
 	}
 
+	if iType == moonlight.InputTypeGamepad {
+		data = sess.PeerCalibration(peerID).Apply(data)
+	}
+
 	// Queue input for sending to Sunshine
 	sess.SendInput(moonlight.InputPacket{
 		Type:       iType,
@@ -345,9 +707,106 @@ func (s *Server) handlePeerInput(peerID, inputType string, data []byte) {
 	})
 }
 
-func (s *Server) broadcastSessionUpdate(sess *session.Session) {
-	// This would broadcast to all connected WebSocket clients
-	// Implementation depends on maintaining a list of all ws clients
+// relayChat forwards a chat message from one peer to everyone else in the session
+func (s *Server) relayChat(sess *session.Session, from *session.Peer, text []byte) {
+	data, err := json.Marshal(map[string]interface{}{
+		"from":    from.Name,
+		"peer_id": from.ID,
+		"text":    string(text),
+	})
+	if err != nil {
+		return
+	}
+
+	for _, peer := range sess.GetAllPeers() {
+		if peer.ID == from.ID {
+			continue
+		}
+		if pc := s.webrtc.GetPeerConnection(peer.ID); pc != nil {
+			pc.SendChat(data)
+		}
+	}
+}
+
+// broadcastConnectionQuality tells every peer in the session connected over
+// WebSocket that the stream from Sunshine turned poor or recovered. Everyone
+// watches the same stream, so the one message suits them all.
+func (s *Server) broadcastConnectionQuality(sess *session.Session, q moonlight.ConnectionQuality) {
+	msg := WSMessage{Type: WSMsgConnectionQuality, Payload: jsonRaw(q)}
+	for _, p := range sess.GetAllPeers() {
+		if c := s.wsClient(p.ID); c != nil {
+			c.sendJSON(msg)
+		}
+	}
+}
+
+// broadcastSessionUpdate tells every other peer in the session connected
+// over WebSocket that the roster changed because of peer. Joins and leaves
+// go out as peer_joined and peer_left with the new roster; any other change
+// (a role, a slot, a peer reconnecting) as each recipient's own session_info.
+func (s *Server) broadcastSessionUpdate(sess *session.Session, msgType WSMessageType, peer *session.Peer) {
+	var update json.RawMessage
+	if msgType != WSMsgSessionInfo {
+		roster := sessionRoster(sess)
+		roster["peer_id"] = peer.ID
+		roster["name"] = peer.Name
+		roster["role"] = peer.Role
+		update = jsonRaw(roster)
+	}
+
+	for _, p := range sess.GetAllPeers() {
+		if p.ID == peer.ID && msgType != WSMsgSessionInfo {
+			continue
+		}
+		c := s.wsClient(p.ID)
+		if c == nil {
+			continue
+		}
+		payload := update
+		if msgType == WSMsgSessionInfo {
+			payload = jsonRaw(sessionInfo(sess, p))
+		}
+		c.sendJSON(WSMessage{Type: msgType, Payload: payload})
+	}
+}
+
+// sessionRoster is who is in the session: the seated players, how many are
+// watching, and the host's peer ID
+func sessionRoster(sess *session.Session) map[string]interface{} {
+	roster := map[string]interface{}{
+		"players":     sess.GetPlayers(),
+		"spectators":  sess.GetSpectatorCount(),
+		"host":        "",
+		"input_owner": sess.InputOwner(),
+	}
+	if host := sess.GetHost(); host != nil {
+		roster["host"] = host.ID
+	}
+	return roster
+}
+
+// sessionInfo is the session_info a peer gets on connecting and whenever its
+// session changes: the roster plus the peer's own place in it
+func sessionInfo(sess *session.Session, peer *session.Peer) map[string]interface{} {
+	info := sessionRoster(sess)
+	info["session_id"] = sess.ID
+	info["peer_id"] = peer.ID
+	info["role"] = peer.Role
+	info["slot"] = peer.PlayerSlot
+	info["is_host"] = peer.Role == session.RoleHost
+	info["input_only"] = peer.InputOnly
+	info["paused"] = sess.IsPaused()
+	info["restarting"] = sess.IsStreamRestarting()
+	return info
+}
+
+// clientFingerprint reads the fingerprint from the header or query parameter.
+// Browsers cannot set headers on WebSocket requests, so the query is the usual path.
+func clientFingerprint(r *http.Request) string {
+	if fp := r.Header.Get("X-Client-Fingerprint"); fp != "" {
+		return fp
+	}
+	return r.URL.Query().Get("fingerprint")
 }
 
 func jsonRaw(v interface{}) json.RawMessage {
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v4"
+	"github.com/zalo/moonparty/internal/session"
+)
+
+// newTestServer returns a server with a session already running in the
+// default room, so connecting doesn't launch a stream, and the WebSocket
+// URL it's served on. configure, if not nil, adjusts the config first.
+func newTestServer(t *testing.T, configure func(*Config)) (*Server, string) {
+	t.Helper()
+
+	cfg := DefaultConfig()
+	cfg.IdentityDir = t.TempDir()
+	cfg.ICEServers = nil
+	cfg.ReconnectGraceSeconds = 0
+	if configure != nil {
+		configure(cfg)
+	}
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.sessions.CreateSession(session.DefaultRoom); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(s.handleWebSocket))
+	t.Cleanup(func() {
+		ts.Close()
+		s.sessions.CloseAll()
+		s.webrtc.CloseAll()
+	})
+	return s, "ws" + strings.TrimPrefix(ts.URL, "http")
+}
+
+// browserOffer returns an offer like a browser's, with a data channel
+func browserOffer(t *testing.T) string {
+	t.Helper()
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	if _, err := pc.CreateDataChannel("input", nil); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return offer.SDP
+}
+
+func TestDroppedWebSocketsDoNotLeak(t *testing.T) {
+	s, url := newTestServer(t, nil)
+	offer, err := json.Marshal(WSMessage{Type: WSMsgOffer, Payload: jsonRaw(map[string]string{"sdp": browserOffer(t)})})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The host stays connected throughout
+	host, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	time.Sleep(100 * time.Millisecond)
+	baseline := runtime.NumGoroutine()
+
+	// Spectators drop mid-negotiation, without a close handshake, while
+	// their answers are still gathering candidates
+	const clients = 30
+	for range clients {
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, offer); err != nil {
+			t.Fatal(err)
+		}
+		conn.NetConn().Close()
+	}
+
+	// Everything started for them winds down
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		peers := len(s.sessions.GetActiveSession(session.DefaultRoom).GetAllPeers())
+		n := runtime.NumGoroutine()
+		if peers == 1 && n <= baseline+5 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d peers and %d goroutines left after %d dropped clients, started with 1 and %d",
+				peers, n, clients, baseline)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// readUntil reads messages from conn until one of type typ, and returns it
+func readUntil(t *testing.T, conn *websocket.Conn, typ WSMessageType) WSMessage {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg WSMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("waiting for %s: %v", typ, err)
+		}
+		if msg.Type == typ {
+			return msg
+		}
+	}
+}
+
+func TestSessionFullWaitingRoom(t *testing.T) {
+	s, url := newTestServer(t, func(cfg *Config) { cfg.MaxSpectators = 1 })
+
+	host, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	readUntil(t, host, WSMsgSessionInfo)
+
+	spectator, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, spectator, WSMsgSessionInfo)
+
+	// The next one is told the session is full and when to try again
+	overflow, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer overflow.Close()
+	msg := readUntil(t, overflow, WSMsgSessionFull)
+	var full struct {
+		Spectators    int `json:"spectators"`
+		MaxSpectators int `json:"max_spectators"`
+		RetryAfterSec int `json:"retry_after_sec"`
+	}
+	if err := json.Unmarshal(msg.Payload, &full); err != nil {
+		t.Fatal(err)
+	}
+	if full.Spectators != 1 || full.MaxSpectators != 1 || full.RetryAfterSec <= 0 {
+		t.Fatalf("session_full said %+v, want 1 of 1 and a retry interval", full)
+	}
+
+	// Once the spectator leaves, trying again gets in
+	spectator.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.sessions.GetActiveSession(session.DefaultRoom).GetSpectatorCount() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the spectator that left is still counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	retry, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer retry.Close()
+	readUntil(t, retry, WSMsgSessionInfo)
+}
+
+func TestOnlyHostClaimsHost(t *testing.T) {
+	s, url := newTestServer(t, func(cfg *Config) {
+		cfg.AuthMode = "shared_secret"
+		cfg.AuthSecret = "guest-token"
+		cfg.AuthHostSecret = "host-token"
+	})
+
+	// A guest first in doesn't become host
+	guest, _, err := websocket.DefaultDialer.Dial(url+"?token=guest-token&name=guest", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer guest.Close()
+	readUntil(t, guest, WSMsgSessionInfo)
+
+	host, _, err := websocket.DefaultDialer.Dial(url+"?token=host-token&name=host", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	readUntil(t, host, WSMsgSessionInfo)
+
+	roles := make(map[string]session.Role)
+	for _, p := range s.sessions.GetActiveSession(session.DefaultRoom).GetAllPeers() {
+		roles[p.Name] = p.Role
+	}
+	if roles["guest"] != session.RoleSpectator || roles["host"] != session.RoleHost {
+		t.Fatalf("roles %v, want the guest spectating and the host hosting", roles)
+	}
+}
+
+func TestGuestCannotStartSession(t *testing.T) {
+	s, url := newTestServer(t, func(cfg *Config) {
+		cfg.AuthMode = "shared_secret"
+		cfg.AuthSecret = "guest-token"
+		cfg.AuthHostSecret = "host-token"
+	})
+
+	// A guest in a room with no session is turned away without a launch
+	conn, _, err := websocket.DefaultDialer.Dial(url+"?token=guest-token&room=empty", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	readUntil(t, conn, WSMsgError)
+	if s.sessions.HasActiveSession("empty") {
+		t.Fatal("a guest started a session")
+	}
+
+	for _, tt := range []struct {
+		token string
+		want  int
+	}{
+		{"", http.StatusUnauthorized},
+		{"guest-token", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/api/session/start", strings.NewReader(`{"room": "empty"}`))
+		if tt.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		s.handleStartSession(w, r)
+		if w.Code != tt.want {
+			t.Errorf("start with token %q answered %d, want %d", tt.token, w.Code, tt.want)
+		}
+	}
+	if s.sessions.HasActiveSession("empty") {
+		t.Fatal("a guest started a session over the API")
+	}
+}
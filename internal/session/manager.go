@@ -5,44 +5,97 @@ import (
 	"sync"
 )
 
-// Manager manages all active sessions
+// HistorySize is how many closed sessions the manager remembers
+const HistorySize = 50
+
+// DefaultRoom is the room of clients that don't name one
+const DefaultRoom = ""
+
+// maxRoomLength bounds client-supplied room codes
+const maxRoomLength = 32
+
+// ErrInvalidRoom is returned for a room code longer than 32 characters or
+// with anything but letters, digits, dashes and underscores
+var ErrInvalidRoom = errors.New("invalid room code")
+
+// ValidateRoom checks a client-supplied room code; DefaultRoom is valid
+func ValidateRoom(room string) error {
+	if len(room) > maxRoomLength {
+		return ErrInvalidRoom
+	}
+	for _, c := range room {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return ErrInvalidRoom
+		}
+	}
+	return nil
+}
+
+// Manager manages all active sessions. Each room, named by a code clients
+// share, has at most one session; clients that don't name a room share the
+// default one.
 type Manager struct {
-	mu         sync.RWMutex
-	sessions   map[string]*Session
-	active     *Session // Currently only one session at a time
-	maxPlayers int
+	mu            sync.RWMutex
+	sessions      map[string]*Session // By session ID
+	rooms         map[string]*Session // By room code
+	maxPlayers    int
+	maxSpectators int               // Per session; 0 for no limit
+	history       []*SessionSummary // Closed sessions, oldest first, at most HistorySize
+	recorder      *InputRecorder    // Given to new sessions to record their input
 }
 
-// NewManager creates a new session manager
-func NewManager(maxPlayers int) *Manager {
+// NewManager creates a new session manager. Sessions admit at most
+// maxSpectators spectators each, or any number for 0.
+func NewManager(maxPlayers, maxSpectators int) *Manager {
 	if maxPlayers <= 0 || maxPlayers > 4 {
 		maxPlayers = 4
 	}
+	if maxSpectators < 0 {
+		maxSpectators = 0
+	}
 
 	return &Manager{
-		sessions:   make(map[string]*Session),
-		maxPlayers: maxPlayers,
+		sessions:      make(map[string]*Session),
+		rooms:         make(map[string]*Session),
+		maxPlayers:    maxPlayers,
+		maxSpectators: maxSpectators,
 	}
 }
 
-// CreateSession creates a new streaming session
-func (m *Manager) CreateSession() (*Session, error) {
+// SetInputRecorder records the input of sessions created from now on to r,
+// or stops recording for nil
+func (m *Manager) SetInputRecorder(r *InputRecorder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.recorder = r
+}
+
+// CreateSession creates a new streaming session in a room
+func (m *Manager) CreateSession(room string) (*Session, error) {
+	if err := ValidateRoom(room); err != nil {
+		return nil, err
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if m.active != nil {
-		return nil, errors.New("a session is already active")
+	if m.rooms[room] != nil {
+		return nil, errors.New("a session is already active in this room")
 	}
 
-	sess := NewSession(m.maxPlayers)
+	sess := NewSession(m.maxPlayers, m.maxSpectators)
+	sess.Room = room
+	sess.recorder = m.recorder
 	m.sessions[sess.ID] = sess
-	m.active = sess
+	m.rooms[room] = sess
 
 	// Add host as Player 1
 	_, err := sess.AddHost("Host")
 	if err != nil {
 		delete(m.sessions, sess.ID)
-		m.active = nil
+		delete(m.rooms, room)
 		return nil, err
 	}
 
@@ -57,20 +110,20 @@ func (m *Manager) GetSession(id string) *Session {
 	return m.sessions[id]
 }
 
-// GetActiveSession returns the current active session
-func (m *Manager) GetActiveSession() *Session {
+// GetActiveSession returns the active session in a room, or nil
+func (m *Manager) GetActiveSession(room string) *Session {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	return m.active
+	return m.rooms[room]
 }
 
-// HasActiveSession checks if there's an active session
-func (m *Manager) HasActiveSession() bool {
+// HasActiveSession checks if a room has an active session
+func (m *Manager) HasActiveSession(room string) bool {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	return m.active != nil
+	return m.rooms[room] != nil
 }
 
 // CloseSession terminates and removes a session
@@ -85,9 +138,10 @@ func (m *Manager) CloseSession(id string) {
 
 	sess.Close()
 	delete(m.sessions, id)
+	m.recordLocked(sess)
 
-	if m.active != nil && m.active.ID == id {
-		m.active = nil
+	if m.rooms[sess.Room] == sess {
+		delete(m.rooms, sess.Room)
 	}
 }
 
@@ -98,10 +152,11 @@ func (m *Manager) CloseAll() {
 
 	for _, sess := range m.sessions {
 		sess.Close()
+		m.recordLocked(sess)
 	}
 
 	m.sessions = make(map[string]*Session)
-	m.active = nil
+	m.rooms = make(map[string]*Session)
 }
 
 // ListSessions returns all active sessions
@@ -115,3 +170,22 @@ func (m *Manager) ListSessions() []*Session {
 	}
 	return sessions
 }
+
+// recordLocked adds a closed session to the history, dropping the oldest
+// entry once it is full
+func (m *Manager) recordLocked(sess *Session) {
+	if len(m.history) >= HistorySize {
+		m.history = append(m.history[:0], m.history[1:]...)
+	}
+	m.history = append(m.history, sess.Summary())
+}
+
+// History returns summaries of recently closed sessions, oldest first
+func (m *Manager) History() []*SessionSummary {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	history := make([]*SessionSummary, len(m.history))
+	copy(history, m.history)
+	return history
+}
@@ -0,0 +1,131 @@
+package session
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/zalo/moonparty/internal/moonlight"
+)
+
+// InputRecord is one input packet as an InputRecorder writes it, a line of
+// JSON each
+type InputRecord struct {
+	Time       time.Time `json:"time"`
+	Session    string    `json:"session"`
+	PeerID     string    `json:"peer"`
+	PlayerSlot int       `json:"slot"`
+	Type       string    `json:"type"`
+	Data       string    `json:"data"` // Hex
+}
+
+// InputRecorder writes every input packet sessions are sent to a file, for
+// reproducing input bugs with ReplayInput
+type InputRecorder struct {
+	mu  sync.Mutex
+	f   *os.File
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+// CreateInputRecorder creates or truncates the file at path and records to it
+func CreateInputRecorder(path string) (*InputRecorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create input recording: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	return &InputRecorder{f: f, w: w, enc: json.NewEncoder(w)}, nil
+}
+
+// Record appends an input packet sent to a session. Packets are flushed
+// as they're recorded, so a crash loses none.
+func (r *InputRecorder) Record(sessionID string, input moonlight.InputPacket) {
+	rec := InputRecord{
+		Time:       time.Now(),
+		Session:    sessionID,
+		PeerID:     input.PeerID,
+		PlayerSlot: input.PlayerSlot,
+		Type:       input.Type.String(),
+		Data:       hex.EncodeToString(input.Data),
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.enc.Encode(rec) == nil {
+		r.w.Flush()
+	}
+}
+
+// Close flushes and closes the recording
+func (r *InputRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.w.Flush(); err != nil {
+		r.f.Close()
+		return err
+	}
+	return r.f.Close()
+}
+
+// ReplayInput sends the input recorded in the file at path to the session,
+// through SendInput and with the gaps between packets they were recorded
+// with. Packets keep the player slot they were recorded from, whichever
+// session that was. It returns once the recording ends or ctx does.
+func (s *Session) ReplayInput(ctx context.Context, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open input recording: %w", err)
+	}
+	defer f.Close()
+
+	return s.replayInput(ctx, f)
+}
+
+func (s *Session) replayInput(ctx context.Context, r io.Reader) error {
+	dec := json.NewDecoder(r)
+	var start, first time.Time
+	for n := 1; ; n++ {
+		var rec InputRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("input recording entry %d: %w", n, err)
+		}
+
+		inputType, ok := moonlight.ParseInputType(rec.Type)
+		if !ok {
+			return fmt.Errorf("input recording entry %d: unknown input type %q", n, rec.Type)
+		}
+		data, err := hex.DecodeString(rec.Data)
+		if err != nil {
+			return fmt.Errorf("input recording entry %d: %w", n, err)
+		}
+
+		if first.IsZero() {
+			start, first = time.Now(), rec.Time
+		}
+		if wait := time.Until(start.Add(rec.Time.Sub(first))); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+
+		s.SendInput(moonlight.InputPacket{
+			Type:       inputType,
+			PeerID:     rec.PeerID,
+			PlayerSlot: rec.PlayerSlot,
+			Data:       data,
+		})
+	}
+}
@@ -3,7 +3,9 @@ package session
 import (
 	"context"
 	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -19,6 +21,30 @@ const (
 	RoleSpectator Role = "spectator"
 )
 
+// SlotsFullError is returned when a peer asks to play but every player slot
+// is taken. The peer is queued and promoted automatically when a slot frees.
+type SlotsFullError struct {
+	Players       int `json:"players"`
+	MaxPlayers    int `json:"max_players"`
+	QueuePosition int `json:"queue_position"` // 1-based position in the player queue
+}
+
+func (e *SlotsFullError) Error() string {
+	return fmt.Sprintf("no player slots available (%d/%d players, queue position %d)",
+		e.Players, e.MaxPlayers, e.QueuePosition)
+}
+
+// SpectatorsFullError is returned when a peer joins a session already
+// watched by as many spectators as it allows
+type SpectatorsFullError struct {
+	Spectators    int `json:"spectators"`
+	MaxSpectators int `json:"max_spectators"`
+}
+
+func (e *SpectatorsFullError) Error() string {
+	return fmt.Sprintf("session is full (%d/%d spectators)", e.Spectators, e.MaxSpectators)
+}
+
 // Peer represents a connected participant
 type Peer struct {
 	ID              string    `json:"id"`
@@ -26,36 +52,92 @@ type Peer struct {
 	Role            Role      `json:"role"`
 	PlayerSlot      int       `json:"player_slot"` // 0-3 for players, -1 for spectators
 	JoinedAt        time.Time `json:"joined_at"`
-	KeyboardEnabled bool      `json:"keyboard_enabled"` // Only host can toggle this for other players
+	KeyboardEnabled bool      `json:"keyboard_enabled"`   // Only host can toggle this for other players
+	InputOnly       bool      `json:"input_only"`         // Attached for input only, receives no media
+	Reconnecting    bool      `json:"reconnecting"`       // Disconnected, slot held for the grace window
+	Identity        string    `json:"identity,omitempty"` // Authenticated user, if the server has an Authenticator
+
+	Gamepad     moonlight.Gamepad          `json:"-"` // The controller the peer's browser reported
+	Calibration moonlight.StickCalibration `json:"-"` // Applied to the peer's sticks
 }
 
 // Session represents an active streaming session
 type Session struct {
-	ID        string    `json:"id"`
-	CreatedAt time.Time `json:"created_at"`
-
-	mu         sync.RWMutex
-	peers      map[string]*Peer
-	playerSlot [4]*Peer // Fixed 4 player slots
-	host       *Peer
-	cancelFunc context.CancelFunc
-	inputChan  chan moonlight.InputPacket
-	maxPlayers int
+	ID              string    `json:"id"`
+	Room            string    `json:"room,omitempty"` // Room code the session runs in; empty for the default room
+	CreatedAt       time.Time `json:"created_at"`
+	EndedAt         time.Time `json:"ended_at"`          // Zero until the session closes
+	PeakPlayerCount int       `json:"peak_player_count"` // Most players seated at once
+
+	mu            sync.RWMutex
+	peers         map[string]*Peer
+	departed      map[string]departedPeer // Recently removed peers, kept for Reconnect
+	held          map[string]*time.Timer  // Disconnected peers whose slot is held, by peer ID
+	playerSlot    [4]*Peer                // Fixed 4 player slots
+	queue         []string                // Peers waiting for a player slot, in order
+	host          *Peer
+	hostClaims    int    // Connections that have taken over the host peer
+	inputOwner    string // Peer the host handed the keyboard and mouse to; see inputOwnerLocked
+	paused        bool   // Host disconnected; input is paused until it returns
+	restarting    bool   // Sunshine's stream dropped and is being started again
+	closed        bool
+	cancelFunc    context.CancelFunc
+	inputChan     chan moonlight.InputPacket
+	gamepads      chan struct{} // Signaled when the occupied player slots change
+	motion        [4]uint8      // Per player slot, a bit per motion type Sunshine asked to be sent
+	maxPlayers    int
+	maxSpectators int                   // Most spectators AddSpectator admits; 0 for no limit
+	totalPeers    int                   // Peers that ever joined, reconnects excluded
+	stats         moonlight.StreamStats // Latest sample of the stream's counters
+	stream        moonlight.Streamer    // Stream being relayed to the peers, if any
+	bitrate       int                   // Video bitrate of the stream, in Kbps
+
+	// Keyframe requests for the stream loop, coalesced while one is pending
+	idrRequests    chan struct{}
+	lastIDRRequest atomic.Int64 // UnixNano of the last RequestIDRAtMost request
+
+	// Relaunch requests for the stream loop, coalesced while one is pending
+	relaunches chan struct{}
+
+	// Input queue accounting. SendInput runs under the read lock from every
+	// peer at once, so these have their own synchronization.
+	gamepadButtons [4]atomic.Uint32 // Button flags last queued for each player slot
+	penButtons     atomic.Uint32    // Pen barrel buttons last queued
+	dropMu         sync.Mutex
+	inputDrops     map[string]uint64 // Inputs dropped on a full queue, by type
+	recorder       *InputRecorder    // Records input sent to the session, if set
 
 	// Callbacks for session events
-	onPeerJoined   func(*Peer)
-	onPeerLeft     func(*Peer)
-	onRoleChanged  func(*Peer, Role)
+	onPeerJoined    func(*Peer)
+	onPeerLeft      func(*Peer)
+	onRoleChanged   func(*Peer, Role)
+	onPausedChanged func(bool)
+	onRestarting    func(bool)
+	onHostLost      func()
 }
 
-// NewSession creates a new streaming session
-func NewSession(maxPlayers int) *Session {
+// departedPeer remembers a removed peer so it can reconnect
+type departedPeer struct {
+	peer   *Peer
+	leftAt time.Time
+}
+
+// NewSession creates a new streaming session. maxSpectators limits the
+// spectators who can join; 0 leaves them unlimited.
+func NewSession(maxPlayers, maxSpectators int) *Session {
 	return &Session{
-		ID:         uuid.New().String()[:8], // Short ID for easy sharing
-		CreatedAt:  time.Now(),
-		peers:      make(map[string]*Peer),
-		inputChan:  make(chan moonlight.InputPacket, 256),
-		maxPlayers: maxPlayers,
+		ID:            uuid.New().String()[:8], // Short ID for easy sharing
+		CreatedAt:     time.Now(),
+		peers:         make(map[string]*Peer),
+		departed:      make(map[string]departedPeer),
+		held:          make(map[string]*time.Timer),
+		inputChan:     make(chan moonlight.InputPacket, 256),
+		gamepads:      make(chan struct{}, 1),
+		idrRequests:   make(chan struct{}, 1),
+		relaunches:    make(chan struct{}, 1),
+		inputDrops:    make(map[string]uint64),
+		maxPlayers:    maxPlayers,
+		maxSpectators: maxSpectators,
 	}
 }
 
@@ -70,16 +152,19 @@ func (s *Session) AddHost(name string) (*Peer, error) {
 
 	peer := &Peer{
 		ID:              uuid.New().String(),
-		Name:           name,
-		Role:           RoleHost,
-		PlayerSlot:     0,
-		JoinedAt:       time.Now(),
+		Name:            name,
+		Role:            RoleHost,
+		PlayerSlot:      0,
+		JoinedAt:        time.Now(),
+		Calibration:     moonlight.DefaultStickCalibration(),
 		KeyboardEnabled: true, // Host always has keyboard
 	}
 
 	s.peers[peer.ID] = peer
 	s.playerSlot[0] = peer
 	s.host = peer
+	s.totalPeers++
+	s.slotsChangedLocked()
 
 	if s.onPeerJoined != nil {
 		go s.onPeerJoined(peer)
@@ -88,21 +173,80 @@ func (s *Session) AddHost(name string) (*Peer, error) {
 	return peer, nil
 }
 
-// AddSpectator adds a new spectator to the session
+// ClaimHost hands the host peer created with the session to the first
+// connection that asks for it. Later callers get false.
+func (s *Session) ClaimHost(name string) (*Peer, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.host == nil || s.hostClaims > 0 {
+		return nil, false
+	}
+	s.hostClaims++
+	s.host.Name = name
+	return s.host, true
+}
+
+// AddSpectator adds a new spectator to the session. It returns a
+// *SpectatorsFullError if the session has as many as it allows.
 func (s *Session) AddSpectator(name string) (*Peer, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.maxSpectators > 0 {
+		if n := s.spectatorCountLocked(); n >= s.maxSpectators {
+			return nil, &SpectatorsFullError{Spectators: n, MaxSpectators: s.maxSpectators}
+		}
+	}
+
+	peer := &Peer{
+		ID:              uuid.New().String(),
+		Name:            name,
+		Role:            RoleSpectator,
+		PlayerSlot:      -1,
+		JoinedAt:        time.Now(),
+		Calibration:     moonlight.DefaultStickCalibration(),
+		KeyboardEnabled: false,
+	}
+
+	s.peers[peer.ID] = peer
+	s.totalPeers++
+
+	if s.onPeerJoined != nil {
+		go s.onPeerJoined(peer)
+	}
+
+	return peer, nil
+}
+
+// AttachInput adds a peer that only drives input on the running stream.
+// Video is already launched once and broadcast to every peer, so an extra
+// controller (e.g. a phone used as a gamepad) just needs a player slot to
+// tag its input with; no media is sent to it and nothing is launched on Sunshine.
+func (s *Session) AttachInput(name string) (*Peer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	slot := s.freeSlotLocked()
+	if slot == -1 {
+		return nil, errors.New("no player slots available")
+	}
+
 	peer := &Peer{
 		ID:              uuid.New().String(),
-		Name:           name,
-		Role:           RoleSpectator,
-		PlayerSlot:     -1,
-		JoinedAt:       time.Now(),
+		Name:            name,
+		Role:            RolePlayer,
+		PlayerSlot:      slot,
+		JoinedAt:        time.Now(),
+		Calibration:     moonlight.DefaultStickCalibration(),
 		KeyboardEnabled: false,
+		InputOnly:       true,
 	}
 
 	s.peers[peer.ID] = peer
+	s.playerSlot[slot] = peer
+	s.totalPeers++
+	s.slotsChangedLocked()
 
 	if s.onPeerJoined != nil {
 		go s.onPeerJoined(peer)
@@ -111,6 +255,17 @@ func (s *Session) AddSpectator(name string) (*Peer, error) {
 	return peer, nil
 }
 
+// freeSlotLocked returns the first free non-host player slot, or -1
+func (s *Session) freeSlotLocked() int {
+	// Slot 0 is reserved for the host
+	for i := 1; i < s.maxPlayers && i < 4; i++ {
+		if s.playerSlot[i] == nil {
+			return i
+		}
+	}
+	return -1
+}
+
 // PromoteToPlayer promotes a spectator to an active player
 func (s *Session) PromoteToPlayer(peerID string) (int, error) {
 	s.mu.Lock()
@@ -126,27 +281,90 @@ func (s *Session) PromoteToPlayer(peerID string) (int, error) {
 	}
 
 	// Find an available slot (1-3, since 0 is host)
-	slot := -1
-	for i := 1; i < s.maxPlayers && i < 4; i++ {
-		if s.playerSlot[i] == nil {
-			slot = i
-			break
+	slot := s.freeSlotLocked()
+	if slot == -1 {
+		return -1, &SlotsFullError{
+			Players:       s.playerCountLocked(),
+			MaxPlayers:    s.slotLimit(),
+			QueuePosition: s.enqueueLocked(peerID),
 		}
 	}
 
-	if slot == -1 {
-		return -1, errors.New("no player slots available")
-	}
+	s.assignSlotLocked(peer, slot)
+	return slot, nil
+}
+
+// assignSlotLocked makes a peer the player in the given slot
+func (s *Session) assignSlotLocked(peer *Peer, slot int) {
+	s.dequeueLocked(peer.ID)
 
 	peer.Role = RolePlayer
 	peer.PlayerSlot = slot
 	s.playerSlot[slot] = peer
+	s.slotsChangedLocked()
 
 	if s.onRoleChanged != nil {
 		go s.onRoleChanged(peer, RolePlayer)
 	}
+}
 
-	return slot, nil
+// enqueueLocked adds a peer to the player queue and returns its 1-based position
+func (s *Session) enqueueLocked(peerID string) int {
+	for i, id := range s.queue {
+		if id == peerID {
+			return i + 1
+		}
+	}
+	s.queue = append(s.queue, peerID)
+	return len(s.queue)
+}
+
+// dequeueLocked removes a peer from the player queue
+func (s *Session) dequeueLocked(peerID string) {
+	for i, id := range s.queue {
+		if id == peerID {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// promoteQueuedLocked fills a freed slot with the next queued peer
+func (s *Session) promoteQueuedLocked() {
+	for len(s.queue) > 0 {
+		slot := s.freeSlotLocked()
+		if slot == -1 {
+			return
+		}
+
+		peer, ok := s.peers[s.queue[0]]
+		if !ok || peer.Role != RoleSpectator {
+			s.queue = s.queue[1:]
+			continue
+		}
+		s.assignSlotLocked(peer, slot)
+	}
+}
+
+// GetQueuePosition returns a peer's 1-based position in the player queue, or 0
+func (s *Session) GetQueuePosition(peerID string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for i, id := range s.queue {
+		if id == peerID {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// slotLimit returns the number of usable player slots
+func (s *Session) slotLimit() int {
+	if s.maxPlayers > 4 {
+		return 4
+	}
+	return s.maxPlayers
 }
 
 // DemoteToSpectator demotes a player back to spectator
@@ -170,6 +388,7 @@ func (s *Session) DemoteToSpectator(peerID string) error {
 	// Free the slot
 	if peer.PlayerSlot >= 0 && peer.PlayerSlot < 4 {
 		s.playerSlot[peer.PlayerSlot] = nil
+		s.slotsChangedLocked()
 	}
 
 	peer.Role = RoleSpectator
@@ -180,6 +399,8 @@ func (s *Session) DemoteToSpectator(peerID string) error {
 		go s.onRoleChanged(peer, RoleSpectator)
 	}
 
+	s.promoteQueuedLocked()
+
 	return nil
 }
 
@@ -188,21 +409,228 @@ func (s *Session) RemovePeer(peerID string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	s.removePeerLocked(peerID)
+}
+
+// ErrNotHost is returned when a peer other than the host tries to manage
+// the session
+var ErrNotHost = errors.New("only the host can do that")
+
+// KickPeer removes a peer at the host's request, freeing its player slot.
+// A kicked peer can't reclaim its place with Reconnect.
+func (s *Session) KickPeer(requesterID, targetID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.host == nil || s.host.ID != requesterID {
+		return ErrNotHost
+	}
+	if targetID == requesterID {
+		return errors.New("host cannot kick itself")
+	}
+	if _, ok := s.peers[targetID]; !ok {
+		return errors.New("peer not found")
+	}
+
+	s.removePeerLocked(targetID)
+	delete(s.departed, targetID)
+	return nil
+}
+
+// HoldPeer marks a disconnected peer as reconnecting and keeps its role and
+// player slot for the grace window. If it hasn't reconnected by then it is
+// removed and its slot goes to the next queued peer. A zero grace removes it now.
+func (s *Session) HoldPeer(peerID string, grace time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	peer, ok := s.peers[peerID]
 	if !ok {
 		return
 	}
+	if grace <= 0 {
+		s.removePeerLocked(peerID)
+		return
+	}
+
+	peer.Reconnecting = true
+	if peer == s.host {
+		// Keep the stream and spectators; just hold input until the host returns
+		s.setPausedLocked(true)
+	}
+	if t, ok := s.held[peerID]; ok {
+		t.Stop()
+	}
+	s.held[peerID] = time.AfterFunc(grace, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if p, ok := s.peers[peerID]; ok && p.Reconnecting {
+			s.removePeerLocked(peerID)
+		}
+	})
+}
+
+func (s *Session) removePeerLocked(peerID string) {
+	peer, ok := s.peers[peerID]
+	if !ok {
+		return
+	}
+
+	if t, ok := s.held[peerID]; ok {
+		t.Stop()
+		delete(s.held, peerID)
+	}
+	peer.Reconnecting = false
 
 	// Free player slot if applicable
 	if peer.PlayerSlot >= 0 && peer.PlayerSlot < 4 {
 		s.playerSlot[peer.PlayerSlot] = nil
+		s.slotsChangedLocked()
 	}
 
 	delete(s.peers, peerID)
+	s.departed[peerID] = departedPeer{peer: peer, leftAt: time.Now()}
+	s.dequeueLocked(peerID)
+	s.promoteQueuedLocked()
 
 	if s.onPeerLeft != nil {
 		go s.onPeerLeft(peer)
 	}
+
+	if peer == s.host && s.onHostLost != nil {
+		go s.onHostLost()
+	}
+}
+
+// setPausedLocked updates the paused state and reports changes
+func (s *Session) setPausedLocked(paused bool) {
+	if s.paused == paused {
+		return
+	}
+	s.paused = paused
+	if s.onPausedChanged != nil {
+		go s.onPausedChanged(paused)
+	}
+}
+
+// IsPaused reports whether the session is waiting for its host to reconnect
+func (s *Session) IsPaused() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.paused
+}
+
+// SetStreamRestarting records whether the stream from Sunshine is being
+// started again after dropping, and reports changes
+func (s *Session) SetStreamRestarting(restarting bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.restarting == restarting {
+		return
+	}
+	s.restarting = restarting
+	if s.onRestarting != nil {
+		go s.onRestarting(restarting)
+	}
+}
+
+// IsStreamRestarting reports whether the stream from Sunshine dropped and is
+// being started again
+func (s *Session) IsStreamRestarting() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.restarting
+}
+
+// Reconnect restores a peer that left within the given window.
+// A peer still held by HoldPeer simply resumes. Otherwise the peer gets its
+// old player slot back if it is still free, or rejoins as a spectator; the
+// host keeps its role and takes any free slot instead.
+func (s *Session) Reconnect(peerID string, window time.Duration) (*Peer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Forget peers that have been gone too long
+	s.expireDepartedLocked(window)
+
+	// Peers still inside their grace window kept everything; just resume
+	if peer, ok := s.peers[peerID]; ok && peer.Reconnecting {
+		if t, ok := s.held[peerID]; ok {
+			t.Stop()
+			delete(s.held, peerID)
+		}
+		peer.Reconnecting = false
+		if peer == s.host {
+			s.setPausedLocked(false)
+		}
+		return peer, nil
+	}
+
+	d, ok := s.departed[peerID]
+	if !ok {
+		return nil, errors.New("no recently disconnected peer to restore")
+	}
+	delete(s.departed, peerID)
+
+	peer := d.peer
+	if slot := peer.PlayerSlot; slot >= 0 && slot < 4 {
+		switch {
+		case s.playerSlot[slot] == nil:
+			s.playerSlot[slot] = peer
+			s.slotsChangedLocked()
+		case peer.Role == RoleHost:
+			// The host stays host, in another slot if one is free and
+			// otherwise without one
+			peer.PlayerSlot = s.freeSlotLocked()
+			if peer.PlayerSlot != -1 {
+				s.playerSlot[peer.PlayerSlot] = peer
+				s.slotsChangedLocked()
+			}
+		default:
+			peer.Role = RoleSpectator
+			peer.PlayerSlot = -1
+			peer.KeyboardEnabled = false
+		}
+	}
+
+	s.peers[peer.ID] = peer
+
+	if s.onPeerJoined != nil {
+		go s.onPeerJoined(peer)
+	}
+
+	return peer, nil
+}
+
+// ExpireDeparted forgets peers that left more than window ago, after which
+// they can't Reconnect. It returns how many were forgotten.
+func (s *Session) ExpireDeparted(window time.Duration) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.expireDepartedLocked(window)
+}
+
+func (s *Session) expireDepartedLocked(window time.Duration) int {
+	expired := 0
+	now := time.Now()
+	for id, d := range s.departed {
+		if now.Sub(d.leftAt) > window {
+			delete(s.departed, id)
+			expired++
+		}
+	}
+	return expired
+}
+
+// SetPeerIdentity records the authenticated user behind a peer
+func (s *Session) SetPeerIdentity(peerID, identity string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if peer, ok := s.peers[peerID]; ok {
+		peer.Identity = identity
+	}
 }
 
 // SetKeyboardEnabled toggles keyboard input for a player
@@ -223,6 +651,57 @@ func (s *Session) SetKeyboardEnabled(peerID string, enabled bool) {
 	peer.KeyboardEnabled = enabled
 }
 
+// SetInputOwner hands the keyboard and mouse to a peer; nobody else can
+// send them until they're handed on. The host can always be given them
+// back, and a player given them is allowed the keyboard. Spectators can't
+// own them.
+func (s *Session) SetInputOwner(peerID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peer, ok := s.peers[peerID]
+	if !ok {
+		return errors.New("peer not found")
+	}
+	switch peer.Role {
+	case RoleHost:
+	case RolePlayer:
+		peer.KeyboardEnabled = true
+	default:
+		return errors.New("only the host or a player can own the keyboard and mouse")
+	}
+
+	s.inputOwner = peerID
+	return nil
+}
+
+// InputOwner returns the ID of the peer holding the keyboard and mouse, or
+// "" if nobody can send them
+func (s *Session) InputOwner() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if owner := s.inputOwnerLocked(); owner != nil {
+		return owner.ID
+	}
+	return ""
+}
+
+// inputOwnerLocked returns the peer holding the keyboard and mouse. They
+// go back to the host when their owner leaves, is demoted or loses the
+// keyboard.
+func (s *Session) inputOwnerLocked() *Peer {
+	if peer, ok := s.peers[s.inputOwner]; ok {
+		if peer.Role == RoleHost || (peer.Role == RolePlayer && peer.KeyboardEnabled) {
+			return peer
+		}
+	}
+	if s.host != nil && s.peers[s.host.ID] == s.host {
+		return s.host
+	}
+	return nil
+}
+
 // GetPeer returns a peer by ID
 func (s *Session) GetPeer(peerID string) *Peer {
 	s.mu.RLock()
@@ -231,6 +710,17 @@ func (s *Session) GetPeer(peerID string) *Peer {
 	return s.peers[peerID]
 }
 
+// GetPeerBySlot returns the peer occupying a player slot, or nil
+func (s *Session) GetPeerBySlot(slot int) *Peer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if slot < 0 || slot >= len(s.playerSlot) {
+		return nil
+	}
+	return s.playerSlot[slot]
+}
+
 // GetHost returns the session host
 func (s *Session) GetHost() *Peer {
 	s.mu.RLock()
@@ -258,6 +748,10 @@ func (s *Session) GetPlayerCount() int {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
+	return s.playerCountLocked()
+}
+
+func (s *Session) playerCountLocked() int {
 	count := 0
 	for _, p := range s.playerSlot {
 		if p != nil {
@@ -267,11 +761,106 @@ func (s *Session) GetPlayerCount() int {
 	return count
 }
 
+// slotsChangedLocked records a new peak in seated players and tells the
+// stream the set of connected controllers changed
+func (s *Session) slotsChangedLocked() {
+	if n := s.playerCountLocked(); n > s.PeakPlayerCount {
+		s.PeakPlayerCount = n
+	}
+
+	s.signalGamepadsLocked()
+}
+
+// signalGamepadsLocked tells the stream the seated controllers changed
+func (s *Session) signalGamepadsLocked() {
+	select {
+	case s.gamepads <- struct{}{}:
+	default:
+		// A change is already pending; the stream reads the latest mask
+	}
+}
+
+// ActiveGamepadMask returns one bit per occupied player slot. Players who
+// are reconnecting keep their bit so their controller doesn't drop in-game.
+func (s *Session) ActiveGamepadMask() uint16 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var mask uint16
+	for i, p := range s.playerSlot {
+		if p != nil {
+			mask |= 1 << i
+		}
+	}
+	return mask
+}
+
+// SetPeerGamepad records the controller a peer's browser reported, passing
+// it on to the stream if the peer holds a player slot
+func (s *Session) SetPeerGamepad(peerID string, pad moonlight.Gamepad) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peer, ok := s.peers[peerID]
+	if !ok || peer.Gamepad == pad {
+		return
+	}
+	peer.Gamepad = pad
+	if peer.PlayerSlot >= 0 && peer.PlayerSlot < 4 {
+		s.signalGamepadsLocked()
+	}
+}
+
+// SetPeerCalibration sets how a peer's sticks are corrected
+func (s *Session) SetPeerCalibration(peerID string, cal moonlight.StickCalibration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if peer, ok := s.peers[peerID]; ok {
+		peer.Calibration = cal
+	}
+}
+
+// PeerCalibration returns how a peer's sticks are corrected
+func (s *Session) PeerCalibration(peerID string) moonlight.StickCalibration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if peer, ok := s.peers[peerID]; ok {
+		return peer.Calibration
+	}
+	return moonlight.DefaultStickCalibration()
+}
+
+// SlotGamepads returns the controller reported for each player slot; empty
+// slots and peers that reported none give the zero Gamepad
+func (s *Session) SlotGamepads() [4]moonlight.Gamepad {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var pads [4]moonlight.Gamepad
+	for i, p := range s.playerSlot {
+		if p != nil {
+			pads[i] = p.Gamepad
+		}
+	}
+	return pads
+}
+
+// GamepadsChanged signals when ActiveGamepadMask or SlotGamepads may have
+// changed. Changes made while a signal is pending are coalesced.
+func (s *Session) GamepadsChanged() <-chan struct{} {
+	return s.gamepads
+}
+
 // GetSpectatorCount returns the number of spectators
 func (s *Session) GetSpectatorCount() int {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
+	return s.spectatorCountLocked()
+}
 
+func (s *Session) spectatorCountLocked() int {
 	count := 0
 	for _, p := range s.peers {
 		if p.Role == RoleSpectator {
@@ -298,13 +887,96 @@ func (s *Session) InputChannel() <-chan moonlight.InputPacket {
 	return s.inputChan
 }
 
-// SendInput queues an input packet for sending to Sunshine
+// inputReserve is how much of the input queue is kept for reliable input, so
+// a flood of mouse moves or stick updates can't crowd out a button release
+const inputReserve = 64
+
+// SendInput queues an input packet for sending to Sunshine.
+// Input is dropped while the session is paused or its stream is restarting.
+// When the queue backs up, coalescable input (mouse moves, analog-only
+// gamepad updates) is dropped first; see isReliableInput.
 func (s *Session) SendInput(input moonlight.InputPacket) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.paused || s.restarting || s.closed {
+		return
+	}
+	if s.recorder != nil {
+		s.recorder.Record(s.ID, input)
+	}
+
+	if !s.isReliableInput(input) && len(s.inputChan) >= cap(s.inputChan)-inputReserve {
+		s.noteInputDropped(input.Type)
+		return
+	}
+
 	select {
 	case s.inputChan <- input:
+		if input.Type == moonlight.InputTypeGamepad && len(input.Data) >= 2 &&
+			input.PlayerSlot >= 0 && input.PlayerSlot < len(s.gamepadButtons) {
+			s.gamepadButtons[input.PlayerSlot].Store(uint32(input.Data[0]) | uint32(input.Data[1])<<8)
+		}
+		if input.Type == moonlight.InputTypePen && len(input.Data) >= 3 {
+			s.penButtons.Store(uint32(input.Data[2]))
+		}
+	default:
+		s.noteInputDropped(input.Type)
+	}
+}
+
+// isReliableInput reports whether losing the input could leave something
+// stuck on the host. Keys, buttons and text always are. A mouse move, pointer
+// position, scroll or motion sample isn't. A gamepad state is when its buttons
+// changed or it returns every axis and trigger to rest, since browsers only
+// send states that changed; otherwise the next state supersedes it. A pen
+// hovering or moving is when its barrel buttons changed, which is also when
+// the input stream stops letting it drop.
+func (s *Session) isReliableInput(input moonlight.InputPacket) bool {
+	switch input.Type {
+	case moonlight.InputTypeMouseRelative, moonlight.InputTypeMouseAbsolute, moonlight.InputTypeScroll,
+		moonlight.InputTypeMotion:
+		return false
+	case moonlight.InputTypePen:
+		pen, ok := moonlight.ParsePen(input.Data)
+		return !ok || !pen.Moving() || uint32(pen.Buttons) != s.penButtons.Load()
+	case moonlight.InputTypeGamepad:
+		if len(input.Data) < 12 || input.PlayerSlot < 0 || input.PlayerSlot >= len(s.gamepadButtons) {
+			return true
+		}
+		buttons := uint32(input.Data[0]) | uint32(input.Data[1])<<8
+		if buttons != s.gamepadButtons[input.PlayerSlot].Load() {
+			return true
+		}
+		for _, b := range input.Data[2:12] {
+			if b != 0 {
+				return false
+			}
+		}
+		return true
 	default:
-		// Drop input if buffer is full
+		return true
+	}
+}
+
+// noteInputDropped counts an input lost to a full queue
+func (s *Session) noteInputDropped(t moonlight.InputType) {
+	s.dropMu.Lock()
+	defer s.dropMu.Unlock()
+	s.inputDrops[t.String()]++
+}
+
+// InputDrops returns how many inputs of each type were dropped because the
+// queue to Sunshine was full
+func (s *Session) InputDrops() map[string]uint64 {
+	s.dropMu.Lock()
+	defer s.dropMu.Unlock()
+
+	drops := make(map[string]uint64, len(s.inputDrops))
+	for t, n := range s.inputDrops {
+		drops[t] = n
 	}
+	return drops
 }
 
 // SetCancelFunc sets the cancel function for the stream
@@ -323,7 +995,138 @@ func (s *Session) Close() {
 		s.cancelFunc()
 	}
 
-	close(s.inputChan)
+	for id, t := range s.held {
+		t.Stop()
+		delete(s.held, id)
+	}
+
+	if !s.closed {
+		s.closed = true
+		s.EndedAt = time.Now()
+		close(s.inputChan)
+	}
+}
+
+// SetStream records the stream being relayed to the session, or nil
+func (s *Session) SetStream(stream moonlight.Streamer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stream = stream
+}
+
+// Stream returns the stream being relayed to the session, or nil
+func (s *Session) Stream() moonlight.Streamer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.stream
+}
+
+// RequestIDR asks the session's stream for a keyframe; requests made while
+// one is already pending are coalesced
+func (s *Session) RequestIDR() {
+	select {
+	case s.idrRequests <- struct{}{}:
+	default:
+	}
+}
+
+// RequestIDRAtMost is RequestIDR limited to one request per interval,
+// however many peers ask
+func (s *Session) RequestIDRAtMost(interval time.Duration) {
+	now := time.Now().UnixNano()
+	last := s.lastIDRRequest.Load()
+	if now-last < int64(interval) || !s.lastIDRRequest.CompareAndSwap(last, now) {
+		return
+	}
+	s.RequestIDR()
+}
+
+// IDRRequests returns the channel the stream loop reads keyframe requests from
+func (s *Session) IDRRequests() <-chan struct{} {
+	return s.idrRequests
+}
+
+// RequestRelaunch asks the stream loop to launch the stream again, picking
+// up changed stream settings; requests made while one is already pending are
+// coalesced
+func (s *Session) RequestRelaunch() {
+	select {
+	case s.relaunches <- struct{}{}:
+	default:
+	}
+}
+
+// RelaunchRequests returns the channel the stream loop reads relaunch
+// requests from
+func (s *Session) RelaunchRequests() <-chan struct{} {
+	return s.relaunches
+}
+
+// SetStreamBitrate records the video bitrate, in Kbps, that the session's
+// stream was launched with
+func (s *Session) SetStreamBitrate(kbps int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bitrate = kbps
+}
+
+// StreamBitrate returns the video bitrate of the session's stream in Kbps,
+// or 0 before one has launched
+func (s *Session) StreamBitrate() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.bitrate
+}
+
+// SetStreamStats records the latest stream counters for the session summary
+func (s *Session) SetStreamStats(stats moonlight.StreamStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats = stats
+}
+
+// SessionSummary describes a finished session for the history
+type SessionSummary struct {
+	ID                   string        `json:"id"`
+	Room                 string        `json:"room,omitempty"`
+	CreatedAt            time.Time     `json:"created_at"`
+	EndedAt              time.Time     `json:"ended_at"`
+	Duration             time.Duration `json:"duration"`
+	PeakPlayerCount      int           `json:"peak_player_count"`
+	TotalPeers           int           `json:"total_peers"`
+	VideoPacketsReceived uint32        `json:"video_packets_received"`
+	VideoPacketsDropped  uint32        `json:"video_packets_dropped"`
+	IDRRequests          uint32        `json:"idr_requests"`
+	RefInvalidations     uint32        `json:"ref_invalidations"`
+
+	// InputsDropped counts inputs lost to a full queue, by type
+	InputsDropped map[string]uint64 `json:"inputs_dropped,omitempty"`
+}
+
+// Summary returns the session's summary; for a session that hasn't closed
+// the duration runs up to now
+func (s *Session) Summary() *SessionSummary {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	end := s.EndedAt
+	if end.IsZero() {
+		end = time.Now()
+	}
+	return &SessionSummary{
+		ID:                   s.ID,
+		Room:                 s.Room,
+		CreatedAt:            s.CreatedAt,
+		EndedAt:              s.EndedAt,
+		Duration:             end.Sub(s.CreatedAt),
+		PeakPlayerCount:      s.PeakPlayerCount,
+		TotalPeers:           s.totalPeers,
+		VideoPacketsReceived: s.stats.VideoPacketsReceived,
+		VideoPacketsDropped:  s.stats.VideoPacketsDropped,
+		IDRRequests:          s.stats.IDRRequests,
+		RefInvalidations:     s.stats.RefInvalidations,
+		InputsDropped:        s.InputDrops(),
+	}
 }
 
 // OnPeerJoined sets a callback for peer join events
@@ -341,6 +1144,24 @@ func (s *Session) OnRoleChanged(fn func(*Peer, Role)) {
 	s.onRoleChanged = fn
 }
 
+// OnPausedChanged sets a callback for when the session pauses or resumes
+// around a host disconnect
+func (s *Session) OnPausedChanged(fn func(bool)) {
+	s.onPausedChanged = fn
+}
+
+// OnStreamRestarting sets a callback for when the stream from Sunshine drops
+// and is being started again, and for when it's back or given up on
+func (s *Session) OnStreamRestarting(fn func(bool)) {
+	s.onRestarting = fn
+}
+
+// OnHostLost sets a callback for when the host leaves for good, either
+// explicitly or by not reconnecting within its grace window
+func (s *Session) OnHostLost(fn func()) {
+	s.onHostLost = fn
+}
+
 // CanSendInput checks if a peer can send the given input type
 func (s *Session) CanSendInput(peerID string, inputType moonlight.InputType) bool {
 	s.mu.RLock()
@@ -351,24 +1172,63 @@ func (s *Session) CanSendInput(peerID string, inputType moonlight.InputType) boo
 		return false
 	}
 
-	// Spectators cannot send any input
-	if peer.Role == RoleSpectator {
+	// Spectators cannot send any input, and nobody can while paused
+	if peer.Role == RoleSpectator || s.paused {
 		return false
 	}
 
 	// Check input type permissions
 	switch inputType {
-	case moonlight.InputTypeKeyboard, moonlight.InputTypeMouse, moonlight.InputTypeMouseRelative:
-		// Only host or players with keyboard enabled
-		return peer.Role == RoleHost || peer.KeyboardEnabled
+	case moonlight.InputTypeKeyboard, moonlight.InputTypeMouse, moonlight.InputTypeMouseRelative,
+		moonlight.InputTypeMouseAbsolute, moonlight.InputTypeScroll, moonlight.InputTypeText,
+		moonlight.InputTypePen:
+		// Only whoever holds the keyboard and mouse; there's one cursor
+		return peer == s.inputOwnerLocked()
 	case moonlight.InputTypeGamepad:
 		// All players can send gamepad
 		return peer.Role == RoleHost || peer.Role == RolePlayer
+	case moonlight.InputTypeMotion:
+		// All players can send motion, of the types WantsMotion allows
+		return peer.Role == RoleHost || peer.Role == RolePlayer
 	default:
 		return false
 	}
 }
 
+// WantsMotion reports whether Sunshine asked for motion of motionType
+// (types.MotionType) from the controller in a peer's player slot
+func (s *Session) WantsMotion(peerID string, motionType uint8) bool {
+	if motionType < 1 || motionType > 8 {
+		return false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	peer, ok := s.peers[peerID]
+	if !ok || peer.PlayerSlot < 0 || peer.PlayerSlot >= len(s.motion) {
+		return false
+	}
+	return s.motion[peer.PlayerSlot]&(1<<(motionType-1)) != 0
+}
+
+// SetMotionReporting records Sunshine starting or stopping motion reports of
+// a type from the controller in a player slot
+func (s *Session) SetMotionReporting(slot int, motionType uint8, enabled bool) {
+	if slot < 0 || slot >= len(s.motion) || motionType < 1 || motionType > 8 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if enabled {
+		s.motion[slot] |= 1 << (motionType - 1)
+	} else {
+		s.motion[slot] &^= 1 << (motionType - 1)
+	}
+}
+
 // GetPlayerSlot returns the gamepad slot for a peer's input
 func (s *Session) GetPlayerSlot(peerID string) int {
 	s.mu.RLock()
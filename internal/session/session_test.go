@@ -0,0 +1,181 @@
+package session
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// checkSlots fails if a peer claims a player slot that holds someone else
+func checkSlots(t *testing.T, s *Session) {
+	t.Helper()
+	for _, p := range s.GetAllPeers() {
+		if p.PlayerSlot >= 0 && s.GetPeerBySlot(p.PlayerSlot) != p {
+			t.Errorf("%s claims slot %d, which holds %v", p.Name, p.PlayerSlot, s.GetPeerBySlot(p.PlayerSlot))
+		}
+	}
+}
+
+// hostWithSlotTaken returns a session whose host left and came back to find
+// its slot taken, with fill more input peers attached while it was gone
+func hostWithSlotTaken(t *testing.T, fill int) (*Session, *Peer) {
+	t.Helper()
+
+	s := NewSession(4, 0)
+	host, err := s.AddHost("host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RemovePeer(host.ID)
+
+	intruder, err := s.AttachInput("intruder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	s.playerSlot[intruder.PlayerSlot] = nil
+	intruder.PlayerSlot = 0
+	s.playerSlot[0] = intruder
+	s.mu.Unlock()
+
+	for i := 0; i < fill; i++ {
+		if _, err := s.AttachInput("pad"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	back, err := s.Reconnect(host.ID, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, back
+}
+
+func TestReconnectHostTakesFreeSlot(t *testing.T) {
+	s, host := hostWithSlotTaken(t, 1)
+
+	if host.Role != RoleHost || host.PlayerSlot != 2 {
+		t.Fatalf("host came back as %s in slot %d, want host in slot 2", host.Role, host.PlayerSlot)
+	}
+	checkSlots(t, s)
+}
+
+func TestReconnectHostWithoutFreeSlot(t *testing.T) {
+	s, host := hostWithSlotTaken(t, 3)
+
+	if host.Role != RoleHost || host.PlayerSlot != -1 {
+		t.Fatalf("host came back as %s in slot %d, want host without a slot", host.Role, host.PlayerSlot)
+	}
+	checkSlots(t, s)
+}
+
+func TestReconnectPlayerSlotTaken(t *testing.T) {
+	s := NewSession(2, 0)
+	if _, err := s.AddHost("host"); err != nil {
+		t.Fatal(err)
+	}
+	player, err := s.AttachInput("player")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.RemovePeer(player.ID)
+	if _, err := s.AttachInput("replacement"); err != nil {
+		t.Fatal(err)
+	}
+
+	back, err := s.Reconnect(player.ID, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back.Role != RoleSpectator || back.PlayerSlot != -1 {
+		t.Fatalf("player came back as %s in slot %d, want a spectator", back.Role, back.PlayerSlot)
+	}
+	checkSlots(t, s)
+}
+
+func TestSpectatorLimit(t *testing.T) {
+	s := NewSession(4, 2)
+	if _, err := s.AddHost("host"); err != nil {
+		t.Fatal(err)
+	}
+
+	var spectators []*Peer
+	for i := 0; i < 2; i++ {
+		p, err := s.AddSpectator("spectator")
+		if err != nil {
+			t.Fatalf("spectator %d of 2: %v", i+1, err)
+		}
+		spectators = append(spectators, p)
+	}
+
+	// The host doesn't count; a third spectator does, and is turned away
+	_, err := s.AddSpectator("overflow")
+	var full *SpectatorsFullError
+	if !errors.As(err, &full) || full.Spectators != 2 || full.MaxSpectators != 2 {
+		t.Fatalf("third spectator: %v, want a SpectatorsFullError for 2 of 2", err)
+	}
+
+	// Nor do spectators promoted to players, so the waiting one gets in
+	if _, err := s.PromoteToPlayer(spectators[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddSpectator("waiting"); err != nil {
+		t.Fatalf("joining after a spectator became a player: %v", err)
+	}
+
+	// And a spectator leaving makes room too
+	if _, err := s.AddSpectator("overflow"); err == nil {
+		t.Fatal("admitted a spectator past the limit")
+	}
+	s.RemovePeer(spectators[1].ID)
+	if _, err := s.AddSpectator("waiting"); err != nil {
+		t.Fatalf("joining after a spectator left: %v", err)
+	}
+}
+
+func TestSpectatorsUnlimited(t *testing.T) {
+	s := NewSession(4, 0)
+	for i := 0; i < 100; i++ {
+		if _, err := s.AddSpectator("spectator"); err != nil {
+			t.Fatalf("spectator %d with no limit: %v", i+1, err)
+		}
+	}
+}
+
+func TestWantsMotion(t *testing.T) {
+	s := NewSession(4, 0)
+	host, err := s.AddHost("host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spectator, err := s.AddSpectator("spectator")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const accel, gyro = 1, 2
+	s.SetMotionReporting(host.PlayerSlot, accel, true)
+
+	tests := []struct {
+		name       string
+		peerID     string
+		motionType uint8
+		want       bool
+	}{
+		{"requested type", host.ID, accel, true},
+		{"other type", host.ID, gyro, false},
+		{"out of range type", host.ID, 0, false},
+		{"no player slot", spectator.ID, accel, false},
+		{"unknown peer", "nobody", accel, false},
+	}
+	for _, tt := range tests {
+		if got := s.WantsMotion(tt.peerID, tt.motionType); got != tt.want {
+			t.Errorf("%s: WantsMotion = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	s.SetMotionReporting(host.PlayerSlot, accel, false)
+	if s.WantsMotion(host.ID, accel) {
+		t.Error("WantsMotion after Sunshine stopped asking for the accelerometer")
+	}
+}
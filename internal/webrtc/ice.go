@@ -0,0 +1,73 @@
+package webrtc
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// ICEConfig lists the STUN/TURN servers offered to peers and says how TURN
+// credentials are issued
+type ICEConfig struct {
+	// URLs of the STUN and TURN servers
+	URLs []string
+
+	// Username and Credential are static TURN credentials, used when
+	// Secret is empty
+	Username   string
+	Credential string
+
+	// Secret is the TURN server's shared secret (coturn's
+	// static-auth-secret). When set, every request for ICE servers gets
+	// fresh credentials that expire after TTL.
+	Secret string
+	TTL    time.Duration
+}
+
+// defaultTURNCredentialTTL is how long issued TURN credentials last when no
+// TTL is configured
+const defaultTURNCredentialTTL = 24 * time.Hour
+
+// Servers returns the ICE servers for user, with credentials on the TURN ones
+func (c ICEConfig) Servers(user string) []webrtc.ICEServer {
+	username, credential := c.Username, c.Credential
+	if c.Secret != "" {
+		ttl := c.TTL
+		if ttl <= 0 {
+			ttl = defaultTURNCredentialTTL
+		}
+		username, credential = turnRESTCredentials(c.Secret, user, ttl, time.Now())
+	}
+
+	servers := make([]webrtc.ICEServer, 0, len(c.URLs))
+	for _, url := range c.URLs {
+		server := webrtc.ICEServer{URLs: []string{url}}
+		if username != "" && strings.HasPrefix(url, "turn") {
+			server.Username = username
+			server.Credential = credential
+		}
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+// turnRESTCredentials issues TURN credentials under the TURN REST API scheme
+// coturn implements: the username is the expiry as a Unix timestamp, a
+// colon and the user, and the credential is the base64 HMAC-SHA1 of the
+// username keyed with the shared secret
+func turnRESTCredentials(secret, user string, ttl time.Duration, now time.Time) (username, credential string) {
+	username = strconv.FormatInt(now.Add(ttl).Unix(), 10)
+	if user != "" {
+		// A colon in the user would be read as the end of the timestamp
+		username += ":" + strings.ReplaceAll(user, ":", "_")
+	}
+
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
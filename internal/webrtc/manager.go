@@ -2,73 +2,142 @@ package webrtc
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v4"
+
+	"github.com/zalo/moonparty/moonlight-common-go/logging"
 )
 
 // Manager manages WebRTC peer connections
 type Manager struct {
 	mu          sync.RWMutex
 	api         *webrtc.API
-	config      webrtc.Configuration
+	ice         ICEConfig
 	connections map[string]*PeerConnection
+
+	// newEstimator hands the bandwidth estimator the congestion control
+	// interceptor creates inside NewPeerConnection to CreatePeerConnection,
+	// which holds mu across the call so only one is ever in flight
+	newEstimator chan cc.BandwidthEstimator
 }
 
-// NewManager creates a new WebRTC manager
-func NewManager(iceServers []string, turnUsername, turnCredential string) (*Manager, error) {
-	// Build ICE server configuration
-	servers := make([]webrtc.ICEServer, 0, len(iceServers))
-	for _, url := range iceServers {
-		server := webrtc.ICEServer{URLs: []string{url}}
-		if turnUsername != "" && (len(url) > 4 && url[:4] == "turn") {
-			server.Username = turnUsername
-			server.Credential = turnCredential
-		}
-		servers = append(servers, server)
-	}
+// AudioConfig controls the Opus parameters advertised for the audio track
+type AudioConfig struct {
+	// BitrateKbps is the target Opus bitrate; 0 leaves it to the browser
+	BitrateKbps int
+	// FEC enables Opus in-band forward error correction
+	FEC bool
+}
 
-	config := webrtc.Configuration{
-		ICEServers: servers,
+// fmtpLine returns the Opus SDP fmtp parameters for the config
+func (a AudioConfig) fmtpLine() string {
+	params := []string{"minptime=10"}
+	if a.FEC {
+		params = append(params, "useinbandfec=1")
+	}
+	if a.BitrateKbps > 0 {
+		params = append(params, fmt.Sprintf("maxaveragebitrate=%d", a.BitrateKbps*1000))
 	}
+	return strings.Join(params, ";")
+}
 
+// NewManager creates a new WebRTC manager. videoBitrateKbps is the stream's
+// bitrate, where peers' bandwidth estimates start.
+func NewManager(ice ICEConfig, videoBitrateKbps int, audio AudioConfig) (*Manager, error) {
 	// Create MediaEngine with codec support
 	m := &webrtc.MediaEngine{}
 
+	// Browsers send transport-wide congestion control feedback for video,
+	// which drives each peer's bandwidth estimate
+	videoFeedback := []webrtc.RTCPFeedback{{Type: webrtc.TypeRTCPFBTransportCC}}
+
 	// Register H.264 codec for video
 	if err := m.RegisterCodec(webrtc.RTPCodecParameters{
 		RTPCodecCapability: webrtc.RTPCodecCapability{
-			MimeType:    webrtc.MimeTypeH264,
-			ClockRate:   90000,
-			SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+			MimeType:     webrtc.MimeTypeH264,
+			ClockRate:    90000,
+			SDPFmtpLine:  "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+			RTCPFeedback: videoFeedback,
 		},
 		PayloadType: 96,
 	}, webrtc.RTPCodecTypeVideo); err != nil {
 		return nil, err
 	}
 
+	// Register H.265 and AV1 so a running connection can be renegotiated
+	// onto them (see PeerConnection.Renegotiate)
+	for _, codec := range []webrtc.RTPCodecParameters{
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH265, ClockRate: 90000, RTCPFeedback: videoFeedback}, PayloadType: 98},
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeAV1, ClockRate: 90000, RTCPFeedback: videoFeedback}, PayloadType: 45},
+	} {
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, err
+		}
+	}
+
 	// Register Opus codec for audio
 	if err := m.RegisterCodec(webrtc.RTPCodecParameters{
 		RTPCodecCapability: webrtc.RTPCodecCapability{
-			MimeType:  webrtc.MimeTypeOpus,
-			ClockRate: 48000,
-			Channels:  2,
+			MimeType:    webrtc.MimeTypeOpus,
+			ClockRate:   48000,
+			Channels:    2,
+			SDPFmtpLine: audio.fmtpLine(),
 		},
 		PayloadType: 111,
 	}, webrtc.RTPCodecTypeAudio); err != nil {
 		return nil, err
 	}
 
+	// Give SCTP a larger receive window so bursts of gamepad input from the
+	// browser don't stall behind control traffic
+	se := webrtc.SettingEngine{}
+	se.SetSCTPMaxReceiveBufferSize(sctpReceiveBufferSize)
+
+	manager := &Manager{
+		ice:          ice,
+		connections:  make(map[string]*PeerConnection),
+		newEstimator: make(chan cc.BandwidthEstimator, 1),
+	}
+
+	// Estimate each peer's bandwidth with Google Congestion Control. Every
+	// peer is sent the same encoded stream, so the estimate is only measured,
+	// never enforced: packets go out unpaced.
+	bweOptions := []gcc.Option{gcc.SendSideBWEPacer(gcc.NewNoOpPacer())}
+	if videoBitrateKbps > 0 {
+		bweOptions = append(bweOptions, gcc.SendSideBWEInitialBitrate(videoBitrateKbps*1000))
+	}
+	registry := &interceptor.Registry{}
+	congestion, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		return gcc.NewSendSideBWE(bweOptions...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	congestion.OnNewPeerConnection(func(_ string, estimator cc.BandwidthEstimator) {
+		manager.newEstimator <- estimator
+	})
+	registry.Add(congestion)
+	if err := webrtc.ConfigureTWCCHeaderExtensionSender(m, registry); err != nil {
+		return nil, err
+	}
+
 	// Create API with custom MediaEngine
-	api := webrtc.NewAPI(webrtc.WithMediaEngine(m))
+	manager.api = webrtc.NewAPI(
+		webrtc.WithMediaEngine(m),
+		webrtc.WithSettingEngine(se),
+		webrtc.WithInterceptorRegistry(registry))
 
-	return &Manager{
-		api:         api,
-		config:      config,
-		connections: make(map[string]*PeerConnection),
-	}, nil
+	return manager, nil
 }
 
 // CreatePeerConnection creates a new peer connection for a client
@@ -76,8 +145,19 @@ func (m *Manager) CreatePeerConnection(peerID string) (*PeerConnection, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	// Create the underlying WebRTC peer connection
-	pc, err := m.api.NewPeerConnection(m.config)
+	// Create the underlying WebRTC peer connection, with TURN credentials
+	// of its own when they're issued per request
+	pc, err := m.api.NewPeerConnection(webrtc.Configuration{
+		ICEServers: m.ice.Servers(peerID),
+	})
+
+	// Claim the estimator even if creation failed, so it can't be mistaken
+	// for the next peer's
+	var estimator cc.BandwidthEstimator
+	select {
+	case estimator = <-m.newEstimator:
+	default:
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to create peer connection: %w", err)
 	}
@@ -87,11 +167,22 @@ func (m *Manager) CreatePeerConnection(peerID string) (*PeerConnection, error) {
 		pc:         pc,
 		videoTrack: nil,
 		audioTrack: nil,
+		done:       make(chan struct{}),
+		estimator:  estimator,
 	}
+	conn.initOutbound()
 
 	// Set up connection state handler
 	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
-		log.Printf("Peer %s connection state: %s", peerID, state.String())
+		logging.Infof("Peer %s connection state: %s", peerID, state.String())
+		if state == webrtc.PeerConnectionStateConnected {
+			conn.mu.Lock()
+			fn := conn.onConnected
+			conn.mu.Unlock()
+			if fn != nil {
+				go fn()
+			}
+		}
 		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
 			m.RemovePeerConnection(peerID)
 		}
@@ -99,7 +190,12 @@ func (m *Manager) CreatePeerConnection(peerID string) (*PeerConnection, error) {
 
 	// Set up ICE connection state handler
 	pc.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
-		log.Printf("Peer %s ICE state: %s", peerID, state.String())
+		logging.Debugf("Peer %s ICE state: %s", peerID, state.String())
+	})
+
+	// The only track a browser sends is its microphone
+	pc.OnTrack(func(remote *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		conn.receiveVoice(remote)
 	})
 
 	m.connections[peerID] = conn
@@ -114,15 +210,31 @@ func (m *Manager) GetPeerConnection(peerID string) *PeerConnection {
 	return m.connections[peerID]
 }
 
-// RemovePeerConnection closes and removes a peer connection
+// RemovePeerConnection closes and removes a peer connection. The other
+// peers stop receiving its voice.
 func (m *Manager) RemovePeerConnection(peerID string) {
 	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	if conn, ok := m.connections[peerID]; ok {
+	conn, ok := m.connections[peerID]
+	if ok {
 		conn.Close()
 		delete(m.connections, peerID)
 	}
+	others := make([]*PeerConnection, 0, len(m.connections))
+	for _, other := range m.connections {
+		others = append(others, other)
+	}
+	m.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	for _, other := range others {
+		go func() {
+			if err := other.RemoveVoice(peerID); err != nil {
+				logging.Warnf("Peer %s: failed to remove voice of %s: %v", other.id, peerID, err)
+			}
+		}()
+	}
 }
 
 // CloseAll closes all peer connections
@@ -136,6 +248,31 @@ func (m *Manager) CloseAll() {
 	m.connections = make(map[string]*PeerConnection)
 }
 
+// RenegotiateVideo switches every peer with a video track to format,
+// returning the first error encountered
+func (m *Manager) RenegotiateVideo(format VideoFormat) error {
+	m.mu.RLock()
+	conns := make([]*PeerConnection, 0, len(m.connections))
+	for _, conn := range m.connections {
+		conns = append(conns, conn)
+	}
+	m.mu.RUnlock()
+
+	var firstErr error
+	for _, conn := range conns {
+		if conn.VideoFormat() == "" {
+			continue // Input-only peers have no video track
+		}
+		if err := conn.Renegotiate(format); err != nil {
+			logging.Warnf("Peer %s: renegotiation to %s failed: %v", conn.id, format, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
 // BroadcastVideo sends video data to all connected peers
 func (m *Manager) BroadcastVideo(data []byte) {
 	m.mu.RLock()
@@ -156,6 +293,78 @@ func (m *Manager) BroadcastAudio(data []byte) {
 	}
 }
 
+// statsInterval is how often peer connection stats are polled
+const statsInterval = 2 * time.Second
+
+// sctpReceiveBufferSize is the SCTP receive buffer for data channels
+const sctpReceiveBufferSize = 4 * 1024 * 1024
+
+// ChannelPriority orders outbound data channel messages.
+// pion opens every channel at normal SCTP stream priority and has no way to
+// set another, so the ordering is enforced by the peer's send loops instead.
+// Each priority has its own queue and loop: queued higher-priority messages
+// are always written to the association before lower-priority ones, and a
+// congested channel only holds back its own priority and those below it.
+type ChannelPriority int
+
+const (
+	PriorityLow ChannelPriority = iota
+	PriorityMedium
+	PriorityHigh
+
+	numPriorities
+)
+
+// channelPriorities maps data channel labels to their send priority
+var channelPriorities = map[string]ChannelPriority{
+	"control":   PriorityHigh,
+	"input":     PriorityMedium,
+	"chat":      PriorityLow,
+	"clipboard": PriorityLow,
+	"rumble":    PriorityMedium,
+}
+
+const (
+	// maxQueuedPerPriority bounds each priority's outbound queue
+	maxQueuedPerPriority = 256
+
+	// maxBufferedAmount pauses the send loop until SCTP drains below it,
+	// so queued messages can still be reordered by priority
+	maxBufferedAmount = 64 * 1024
+)
+
+var (
+	// ErrSendQueueFull is returned when a data channel message can't be queued
+	ErrSendQueueFull = errors.New("data channel send queue full")
+	// ErrUnknownChannel is returned for a label with no data channel priority
+	ErrUnknownChannel = errors.New("unknown data channel")
+)
+
+// outboundMessage is a data channel message waiting in a send loop
+type outboundMessage struct {
+	label string
+	data  []byte
+}
+
+// outboundChannel is the part of a data channel the send loops write to
+type outboundChannel interface {
+	BufferedAmount() uint64
+	Send(data []byte) error
+}
+
+// Stats summarizes the health of a peer's connection as seen by the server
+type Stats struct {
+	PacketsLost  int32   `json:"packets_lost"`
+	FractionLost float64 `json:"fraction_lost"`
+	JitterMs     float64 `json:"jitter_ms"`
+	RTTMs        float64 `json:"rtt_ms"`
+
+	// EstimatedBitrateKbps is the congestion controller's estimate of the
+	// bandwidth to the peer. It starts at the stream's bitrate and follows
+	// the browser's feedback from there.
+	EstimatedBitrateKbps int `json:"estimated_bitrate_kbps"`
+}
+
 // PeerConnection wraps a WebRTC peer connection
 type PeerConnection struct {
 	id         string
@@ -164,19 +373,179 @@ type PeerConnection struct {
 	audioTrack *webrtc.TrackLocalStaticRTP
 	dataChans  map[string]*webrtc.DataChannel
 	mu         sync.Mutex
+	done       chan struct{}
+	closeOnce  sync.Once
+
+	// videoPaused stops video RTP to this peer while audio keeps flowing
+	videoPaused atomic.Bool
+
+	// videoQueue holds video waiting for writeVideo; videoResync tells it
+	// the peer missed some and must wait for a keyframe
+	videoQueue  chan []byte
+	videoResync atomic.Bool
+
+	// videoReduced has the peer sent transcoded video instead of the host's;
+	// see VideoTranscoder
+	videoReduced atomic.Bool
+
+	// estimator tracks the bandwidth available to this peer, if congestion
+	// control is running
+	estimator cc.BandwidthEstimator
+
+	// Video sender and codec, replaced by Renegotiate
+	videoSender *webrtc.RTPSender
+	videoFormat VideoFormat
+
+	// Server-initiated offers go out through onOffer; answerCh is set while
+	// negotiate waits for the browser's answer
+	onOffer     func(offerSDP string)
+	answerCh    chan error
+	negotiateMu sync.Mutex
+
+	// voiceTrack forwards this peer's microphone to the others, once it
+	// starts sending; voiceSenders are the other peers' voices sent to this
+	// one, by speaker peer ID
+	voiceTrack   *webrtc.TrackLocalStaticRTP
+	voiceSenders map[string]*webrtc.RTPSender
+	voiceMuted   atomic.Bool
+	onVoice      func()
+
+	onConnected       func()
+	onKeyframeRequest func()
+
+	// Outbound data channel queues, one per priority, each drained by its
+	// own sendLoop. A message stays at the head of its queue until sent.
+	outMu     sync.Mutex
+	outQueues [numPriorities][]outboundMessage
+	outReady  [numPriorities]chan struct{}
+	outLow    [numPriorities]chan struct{}
 
 	// Callbacks
 	OnInput func(channelID string, data []byte)
 }
 
-// SetupTracks initializes video and audio tracks for sending
-func (p *PeerConnection) SetupTracks() error {
+// OnConnected sets a callback for when media starts flowing to the peer
+func (p *PeerConnection) OnConnected(fn func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.onConnected = fn
+}
+
+// OnKeyframeRequest sets a callback for when the browser asks for a keyframe
+// with an RTCP PLI or FIR, e.g. because its decoder lost a reference frame
+func (p *PeerConnection) OnKeyframeRequest(fn func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.onKeyframeRequest = fn
+}
+
+// readVideoRTCP reads the browser's RTCP for a video sender until the sender
+// is removed or the connection closes, passing keyframe requests on
+func (p *PeerConnection) readVideoRTCP(sender *webrtc.RTPSender) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, pkt := range packets {
+			switch pkt.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				p.requestKeyframe()
+			}
+		}
+	}
+}
+
+// OnStatsUpdate starts polling connection stats and calls fn with each sample.
+// Polling stops when the peer connection is closed.
+func (p *PeerConnection) OnStatsUpdate(fn func(Stats)) {
+	go func() {
+		ticker := time.NewTicker(statsInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-p.done:
+				return
+			case <-ticker.C:
+				fn(p.collectStats())
+			}
+		}
+	}()
+}
+
+// collectStats reduces a pion stats report to the fields we report to clients
+func (p *PeerConnection) collectStats() Stats {
+	stats := Stats{EstimatedBitrateKbps: p.EstimatedBitrate()}
+
+	for _, s := range p.pc.GetStats() {
+		switch st := s.(type) {
+		case webrtc.RemoteInboundRTPStreamStats:
+			// Receiver reports from the browser describe our outbound video
+			if st.Kind != string(webrtc.MediaKindVideo) {
+				continue
+			}
+			stats.PacketsLost = st.PacketsLost
+			stats.FractionLost = st.FractionLost
+			stats.JitterMs = st.Jitter * 1000
+			if st.RoundTripTime > 0 {
+				stats.RTTMs = st.RoundTripTime * 1000
+			}
+		case webrtc.ICECandidatePairStats:
+			if st.Nominated && stats.RTTMs == 0 {
+				stats.RTTMs = st.CurrentRoundTripTime * 1000
+			}
+		}
+	}
+
+	return stats
+}
+
+// EstimatedBitrate returns the congestion controller's estimate of the
+// bandwidth to the peer in kbps, or 0 if there is none
+func (p *PeerConnection) EstimatedBitrate() int {
+	if p.estimator == nil {
+		return 0
+	}
+	return p.estimator.GetTargetBitrate() / 1000
+}
+
+// State is a snapshot of a peer connection's negotiation and transport state
+type State struct {
+	Connection  string      `json:"connection"`
+	ICE         string      `json:"ice"`
+	Signaling   string      `json:"signaling"`
+	VideoFormat VideoFormat `json:"video_format"`
+	VideoPaused bool        `json:"video_paused"`
+	Stats       Stats       `json:"stats"`
+}
+
+// State returns the peer connection's current state
+func (p *PeerConnection) State() State {
+	return State{
+		Connection:  p.pc.ConnectionState().String(),
+		ICE:         p.pc.ICEConnectionState().String(),
+		Signaling:   p.pc.SignalingState().String(),
+		VideoFormat: p.VideoFormat(),
+		VideoPaused: p.VideoPaused(),
+		Stats:       p.collectStats(),
+	}
+}
+
+// SetupTracks initializes video and audio tracks for sending, with video in
+// format
+func (p *PeerConnection) SetupTracks(format VideoFormat) error {
+	mime, err := format.mimeType()
+	if err != nil {
+		return err
+	}
+
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
 	// Create video track
 	videoTrack, err := webrtc.NewTrackLocalStaticRTP(
-		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264},
+		webrtc.RTPCodecCapability{MimeType: mime},
 		"video",
 		"moonparty-video",
 	)
@@ -184,10 +553,16 @@ func (p *PeerConnection) SetupTracks() error {
 		return fmt.Errorf("failed to create video track: %w", err)
 	}
 
-	if _, err := p.pc.AddTrack(videoTrack); err != nil {
+	videoSender, err := p.pc.AddTrack(videoTrack)
+	if err != nil {
 		return fmt.Errorf("failed to add video track: %w", err)
 	}
 	p.videoTrack = videoTrack
+	p.videoSender = videoSender
+	p.videoFormat = format
+	go p.readVideoRTCP(videoSender)
+	p.videoQueue = make(chan []byte, videoQueueSize)
+	go p.writeVideo()
 
 	// Create audio track
 	audioTrack, err := webrtc.NewTrackLocalStaticRTP(
@@ -207,7 +582,7 @@ func (p *PeerConnection) SetupTracks() error {
 	return nil
 }
 
-// SetupDataChannels creates data channels for input
+// SetupDataChannels creates data channels for control, input, chat and clipboard
 func (p *PeerConnection) SetupDataChannels() error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -233,23 +608,177 @@ func (p *PeerConnection) SetupDataChannels() error {
 	}
 	p.dataChans["input"] = inputDC
 
-	// Set up message handlers
-	controlDC.OnMessage(func(msg webrtc.DataChannelMessage) {
-		if p.OnInput != nil {
-			p.OnInput("control", msg.Data)
-		}
+	// Create ordered reliable channel for chat, sent at the lowest priority
+	chatDC, err := p.pc.CreateDataChannel("chat", &webrtc.DataChannelInit{
+		Ordered: boolPtr(true),
 	})
+	if err != nil {
+		return err
+	}
+	p.dataChans["chat"] = chatDC
 
-	inputDC.OnMessage(func(msg webrtc.DataChannelMessage) {
-		if p.OnInput != nil {
-			p.OnInput("input", msg.Data)
-		}
+	// Create ordered reliable channel for clipboard text, sent in chunks
+	clipboardDC, err := p.pc.CreateDataChannel("clipboard", &webrtc.DataChannelInit{
+		Ordered: boolPtr(true),
+	})
+	if err != nil {
+		return err
+	}
+	p.dataChans["clipboard"] = clipboardDC
+
+	// Create ordered reliable channel for rumble, so a stop is never lost
+	rumbleDC, err := p.pc.CreateDataChannel("rumble", &webrtc.DataChannelInit{
+		Ordered: boolPtr(true),
 	})
+	if err != nil {
+		return err
+	}
+	p.dataChans["rumble"] = rumbleDC
+
+	// Set up message handlers
+	for label, dc := range p.dataChans {
+		label := label
+		dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+			if p.OnInput != nil {
+				p.OnInput(label, msg.Data)
+			}
+		})
+
+		// Wake the channel's send loop once SCTP has drained
+		low := p.outLow[channelPriorities[label]]
+		dc.SetBufferedAmountLowThreshold(maxBufferedAmount / 2)
+		dc.OnBufferedAmountLow(func() { wake(low) })
+	}
+
+	for prio := range numPriorities {
+		go p.sendLoop(prio, p.openChannel)
+	}
 
 	return nil
 }
 
-// HandleOffer processes an SDP offer and returns an answer
+// initOutbound makes the send loops' wakeup channels
+func (p *PeerConnection) initOutbound() {
+	for prio := range numPriorities {
+		p.outReady[prio] = make(chan struct{}, 1)
+		p.outLow[prio] = make(chan struct{}, 1)
+	}
+}
+
+// wake signals a send loop without blocking
+func wake(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// openChannel returns the open data channel with the given label, or nil
+func (p *PeerConnection) openChannel(label string) outboundChannel {
+	p.mu.Lock()
+	dc := p.dataChans[label]
+	p.mu.Unlock()
+
+	if dc == nil || dc.ReadyState() != webrtc.DataChannelStateOpen {
+		return nil
+	}
+	return dc
+}
+
+// queueData queues a message for a data channel at the channel's priority
+func (p *PeerConnection) queueData(label string, data []byte) error {
+	prio, ok := channelPriorities[label]
+	if !ok {
+		return fmt.Errorf("%w %q", ErrUnknownChannel, label)
+	}
+
+	p.outMu.Lock()
+	if len(p.outQueues[prio]) >= maxQueuedPerPriority {
+		p.outMu.Unlock()
+		return ErrSendQueueFull
+	}
+	p.outQueues[prio] = append(p.outQueues[prio], outboundMessage{label: label, data: data})
+	p.outMu.Unlock()
+
+	wake(p.outReady[prio])
+	return nil
+}
+
+// nextOutbound returns the message at the head of prio's queue, unless a
+// higher priority still has messages to send first
+func (p *PeerConnection) nextOutbound(prio ChannelPriority) (outboundMessage, bool) {
+	p.outMu.Lock()
+	defer p.outMu.Unlock()
+
+	for higher := prio + 1; higher < numPriorities; higher++ {
+		if len(p.outQueues[higher]) > 0 {
+			return outboundMessage{}, false
+		}
+	}
+	if len(p.outQueues[prio]) == 0 {
+		return outboundMessage{}, false
+	}
+	return p.outQueues[prio][0], true
+}
+
+// finishOutbound drops the head of prio's queue once it has been sent, and
+// lets the lower priorities go once the queue is empty
+func (p *PeerConnection) finishOutbound(prio ChannelPriority) {
+	p.outMu.Lock()
+	p.outQueues[prio] = p.outQueues[prio][1:]
+	empty := len(p.outQueues[prio]) == 0
+	p.outMu.Unlock()
+
+	if empty {
+		for lower := range prio {
+			wake(p.outReady[lower])
+		}
+	}
+}
+
+// sendLoop writes the messages queued at prio, each once no higher-priority
+// message is waiting, to the channels channel looks up by label
+func (p *PeerConnection) sendLoop(prio ChannelPriority, channel func(label string) outboundChannel) {
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-p.outReady[prio]:
+		}
+
+		for {
+			msg, ok := p.nextOutbound(prio)
+			if !ok {
+				break
+			}
+
+			dc := channel(msg.label)
+			if dc == nil {
+				p.finishOutbound(prio)
+				continue
+			}
+
+			// Hold this priority back while its channel is congested
+			for dc.BufferedAmount() > maxBufferedAmount {
+				select {
+				case <-p.done:
+					return
+				case <-p.outLow[prio]:
+				case <-time.After(100 * time.Millisecond):
+				}
+			}
+
+			if err := dc.Send(msg.data); err != nil {
+				logging.Warnf("Peer %s: failed to send on %s: %v", p.id, msg.label, err)
+			}
+			p.finishOutbound(prio)
+		}
+	}
+}
+
+// HandleOffer applies an SDP offer and returns the answer right away. ICE
+// candidates are gathered afterwards and trickle out through OnICECandidate,
+// so the browser can start connecting before gathering finishes.
 func (p *PeerConnection) HandleOffer(offerSDP string) (string, error) {
 	offer := webrtc.SessionDescription{
 		Type: webrtc.SDPTypeOffer,
@@ -269,14 +798,11 @@ func (p *PeerConnection) HandleOffer(offerSDP string) (string, error) {
 		return "", fmt.Errorf("failed to set local description: %w", err)
 	}
 
-	// Wait for ICE gathering to complete
-	gatherComplete := webrtc.GatheringCompletePromise(p.pc)
-	<-gatherComplete
-
-	return p.pc.LocalDescription().SDP, nil
+	return answer.SDP, nil
 }
 
-// CreateOffer creates an SDP offer
+// CreateOffer creates an SDP offer. Like an answer, it doesn't wait for
+// ICE gathering; new candidates trickle out through OnICECandidate.
 func (p *PeerConnection) CreateOffer() (string, error) {
 	offer, err := p.pc.CreateOffer(nil)
 	if err != nil {
@@ -287,11 +813,7 @@ func (p *PeerConnection) CreateOffer() (string, error) {
 		return "", fmt.Errorf("failed to set local description: %w", err)
 	}
 
-	// Wait for ICE gathering to complete
-	gatherComplete := webrtc.GatheringCompletePromise(p.pc)
-	<-gatherComplete
-
-	return p.pc.LocalDescription().SDP, nil
+	return offer.SDP, nil
 }
 
 // HandleAnswer processes an SDP answer
@@ -301,7 +823,19 @@ func (p *PeerConnection) HandleAnswer(answerSDP string) error {
 		SDP:  answerSDP,
 	}
 
-	return p.pc.SetRemoteDescription(answer)
+	err := p.pc.SetRemoteDescription(answer)
+
+	// Hand the result to a Renegotiate call waiting on this answer
+	p.mu.Lock()
+	if p.answerCh != nil {
+		select {
+		case p.answerCh <- err:
+		default:
+		}
+	}
+	p.mu.Unlock()
+
+	return err
 }
 
 // AddICECandidate adds an ICE candidate
@@ -313,30 +847,20 @@ func (p *PeerConnection) AddICECandidate(candidateJSON string) error {
 	return p.pc.AddICECandidate(candidate)
 }
 
-// OnICECandidate sets a callback for new ICE candidates
+// OnICECandidate sets a callback for local ICE candidates as they're
+// gathered, each as RTCIceCandidateInit JSON. An empty candidate follows the
+// last one to mark the end of candidates.
 func (p *PeerConnection) OnICECandidate(fn func(candidate string)) {
 	p.pc.OnICECandidate(func(c *webrtc.ICECandidate) {
-		if c != nil {
-			candidateJSON, _ := json.Marshal(c.ToJSON())
-			fn(string(candidateJSON))
+		if c == nil {
+			fn("")
+			return
 		}
+		candidateJSON, _ := json.Marshal(c.ToJSON())
+		fn(string(candidateJSON))
 	})
 }
 
-// SendVideo sends video RTP data
-func (p *PeerConnection) SendVideo(data []byte) error {
-	p.mu.Lock()
-	track := p.videoTrack
-	p.mu.Unlock()
-
-	if track == nil {
-		return nil
-	}
-
-	_, err := track.Write(data)
-	return err
-}
-
 // SendAudio sends audio RTP data
 func (p *PeerConnection) SendAudio(data []byte) error {
 	p.mu.Lock()
@@ -353,19 +877,33 @@ func (p *PeerConnection) SendAudio(data []byte) error {
 
 // SendControl sends a control message
 func (p *PeerConnection) SendControl(data []byte) error {
-	p.mu.Lock()
-	dc := p.dataChans["control"]
-	p.mu.Unlock()
+	return p.queueData("control", data)
+}
 
-	if dc == nil || dc.ReadyState() != webrtc.DataChannelStateOpen {
-		return nil
-	}
+// SendChat sends a chat message
+func (p *PeerConnection) SendChat(data []byte) error {
+	return p.queueData("chat", data)
+}
 
-	return dc.Send(data)
+// SendRumble tells the browser to run a controller's motors at the given
+// speeds until the next rumble event
+func (p *PeerConnection) SendRumble(controllerNumber, lowFreq, highFreq uint16) error {
+	data, err := json.Marshal(struct {
+		Controller uint16 `json:"controller"`
+		LowFreq    uint16 `json:"low_freq"`
+		HighFreq   uint16 `json:"high_freq"`
+	}{controllerNumber, lowFreq, highFreq})
+	if err != nil {
+		return err
+	}
+	return p.queueData("rumble", data)
 }
 
 // Close closes the peer connection
 func (p *PeerConnection) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.done)
+	})
 	return p.pc.Close()
 }
 
@@ -0,0 +1,139 @@
+package webrtc
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// sentLog records the messages the fake channels send, in order
+type sentLog struct {
+	mu   sync.Mutex
+	sent []string
+}
+
+func (l *sentLog) messages() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Clone(l.sent)
+}
+
+// waitFor returns the messages sent once there are n, or whatever was sent
+// within two seconds
+func (l *sentLog) waitFor(n int) []string {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if got := l.messages(); len(got) >= n {
+			return got
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return l.messages()
+}
+
+// fakeChannel is an open data channel that records what it sends
+type fakeChannel struct {
+	log      *sentLog
+	buffered atomic.Uint64
+}
+
+func (c *fakeChannel) BufferedAmount() uint64 { return c.buffered.Load() }
+
+func (c *fakeChannel) Send(data []byte) error {
+	c.log.mu.Lock()
+	defer c.log.mu.Unlock()
+	c.log.sent = append(c.log.sent, string(data))
+	return nil
+}
+
+// newTestPeer returns a peer whose data channels are fakes sharing one log
+func newTestPeer(t *testing.T) (*PeerConnection, map[string]*fakeChannel, *sentLog) {
+	p := &PeerConnection{id: "test", done: make(chan struct{})}
+	p.initOutbound()
+	t.Cleanup(func() { close(p.done) })
+
+	log := &sentLog{}
+	chans := make(map[string]*fakeChannel)
+	for label := range channelPriorities {
+		chans[label] = &fakeChannel{log: log}
+	}
+	return p, chans, log
+}
+
+// start runs the peer's send loops over its fake channels
+func start(p *PeerConnection, chans map[string]*fakeChannel) {
+	lookup := func(label string) outboundChannel {
+		if dc, ok := chans[label]; ok {
+			return dc
+		}
+		return nil
+	}
+	for prio := range numPriorities {
+		go p.sendLoop(prio, lookup)
+	}
+}
+
+func TestSendPriorityOrder(t *testing.T) {
+	p, chans, log := newTestPeer(t)
+
+	// Queued all at once, before any goes out
+	for _, msg := range []struct{ label, data string }{
+		{"chat", "chat 1"},
+		{"input", "input 1"},
+		{"chat", "chat 2"},
+		{"control", "control 1"},
+		{"input", "input 2"},
+	} {
+		if err := p.queueData(msg.label, []byte(msg.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start(p, chans)
+
+	want := []string{"control 1", "input 1", "input 2", "chat 1", "chat 2"}
+	if got := log.waitFor(len(want)); !slices.Equal(got, want) {
+		t.Fatalf("sent %q, want %q", got, want)
+	}
+}
+
+func TestCongestedChannelDoesNotBlockHigherPriority(t *testing.T) {
+	p, chans, log := newTestPeer(t)
+	start(p, chans)
+
+	// Chat's channel is congested, so its message waits
+	chans["chat"].buffered.Store(maxBufferedAmount + 1)
+	if err := p.queueData("chat", []byte("chat")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// Control and input still go out past it
+	if err := p.queueData("control", []byte("control")); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.queueData("input", []byte("input")); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"control", "input"}
+	if got := log.waitFor(len(want)); !slices.Equal(got, want) {
+		t.Fatalf("sent %q while chat was congested, want %q", got, want)
+	}
+
+	// And chat follows once its channel drains
+	chans["chat"].buffered.Store(0)
+	want = append(want, "chat")
+	if got := log.waitFor(len(want)); !slices.Equal(got, want) {
+		t.Fatalf("sent %q, want %q", got, want)
+	}
+}
+
+func TestQueueUnknownChannel(t *testing.T) {
+	p, _, _ := newTestPeer(t)
+
+	if err := p.queueData("nonexistent", []byte("x")); !errors.Is(err, ErrUnknownChannel) {
+		t.Fatalf("queueData on an unknown label = %v, want ErrUnknownChannel", err)
+	}
+}
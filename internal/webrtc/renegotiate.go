@@ -0,0 +1,161 @@
+package webrtc
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+
+	"github.com/zalo/moonparty/moonlight-common-go/logging"
+)
+
+// VideoFormat names a video codec that can be negotiated with the browser
+type VideoFormat string
+
+const (
+	VideoFormatH264 VideoFormat = "h264"
+	VideoFormatH265 VideoFormat = "h265"
+	VideoFormatAV1  VideoFormat = "av1"
+)
+
+// renegotiationTimeout bounds how long Renegotiate waits for the browser's answer
+const renegotiationTimeout = 10 * time.Second
+
+// ErrRenegotiationInProgress is returned when a renegotiation is already waiting for an answer
+var ErrRenegotiationInProgress = errors.New("renegotiation already in progress")
+
+// mimeType returns the RTP mime type for the format
+func (f VideoFormat) mimeType() (string, error) {
+	switch f {
+	case VideoFormatH264:
+		return webrtc.MimeTypeH264, nil
+	case VideoFormatH265:
+		return webrtc.MimeTypeH265, nil
+	case VideoFormatAV1:
+		return webrtc.MimeTypeAV1, nil
+	default:
+		return "", fmt.Errorf("unsupported video format %q", f)
+	}
+}
+
+// OnRenegotiationOffer sets the callback that delivers server-initiated
+// offers to the browser; the answer comes back through HandleAnswer
+func (p *PeerConnection) OnRenegotiationOffer(fn func(offerSDP string)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.onOffer = fn
+}
+
+// VideoFormat returns the codec currently negotiated for the video track
+func (p *PeerConnection) VideoFormat() VideoFormat {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.videoFormat
+}
+
+// Renegotiate swaps the video track for one using newCodec and runs a
+// server-initiated offer/answer exchange so the browser switches decoders
+// without reconnecting. Audio and data channels are left untouched.
+func (p *PeerConnection) Renegotiate(newCodec VideoFormat) error {
+	mime, err := newCodec.mimeType()
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	if p.videoSender == nil {
+		p.mu.Unlock()
+		return errors.New("peer has no video track")
+	}
+	if p.onOffer == nil {
+		p.mu.Unlock()
+		return errors.New("no signaling channel for renegotiation")
+	}
+	if p.answerCh != nil {
+		p.mu.Unlock()
+		return ErrRenegotiationInProgress
+	}
+	if p.videoFormat == newCodec {
+		p.mu.Unlock()
+		return nil
+	}
+	oldFormat := p.videoFormat
+
+	videoTrack, err := webrtc.NewTrackLocalStaticRTP(
+		webrtc.RTPCodecCapability{MimeType: mime},
+		"video",
+		"moonparty-video",
+	)
+	if err != nil {
+		p.mu.Unlock()
+		return fmt.Errorf("failed to create video track: %w", err)
+	}
+
+	if err := p.pc.RemoveTrack(p.videoSender); err != nil {
+		p.mu.Unlock()
+		return fmt.Errorf("failed to remove video track: %w", err)
+	}
+	sender, err := p.pc.AddTrack(videoTrack)
+	if err != nil {
+		p.mu.Unlock()
+		return fmt.Errorf("failed to add video track: %w", err)
+	}
+	p.videoTrack = videoTrack
+	p.videoSender = sender
+	p.videoFormat = newCodec
+	go p.readVideoRTCP(sender)
+	p.mu.Unlock()
+
+	// The new track starts at a keyframe in the new codec
+	p.videoResync.Store(true)
+
+	if err := p.negotiate(); err != nil {
+		return err
+	}
+
+	logging.Infof("Peer %s: video codec changed from %s to %s", p.id, oldFormat, newCodec)
+	return nil
+}
+
+// negotiate runs a server-initiated offer/answer exchange for tracks already
+// added or removed. Exchanges are run one at a time, so changes made while
+// one is waiting go out in the next.
+func (p *PeerConnection) negotiate() error {
+	p.negotiateMu.Lock()
+	defer p.negotiateMu.Unlock()
+
+	p.mu.Lock()
+	sendOffer := p.onOffer
+	if sendOffer == nil {
+		p.mu.Unlock()
+		return errors.New("no signaling channel for renegotiation")
+	}
+	answerCh := make(chan error, 1)
+	p.answerCh = answerCh
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		p.answerCh = nil
+		p.mu.Unlock()
+	}()
+
+	offer, err := p.CreateOffer()
+	if err != nil {
+		return err
+	}
+	sendOffer(offer)
+
+	select {
+	case err := <-answerCh:
+		if err != nil {
+			return fmt.Errorf("failed to apply renegotiation answer: %w", err)
+		}
+	case <-p.done:
+		return errors.New("peer connection closed during renegotiation")
+	case <-time.After(renegotiationTimeout):
+		return errors.New("timed out waiting for renegotiation answer")
+	}
+	return nil
+}
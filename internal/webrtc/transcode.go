@@ -0,0 +1,70 @@
+package webrtc
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Spectators can be sent a reduced copy of the video, re-encoded at a lower
+// resolution and bitrate, so a room full of them doesn't take the players'
+// bandwidth. The host's frames are already encoded, so this means decoding
+// and encoding every frame again, which a VideoTranscoder does off the relay
+// loop. None is built in unless moonparty is built with -tags ffmpeg, which
+// runs an ffmpeg process for it.
+
+// VideoTranscoder re-encodes the host's video for reduced peers. Frames go in
+// as the stream delivers them, a whole access unit each, and come out the
+// same way in the same format, ready for SendVideo.
+type VideoTranscoder interface {
+	// Write queues a frame for re-encoding without waiting for it. A frame
+	// that can't be queued is dropped, along with what follows until the
+	// next keyframe.
+	Write(frame []byte) error
+
+	// Frames delivers re-encoded frames. It's closed once the transcoder
+	// fails or is closed.
+	Frames() <-chan []byte
+
+	// Close stops the transcoder
+	Close() error
+}
+
+// TranscodeSettings is the reduced video a VideoTranscoder produces
+type TranscodeSettings struct {
+	Height      int // Width follows the host's aspect ratio
+	BitrateKbps int
+	FPS         int // Of the host's video, which is kept
+}
+
+// ErrVideoTranscodeUnavailable is returned by NewVideoTranscoder when
+// moonparty has no transcoder for the format
+var ErrVideoTranscodeUnavailable = errors.New("video transcoding unavailable")
+
+// newVideoTranscoder creates the built-in transcoder, if one is built in
+var newVideoTranscoder func(format VideoFormat, settings TranscodeSettings) (VideoTranscoder, error)
+
+// NewVideoTranscoder starts a transcoder for video in format. Only H.264 can
+// be transcoded, and only when moonparty is built with -tags ffmpeg.
+func NewVideoTranscoder(format VideoFormat, settings TranscodeSettings) (VideoTranscoder, error) {
+	if newVideoTranscoder == nil {
+		return nil, fmt.Errorf("%w: moonparty was built without -tags ffmpeg", ErrVideoTranscodeUnavailable)
+	}
+	if format != VideoFormatH264 {
+		return nil, fmt.Errorf("%w for %s video", ErrVideoTranscodeUnavailable, format)
+	}
+	return newVideoTranscoder(format, settings)
+}
+
+// SetVideoReduced switches the peer between the host's video and the
+// transcoded video. A peer that switches waits for a keyframe of the video
+// it switched to.
+func (p *PeerConnection) SetVideoReduced(reduced bool) {
+	if p.videoReduced.Swap(reduced) != reduced {
+		p.videoResync.Store(true)
+	}
+}
+
+// VideoReduced reports whether the peer is sent the transcoded video
+func (p *PeerConnection) VideoReduced() bool {
+	return p.videoReduced.Load()
+}
@@ -0,0 +1,208 @@
+//go:build ffmpeg
+
+package webrtc
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zalo/moonparty/moonlight-common-go/logging"
+)
+
+func init() {
+	newVideoTranscoder = newFFmpegTranscoder
+}
+
+const (
+	// ffmpegQueueSize is how many frames wait to be written to ffmpeg
+	ffmpegQueueSize = 16
+
+	// ffmpegKeyframeInterval is the longest ffmpeg goes without a keyframe
+	// of its own, in frames; it also makes one wherever the host did
+	ffmpegKeyframeInterval = 240
+
+	// ffmpegMaxFrameSize bounds an access unit read back from ffmpeg
+	ffmpegMaxFrameSize = 4 << 20
+
+	// ffmpegStopTimeout is how long Close waits for ffmpeg to exit once its
+	// input is closed before killing it
+	ffmpegStopTimeout = 2 * time.Second
+)
+
+// ffmpegTranscoder re-encodes H.264 with an ffmpeg process on the PATH,
+// writing the host's frames to its stdin and reading the reduced ones back
+// from its stdout. ffmpeg marks each access unit with a delimiter, and a unit
+// is only known to be whole once the next one starts, so frames come out a
+// frame late.
+type ffmpegTranscoder struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	input  chan []byte
+	frames chan []byte
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	// waiting drops frames until a keyframe after one was dropped; only
+	// Write touches it
+	waiting bool
+
+	closeOnce sync.Once
+}
+
+func newFFmpegTranscoder(format VideoFormat, settings TranscodeSettings) (VideoTranscoder, error) {
+	fps := max(settings.FPS, 1)
+	kbps := strconv.Itoa(settings.BitrateKbps) + "k"
+	cmd := exec.Command("ffmpeg",
+		"-hide_banner", "-loglevel", "error", "-nostdin",
+		"-fflags", "nobuffer", "-flags", "low_delay",
+		"-probesize", "32", "-analyzeduration", "0",
+		"-f", "h264", "-framerate", strconv.Itoa(fps), "-i", "pipe:0",
+		"-vf", fmt.Sprintf("scale=-2:%d", settings.Height),
+		"-c:v", "libx264", "-preset", "ultrafast", "-tune", "zerolatency",
+		"-profile:v", "baseline", "-pix_fmt", "yuv420p",
+		"-b:v", kbps, "-maxrate", kbps, "-bufsize", strconv.Itoa(max(settings.BitrateKbps*2/fps, 1))+"k",
+		"-g", strconv.Itoa(ffmpegKeyframeInterval), "-force_key_frames", "source",
+		"-bsf:v", "h264_metadata=aud=insert",
+		"-flush_packets", "1", "-f", "h264", "pipe:1",
+	)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+
+	t := &ffmpegTranscoder{
+		cmd:     cmd,
+		stdin:   stdin,
+		input:   make(chan []byte, ffmpegQueueSize),
+		frames:  make(chan []byte, ffmpegQueueSize),
+		done:    make(chan struct{}),
+		waiting: true,
+	}
+	t.wg.Add(2)
+	go t.writeLoop()
+	go func() {
+		t.readLoop(stdout)
+		if err := cmd.Wait(); err != nil {
+			logging.Warnf("Video transcoder exited: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+		}
+	}()
+	logging.Infof("Transcoding spectator video to %dp at %d kbps", settings.Height, settings.BitrateKbps)
+	return t, nil
+}
+
+// Write queues a frame for ffmpeg
+func (t *ffmpegTranscoder) Write(frame []byte) error {
+	if t.waiting {
+		if keyframe, _ := isKeyframe(VideoFormatH264, frame); !keyframe {
+			return nil
+		}
+		t.waiting = false
+	}
+
+	select {
+	case <-t.done:
+		return errors.New("video transcoder closed")
+	case t.input <- frame:
+		return nil
+	default:
+		t.waiting = true
+		return ErrVideoQueueFull
+	}
+}
+
+// Frames delivers ffmpeg's re-encoded frames
+func (t *ffmpegTranscoder) Frames() <-chan []byte {
+	return t.frames
+}
+
+// Close ends ffmpeg's input and waits for it to exit, killing it if it
+// doesn't
+func (t *ffmpegTranscoder) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.done)
+		exited := make(chan struct{})
+		go func() {
+			t.wg.Wait()
+			close(exited)
+		}()
+		select {
+		case <-exited:
+		case <-time.After(ffmpegStopTimeout):
+			t.cmd.Process.Kill()
+			<-exited
+		}
+	})
+	return nil
+}
+
+// writeLoop feeds queued frames to ffmpeg until the transcoder closes
+func (t *ffmpegTranscoder) writeLoop() {
+	defer t.wg.Done()
+	defer t.stdin.Close()
+
+	for {
+		select {
+		case <-t.done:
+			return
+		case frame := <-t.input:
+			if _, err := t.stdin.Write(frame); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readLoop passes ffmpeg's access units on until its output ends, dropping
+// them while nobody keeps up
+func (t *ffmpegTranscoder) readLoop(stdout io.Reader) {
+	defer t.wg.Done()
+	defer close(t.frames)
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 256<<10), ffmpegMaxFrameSize)
+	scanner.Split(splitAccessUnits)
+	for scanner.Scan() {
+		frame := bytes.Clone(scanner.Bytes())
+		select {
+		case t.frames <- frame:
+		default:
+		}
+	}
+}
+
+// accessUnitDelimiter is the start of an H.264 access unit delimiter NAL unit
+var accessUnitDelimiter = []byte{0, 0, 1, 9}
+
+// splitAccessUnits is a bufio.SplitFunc returning the access units of an
+// H.264 stream that starts each with a delimiter
+func splitAccessUnits(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if len(data) > len(accessUnitDelimiter) {
+		if i := bytes.Index(data[len(accessUnitDelimiter):], accessUnitDelimiter); i >= 0 {
+			end := len(accessUnitDelimiter) + i
+			if data[end-1] == 0 {
+				end-- // Four-byte start code
+			}
+			return end, data[:end], nil
+		}
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
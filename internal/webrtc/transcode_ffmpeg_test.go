@@ -0,0 +1,96 @@
+//go:build ffmpeg
+
+package webrtc
+
+import (
+	"bufio"
+	"bytes"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testH264 encodes frames of ffmpeg's test pattern at the given height and
+// returns their access units
+func testH264(t *testing.T, height, frames int) [][]byte {
+	t.Helper()
+
+	out, err := exec.Command("ffmpeg", "-hide_banner", "-loglevel", "error",
+		"-f", "lavfi", "-i", "testsrc=size=1280x"+strconv.Itoa(height)+":rate=30",
+		"-frames:v", strconv.Itoa(frames),
+		"-c:v", "libx264", "-preset", "ultrafast", "-tune", "zerolatency", "-g", "10",
+		"-bsf:v", "h264_metadata=aud=insert", "-f", "h264", "pipe:1",
+	).Output()
+	if err != nil {
+		t.Fatalf("encoding test video: %v", err)
+	}
+
+	var units [][]byte
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(make([]byte, 0, 256<<10), ffmpegMaxFrameSize)
+	scanner.Split(splitAccessUnits)
+	for scanner.Scan() {
+		units = append(units, bytes.Clone(scanner.Bytes()))
+	}
+	return units
+}
+
+func TestFFmpegTranscoder(t *testing.T) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		t.Skip("ffmpeg is not on the PATH")
+	}
+
+	input := testH264(t, 720, 60)
+	tr, err := NewVideoTranscoder(VideoFormatH264, TranscodeSettings{Height: 360, BitrateKbps: 500, FPS: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var output [][]byte
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		for frame := range tr.Frames() {
+			output = append(output, frame)
+		}
+	}()
+
+	for _, frame := range input {
+		if err := tr.Write(frame); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// ffmpeg has everything written once its output catches up
+	time.Sleep(500 * time.Millisecond)
+	tr.Close()
+	select {
+	case <-read:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Frames not closed after Close")
+	}
+
+	if len(output) < len(input)/2 {
+		t.Fatalf("transcoded %d of %d frames", len(output), len(input))
+	}
+	if keyframe, _ := isKeyframe(VideoFormatH264, output[0]); !keyframe {
+		t.Error("first transcoded frame isn't a keyframe")
+	}
+
+	// The output is H.264 at the reduced size
+	if _, err := exec.LookPath("ffprobe"); err != nil {
+		return
+	}
+	probe := exec.Command("ffprobe", "-v", "error", "-f", "h264", "-i", "pipe:0",
+		"-select_streams", "v:0", "-show_entries", "stream=codec_name,height", "-of", "csv=p=0")
+	probe.Stdin = bytes.NewReader(bytes.Join(output, nil))
+	info, err := probe.Output()
+	if err != nil {
+		t.Fatalf("ffprobe: %v", err)
+	}
+	if got := strings.TrimSpace(string(info)); got != "h264,360" {
+		t.Fatalf("transcoded video is %q, want h264,360", got)
+	}
+}
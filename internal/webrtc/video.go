@@ -0,0 +1,197 @@
+package webrtc
+
+import (
+	"bytes"
+	"errors"
+	"time"
+)
+
+// Every peer has a video track of its own, fed from a queue of its own.
+// The broadcaster hands each peer the same frame with SendVideo, which only
+// queues it, and a goroutine per peer writes the queue to the track, so a
+// peer whose connection is slow to take writes drops its own frames instead
+// of holding up everyone else's.
+//
+// A peer can only start decoding at a keyframe, so each peer keeps track of
+// whether it has had one since it joined, resumed video or last dropped a
+// frame. Until it has, frames it couldn't decode are skipped rather than
+// sent. Sunshine's keyframes go to every peer, so a peer that's waiting
+// first gives one another peer asked for a chance to come by, and only asks
+// for one itself after keyframeWait.
+
+const (
+	// videoQueueSize is how many frames a peer's queue holds before it
+	// drops them
+	videoQueueSize = 64
+
+	// keyframeWait is how long a peer waiting for a keyframe waits for one
+	// to come by before asking for it
+	keyframeWait = time.Second
+)
+
+// ErrVideoQueueFull is returned by SendVideo when the peer can't keep up
+// and the frame was dropped
+var ErrVideoQueueFull = errors.New("video send queue full")
+
+// SetVideoPaused stops or resumes sending video to this peer without
+// touching audio or the connection. A resumed peer waits for a keyframe.
+func (p *PeerConnection) SetVideoPaused(paused bool) {
+	if !paused && p.videoPaused.Load() {
+		p.videoResync.Store(true)
+	}
+	p.videoPaused.Store(paused)
+}
+
+// VideoPaused reports whether video is paused for this peer
+func (p *PeerConnection) VideoPaused() bool {
+	return p.videoPaused.Load()
+}
+
+// SendVideo queues video for the peer without waiting for it to be written,
+// dropping it while video is paused. If the queue is full the data is
+// dropped and the peer waits for the next keyframe.
+func (p *PeerConnection) SendVideo(data []byte) error {
+	if p.videoPaused.Load() || p.videoQueue == nil {
+		return nil
+	}
+
+	select {
+	case p.videoQueue <- data:
+		return nil
+	default:
+		p.videoResync.Store(true)
+		return ErrVideoQueueFull
+	}
+}
+
+// writeVideo writes the peer's queued video to its track until the
+// connection closes, skipping what the peer can't decode until a keyframe
+func (p *PeerConnection) writeVideo() {
+	waiting, asked := true, false
+	since := time.Now()
+
+	for {
+		var data []byte
+		select {
+		case <-p.done:
+			return
+		case data = <-p.videoQueue:
+		}
+
+		if p.videoResync.Swap(false) {
+			waiting, asked = true, false
+			since = time.Now()
+		}
+
+		p.mu.Lock()
+		track := p.videoTrack
+		format := p.videoFormat
+		p.mu.Unlock()
+		if track == nil {
+			continue
+		}
+
+		if waiting {
+			keyframe, known := isKeyframe(format, data)
+			if !asked && (!known || time.Since(since) >= keyframeWait) {
+				// Data we can't look into is sent as it comes, so ask
+				// for a keyframe straight away as there's no telling
+				// when one passes
+				asked = true
+				p.requestKeyframe()
+			}
+			if known && !keyframe {
+				continue
+			}
+			waiting = false
+		}
+
+		track.Write(data)
+	}
+}
+
+// requestKeyframe passes a keyframe request on as if the browser sent one
+func (p *PeerConnection) requestKeyframe() {
+	p.mu.Lock()
+	fn := p.onKeyframeRequest
+	p.mu.Unlock()
+	if fn != nil {
+		fn()
+	}
+}
+
+// annexBStartCode begins each NAL unit of an H.264 or H.265 frame
+var annexBStartCode = []byte{0, 0, 1}
+
+// isKeyframe reports whether a video frame in format can be decoded on its
+// own. known is false for data that isn't a whole frame, such as RTP
+// packets passed through as they arrived.
+func isKeyframe(format VideoFormat, frame []byte) (keyframe, known bool) {
+	switch format {
+	case VideoFormatH264, VideoFormatH265:
+		if !bytes.HasPrefix(frame, annexBStartCode) && !bytes.HasPrefix(frame, []byte{0, 0, 0, 1}) {
+			return false, false
+		}
+		for rest := frame; ; {
+			i := bytes.Index(rest, annexBStartCode)
+			if i < 0 || i+3 >= len(rest) {
+				return false, true
+			}
+			rest = rest[i+3:]
+			if isIRAP(format, rest[0]) {
+				return true, true
+			}
+		}
+	case VideoFormatAV1:
+		// A keyframe starts a new sequence, with a sequence header OBU
+		// after the optional temporal delimiter
+		for rest, n := frame, 0; len(rest) > 0 && n < 2; n++ {
+			obuType := rest[0] >> 3 & 0x0f
+			if rest[0]&0x80 != 0 || rest[0]&0x02 == 0 {
+				return false, false // Not a low-overhead OBU stream
+			}
+			if obuType == 1 {
+				return true, true
+			}
+			if obuType != 2 {
+				return false, true
+			}
+			rest = skipOBU(rest)
+		}
+		return false, true
+	}
+	return false, false
+}
+
+// isIRAP reports whether a NAL unit header starts a keyframe: an IDR slice
+// or SPS in H.264, an IRAP picture or VPS in H.265
+func isIRAP(format VideoFormat, header byte) bool {
+	if format == VideoFormatH264 {
+		nalType := header & 0x1f
+		return nalType == 5 || nalType == 7
+	}
+	nalType := header >> 1 & 0x3f
+	return (nalType >= 16 && nalType <= 21) || nalType == 32
+}
+
+// skipOBU returns what follows the OBU at the start of data, or nil if it
+// can't be parsed
+func skipOBU(data []byte) []byte {
+	i := 1
+	if data[0]&0x04 != 0 {
+		i++ // Extension header
+	}
+	var size, shift uint
+	for ; i < len(data) && shift < 56; i++ {
+		size |= uint(data[i]&0x7f) << shift
+		shift += 7
+		if data[i]&0x80 == 0 {
+			i++
+			if uint(len(data)-i) < size {
+				return nil
+			}
+			return data[i+int(size):]
+		}
+	}
+	return nil
+}
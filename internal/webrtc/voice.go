@@ -0,0 +1,140 @@
+package webrtc
+
+import (
+	"fmt"
+
+	"github.com/pion/webrtc/v4"
+
+	"github.com/zalo/moonparty/moonlight-common-go/logging"
+)
+
+// Voice chat is forwarded rather than mixed: each peer's microphone arrives
+// as a track of its own and goes out unchanged, as a track of its own, to
+// every other peer in the session. The server never decodes or encodes
+// voice, so it adds no latency and costs next to no CPU, but a listener
+// receives one stream per speaker and mixes them itself, and every speaker
+// who starts or stops costs the others a renegotiation. Mixing on the server
+// would send each listener one stream whatever the number of speakers, at
+// the price of decoding and re-encoding every voice for every listener.
+
+// voiceStreamPrefix starts the stream ID of a forwarded voice, followed by
+// the speaker's peer ID, so browsers can tell voices from the game's audio
+const voiceStreamPrefix = "moonparty-voice-"
+
+// voicePacketSize fits any RTP packet a browser sends for its microphone
+const voicePacketSize = 1500
+
+// OnVoice sets a callback for when the peer's microphone starts arriving,
+// after which AddVoice can forward it to the other peers
+func (p *PeerConnection) OnVoice(fn func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.onVoice = fn
+}
+
+// HasVoice reports whether the peer is sending its microphone
+func (p *PeerConnection) HasVoice() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.voiceTrack != nil
+}
+
+// SetVoiceMuted stops or resumes forwarding the peer's microphone to the
+// others
+func (p *PeerConnection) SetVoiceMuted(muted bool) {
+	p.voiceMuted.Store(muted)
+}
+
+// VoiceMuted reports whether the peer's microphone is muted
+func (p *PeerConnection) VoiceMuted() bool {
+	return p.voiceMuted.Load()
+}
+
+// receiveVoice copies the peer's microphone into its voice track until the
+// connection closes, dropping it while muted
+func (p *PeerConnection) receiveVoice(remote *webrtc.TrackRemote) {
+	if remote.Kind() != webrtc.RTPCodecTypeAudio {
+		return
+	}
+
+	track, err := webrtc.NewTrackLocalStaticRTP(
+		remote.Codec().RTPCodecCapability,
+		"voice",
+		voiceStreamPrefix+p.id,
+	)
+	if err != nil {
+		logging.Errorf("Peer %s: failed to create voice track: %v", p.id, err)
+		return
+	}
+
+	p.mu.Lock()
+	p.voiceTrack = track
+	fn := p.onVoice
+	p.mu.Unlock()
+
+	logging.Infof("Peer %s: receiving voice (%s)", p.id, remote.Codec().MimeType)
+	if fn != nil {
+		go fn()
+	}
+
+	buf := make([]byte, voicePacketSize)
+	for {
+		n, _, err := remote.Read(buf)
+		if err != nil {
+			return
+		}
+		if p.voiceMuted.Load() {
+			continue
+		}
+		track.Write(buf[:n])
+	}
+}
+
+// AddVoice forwards speaker's microphone to this peer, renegotiating so the
+// browser receives it. It does nothing if the speaker has no microphone or
+// is already forwarded.
+func (p *PeerConnection) AddVoice(speaker *PeerConnection) error {
+	speaker.mu.Lock()
+	track := speaker.voiceTrack
+	speaker.mu.Unlock()
+
+	if track == nil || speaker == p {
+		return nil
+	}
+
+	p.mu.Lock()
+	if _, ok := p.voiceSenders[speaker.id]; ok {
+		p.mu.Unlock()
+		return nil
+	}
+	sender, err := p.pc.AddTrack(track)
+	if err != nil {
+		p.mu.Unlock()
+		return fmt.Errorf("failed to add voice track: %w", err)
+	}
+	if p.voiceSenders == nil {
+		p.voiceSenders = make(map[string]*webrtc.RTPSender)
+	}
+	p.voiceSenders[speaker.id] = sender
+	p.mu.Unlock()
+
+	return p.negotiate()
+}
+
+// RemoveVoice stops forwarding speakerID's microphone to this peer
+func (p *PeerConnection) RemoveVoice(speakerID string) error {
+	p.mu.Lock()
+	sender, ok := p.voiceSenders[speakerID]
+	if !ok {
+		p.mu.Unlock()
+		return nil
+	}
+	delete(p.voiceSenders, speakerID)
+	err := p.pc.RemoveTrack(sender)
+	p.mu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("failed to remove voice track: %w", err)
+	}
+	return p.negotiate()
+}
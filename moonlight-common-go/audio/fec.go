@@ -0,0 +1,315 @@
+package audio
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+
+	"github.com/zalo/moonparty/moonlight-common-go/fec"
+	"github.com/zalo/moonparty/moonlight-common-go/protocol"
+)
+
+const (
+	// DataShards is the number of audio packets in an FEC block
+	DataShards = 4
+	// FECShards is the number of parity packets in an FEC block
+	FECShards = 2
+	// BlockShards is the total number of packets in an FEC block
+	BlockShards = DataShards + FECShards
+
+	// DefaultFECWorkers is the FEC worker count when the config leaves it unset
+	DefaultFECWorkers = 2
+
+	payloadTypeAudio = 97
+	payloadTypeFEC   = 127
+
+	// fecHeaderSize is the audio FEC header following the RTP header:
+	// shard index (1), payload type (1), base sequence (2), base timestamp (4), SSRC (4)
+	fecHeaderSize = 12
+
+	// fecGroupQueueSize bounds the groups waiting for a worker
+	fecGroupQueueSize = 8
+	// maxConcealedBlocks bounds the blocks concealed for a gap in the
+	// stream; past it, playback just resumes with the new audio
+	maxConcealedBlocks = 4
+)
+
+// fecParity is the audio parity matrix used by GFE and Sunshine. It doesn't
+// match the Cauchy rows our codec generates, so it is supplied explicitly.
+var fecParity = []byte{0x77, 0x40, 0x38, 0x0e, 0xc7, 0xa7, 0x0d, 0x6c}
+
+// fecGroup is one FEC block handed to a worker. Index orders groups for the
+// reorder buffer; packets[0:DataShards] are audio, the rest parity.
+type fecGroup struct {
+	index   uint64
+	baseSeq uint16
+	packets [BlockShards]*audioPacket
+	present int
+}
+
+// fecResult is a decoded group waiting in the reorder buffer
+type fecResult struct {
+	packets []*audioPacket
+}
+
+// fecAssembler collects packets from the receive loop into FEC blocks. It
+// is only used from receiveLoop, apart from buffered.
+//
+// It doubles as the jitter buffer: blocks are kept in sequence order, up to
+// depth of them, and only ever leave from the oldest. A block leaves as soon
+// as its audio is complete or recoverable, or incomplete once depth newer
+// blocks have started arriving, so a packet may come that far behind the
+// ones after it and still be played in order. With a depth of 1 a block is
+// given up on as soon as the next one starts.
+type fecAssembler struct {
+	depth     int
+	blocks    []*fecGroup // Consecutive blocks, oldest first
+	base      uint16      // Base sequence of blocks[0], or of the next block once empty
+	started   bool
+	nextIndex uint64
+
+	// buffered is how many audio packets the held blocks have, for
+	// GetPendingDuration
+	buffered atomic.Int32
+}
+
+// add files a packet into its block and returns the groups that are ready
+// for the workers, in order: the oldest blocks, once their audio is complete
+// or can be fully recovered or depth newer blocks started. Blocks that never
+// arrived go as empty groups, so the decoder conceals their audio rather
+// than skipping it, unless the gap is too long to be worth concealing.
+func (a *fecAssembler) add(baseSeq uint16, shard int, pkt *audioPacket) []*fecGroup {
+	var ready []*fecGroup
+
+	if !a.started {
+		a.started = true
+		a.base = baseSeq
+	}
+	if int16(baseSeq-a.base) < 0 {
+		return nil // Late packet for a block we already moved past
+	}
+
+	i := int(baseSeq-a.base) / DataShards
+	if missing := i - len(a.blocks); missing > maxConcealedBlocks {
+		// Too long a gap; resume with the new audio
+		ready = a.flush()
+		a.base = baseSeq
+		i = 0
+	}
+	for len(a.blocks) <= i {
+		a.blocks = append(a.blocks, &fecGroup{baseSeq: a.base + uint16(len(a.blocks)*DataShards)})
+	}
+
+	g := a.blocks[i]
+	if g.baseSeq == baseSeq && g.packets[shard] == nil {
+		g.packets[shard] = pkt
+		g.present++
+	}
+
+	// Let the oldest blocks go as soon as their audio is here or enough
+	// shards arrived to rebuild it, rather than waiting on parity we won't
+	// need, and whatever state they're in once the buffer is over depth
+	for len(a.blocks) > 0 && (a.blocks[0].present >= DataShards || len(a.blocks) > max(a.depth, 1)) {
+		ready = append(ready, a.pop())
+	}
+
+	a.count()
+	return ready
+}
+
+// pop hands off the oldest block, complete or not
+func (a *fecAssembler) pop() *fecGroup {
+	g := a.blocks[0]
+	a.blocks[0] = nil
+	a.blocks = a.blocks[1:]
+	g.index = a.nextIndex
+	a.nextIndex++
+	a.base = g.baseSeq + DataShards
+	return g
+}
+
+// flush hands off every held block, complete or not
+func (a *fecAssembler) flush() []*fecGroup {
+	var groups []*fecGroup
+	for len(a.blocks) > 0 {
+		groups = append(groups, a.pop())
+	}
+	a.count()
+	return groups
+}
+
+// count updates buffered with the audio packets the held blocks have
+func (a *fecAssembler) count() {
+	n := 0
+	for _, g := range a.blocks {
+		for _, pkt := range g.packets[:DataShards] {
+			if pkt != nil {
+				n++
+			}
+		}
+	}
+	a.buffered.Store(int32(n))
+}
+
+// reorderBuffer releases decoded groups in group order, since workers may
+// finish out of order
+type reorderBuffer struct {
+	mu      sync.Mutex
+	next    uint64
+	pending map[uint64]fecResult
+}
+
+func newReorderBuffer() *reorderBuffer {
+	return &reorderBuffer{pending: make(map[uint64]fecResult)}
+}
+
+// push stores a group's result and emits every group that is now in order
+func (r *reorderBuffer) push(index uint64, res fecResult, emit func(*audioPacket)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.pending[index] = res
+	for {
+		res, ok := r.pending[r.next]
+		if !ok {
+			return
+		}
+		delete(r.pending, r.next)
+		r.next++
+		for _, pkt := range res.packets {
+			emit(pkt)
+		}
+	}
+}
+
+// handleFECPacket splits an RTP packet into its block and shard and feeds
+// the assembler. Payloads stay encrypted; FEC is computed over ciphertext.
+func (s *Stream) handleFECPacket(packet []byte, payloadType byte, seqNum uint16) {
+	var baseSeq uint16
+	var shard int
+	var payload []byte
+
+	switch payloadType {
+	case payloadTypeAudio:
+		baseSeq = seqNum - seqNum%DataShards
+		shard = int(seqNum - baseSeq)
+		payload = packet[protocol.RTPHeaderSize:]
+	case payloadTypeFEC:
+		if len(packet) < protocol.RTPHeaderSize+fecHeaderSize {
+			return
+		}
+		hdr := packet[protocol.RTPHeaderSize:]
+		index := int(hdr[0])
+		if index >= FECShards {
+			return
+		}
+		baseSeq = binary.BigEndian.Uint16(hdr[2:4])
+		shard = DataShards + index
+		payload = hdr[fecHeaderSize:]
+	default:
+		return
+	}
+
+	data := make([]byte, len(payload))
+	copy(data, payload)
+
+	for _, g := range s.fecAssembler.add(baseSeq, shard, &audioPacket{data: data, size: len(data)}) {
+		s.dispatchFECGroup(g)
+	}
+}
+
+// flushFECGroups hands every held block to the workers, e.g. when audio
+// pauses
+func (s *Stream) flushFECGroups() {
+	for _, g := range s.fecAssembler.flush() {
+		s.dispatchFECGroup(g)
+	}
+}
+
+func (s *Stream) dispatchFECGroup(g *fecGroup) {
+	select {
+	case s.fecGroups <- g:
+	case <-s.ctx.Done():
+	}
+}
+
+// fecWorker reconstructs missing audio in each group it receives and hands
+// the group's packets to the reorder buffer
+func (s *Stream) fecWorker(rs *fec.ReedSolomon) {
+	defer s.wg.Done()
+
+	pool := fec.NewShardPool(DataShards)
+	shards := make([][]byte, BlockShards)
+	present := make([]bool, BlockShards)
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case g, ok := <-s.fecGroups:
+			if !ok {
+				return
+			}
+			s.fecReorder.push(g.index, s.decodeFECGroup(rs, pool, g, shards, present), s.submitPacket)
+		}
+	}
+}
+
+// decodeFECGroup recovers what it can of a group's audio, decrypting each
+// packet. Audio that can't be recovered becomes an empty packet so the
+// decoder runs packet loss concealment.
+func (s *Stream) decodeFECGroup(rs *fec.ReedSolomon, pool *fec.ShardPool, g *fecGroup, shards [][]byte, present []bool) fecResult {
+	missing := 0
+	for i := 0; i < DataShards; i++ {
+		if g.packets[i] == nil {
+			missing++
+		}
+	}
+
+	if missing > 0 && g.present >= DataShards {
+		for i, pkt := range g.packets {
+			present[i] = pkt != nil
+			if pkt != nil {
+				shards[i] = pkt.data
+			} else {
+				shards[i] = nil
+			}
+		}
+
+		if err := rs.Reconstruct(shards, present, pool); err == nil {
+			for i := 0; i < DataShards; i++ {
+				if g.packets[i] == nil {
+					data := make([]byte, len(shards[i]))
+					copy(data, shards[i])
+					pool.Put(shards[i])
+					g.packets[i] = &audioPacket{data: data, size: len(data)}
+				}
+			}
+
+			s.mu.Lock()
+			s.stats.RecoveredPackets += uint32(missing)
+			s.mu.Unlock()
+		}
+	}
+
+	res := fecResult{packets: make([]*audioPacket, 0, DataShards)}
+	for i := 0; i < DataShards; i++ {
+		pkt := g.packets[i]
+		if pkt == nil {
+			res.packets = append(res.packets, &audioPacket{})
+			continue
+		}
+
+		if s.encrypted {
+			decrypted, err := s.decryptPayload(pkt.data, g.baseSeq+uint16(i))
+			if err != nil {
+				res.packets = append(res.packets, &audioPacket{})
+				continue
+			}
+			pkt = &audioPacket{data: decrypted, size: len(decrypted)}
+		}
+		res.packets = append(res.packets, pkt)
+	}
+
+	return res
+}
@@ -0,0 +1,118 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/zalo/moonparty/moonlight-common-go/types"
+)
+
+// gfMul multiplies in GF(2^8) over x^8+x^4+x^3+x^2+1, bit by bit, as a
+// reference independent of the fec package's tables
+func gfMul(a, b byte) byte {
+	var p byte
+	for ; b != 0; b >>= 1 {
+		if b&1 != 0 {
+			p ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1d
+		}
+	}
+	return p
+}
+
+// hostParity computes a block's parity the way Sunshine does: parity shard
+// i is the sum of data shard j times fecParity[i*DataShards+j]
+func hostParity(data [DataShards][]byte) [FECShards][]byte {
+	var parity [FECShards][]byte
+	for i := range parity {
+		parity[i] = make([]byte, len(data[0]))
+		for j, shard := range data {
+			c := fecParity[i*DataShards+j]
+			for k, b := range shard {
+				parity[i][k] ^= gfMul(c, b)
+			}
+		}
+	}
+	return parity
+}
+
+// fec sends parity shard index of the block starting at baseSeq
+func (h *testHost) fec(seq uint16, index int, baseSeq uint16, payload []byte) {
+	pkt := make([]byte, 12+fecHeaderSize, 12+fecHeaderSize+len(payload))
+	pkt[0] = 0x80
+	pkt[1] = payloadTypeFEC
+	binary.BigEndian.PutUint16(pkt[2:4], seq)
+	hdr := pkt[12:]
+	hdr[0] = byte(index)
+	hdr[1] = payloadTypeAudio
+	binary.BigEndian.PutUint16(hdr[2:4], baseSeq)
+	binary.BigEndian.PutUint32(hdr[4:8], uint32(baseSeq)*packetMs)
+	h.send(append(pkt, payload...))
+}
+
+func TestFECRecoversAudio(t *testing.T) {
+	for _, drop := range [][]int{{1}, {0, 3}, {1, 2}} {
+		t.Run(fmt.Sprint(drop), func(t *testing.T) {
+			rec, s, host := startHost(t, types.StreamConfiguration{})
+
+			// A block of audio, each packet starting with its sequence
+			var data [DataShards][]byte
+			for seq := range data {
+				data[seq] = make([]byte, 40)
+				for k := range data[seq] {
+					data[seq][k] = byte(seq + k*13)
+				}
+			}
+			parity := hostParity(data)
+
+			for seq, payload := range data {
+				if !slices.Contains(drop, seq) {
+					host.audio(uint16(seq), payload)
+				}
+			}
+			for i, payload := range parity {
+				host.fec(uint16(i), i, 0, payload)
+			}
+
+			want := []int{0, 1, 2, 3}
+			if got := rec.waitFor(len(want)); !slices.Equal(got, want) {
+				t.Fatalf("played %v, want %v", got, want)
+			}
+			rec.mu.Lock()
+			defer rec.mu.Unlock()
+			for seq, payload := range rec.payloads {
+				if !bytes.Equal(payload, data[seq]) {
+					t.Errorf("packet %d played as % x, want % x", seq, payload, data[seq])
+				}
+			}
+			if got := s.GetStats().RecoveredPackets; got != uint32(len(drop)) {
+				t.Errorf("RecoveredPackets = %d, want %d", got, len(drop))
+			}
+		})
+	}
+}
+
+func TestFECTooManyLost(t *testing.T) {
+	rec, s, host := startHost(t, types.StreamConfiguration{})
+
+	// Three packets lost is more than two parity shards rebuild; the block
+	// goes once audio pauses and its losses are concealed
+	host.audio(0, bytes.Repeat([]byte{0}, 40))
+	host.fec(0, 0, 0, make([]byte, 40))
+	host.fec(1, 1, 0, make([]byte, 40))
+
+	want := []int{0, -1, -1, -1}
+	if got := rec.waitFor(len(want)); !slices.Equal(got, want) {
+		t.Fatalf("played %v, want %v", got, want)
+	}
+	if got := s.GetStats().RecoveredPackets; got != 0 {
+		t.Errorf("RecoveredPackets = %d, want 0", got)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/zalo/moonparty/moonlight-common-go/crypto"
+	"github.com/zalo/moonparty/moonlight-common-go/fec"
 	"github.com/zalo/moonparty/moonlight-common-go/protocol"
 	"github.com/zalo/moonparty/moonlight-common-go/types"
 )
@@ -18,8 +19,6 @@ const (
 	MaxPacketSize = 1400
 	// UDPRecvPollTimeout is the receive timeout
 	UDPRecvPollTimeout = 100 * time.Millisecond
-	// InitialDropMs is the initial audio to drop to catch up
-	InitialDropMs = 500
 )
 
 // Stream manages audio RTP reception
@@ -27,9 +26,9 @@ type Stream struct {
 	mu sync.Mutex
 
 	// Configuration
-	config      types.StreamConfiguration
-	callbacks   types.AudioCallbacks
-	opusConfig  *types.OpusConfig
+	config         types.StreamConfiguration
+	callbacks      types.AudioCallbacks
+	opusConfig     *types.OpusConfig
 	packetDuration int // In milliseconds
 
 	// Networking
@@ -53,13 +52,25 @@ type Stream struct {
 	wg     sync.WaitGroup
 
 	// State
-	receivedData   bool
-	lastSeq        uint16
-	packetsToDrop  int
+	receivedData  bool
+	lastSeq       uint16
+	packetsToDrop int
 
 	// Queue for non-direct submit
 	packetQueue chan *audioPacket
 
+	// Opus decoding for PCM callbacks, set up by Start when the
+	// configuration has a decoder
+	decoder      types.OpusDecoder
+	pcmCallbacks types.PCMAudioCallbacks
+	pcm          []int16
+
+	// FEC decoding, off the receive path
+	fecAssembler fecAssembler
+	fecGroups    chan *fecGroup
+	fecReorder   *reorderBuffer
+	fecWorkers   int
+
 	// Stats
 	stats types.RTPAudioStats
 }
@@ -87,6 +98,10 @@ func NewStream(config types.StreamConfiguration, callbacks types.AudioCallbacks,
 		aesKey:     config.RemoteInputAesKey,
 		aesIV:      config.RemoteInputAesIV,
 		riKeyID:    riKeyID,
+		fecWorkers: config.AudioFECWorkers,
+	}
+	if s.fecWorkers <= 0 {
+		s.fecWorkers = DefaultFECWorkers
 	}
 	// Copy ping payload (X-SS-Ping-Payload is a 16-char hex string sent as ASCII)
 	if len(pingPayload) == 16 {
@@ -119,19 +134,44 @@ func (s *Stream) Start(ctx context.Context, remoteAddr, localAddr *net.UDPAddr,
 		s.packetQueue = make(chan *audioPacket, 30)
 	}
 
-	// Calculate packets to drop
-	s.packetsToDrop = InitialDropMs / packetDuration
+	// Calculate packets to drop, and how many FEC blocks of jitter to hold
+	if packetDuration > 0 {
+		s.packetsToDrop = max(s.config.AudioInitialDropMs, 0) / packetDuration
+		blockMs := packetDuration * DataShards
+		s.fecAssembler.depth = 1 + (max(s.config.AudioJitterBufferMs, 0)+blockMs-1)/blockMs
+	}
 
 	// Initialize stats
 	s.stats.MeasurementStartTime = time.Now()
 
+	rs, err := fec.NewWithParity(DataShards, FECShards, fecParity)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	// Decode to PCM if the configuration asks for it
+	if err := s.setupOpusDecoder(opusConfig); err != nil {
+		conn.Close()
+		return err
+	}
+
 	// Initialize audio decoder
 	if err := s.callbacks.Init(s.config.AudioConfiguration, opusConfig, nil, 0); err != nil {
 		conn.Close()
+		s.closeOpusDecoder()
 		return err
 	}
 	s.callbacks.Start()
 
+	// Start FEC workers
+	s.fecGroups = make(chan *fecGroup, fecGroupQueueSize)
+	s.fecReorder = newReorderBuffer()
+	for i := 0; i < s.fecWorkers; i++ {
+		s.wg.Add(1)
+		go s.fecWorker(rs)
+	}
+
 	// Start threads
 	s.wg.Add(2)
 	go s.receiveLoop()
@@ -158,13 +198,48 @@ func (s *Stream) Stop() {
 		s.conn.Close()
 	}
 
+	s.wg.Wait()
+
+	// Close only once nothing can still be enqueueing
 	if s.packetQueue != nil {
 		close(s.packetQueue)
 	}
 
-	s.wg.Wait()
-
 	s.callbacks.Cleanup()
+	s.closeOpusDecoder()
+}
+
+// maxOpusFrameSamples is the longest Opus frame, 120ms at 48kHz, in samples
+// per channel
+const maxOpusFrameSamples = 5760
+
+// setupOpusDecoder creates the configured Opus decoder for queued audio
+func (s *Stream) setupOpusDecoder(opusConfig *types.OpusConfig) error {
+	if s.config.OpusDecoder == nil || s.packetQueue == nil {
+		return nil
+	}
+
+	pcmCallbacks, ok := s.callbacks.(types.PCMAudioCallbacks)
+	if !ok {
+		return ErrNoPCMCallbacks
+	}
+	decoder, err := s.config.OpusDecoder(opusConfig)
+	if err != nil {
+		return err
+	}
+
+	s.decoder = decoder
+	s.pcmCallbacks = pcmCallbacks
+	s.pcm = make([]int16, maxOpusFrameSamples*max(opusConfig.ChannelCount, 1))
+	return nil
+}
+
+// closeOpusDecoder releases the Opus decoder, if there is one
+func (s *Stream) closeOpusDecoder() {
+	if s.decoder != nil {
+		s.decoder.Close()
+		s.decoder = nil
+	}
 }
 
 // GetStats returns current audio statistics
@@ -174,6 +249,11 @@ func (s *Stream) GetStats() types.RTPAudioStats {
 	return s.stats
 }
 
+// IsEncrypted returns whether audio packets are decrypted as they arrive
+func (s *Stream) IsEncrypted() bool {
+	return s.encrypted
+}
+
 // GetPendingFrames returns the number of pending audio frames
 func (s *Stream) GetPendingFrames() int {
 	if s.packetQueue == nil {
@@ -182,14 +262,16 @@ func (s *Stream) GetPendingFrames() int {
 	return len(s.packetQueue)
 }
 
-// GetPendingDuration returns the pending audio duration in milliseconds
+// GetPendingDuration returns the pending audio duration in milliseconds:
+// what's queued for the decoder and what the jitter buffer holds
 func (s *Stream) GetPendingDuration() int {
-	return s.GetPendingFrames() * s.packetDuration
+	return (s.GetPendingFrames() + int(s.fecAssembler.buffered.Load())) * s.packetDuration
 }
 
 // receiveLoop handles incoming RTP packets
 func (s *Stream) receiveLoop() {
 	defer s.wg.Done()
+	defer close(s.fecGroups)
 
 	buffer := make([]byte, MaxPacketSize)
 
@@ -209,6 +291,8 @@ func (s *Stream) receiveLoop() {
 				if s.receivedData {
 					s.packetsToDrop = 0
 				}
+				// Audio paused, so don't hold partial blocks back
+				s.flushFECGroups()
 				continue
 			}
 			return
@@ -240,42 +324,45 @@ func (s *Stream) receiveLoop() {
 		// Extract sequence number
 		seqNum := binary.BigEndian.Uint16(buffer[2:4])
 
-		// Check for packet loss
-		if s.lastSeq != 0 && seqNum != s.lastSeq+1 {
-			// Packet loss detected
-			s.mu.Lock()
-			s.stats.DroppedPackets += uint32(seqNum - s.lastSeq - 1)
-			s.mu.Unlock()
+		// Check for packet loss. Parity packets aren't part of the audio sequence.
+		if packetType == payloadTypeAudio {
+			if s.lastSeq != 0 && seqNum != s.lastSeq+1 {
+				// Packet loss detected
+				s.mu.Lock()
+				s.stats.DroppedPackets += uint32(seqNum - s.lastSeq - 1)
+				s.mu.Unlock()
+			}
+			s.lastSeq = seqNum
 		}
-		s.lastSeq = seqNum
 
-		// Decrypt if needed
-		var audioData []byte
-		if s.encrypted {
-			decrypted, err := s.decryptPacket(buffer[:n], seqNum)
-			if err != nil {
-				continue
-			}
-			audioData = decrypted
+		// Group into FEC blocks; the workers recover, decrypt and submit
+		s.handleFECPacket(buffer[:n], packetType, seqNum)
+	}
+}
+
+// submitPacket hands a packet to the decoder, directly or via the queue.
+// An empty packet asks the decoder for loss concealment.
+func (s *Stream) submitPacket(pkt *audioPacket) {
+	if s.callbacks.Capabilities()&types.CapabilityDirectSubmit != 0 {
+		if pkt.size == 0 {
+			s.callbacks.DecodeAndPlaySample(nil)
 		} else {
-			audioData = make([]byte, n-protocol.RTPHeaderSize)
-			copy(audioData, buffer[protocol.RTPHeaderSize:n])
+			s.callbacks.DecodeAndPlaySample(pkt.data)
 		}
+		return
+	}
 
-		// Process audio
-		if s.callbacks.Capabilities()&types.CapabilityDirectSubmit != 0 {
-			s.callbacks.DecodeAndPlaySample(audioData)
-		} else {
-			select {
-			case s.packetQueue <- &audioPacket{data: audioData, size: len(audioData)}:
-			default:
-				// Queue full, drop oldest
-				select {
-				case <-s.packetQueue:
-				default:
-				}
-				s.packetQueue <- &audioPacket{data: audioData, size: len(audioData)}
-			}
+	select {
+	case s.packetQueue <- pkt:
+	default:
+		// Queue full, drop oldest
+		select {
+		case <-s.packetQueue:
+		default:
+		}
+		select {
+		case s.packetQueue <- pkt:
+		default:
 		}
 	}
 }
@@ -331,7 +418,9 @@ func (s *Stream) decoderLoop() {
 			if !ok {
 				return
 			}
-			if pkt.size == 0 {
+			if s.decoder != nil {
+				s.decodePacket(pkt)
+			} else if pkt.size == 0 {
 				// Packet loss concealment
 				s.callbacks.DecodeAndPlaySample(nil)
 			} else {
@@ -341,13 +430,27 @@ func (s *Stream) decoderLoop() {
 	}
 }
 
-// decryptPacket decrypts an audio packet using AES-CBC
-func (s *Stream) decryptPacket(data []byte, seqNum uint16) ([]byte, error) {
-	if len(data) <= protocol.RTPHeaderSize {
-		return nil, ErrPacketTooSmall
+// decodePacket decodes a queued packet to PCM and plays it. An empty packet
+// is concealed by the decoder; one it can't decode is dropped.
+func (s *Stream) decodePacket(pkt *audioPacket) {
+	var data []byte
+	if pkt.size > 0 {
+		data = pkt.data
 	}
 
-	audioData := data[protocol.RTPHeaderSize:]
+	samples, err := s.decoder.Decode(data, s.pcm)
+	if err != nil || samples <= 0 {
+		return
+	}
+	channels := max(s.opusConfig.ChannelCount, 1)
+	s.pcmCallbacks.PlayDecodedSample(s.pcm[:min(samples*channels, len(s.pcm))])
+}
+
+// decryptPayload decrypts an audio RTP payload using AES-CBC
+func (s *Stream) decryptPayload(audioData []byte, seqNum uint16) ([]byte, error) {
+	if len(audioData) == 0 {
+		return nil, ErrPacketTooSmall
+	}
 
 	// Build IV: riKeyID + sequence number
 	iv := make([]byte, 16)
@@ -376,6 +479,7 @@ func decryptAESCBC(key, iv, ciphertext []byte) ([]byte, error) {
 var (
 	ErrPacketTooSmall = &audioError{"packet too small"}
 	ErrDecryptFailed  = &audioError{"decryption failed"}
+	ErrNoPCMCallbacks = &audioError{"audio callbacks can't play PCM for the Opus decoder"}
 )
 
 type audioError struct {
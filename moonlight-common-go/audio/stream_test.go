@@ -0,0 +1,308 @@
+package audio
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zalo/moonparty/moonlight-common-go/types"
+)
+
+// packetMs is the audio packet duration the tests stream at
+const packetMs = 5
+
+// samples records what reaches DecodeAndPlaySample: each packet's first
+// payload byte, or -1 for concealment, and the payloads themselves
+type samples struct {
+	mu       sync.Mutex
+	got      []int
+	payloads [][]byte
+}
+
+func (s *samples) Init(types.AudioConfiguration, *types.OpusConfig, interface{}, int) error {
+	return nil
+}
+func (s *samples) Start()   {}
+func (s *samples) Stop()    {}
+func (s *samples) Cleanup() {}
+
+func (s *samples) Capabilities() int { return types.CapabilityDirectSubmit }
+
+func (s *samples) DecodeAndPlaySample(data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.payloads = append(s.payloads, slices.Clone(data))
+	if data == nil {
+		s.got = append(s.got, -1)
+		return
+	}
+	s.got = append(s.got, int(data[0]))
+}
+
+// waitFor returns the samples once n have arrived, or whatever arrived
+// within two seconds
+func (s *samples) waitFor(n int) []int {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		got := slices.Clone(s.got)
+		s.mu.Unlock()
+		if len(got) >= n {
+			return got
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.got)
+}
+
+// testHost sends RTP packets to a stream from a loopback socket
+type testHost struct {
+	t      *testing.T
+	conn   *net.UDPConn
+	client *net.UDPAddr
+}
+
+// send sends a whole RTP packet
+func (h *testHost) send(pkt []byte) {
+	if _, err := h.conn.WriteToUDP(pkt, h.client); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+// audio sends the audio packet with sequence seq
+func (h *testHost) audio(seq uint16, payload []byte) {
+	pkt := make([]byte, 12, 12+len(payload))
+	pkt[0] = 0x80
+	pkt[1] = payloadTypeAudio
+	binary.BigEndian.PutUint16(pkt[2:4], seq)
+	binary.BigEndian.PutUint32(pkt[4:8], uint32(seq)*packetMs)
+	h.send(append(pkt, payload...))
+}
+
+// startStream starts an audio stream on loopback and returns it with a
+// function that sends it the audio packet with sequence seq, whose payload
+// is seq
+func startStream(t *testing.T, config types.StreamConfiguration) (*samples, func(seq uint16)) {
+	t.Helper()
+	rec, _, host := startHost(t, config)
+	return rec, func(seq uint16) { host.audio(seq, []byte{byte(seq)}) }
+}
+
+// startHost starts an audio stream on loopback and returns it with the host
+// sending to it
+func startHost(t *testing.T, config types.StreamConfiguration) (*samples, *Stream, *testHost) {
+	t.Helper()
+	rec := &samples{}
+	s, host := startHostWith(t, config, rec)
+	return rec, s, host
+}
+
+// startHostWith is startHost with the stream playing to callbacks
+func startHostWith(t *testing.T, config types.StreamConfiguration, callbacks types.AudioCallbacks) (*Stream, *testHost) {
+	t.Helper()
+
+	host, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { host.Close() })
+	hostAddr := host.LocalAddr().(*net.UDPAddr)
+
+	s := NewStream(config, callbacks, "")
+	err = s.Start(context.Background(), hostAddr, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, hostAddr.Port,
+		&types.OpusConfig{SampleRate: 48000, ChannelCount: 2}, packetMs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+
+	return s, &testHost{t: t, conn: host, client: s.conn.LocalAddr().(*net.UDPAddr)}
+}
+
+func TestInitialDrop(t *testing.T) {
+	rec, send := startStream(t, types.StreamConfiguration{AudioInitialDropMs: 4 * packetMs})
+	for seq := uint16(0); seq < 12; seq++ {
+		send(seq)
+	}
+
+	want := []int{4, 5, 6, 7, 8, 9, 10, 11}
+	if got := rec.waitFor(len(want)); !slices.Equal(got, want) {
+		t.Fatalf("played %v, want the first 4 packets dropped: %v", got, want)
+	}
+}
+
+func TestNoInitialDrop(t *testing.T) {
+	rec, send := startStream(t, types.StreamConfiguration{})
+	for seq := uint16(0); seq < 8; seq++ {
+		send(seq)
+	}
+
+	want := []int{0, 1, 2, 3, 4, 5, 6, 7}
+	if got := rec.waitFor(len(want)); !slices.Equal(got, want) {
+		t.Fatalf("played %v, want %v", got, want)
+	}
+}
+
+// reordered sends packet 3 after the whole of the next block
+var reordered = []uint16{0, 1, 2, 4, 5, 6, 7, 3, 8, 9, 10, 11}
+
+func TestJitterBufferReorders(t *testing.T) {
+	// One FEC block (4 packets) of jitter
+	rec, send := startStream(t, types.StreamConfiguration{AudioJitterBufferMs: DataShards * packetMs})
+	for _, seq := range reordered {
+		send(seq)
+	}
+
+	want := []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}
+	if got := rec.waitFor(len(want)); !slices.Equal(got, want) {
+		t.Fatalf("played %v, want %v", got, want)
+	}
+}
+
+func TestNoJitterBufferConceals(t *testing.T) {
+	rec, send := startStream(t, types.StreamConfiguration{})
+	for _, seq := range reordered {
+		send(seq)
+	}
+
+	// Without a jitter buffer, the late packet's block is given up on as
+	// soon as the next starts, and the packet is concealed
+	want := []int{0, 1, 2, -1, 4, 5, 6, 7, 8, 9, 10, 11}
+	if got := rec.waitFor(len(want)); !slices.Equal(got, want) {
+		t.Fatalf("played %v, want %v", got, want)
+	}
+}
+
+// silentFrame is a 20ms CELT fullband stereo Opus packet of silence
+var silentFrame = []byte{0xfc, 0xff, 0xfe}
+
+// opusFrameSamples returns the samples per channel at 48kHz of a packet
+// holding one Opus frame, from its TOC byte
+func opusFrameSamples(toc byte) int {
+	switch config := toc >> 3; {
+	case config < 12: // SILK: 10, 20, 40 or 60ms
+		return []int{480, 960, 1920, 2880}[config%4]
+	case config < 16: // Hybrid: 10 or 20ms
+		return []int{480, 960}[config%2]
+	default: // CELT: 2.5, 5, 10 or 20ms
+		return []int{120, 240, 480, 960}[config%4]
+	}
+}
+
+// fakeOpus decodes single-frame Opus packets to silence of the right length,
+// recording the packets it's given
+type fakeOpus struct {
+	mu      sync.Mutex
+	config  types.OpusConfig
+	packets [][]byte
+	last    int
+}
+
+func (d *fakeOpus) Decode(packet []byte, pcm []int16) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.packets = append(d.packets, slices.Clone(packet))
+
+	// A lost packet is concealed as long as the one before it
+	if packet != nil {
+		d.last = opusFrameSamples(packet[0])
+	}
+	clear(pcm[:d.last*d.config.ChannelCount])
+	return d.last, nil
+}
+
+func (d *fakeOpus) Close() error { return nil }
+
+// pcmPlayer records the length of each PCM sample played
+type pcmPlayer struct {
+	samples
+}
+
+func (p *pcmPlayer) Capabilities() int { return 0 }
+
+func (p *pcmPlayer) PlayDecodedSample(pcm []int16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.got = append(p.got, len(pcm))
+}
+
+func TestOpusDecoderPlaysPCM(t *testing.T) {
+	dec := &fakeOpus{}
+	player := &pcmPlayer{}
+	_, host := startHostWith(t, types.StreamConfiguration{
+		OpusDecoder: func(config *types.OpusConfig) (types.OpusDecoder, error) {
+			dec.config = *config
+			return dec, nil
+		},
+	}, player)
+
+	// Packet 2 is lost and concealed
+	for seq := uint16(0); seq < 8; seq++ {
+		if seq != 2 {
+			host.audio(seq, silentFrame)
+		}
+	}
+
+	// 20ms of stereo each, concealment included
+	played := player.waitFor(8)
+	if want := slices.Repeat([]int{960 * 2}, 8); !slices.Equal(played, want) {
+		t.Fatalf("played PCM of %v samples, want %v", played, want)
+	}
+	if player.payloads != nil {
+		t.Errorf("Opus packets reached DecodeAndPlaySample alongside the decoder")
+	}
+
+	dec.mu.Lock()
+	defer dec.mu.Unlock()
+	if dec.config.SampleRate != 48000 || dec.config.ChannelCount != 2 {
+		t.Errorf("decoder created for %d Hz, %d channels, want the stream's 48000 Hz stereo",
+			dec.config.SampleRate, dec.config.ChannelCount)
+	}
+	for seq, packet := range dec.packets {
+		if lost := seq == 2; lost != (packet == nil) || !lost && !slices.Equal(packet, silentFrame) {
+			t.Errorf("decoder given % x for packet %d", packet, seq)
+		}
+	}
+}
+
+func TestOpusDecoderSkippedForDirectSubmit(t *testing.T) {
+	created := false
+	rec, _, host := startHost(t, types.StreamConfiguration{
+		OpusDecoder: func(*types.OpusConfig) (types.OpusDecoder, error) {
+			created = true
+			return &fakeOpus{}, nil
+		},
+	})
+	host.audio(0, silentFrame)
+
+	// Direct submit forwards the Opus packet untouched; the rest of its
+	// block is concealed once audio pauses
+	rec.waitFor(1)
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if created || !slices.Equal(rec.payloads[0], silentFrame) {
+		t.Fatalf("decoder created: %v; played % x first, want the Opus packet % x", created, rec.payloads[0], silentFrame)
+	}
+}
+
+func TestOpusDecoderNeedsPCMCallbacks(t *testing.T) {
+	s := NewStream(types.StreamConfiguration{
+		OpusDecoder: func(*types.OpusConfig) (types.OpusDecoder, error) { return &fakeOpus{}, nil },
+	}, &queued{}, "")
+	err := s.Start(context.Background(), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, 9,
+		&types.OpusConfig{SampleRate: 48000, ChannelCount: 2}, packetMs)
+	if err != ErrNoPCMCallbacks {
+		t.Fatalf("Start = %v, want ErrNoPCMCallbacks", err)
+	}
+}
+
+// queued is a queued-playback callback that can only take Opus packets
+type queued struct{ samples }
+
+func (q *queued) Capabilities() int { return 0 }
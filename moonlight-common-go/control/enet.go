@@ -0,0 +1,620 @@
+package control
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// ENet protocol commands, as Sunshine's control server speaks them. Only
+// what the control stream needs is implemented: connecting, reliable and
+// unreliable sends with acknowledgements and retransmission, and
+// disconnecting. Fragmentation and bandwidth throttling are not.
+const (
+	enetCommandAcknowledge            = 1
+	enetCommandConnect                = 2
+	enetCommandVerifyConnect          = 3
+	enetCommandDisconnect             = 4
+	enetCommandPing                   = 5
+	enetCommandSendReliable           = 6
+	enetCommandSendUnreliable         = 7
+	enetCommandSendFragment           = 8
+	enetCommandSendUnsequenced        = 9
+	enetCommandBandwidthLimit         = 10
+	enetCommandThrottleConfigure      = 11
+	enetCommandSendUnreliableFragment = 12
+	enetCommandMask                   = 0x0F
+
+	// Command flags, in the high bits of the command byte
+	enetFlagAcknowledge = 1 << 7
+	enetFlagUnsequenced = 1 << 6
+
+	// Protocol header flags, in the high bits of the peer ID
+	enetHeaderFlagCompressed = 1 << 14
+	enetHeaderFlagSentTime   = 1 << 15
+	enetHeaderSessionShift   = 12
+	enetHeaderSessionMask    = 3 << enetHeaderSessionShift
+	enetMaxPeerID            = 0xFFF
+
+	// Commands for the connection itself travel on this channel
+	enetConnectionChannel = 0xFF
+)
+
+// enetCommandSizes is each command's size including its 4-byte header,
+// indexed by command; data follows the send commands
+var enetCommandSizes = [...]int{0, 8, 48, 44, 8, 4, 6, 8, 24, 8, 12, 16, 24}
+
+// Connection parameters sent with CONNECT, ENet's defaults
+const (
+	enetMTU                    = 1400
+	enetWindowSize             = 65536
+	enetPacketThrottleInterval = 5000
+	enetPacketThrottleAccel    = 2
+	enetPacketThrottleDecel    = 2
+)
+
+// Retransmission of unacknowledged reliable commands. The timeout doubles
+// with each retry; a command unacknowledged for ControlStreamTimeoutSec
+// means the host is gone.
+const (
+	enetInitialRTO      = 200 * time.Millisecond
+	enetMaxRTO          = 2 * time.Second
+	enetServiceInterval = 20 * time.Millisecond
+)
+
+// enetMaxPending bounds the reliable packets held for delivery on a channel
+// while an earlier one is missing
+const enetMaxPending = 256
+
+// errENetClosed is returned once the peer has been closed locally
+var errENetClosed = errors.New("enet: connection closed")
+
+// enetChannel is one channel's sequencing state
+type enetChannel struct {
+	outgoingReliableSeq   uint16
+	outgoingUnreliableSeq uint16
+	incomingReliableSeq   uint16
+	pending               map[uint16][]byte // Reliable packets received ahead of sequence
+}
+
+// enetOutgoing is a reliable command awaiting its acknowledgement
+type enetOutgoing struct {
+	channelID uint8
+	seq       uint16
+	command   []byte
+	firstSent time.Time
+	lastSent  time.Time
+	rto       time.Duration
+}
+
+// enetPeer is a client's ENet connection to the host. Reads return the
+// packets the host sent, reliable ones in order per channel.
+type enetPeer struct {
+	conn  *net.UDPConn
+	epoch time.Time // Sent times count milliseconds from here
+
+	mu                sync.Mutex
+	outgoingPeerID    uint16
+	outgoingSessionID uint8
+	connectionSeq     uint16 // Reliable sequence of the connection channel
+	channels          []enetChannel
+	inFlight          []*enetOutgoing
+	err               error // Why the connection ended, once it has
+
+	// Round-trip time, smoothed from acknowledgements like TCP's SRTT and
+	// RTTVAR. Each acknowledgement echoes the sent time of the datagram it
+	// answers, so retransmissions are measured as well.
+	rttSamples  int
+	rtt         time.Duration
+	rttVariance time.Duration
+	lastAck     time.Time
+
+	connected chan struct{} // Closed when the host verifies the connection
+	incoming  chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// dialENet connects to an ENet host with channelCount channels, waiting
+// until the host verifies the connection. connectData is handed to the host
+// with the connection request.
+func dialENet(ctx context.Context, addr *net.UDPAddr, channelCount int, connectData uint32) (*enetPeer, error) {
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &enetPeer{
+		conn:           conn,
+		epoch:          time.Now(),
+		outgoingPeerID: enetMaxPeerID,
+		channels:       make([]enetChannel, channelCount),
+		connected:      make(chan struct{}),
+		incoming:       make(chan []byte, 64),
+		closed:         make(chan struct{}),
+	}
+	for i := range p.channels {
+		p.channels[i].pending = make(map[uint16][]byte)
+	}
+
+	p.wg.Add(2)
+	go p.readLoop()
+	go p.serviceLoop()
+
+	if err := p.sendConnect(channelCount, connectData); err != nil {
+		p.Close()
+		return nil, err
+	}
+
+	timeout := time.NewTimer(ControlStreamTimeoutSec * time.Second)
+	defer timeout.Stop()
+	select {
+	case <-p.connected:
+		return p, nil
+	case <-p.closed:
+		err := p.failure()
+		p.Close()
+		return nil, fmt.Errorf("enet connect: %w", err)
+	case <-timeout.C:
+		p.Close()
+		return nil, errors.New("enet connect: host did not respond")
+	case <-ctx.Done():
+		p.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// Send queues data on a channel. Reliable data is retransmitted until the
+// host acknowledges it; unreliable data is sent once.
+func (p *enetPeer) Send(channelID uint8, data []byte, reliable bool) error {
+	size := enetCommandSizes[enetCommandSendUnreliable]
+	if reliable {
+		size = enetCommandSizes[enetCommandSendReliable]
+	}
+	if size+len(data) > enetMTU-4 {
+		return fmt.Errorf("enet: %d-byte packet needs fragmenting, which isn't supported", len(data))
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.err != nil {
+		return p.err
+	}
+	if int(channelID) >= len(p.channels) {
+		return fmt.Errorf("enet: no channel %d", channelID)
+	}
+
+	ch := &p.channels[channelID]
+	command := make([]byte, size+len(data))
+	command[1] = channelID
+	if reliable {
+		ch.outgoingReliableSeq++
+		command[0] = enetCommandSendReliable | enetFlagAcknowledge
+		binary.BigEndian.PutUint16(command[2:4], ch.outgoingReliableSeq)
+		binary.BigEndian.PutUint16(command[4:6], uint16(len(data)))
+		copy(command[6:], data)
+		return p.sendReliableLocked(channelID, ch.outgoingReliableSeq, command)
+	}
+
+	ch.outgoingUnreliableSeq++
+	command[0] = enetCommandSendUnreliable
+	binary.BigEndian.PutUint16(command[2:4], ch.outgoingReliableSeq)
+	binary.BigEndian.PutUint16(command[4:6], ch.outgoingUnreliableSeq)
+	binary.BigEndian.PutUint16(command[6:8], uint16(len(data)))
+	copy(command[8:], data)
+	return p.writeLocked(false, command)
+}
+
+// Read returns the next packet from the host
+func (p *enetPeer) Read(b []byte) (int, error) {
+	select {
+	case data := <-p.incoming:
+		return copy(b, data), nil
+	case <-p.closed:
+		return 0, p.failure()
+	}
+}
+
+// Write sends data reliably on the first channel
+func (p *enetPeer) Write(b []byte) (int, error) {
+	if err := p.Send(0, b, true); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close tells the host the client is leaving and closes the socket
+func (p *enetPeer) Close() error {
+	p.mu.Lock()
+	if p.err == nil {
+		disconnect := make([]byte, enetCommandSizes[enetCommandDisconnect])
+		disconnect[0] = enetCommandDisconnect | enetFlagUnsequenced
+		disconnect[1] = enetConnectionChannel
+		p.writeLocked(false, disconnect)
+	}
+	p.mu.Unlock()
+
+	p.fail(errENetClosed)
+	p.wg.Wait()
+	return nil
+}
+
+// fail ends the connection, recording why
+func (p *enetPeer) fail(err error) {
+	p.closeOnce.Do(func() {
+		p.mu.Lock()
+		p.err = err
+		p.mu.Unlock()
+		close(p.closed)
+		p.conn.Close()
+	})
+}
+
+// failure returns why the connection ended
+func (p *enetPeer) failure() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// sentTime returns the low 16 bits of the milliseconds since epoch, as ENet
+// stamps packets that need acknowledging
+func (p *enetPeer) sentTime() uint16 {
+	return uint16(time.Since(p.epoch).Milliseconds())
+}
+
+// RTT returns the smoothed round-trip time to the host and its variance.
+// It returns false until the host has acknowledged something, and again
+// once acknowledgements stop arriving for longer than the control timeout.
+func (p *enetPeer) RTT() (rtt, variance time.Duration, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.rttSamples == 0 || time.Since(p.lastAck) > ControlStreamTimeoutSec*time.Second {
+		return 0, 0, false
+	}
+	return p.rtt, p.rttVariance, true
+}
+
+// addRTTSampleLocked folds the round trip of a datagram the host stamped
+// receivedSentTime on into the estimate, the way RFC 6298 does
+func (p *enetPeer) addRTTSampleLocked(receivedSentTime uint16) {
+	rtt := time.Duration(p.sentTime()-receivedSentTime) * time.Millisecond
+	if rtt > ControlStreamTimeoutSec*time.Second {
+		return // Not a time we sent, or too stale to mean anything
+	}
+
+	if p.rttSamples == 0 {
+		p.rtt = rtt
+		p.rttVariance = rtt / 2
+	} else {
+		diff := p.rtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		p.rttVariance = (3*p.rttVariance + diff) / 4
+		p.rtt = (7*p.rtt + rtt) / 8
+	}
+	p.rttSamples++
+	p.lastAck = time.Now()
+}
+
+// sendConnect asks the host for a connection
+func (p *enetPeer) sendConnect(channelCount int, connectData uint32) error {
+	var connectID [4]byte
+	rand.Read(connectID[:])
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.connectionSeq++
+	command := make([]byte, enetCommandSizes[enetCommandConnect])
+	command[0] = enetCommandConnect | enetFlagAcknowledge
+	command[1] = enetConnectionChannel
+	binary.BigEndian.PutUint16(command[2:4], p.connectionSeq)
+	binary.BigEndian.PutUint16(command[4:6], 0) // Our peer ID
+	command[6] = 0xFF                           // Incoming session ID, host's choice
+	command[7] = 0xFF                           // Outgoing session ID, host's choice
+	binary.BigEndian.PutUint32(command[8:12], enetMTU)
+	binary.BigEndian.PutUint32(command[12:16], enetWindowSize)
+	binary.BigEndian.PutUint32(command[16:20], uint32(channelCount))
+	// Incoming and outgoing bandwidth are left unlimited
+	binary.BigEndian.PutUint32(command[28:32], enetPacketThrottleInterval)
+	binary.BigEndian.PutUint32(command[32:36], enetPacketThrottleAccel)
+	binary.BigEndian.PutUint32(command[36:40], enetPacketThrottleDecel)
+	copy(command[40:44], connectID[:])
+	binary.BigEndian.PutUint32(command[44:48], connectData)
+	return p.sendReliableLocked(enetConnectionChannel, p.connectionSeq, command)
+}
+
+// sendReliableLocked sends a command and holds it for retransmission until
+// it's acknowledged
+func (p *enetPeer) sendReliableLocked(channelID uint8, seq uint16, command []byte) error {
+	now := time.Now()
+	p.inFlight = append(p.inFlight, &enetOutgoing{
+		channelID: channelID,
+		seq:       seq,
+		command:   command,
+		firstSent: now,
+		lastSent:  now,
+		rto:       enetInitialRTO,
+	})
+	return p.writeLocked(true, command)
+}
+
+// writeLocked sends commands in one datagram behind the protocol header.
+// Datagrams carrying commands to acknowledge are stamped with their sent time.
+func (p *enetPeer) writeLocked(stamped bool, commands ...[]byte) error {
+	peerID := p.outgoingPeerID
+	if peerID < enetMaxPeerID {
+		peerID |= uint16(p.outgoingSessionID) << enetHeaderSessionShift
+	}
+
+	header := make([]byte, 2, 4)
+	if stamped {
+		peerID |= enetHeaderFlagSentTime
+		header = binary.BigEndian.AppendUint16(header, p.sentTime())
+	}
+	binary.BigEndian.PutUint16(header[0:2], peerID)
+
+	datagram := header
+	for _, c := range commands {
+		datagram = append(datagram, c...)
+	}
+	_, err := p.conn.Write(datagram)
+	return err
+}
+
+// serviceLoop retransmits reliable commands the host hasn't acknowledged
+func (p *enetPeer) serviceLoop() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(enetServiceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.closed:
+			return
+		case <-ticker.C:
+		}
+
+		if err := p.retransmit(time.Now()); err != nil {
+			p.fail(err)
+			return
+		}
+	}
+}
+
+// retransmit resends commands whose retransmission timeout has passed,
+// failing once one has gone unacknowledged for too long
+func (p *enetPeer) retransmit(now time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, out := range p.inFlight {
+		if now.Sub(out.lastSent) < out.rto {
+			continue
+		}
+		if now.Sub(out.firstSent) > ControlStreamTimeoutSec*time.Second {
+			return errors.New("enet: host stopped acknowledging")
+		}
+		out.lastSent = now
+		out.rto = min(out.rto*2, enetMaxRTO)
+		if err := p.writeLocked(true, out.command); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readLoop reads datagrams from the host until the socket closes
+func (p *enetPeer) readLoop() {
+	defer p.wg.Done()
+
+	buf := make([]byte, 2048)
+	for {
+		n, err := p.conn.Read(buf)
+		if err != nil {
+			p.fail(fmt.Errorf("enet: %w", err))
+			return
+		}
+		p.handleDatagram(buf[:n])
+	}
+}
+
+// handleDatagram processes the commands in one datagram from the host and
+// acknowledges those that ask for it
+func (p *enetPeer) handleDatagram(data []byte) {
+	if len(data) < 2 {
+		return
+	}
+	peerID := binary.BigEndian.Uint16(data[0:2])
+	if peerID&enetHeaderFlagCompressed != 0 {
+		return // We never offer compression
+	}
+	data = data[2:]
+
+	var sentTime uint16
+	if peerID&enetHeaderFlagSentTime != 0 {
+		if len(data) < 2 {
+			return
+		}
+		sentTime = binary.BigEndian.Uint16(data[0:2])
+		data = data[2:]
+	}
+
+	var acks [][]byte
+	var deliver [][]byte
+	for len(data) >= 4 {
+		command := data[0] & enetCommandMask
+		if int(command) >= len(enetCommandSizes) || command == 0 {
+			return
+		}
+		size := enetCommandSizes[command]
+		if len(data) < size {
+			return
+		}
+		channelID := data[1]
+		seq := binary.BigEndian.Uint16(data[2:4])
+
+		// Send commands carry their data after the fixed part
+		var payload []byte
+		switch command {
+		case enetCommandSendReliable:
+			payload = data[size:]
+			n := int(binary.BigEndian.Uint16(data[4:6]))
+			if len(payload) < n {
+				return
+			}
+			payload = payload[:n]
+		case enetCommandSendUnreliable, enetCommandSendUnsequenced,
+			enetCommandSendFragment, enetCommandSendUnreliableFragment:
+			payload = data[size:]
+			n := int(binary.BigEndian.Uint16(data[6:8]))
+			if len(payload) < n {
+				return
+			}
+			payload = payload[:n]
+		}
+
+		if data[0]&enetFlagAcknowledge != 0 {
+			ack := make([]byte, enetCommandSizes[enetCommandAcknowledge])
+			ack[0] = enetCommandAcknowledge
+			ack[1] = channelID
+			binary.BigEndian.PutUint16(ack[2:4], seq)
+			binary.BigEndian.PutUint16(ack[4:6], seq)
+			binary.BigEndian.PutUint16(ack[6:8], sentTime)
+			acks = append(acks, ack)
+		}
+
+		deliver = append(deliver, p.handleCommand(command, channelID, seq, data[:size], payload)...)
+		data = data[size+len(payload):]
+	}
+
+	p.mu.Lock()
+	if len(acks) > 0 && p.err == nil {
+		p.writeLocked(false, acks...)
+	}
+	p.mu.Unlock()
+
+	for _, packet := range deliver {
+		select {
+		case p.incoming <- packet:
+		case <-p.closed:
+			return
+		}
+	}
+}
+
+// handleCommand applies one command from the host, returning any packets it
+// makes ready for delivery
+func (p *enetPeer) handleCommand(command, channelID uint8, seq uint16, fixed, payload []byte) [][]byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch command {
+	case enetCommandAcknowledge:
+		acked := binary.BigEndian.Uint16(fixed[4:6])
+		p.removeInFlightLocked(channelID, acked)
+		p.addRTTSampleLocked(binary.BigEndian.Uint16(fixed[6:8]))
+
+	case enetCommandVerifyConnect:
+		// Verification also acknowledges our CONNECT
+		p.removeInFlightLocked(enetConnectionChannel, p.connectionSeq)
+		select {
+		case <-p.connected:
+		default:
+			p.outgoingPeerID = binary.BigEndian.Uint16(fixed[4:6])
+			p.outgoingSessionID = fixed[7]
+			if channels := int(binary.BigEndian.Uint32(fixed[16:20])); channels < len(p.channels) {
+				p.channels = p.channels[:channels]
+			}
+			close(p.connected)
+		}
+
+	case enetCommandDisconnect:
+		go p.fail(errors.New("enet: host disconnected"))
+
+	case enetCommandSendReliable:
+		if int(channelID) >= len(p.channels) {
+			return nil
+		}
+		return p.receiveReliableLocked(&p.channels[channelID], seq, payload)
+
+	case enetCommandSendFragment:
+		// Fragmented packets aren't reassembled, but each fragment takes
+		// a place in the channel's sequence
+		if int(channelID) >= len(p.channels) {
+			return nil
+		}
+		return p.receiveReliableLocked(&p.channels[channelID], seq, nil)
+
+	case enetCommandSendUnreliable, enetCommandSendUnsequenced:
+		if int(channelID) >= len(p.channels) {
+			return nil
+		}
+		return [][]byte{append([]byte(nil), payload...)}
+	}
+
+	// Pings only need acknowledging, and throttling is left to the host
+	return nil
+}
+
+// receiveReliableLocked delivers reliable packets on a channel in sequence,
+// holding those that arrive early until the gap fills. A nil payload takes
+// its place in the sequence without being delivered. Payloads are copied
+// out of the read buffer, which the next datagram overwrites while they
+// may still be queued.
+func (p *enetPeer) receiveReliableLocked(ch *enetChannel, seq uint16, payload []byte) [][]byte {
+	ahead := int16(seq - ch.incomingReliableSeq)
+	if ahead <= 0 {
+		return nil // Already delivered; the host missed our acknowledgement
+	}
+	payload = clonePayload(payload)
+	if ahead > 1 {
+		if len(ch.pending) < enetMaxPending {
+			ch.pending[seq] = payload
+		}
+		return nil
+	}
+
+	var ready [][]byte
+	for {
+		if payload != nil {
+			ready = append(ready, payload)
+		}
+		ch.incomingReliableSeq++
+		next, ok := ch.pending[ch.incomingReliableSeq+1]
+		if !ok {
+			return ready
+		}
+		delete(ch.pending, ch.incomingReliableSeq+1)
+		payload = next
+	}
+}
+
+// clonePayload copies a payload out of the read buffer, keeping nil as nil
+func clonePayload(payload []byte) []byte {
+	if payload == nil {
+		return nil
+	}
+	return append([]byte{}, payload...)
+}
+
+// removeInFlightLocked drops an acknowledged command from retransmission
+func (p *enetPeer) removeInFlightLocked(channelID uint8, seq uint16) {
+	for i, out := range p.inFlight {
+		if out.channelID == channelID && out.seq == seq {
+			p.inFlight = append(p.inFlight[:i], p.inFlight[i+1:]...)
+			return
+		}
+	}
+}
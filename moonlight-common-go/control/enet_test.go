@@ -0,0 +1,44 @@
+package control
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReceiveReliableCopiesPayload(t *testing.T) {
+	p := &enetPeer{}
+	ch := &enetChannel{pending: make(map[uint16][]byte)}
+
+	buf := []byte("first")
+	ready := p.receiveReliableLocked(ch, 1, buf)
+	copy(buf, "XXXXX") // The next datagram reuses the read buffer
+
+	if len(ready) != 1 || !bytes.Equal(ready[0], []byte("first")) {
+		t.Fatalf("delivered %q, want [first]", ready)
+	}
+}
+
+func TestReceiveReliableInOrder(t *testing.T) {
+	p := &enetPeer{}
+	ch := &enetChannel{pending: make(map[uint16][]byte)}
+
+	buf := make([]byte, 1)
+	receive := func(seq uint16, b byte) [][]byte {
+		buf[0] = b
+		return p.receiveReliableLocked(ch, seq, buf)
+	}
+
+	if ready := receive(2, 'b'); len(ready) != 0 {
+		t.Fatalf("seq 2 before 1 delivered %q", ready)
+	}
+	if ready := receive(3, 'c'); len(ready) != 0 {
+		t.Fatalf("seq 3 before 1 delivered %q", ready)
+	}
+	ready := receive(1, 'a')
+	if got := bytes.Join(ready, nil); string(got) != "abc" {
+		t.Fatalf("delivered %q, want abc", got)
+	}
+	if ready := receive(2, 'b'); len(ready) != 0 {
+		t.Fatalf("duplicate seq 2 delivered %q", ready)
+	}
+}
@@ -6,10 +6,13 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"sync"
 	"time"
 
+	"github.com/zalo/moonparty/moonlight-common-go/crypto"
+	"github.com/zalo/moonparty/moonlight-common-go/logging"
 	"github.com/zalo/moonparty/moonlight-common-go/protocol"
 	"github.com/zalo/moonparty/moonlight-common-go/types"
 )
@@ -21,39 +24,63 @@ const (
 	LossReportIntervalMs = 50
 	// PeriodicPingIntervalMs is the interval for periodic pings
 	PeriodicPingIntervalMs = 100
+	// MaxDecryptFailures is how many consecutive undecryptable messages
+	// mean our sequence has desynced from the host's
+	MaxDecryptFailures = 5
 )
 
+// periodicPingType is the control message the client pings the host with.
+// Sunshine doesn't answer it; the round-trip time comes from the ENet
+// acknowledgements of it and every other reliable message instead.
+const periodicPingType = 0x0200
+
+// ErrNoCipher is returned for a control message on an encrypted stream
+// that has no usable key. Such messages are never sent or read in the clear.
+var ErrNoCipher = errors.New("control stream is encrypted but has no cipher")
+
 // Stream manages the control stream connection
 type Stream struct {
 	mu sync.Mutex
 
 	// Configuration
-	config        types.StreamConfiguration
-	callbacks     types.ConnectionCallbacks
-	appVersion    [4]int
-	isSunshine    bool
-
-	// Networking
-	conn       net.Conn
-	remoteAddr net.Addr
+	config     types.StreamConfiguration
+	callbacks  types.ConnectionCallbacks
+	appVersion [4]int
+	isSunshine bool
+	log        logging.Logger
+
+	// Networking: ENet over UDP from Gen5 on, TCP before
+	conn        io.ReadWriteCloser
+	remoteAddr  net.Addr
+	remoteIP    net.IP
+	controlPort int
 
 	// Encryption
-	encrypted       bool
-	aesKey          []byte
-	currentSeq      uint32
-	encryptionCtx   []byte
-	decryptionCtx   []byte
+	encrypted     bool
+	aesKey        []byte
+	currentSeq    uint32
+	encryptionCtx []byte
+	decryptionCtx []byte
+	gcm           *crypto.Context
+	gcmErr        error // Why there's no gcm, returned by Start
+
+	// Desync detection on the host's sequence
+	recvSeq         uint32 // Last host sequence that decrypted
+	decryptFailures int
+
+	// Sent in the ENet connect; see SetConnectData
+	connectData uint32
 
 	// State
-	ctx           context.Context
-	cancel        context.CancelFunc
-	wg            sync.WaitGroup
-	stopping      bool
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	stopping bool
 
 	// Frame tracking
-	lastGoodFrame   uint32
-	lastSeenFrame   uint32
-	idrRequested    bool
+	lastGoodFrame uint32
+	lastSeenFrame uint32
+	idrRequested  bool
 
 	// Connection status
 	intervalGoodCount  int
@@ -63,8 +90,8 @@ type Stream struct {
 	lastConnStatus     types.ConnectionStatus
 
 	// HDR state
-	hdrEnabled    bool
-	hdrMetadata   types.HDRMetadata
+	hdrEnabled  bool
+	hdrMetadata types.HDRMetadata
 
 	// Packet type tables
 	packetTypes map[string]uint16
@@ -78,9 +105,13 @@ func NewStream(config types.StreamConfiguration, callbacks types.ConnectionCallb
 		appVersion: appVersion,
 		isSunshine: isSunshine,
 		aesKey:     config.RemoteInputAesKey,
+		log:        logging.Default(),
 	}
 
 	s.encrypted = appVersionAtLeast(appVersion, 7, 1, 431)
+	if s.encrypted {
+		s.gcm, s.gcmErr = crypto.NewContext(s.aesKey)
+	}
 
 	// Select packet types based on version
 	if s.encrypted {
@@ -90,8 +121,24 @@ func NewStream(config types.StreamConfiguration, callbacks types.ConnectionCallb
 	return s
 }
 
+// SetConnectData sets the value sent in the ENet connect, which Sunshine
+// gives in the control SETUP's X-SS-Connect-Data header to match the
+// connection to its session. Call it before Start.
+func (s *Stream) SetConnectData(data uint32) {
+	s.connectData = data
+}
+
+// SetLogger replaces the Logger the stream writes to, logging.Default() unless set
+func (s *Stream) SetLogger(l logging.Logger) {
+	s.log = l
+}
+
 // Start begins control stream operation
 func (s *Stream) Start(ctx context.Context, remoteAddr net.Addr, controlPort int) error {
+	if s.gcmErr != nil {
+		return fmt.Errorf("control stream encryption: %w", s.gcmErr)
+	}
+
 	s.ctx, s.cancel = context.WithCancel(ctx)
 	s.remoteAddr = remoteAddr
 
@@ -105,34 +152,14 @@ func (s *Stream) Start(ctx context.Context, remoteAddr net.Addr, controlPort int
 	default:
 		return fmt.Errorf("unsupported address type: %T", remoteAddr)
 	}
+	s.remoteIP = remoteIP
+	s.controlPort = controlPort
 
-	// Connect to control port
-	// For Gen5+, this uses ENet over UDP
-	// For older versions, TCP
-	if s.appVersion[0] >= 5 {
-		// ENet connection would go here
-		// For this port, we'll use a placeholder
-		udpAddr := &net.UDPAddr{
-			IP:   remoteIP,
-			Port: controlPort,
-		}
-		conn, err := net.DialUDP("udp", nil, udpAddr)
-		if err != nil {
-			return err
-		}
-		s.conn = conn
-	} else {
-		// TCP connection for older versions
-		tcpAddr := &net.TCPAddr{
-			IP:   remoteIP,
-			Port: 47995,
-		}
-		conn, err := net.DialTimeout("tcp", tcpAddr.String(), ControlStreamTimeoutSec*time.Second)
-		if err != nil {
-			return err
-		}
-		s.conn = conn
+	conn, err := s.dial()
+	if err != nil {
+		return err
 	}
+	s.conn = conn
 
 	// Send startup messages
 	if err := s.sendStartA(); err != nil {
@@ -153,6 +180,25 @@ func (s *Stream) Start(ctx context.Context, remoteAddr net.Addr, controlPort int
 	return nil
 }
 
+// dial connects to the control port
+func (s *Stream) dial() (io.ReadWriteCloser, error) {
+	// Gen5+ hosts speak ENet over UDP
+	if s.appVersion[0] >= 5 {
+		udpAddr := &net.UDPAddr{
+			IP:   s.remoteIP,
+			Port: s.controlPort,
+		}
+		return dialENet(s.ctx, udpAddr, protocol.CtrlChannelCount, s.connectData)
+	}
+
+	// TCP connection for older versions
+	tcpAddr := &net.TCPAddr{
+		IP:   s.remoteIP,
+		Port: 47995,
+	}
+	return net.DialTimeout("tcp", tcpAddr.String(), ControlStreamTimeoutSec*time.Second)
+}
+
 // Stop halts control stream operation
 func (s *Stream) Stop() {
 	s.mu.Lock()
@@ -186,6 +232,18 @@ func (s *Stream) RequestIDRFrame() error {
 	return s.sendInvalidateRefFrames(0, s.lastSeenFrame)
 }
 
+// InvalidateReferenceFrames asks the host to stop using frames start through
+// end as references, so it can recover from their loss without a full IDR
+func (s *Stream) InvalidateReferenceFrames(start, end uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.packetTypes == nil {
+		return errors.New("reference frame invalidation not supported")
+	}
+	return s.sendInvalidateRefFrames(start, end)
+}
+
 // SendInputPacket sends an input packet on the control stream
 func (s *Stream) SendInputPacket(channelID uint8, flags uint32, data []byte, moreData bool) error {
 	s.mu.Lock()
@@ -199,7 +257,9 @@ func (s *Stream) SendInputPacket(channelID uint8, flags uint32, data []byte, mor
 	return s.sendMessage(ptype, data, channelID, flags, moreData)
 }
 
-// UpdateFrameStats updates frame reception statistics
+// UpdateFrameStats records whether a frame arrived intact for the connection
+// status. The counts stay local: Sunshine ignores the FrameStats message, so
+// nothing is reported to the host.
 func (s *Stream) UpdateFrameStats(frameIndex uint32, isGood bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -213,10 +273,29 @@ func (s *Stream) UpdateFrameStats(frameIndex uint32, isGood bool) {
 	}
 }
 
-// GetRTTInfo returns estimated round-trip time information
+// GetRTTInfo returns the smoothed round-trip time to the host and its
+// variance in milliseconds, as measured by ENet acknowledgements. It returns
+// false before the host has acknowledged anything, once acknowledgements
+// stop for longer than the control timeout, and on pre-Gen5 TCP hosts.
 func (s *Stream) GetRTTInfo() (types.RTTInfo, bool) {
-	// This would query ENet peer RTT in a real implementation
-	return types.RTTInfo{}, false
+	peer, ok := s.conn.(*enetPeer)
+	if !ok {
+		return types.RTTInfo{}, false
+	}
+	rtt, variance, ok := peer.RTT()
+	if !ok {
+		return types.RTTInfo{}, false
+	}
+	return types.RTTInfo{
+		EstimatedRTT:         uint32(rtt.Milliseconds()),
+		EstimatedRTTVariance: uint32(variance.Milliseconds()),
+	}, true
+}
+
+// IsEncrypted returns whether control messages are encrypted, which Sunshine
+// does from 7.1.431 on
+func (s *Stream) IsEncrypted() bool {
+	return s.encrypted
 }
 
 // IsHDREnabled returns whether HDR is currently enabled
@@ -272,7 +351,10 @@ func (s *Stream) sendMessage(ptype uint16, payload []byte, channelID uint8, flag
 
 	if s.encrypted {
 		// Build encrypted packet
-		encPacket := s.buildEncryptedPacket(ptype, payload)
+		encPacket, err := s.buildEncryptedPacket(ptype, payload)
+		if err != nil {
+			return err
+		}
 		packet = encPacket
 	} else if s.appVersion[0] >= 5 {
 		// ENet V1 header
@@ -287,30 +369,45 @@ func (s *Stream) sendMessage(ptype uint16, payload []byte, channelID uint8, flag
 		copy(packet[4:], payload)
 	}
 
+	// ENet sends reliable messages on their channel until acknowledged;
+	// TCP is reliable already
+	if peer, ok := s.conn.(*enetPeer); ok {
+		return peer.Send(channelID, packet, flags&protocol.ENetPacketFlagReliable != 0)
+	}
 	_, err := s.conn.Write(packet)
 	return err
 }
 
-func (s *Stream) buildEncryptedPacket(ptype uint16, payload []byte) []byte {
+// controlIV builds the GCM nonce for a control message: the sequence number,
+// then the origin ('C' for client, 'H' for host) and 'C' for the control
+// channel in the last two bytes
+func controlIV(seq uint32, origin byte) []byte {
+	iv := make([]byte, 12)
+	binary.LittleEndian.PutUint32(iv[0:4], seq)
+	iv[10] = origin
+	iv[11] = 'C' // Control stream
+	return iv
+}
+
+func (s *Stream) buildEncryptedPacket(ptype uint16, payload []byte) ([]byte, error) {
+	if s.gcm == nil {
+		return nil, ErrNoCipher
+	}
+
 	// Build V2 header
 	innerHeader := make([]byte, 4+len(payload))
 	binary.LittleEndian.PutUint16(innerHeader[0:2], ptype)
 	binary.LittleEndian.PutUint16(innerHeader[2:4], uint16(len(payload)))
 	copy(innerHeader[4:], payload)
 
-	// Encrypt
 	s.currentSeq++
 	seq := s.currentSeq
 
-	// Build IV
-	iv := make([]byte, 12)
-	binary.LittleEndian.PutUint32(iv[0:4], seq)
-	iv[10] = 'C' // Client originated
-	iv[11] = 'C' // Control stream
-
-	// Encrypt using AES-GCM (placeholder - real impl needed)
-	ciphertext := innerHeader // Would be encrypted
-	tag := make([]byte, 16)   // Would be GCM tag
+	// Sunshine authenticates only the ciphertext, not the outer header
+	ciphertext, tag, err := s.gcm.EncryptGCM(innerHeader, controlIV(seq, 'C'), nil)
+	if err != nil {
+		return nil, fmt.Errorf("encrypt control message: %w", err)
+	}
 
 	// Build outer encrypted header
 	outerLen := 4 + 16 + len(ciphertext) // seq + tag + ciphertext
@@ -321,7 +418,7 @@ func (s *Stream) buildEncryptedPacket(ptype uint16, payload []byte) []byte {
 	copy(packet[8:24], tag)
 	copy(packet[24:], ciphertext)
 
-	return packet
+	return packet, nil
 }
 
 func (s *Stream) receiveLoop() {
@@ -347,7 +444,7 @@ func (s *Stream) receiveLoop() {
 				continue
 			}
 			// Connection error
-			s.callbacks.ConnectionTerminated(-1)
+			s.callbacks.ConnectionTerminated(-1, types.TerminateReasonUnknown)
 			return
 		}
 
@@ -356,13 +453,17 @@ func (s *Stream) receiveLoop() {
 		}
 
 		// Process received message
-		s.processMessage(buffer[:n])
+		if !s.processMessage(buffer[:n]) {
+			return
+		}
 	}
 }
 
-func (s *Stream) processMessage(data []byte) {
+// processMessage handles one received message. It returns false once the
+// stream can't continue.
+func (s *Stream) processMessage(data []byte) bool {
 	if len(data) < 2 {
-		return
+		return true
 	}
 
 	var ptype uint16
@@ -373,12 +474,14 @@ func (s *Stream) processMessage(data []byte) {
 		headerType := binary.LittleEndian.Uint16(data[0:2])
 		if headerType == 0x0001 {
 			// Decrypt and process
-			decrypted, err := s.decryptMessage(data)
+			decrypted, seq, err := s.decryptMessage(data)
 			if err != nil {
-				return
+				return s.handleDecryptFailure(seq, err)
 			}
+			s.recvSeq = seq
+			s.decryptFailures = 0
 			if len(decrypted) < 2 {
-				return
+				return true
 			}
 			ptype = binary.LittleEndian.Uint16(decrypted[0:2])
 			if len(decrypted) >= 4 {
@@ -388,7 +491,7 @@ func (s *Stream) processMessage(data []byte) {
 				}
 			}
 		} else {
-			return // Expected encrypted but got plaintext
+			return true // Expected encrypted but got plaintext
 		}
 	} else {
 		ptype = binary.LittleEndian.Uint16(data[0:2])
@@ -397,11 +500,29 @@ func (s *Stream) processMessage(data []byte) {
 
 	// Handle specific packet types
 	s.handlePacket(ptype, payload)
+	return true
+}
+
+// handleDecryptFailure counts consecutive decrypt failures. Enough of them
+// in a row means the sequence has desynced from the host's. The host keeps
+// its sequence for the life of the session, so nothing short of a new
+// session puts the two back in step: the stream is terminated with
+// ErrControlDesync for the caller to start one, and false is returned.
+func (s *Stream) handleDecryptFailure(seq uint32, err error) bool {
+	s.decryptFailures++
+	if s.decryptFailures < MaxDecryptFailures {
+		return true
+	}
+
+	s.log.Errorf("Control stream desync: expected seq %d, received %d (%d consecutive decrypt failures, last: %v)",
+		s.recvSeq+1, seq, s.decryptFailures, err)
+	s.callbacks.ConnectionTerminated(types.ErrControlDesync, types.TerminateReasonUnknown)
+	return false
 }
 
-func (s *Stream) decryptMessage(data []byte) ([]byte, error) {
+func (s *Stream) decryptMessage(data []byte) ([]byte, uint32, error) {
 	if len(data) < 8 {
-		return nil, errors.New("packet too small")
+		return nil, 0, errors.New("packet too small")
 	}
 
 	// Parse encrypted header
@@ -409,26 +530,26 @@ func (s *Stream) decryptMessage(data []byte) ([]byte, error) {
 	length := binary.LittleEndian.Uint16(data[2:4])
 	seq := binary.LittleEndian.Uint32(data[4:8])
 
-	if len(data) < 4+int(length) {
-		return nil, errors.New("incomplete packet")
+	if len(data) < 4+int(length) || length < 4+16 {
+		return nil, seq, errors.New("incomplete packet")
 	}
 
-	// Build IV
-	iv := make([]byte, 12)
-	binary.LittleEndian.PutUint32(iv[0:4], seq)
-	iv[10] = 'H' // Host originated
-	iv[11] = 'C' // Control stream
-
 	// Tag is after header
-	// tag := data[8:24]
+	tag := data[8:24]
 
 	// Ciphertext is after tag
 	ciphertext := data[24 : 4+int(length)]
 
-	// Decrypt using AES-GCM (placeholder - real impl needed)
-	plaintext := ciphertext // Would be decrypted
+	if s.gcm == nil {
+		return nil, seq, ErrNoCipher
+	}
 
-	return plaintext, nil
+	plaintext, err := s.gcm.DecryptGCM(ciphertext, controlIV(seq, 'H'), tag, nil)
+	if err != nil {
+		return nil, seq, err
+	}
+
+	return plaintext, seq, nil
 }
 
 func (s *Stream) handlePacket(ptype uint16, payload []byte) {
@@ -476,16 +597,71 @@ func (s *Stream) handlePacket(ptype uint16, payload []byte) {
 		s.callbacks.RumbleTriggers(controllerNum, leftTrigger, rightTrigger)
 	}
 
+	// Handle motion sensor requests: controller(2) + reportRateHz(2) + type(1)
+	if s.packetTypes != nil && ptype == s.packetTypes["SetMotionEvent"] && len(payload) >= 5 {
+		controllerNum := binary.LittleEndian.Uint16(payload[0:2])
+		reportRate := binary.LittleEndian.Uint16(payload[2:4])
+		s.callbacks.SetMotionEventState(controllerNum, types.MotionType(payload[4]), reportRate)
+	}
+
+	// Handle controller LED color: controller(2) + r(1) + g(1) + b(1)
+	if s.packetTypes != nil && ptype == s.packetTypes["SetRGBLED"] && len(payload) >= 5 {
+		controllerNum := binary.LittleEndian.Uint16(payload[0:2])
+		s.callbacks.SetControllerLED(controllerNum, payload[2], payload[3], payload[4])
+	}
+
+	// Handle adaptive triggers (DualSense):
+	// controller(2) + eventFlags(1) + typeLeft(1) + typeRight(1) + left(10) + right(10)
+	if s.packetTypes != nil && ptype == s.packetTypes["SetAdaptiveTriggers"] &&
+		len(payload) >= 5+2*types.AdaptiveTriggerPayloadSize {
+		controllerNum := binary.LittleEndian.Uint16(payload[0:2])
+		eventFlags := payload[2]
+		typeLeft := payload[3]
+		typeRight := payload[4]
+		left := make([]byte, types.AdaptiveTriggerPayloadSize)
+		right := make([]byte, types.AdaptiveTriggerPayloadSize)
+		copy(left, payload[5:5+types.AdaptiveTriggerPayloadSize])
+		copy(right, payload[5+types.AdaptiveTriggerPayloadSize:])
+		s.callbacks.SetAdaptiveTriggers(controllerNum, eventFlags, typeLeft, typeRight, left, right)
+	}
+
 	// Handle termination
 	if s.packetTypes != nil && ptype == s.packetTypes["Termination"] {
-		var errorCode int
-		if len(payload) >= 4 {
-			errorCode = int(binary.BigEndian.Uint32(payload[0:4]))
-		} else if len(payload) >= 2 {
-			errorCode = int(binary.LittleEndian.Uint16(payload[0:2]))
+		s.callbacks.ConnectionTerminated(parseTermination(payload))
+	}
+}
+
+// Termination error codes that mean the host ended the stream on purpose
+const (
+	terminationClosed    = 0x80030023 // Sunshine: server terminated, closed
+	terminationClosedGFE = 0x0100     // GFE's 16-bit equivalent
+)
+
+// parseTermination reads a Termination packet. GFE sends a little-endian
+// 16-bit code and Sunshine a big-endian 32-bit one; the extended format
+// follows that with a big-endian 32-bit terminate reason. A graceful close
+// is reported as types.ErrGracefulTermination.
+func parseTermination(payload []byte) (int, types.TerminateReason) {
+	var errorCode int
+	reason := types.TerminateReasonUnknown
+	switch {
+	case len(payload) >= 4:
+		code := binary.BigEndian.Uint32(payload[0:4])
+		if code != terminationClosed {
+			errorCode = int(code)
+		}
+		if len(payload) >= 8 {
+			switch r := types.TerminateReason(binary.BigEndian.Uint32(payload[4:8])); r {
+			case types.TerminateReasonAppExited, types.TerminateReasonTimeout, types.TerminateReasonTakenOver:
+				reason = r
+			}
+		}
+	case len(payload) >= 2:
+		if code := binary.LittleEndian.Uint16(payload[0:2]); code != terminationClosedGFE {
+			errorCode = int(code)
 		}
-		s.callbacks.ConnectionTerminated(errorCode)
 	}
+	return errorCode, reason
 }
 
 func (s *Stream) lossStatsLoop() {
@@ -508,39 +684,55 @@ func (s *Stream) lossStatsLoop() {
 func (s *Stream) sendPeriodicPing() {
 	payload := make([]byte, 8)
 	binary.LittleEndian.PutUint16(payload[0:2], 4) // Length
-	// Timestamp would go in remaining bytes
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.sendMessage(0x0200, payload, protocol.CtrlChannelGeneric, protocol.ENetPacketFlagReliable, false)
+	s.sendMessage(periodicPingType, payload, protocol.CtrlChannelGeneric, protocol.ENetPacketFlagReliable, false)
 }
 
+// checkConnectionStatus reports a change of connection status once the frame
+// loss over an interval crosses a threshold. The callback runs unlocked so
+// it can read LossPercent.
 func (s *Stream) checkConnectionStatus() {
 	s.mu.Lock()
-	defer s.mu.Unlock()
 
+	changed := false
 	now := time.Now()
 	if s.intervalStartTime.IsZero() || now.Sub(s.intervalStartTime) >= 3*time.Second {
 		if s.intervalTotalCount > 0 {
 			lossPercent := 100 - (s.intervalGoodCount * 100 / s.intervalTotalCount)
+			s.lastLossPercent = lossPercent
 
 			// Check for status change
 			if s.lastConnStatus != types.ConnStatusPoor && lossPercent >= 30 {
 				s.lastConnStatus = types.ConnStatusPoor
-				s.callbacks.ConnectionStatusUpdate(types.ConnStatusPoor)
+				changed = true
 			} else if lossPercent <= 5 && s.lastConnStatus != types.ConnStatusOkay {
 				s.lastConnStatus = types.ConnStatusOkay
-				s.callbacks.ConnectionStatusUpdate(types.ConnStatusOkay)
+				changed = true
 			}
-
-			s.lastLossPercent = lossPercent
 		}
 
 		s.intervalStartTime = now
 		s.intervalGoodCount = 0
 		s.intervalTotalCount = 0
 	}
+
+	status := s.lastConnStatus
+	s.mu.Unlock()
+
+	if changed {
+		s.callbacks.ConnectionStatusUpdate(status)
+	}
+}
+
+// LossPercent returns the share of frames lost over the last complete
+// status interval, 0 until one has passed
+func (s *Stream) LossPercent() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastLossPercent
 }
 
 func appVersionAtLeast(v [4]int, major, minor, build int) bool {
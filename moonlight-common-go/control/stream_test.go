@@ -0,0 +1,261 @@
+package control
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/zalo/moonparty/moonlight-common-go/crypto"
+	"github.com/zalo/moonparty/moonlight-common-go/types"
+)
+
+// terminations records the error codes and reasons a stream is terminated
+// with
+type terminations struct {
+	types.NopConnectionCallbacks
+	codes   []int
+	reasons []types.TerminateReason
+}
+
+func (t *terminations) ConnectionTerminated(errorCode int, reason types.TerminateReason) {
+	t.codes = append(t.codes, errorCode)
+	t.reasons = append(t.reasons, reason)
+}
+
+// hostMessage encrypts a control message the way the host sends it
+func hostMessage(t *testing.T, key []byte, seq uint32, ptype uint16) []byte {
+	t.Helper()
+
+	gcm, err := crypto.NewContext(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := binary.LittleEndian.AppendUint16(nil, ptype)
+	inner = binary.LittleEndian.AppendUint16(inner, 0)
+	ciphertext, tag, err := gcm.EncryptGCM(inner, controlIV(seq, 'H'), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packet := binary.LittleEndian.AppendUint16(nil, 0x0001)
+	packet = binary.LittleEndian.AppendUint16(packet, uint16(4+16+len(ciphertext)))
+	packet = binary.LittleEndian.AppendUint32(packet, seq)
+	packet = append(packet, tag...)
+	return append(packet, ciphertext...)
+}
+
+func TestDecryptFailuresTerminate(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	wrongKey := []byte("fedcba9876543210")
+
+	callbacks := &terminations{}
+	s := NewStream(types.StreamConfiguration{RemoteInputAesKey: key}, callbacks, [4]int{7, 1, 431, 0}, true)
+
+	if !s.processMessage(hostMessage(t, key, 1, 0x0100)) || s.recvSeq != 1 {
+		t.Fatalf("a good message left recvSeq at %d", s.recvSeq)
+	}
+
+	// A few bad messages are tolerated, and a good one resets the count
+	for seq := uint32(2); seq < MaxDecryptFailures+1; seq++ {
+		if !s.processMessage(hostMessage(t, wrongKey, seq, 0x0100)) {
+			t.Fatalf("stream gave up after %d decrypt failures", seq-1)
+		}
+	}
+	if !s.processMessage(hostMessage(t, key, MaxDecryptFailures+1, 0x0100)) || s.decryptFailures != 0 {
+		t.Fatalf("a good message left %d decrypt failures counted", s.decryptFailures)
+	}
+	if len(callbacks.codes) != 0 {
+		t.Fatalf("terminated with %v before the host desynced", callbacks.codes)
+	}
+
+	// MaxDecryptFailures in a row end the stream with ErrControlDesync
+	for i := 1; i <= MaxDecryptFailures; i++ {
+		more := s.processMessage(hostMessage(t, wrongKey, uint32(100+i), 0x0100))
+		if more != (i < MaxDecryptFailures) {
+			t.Fatalf("decrypt failure %d: processMessage = %v", i, more)
+		}
+	}
+	if len(callbacks.codes) != 1 || callbacks.codes[0] != types.ErrControlDesync {
+		t.Fatalf("terminated with %v, want [%d]", callbacks.codes, types.ErrControlDesync)
+	}
+}
+
+// triggerEffects records the adaptive trigger effects a stream reports
+type triggerEffects struct {
+	types.NopConnectionCallbacks
+	effects []triggerEffect
+}
+
+type triggerEffect struct {
+	controller                      uint16
+	eventFlags, typeLeft, typeRight uint8
+	left, right                     []byte
+}
+
+func (r *triggerEffects) SetAdaptiveTriggers(controller uint16, eventFlags, typeLeft, typeRight uint8, left, right []byte) {
+	r.effects = append(r.effects, triggerEffect{controller, eventFlags, typeLeft, typeRight, left, right})
+}
+
+func TestSetAdaptiveTriggers(t *testing.T) {
+	callbacks := &triggerEffects{}
+	s := NewStream(types.StreamConfiguration{}, callbacks, [4]int{7, 1, 431, 0}, true)
+
+	// Controller 2 gets a weapon effect on the right trigger only
+	left := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	right := []byte{0x02, 0x07, 0x08, 0, 0, 0, 0, 0, 0, 0}
+	payload := []byte{2, 0, types.AdaptiveTriggerRight, 0x05, 0x25}
+	payload = append(append(payload, left...), right...)
+
+	s.handlePacket(0x5503, payload)
+	copy(payload, make([]byte, len(payload))) // The receive buffer is reused
+
+	if len(callbacks.effects) != 1 {
+		t.Fatalf("reported %d trigger effects, want 1", len(callbacks.effects))
+	}
+	got := callbacks.effects[0]
+	if got.controller != 2 || got.eventFlags != types.AdaptiveTriggerRight ||
+		got.typeLeft != 0x05 || got.typeRight != 0x25 {
+		t.Errorf("controller %d, flags %#x, types %#x/%#x; want 2, %#x, 0x05/0x25",
+			got.controller, got.eventFlags, got.typeLeft, got.typeRight, types.AdaptiveTriggerRight)
+	}
+	if !bytes.Equal(got.left, left) || !bytes.Equal(got.right, right) {
+		t.Errorf("effects % x / % x, want % x / % x", got.left, got.right, left, right)
+	}
+
+	// A truncated packet is ignored
+	s.handlePacket(0x5503, payload[:5+types.AdaptiveTriggerPayloadSize])
+	if len(callbacks.effects) != 1 {
+		t.Fatalf("a truncated packet reported a trigger effect")
+	}
+}
+
+// hostDecrypt decrypts a control message the way the host receives it,
+// returning its type and payload
+func hostDecrypt(t *testing.T, key, packet []byte) (uint16, []byte, error) {
+	t.Helper()
+
+	gcm, err := crypto.NewContext(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary.LittleEndian.Uint16(packet[0:2]) != 0x0001 || int(binary.LittleEndian.Uint16(packet[2:4])) != len(packet)-4 {
+		t.Fatalf("bad encrypted header % x", packet[:4])
+	}
+	seq := binary.LittleEndian.Uint32(packet[4:8])
+	inner, err := gcm.DecryptGCM(packet[24:], controlIV(seq, 'C'), packet[8:24], nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	n := binary.LittleEndian.Uint16(inner[2:4])
+	return binary.LittleEndian.Uint16(inner[0:2]), inner[4 : 4+n], nil
+}
+
+func TestEncryptedControlRoundTrip(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	s := NewStream(types.StreamConfiguration{RemoteInputAesKey: key}, types.NopConnectionCallbacks{}, [4]int{7, 1, 431, 0}, true)
+	payload := []byte("input packet")
+
+	first, err := s.buildEncryptedPacket(0x0206, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(first, payload) {
+		t.Fatal("payload sent in the clear")
+	}
+	ptype, got, err := hostDecrypt(t, key, first)
+	if err != nil {
+		t.Fatalf("host can't decrypt: %v", err)
+	}
+	if ptype != 0x0206 || !bytes.Equal(got, payload) {
+		t.Fatalf("host decrypted type %#x payload %q, want 0x206 %q", ptype, got, payload)
+	}
+
+	// The next message has its own sequence number and nonce
+	second, err := s.buildEncryptedPacket(0x0206, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(first[4:], second[4:]) {
+		t.Fatal("the same message encrypted twice came out the same")
+	}
+
+	// Tampering, or another key, fails authentication
+	second[len(second)-1] ^= 1
+	if _, _, err := hostDecrypt(t, key, second); err == nil {
+		t.Error("host accepted a tampered message")
+	}
+	if _, _, err := hostDecrypt(t, []byte("fedcba9876543210"), first); err == nil {
+		t.Error("host decrypted with the wrong key")
+	}
+
+	// Another client with the same key reads the host's messages, but not
+	// this client's own: the nonce says which way a message travels
+	peer := NewStream(types.StreamConfiguration{RemoteInputAesKey: key}, types.NopConnectionCallbacks{}, [4]int{7, 1, 431, 0}, true)
+	if _, _, err := peer.decryptMessage(hostMessage(t, key, 1, 0x0100)); err != nil {
+		t.Errorf("host message didn't decrypt: %v", err)
+	}
+	if _, _, err := peer.decryptMessage(first); err == nil {
+		t.Error("a client message decrypted as if the host sent it")
+	}
+}
+
+func TestEncryptedControlNoCipher(t *testing.T) {
+	// Encryption is negotiated by version, but there's no key to do it with
+	s := NewStream(types.StreamConfiguration{}, types.NopConnectionCallbacks{}, [4]int{7, 1, 431, 0}, true)
+
+	if packet, err := s.buildEncryptedPacket(0x0206, []byte("input packet")); !errors.Is(err, ErrNoCipher) {
+		t.Errorf("buildEncryptedPacket = % x, %v; want %v", packet, err, ErrNoCipher)
+	}
+	if plaintext, _, err := s.decryptMessage(hostMessage(t, []byte("0123456789abcdef"), 1, 0x0100)); !errors.Is(err, ErrNoCipher) {
+		t.Errorf("decryptMessage = % x, %v; want %v", plaintext, err, ErrNoCipher)
+	}
+}
+
+func TestStartWithoutKey(t *testing.T) {
+	s := NewStream(types.StreamConfiguration{RemoteInputAesKey: []byte("short")}, types.NopConnectionCallbacks{}, [4]int{7, 1, 431, 0}, true)
+
+	err := s.Start(context.Background(), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, 47999)
+	if !errors.Is(err, crypto.ErrInvalidKey) {
+		t.Fatalf("Start = %v, want %v", err, crypto.ErrInvalidKey)
+	}
+}
+
+func TestTerminationPayloads(t *testing.T) {
+	be32 := func(v ...uint32) []byte {
+		var b []byte
+		for _, x := range v {
+			b = binary.BigEndian.AppendUint32(b, x)
+		}
+		return b
+	}
+
+	for _, tt := range []struct {
+		name    string
+		payload []byte
+		code    int
+		reason  types.TerminateReason
+	}{
+		{"empty", nil, types.ErrGracefulTermination, types.TerminateReasonUnknown},
+		{"GFE closed", []byte{0x00, 0x01}, types.ErrGracefulTermination, types.TerminateReasonUnknown},
+		{"GFE error", []byte{0x05, 0x00}, 5, types.TerminateReasonUnknown},
+		{"Sunshine closed", be32(0x80030023), types.ErrGracefulTermination, types.TerminateReasonUnknown},
+		{"Sunshine error", be32(0x80030022), 0x80030022, types.TerminateReasonUnknown},
+		{"app exited", be32(0x80030023, 1), types.ErrGracefulTermination, types.TerminateReasonAppExited},
+		{"timed out", be32(0x80030022, 2), 0x80030022, types.TerminateReasonTimeout},
+		{"taken over", be32(0x80030023, 3), types.ErrGracefulTermination, types.TerminateReasonTakenOver},
+		{"reason we don't know", be32(0x80030022, 99), 0x80030022, types.TerminateReasonUnknown},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			callbacks := &terminations{}
+			s := NewStream(types.StreamConfiguration{}, callbacks, [4]int{7, 1, 431, 0}, true)
+			s.handlePacket(0x0109, tt.payload)
+
+			if len(callbacks.codes) != 1 || callbacks.codes[0] != tt.code || callbacks.reasons[0] != tt.reason {
+				t.Fatalf("terminated with %v %v, want [%d] [%v]", callbacks.codes, callbacks.reasons, tt.code, tt.reason)
+			}
+		})
+	}
+}
@@ -86,7 +86,7 @@ func New(dataShards, parityShards int) (*ReedSolomon, error) {
 
 	// Extract and invert top submatrix
 	top := subMatrix(vm, 0, 0, dataShards, dataShards, totalShards, dataShards)
-	if err := invertMatrix(top, dataShards); err != nil {
+	if err := invertMatrix(top, dataShards, nil); err != nil {
 		return nil, err
 	}
 
@@ -106,6 +106,24 @@ func New(dataShards, parityShards int) (*ReedSolomon, error) {
 	return rs, nil
 }
 
+// NewWithParity creates a codec that uses a fixed parity matrix (parityShards
+// rows of dataShards coefficients) instead of the generated Cauchy rows.
+// GFE and Sunshine use such a matrix for audio FEC.
+func NewWithParity(dataShards, parityShards int, parity []byte) (*ReedSolomon, error) {
+	if len(parity) != dataShards*parityShards {
+		return nil, ErrInvalidShardSize
+	}
+
+	rs, err := New(dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	copy(rs.matrix[dataShards*dataShards:], parity)
+	copy(rs.parity, parity)
+	return rs, nil
+}
+
 // Encode generates parity shards from data shards
 func (rs *ReedSolomon) Encode(shards [][]byte) error {
 	if len(shards) != rs.totalShards {
@@ -127,8 +145,11 @@ func (rs *ReedSolomon) Encode(shards [][]byte) error {
 	return nil
 }
 
-// Reconstruct recovers missing data shards using parity
-func (rs *ReedSolomon) Reconstruct(shards [][]byte, present []bool) error {
+// Reconstruct recovers missing data shards using parity.
+// pool is optional: when non-nil, buffers for missing shards and the decode
+// scratch come from it, and the caller should Put recovered shards back once
+// it is done with them. When nil, everything is allocated per call.
+func (rs *ReedSolomon) Reconstruct(shards [][]byte, present []bool, pool *ShardPool) error {
 	if len(shards) != rs.totalShards || len(present) != rs.totalShards {
 		return ErrInvalidShardSize
 	}
@@ -148,37 +169,50 @@ func (rs *ReedSolomon) Reconstruct(shards [][]byte, present []bool) error {
 		return ErrNotEnoughShards
 	}
 
+	var scratch *reconstructScratch
+	if pool != nil {
+		pool.scratchMu.Lock()
+		defer pool.scratchMu.Unlock()
+		scratch = &pool.scratch
+	} else {
+		scratch = &reconstructScratch{}
+	}
+	scratch.reset(rs.dataShards)
+
 	// Count missing data shards
-	var missingData []int
+	missingData := scratch.missingData
 	for i := 0; i < rs.dataShards; i++ {
 		if !present[i] {
 			missingData = append(missingData, i)
 		}
 	}
+	scratch.missingData = missingData
 
 	if len(missingData) == 0 {
 		return nil // All data shards present
 	}
 
 	// Collect available parity shards
-	var availableParity []int
-	var parityData [][]byte
+	availableParity := scratch.availableParity
+	parityData := scratch.parityData
 	for i := rs.dataShards; i < rs.totalShards && len(availableParity) < len(missingData); i++ {
 		if present[i] {
 			availableParity = append(availableParity, i-rs.dataShards)
 			parityData = append(parityData, shards[i])
 		}
 	}
+	scratch.availableParity = availableParity
+	scratch.parityData = parityData
 
 	if len(availableParity) < len(missingData) {
 		return ErrNotEnoughShards
 	}
 
 	// Build decode matrix
-	decodeMatrix := make([]gf, rs.dataShards*rs.dataShards)
+	decodeMatrix := scratch.decodeMatrix
 
 	subMatrixRow := 0
-	subShards := make([][]byte, rs.dataShards)
+	subShards := scratch.subShards
 	missingIdx := 0
 
 	for i := 0; i < rs.dataShards; i++ {
@@ -206,20 +240,25 @@ func (rs *ReedSolomon) Reconstruct(shards [][]byte, present []bool) error {
 	}
 
 	// Invert decode matrix
-	if err := invertMatrix(decodeMatrix, rs.dataShards); err != nil {
+	if err := invertMatrix(decodeMatrix, rs.dataShards, &scratch.invert); err != nil {
 		return err
 	}
 
 	// Recover missing data shards
-	outputs := make([][]byte, len(missingData))
+	outputs := scratch.outputs
 	for i, idx := range missingData {
 		if shards[idx] == nil {
-			shards[idx] = make([]byte, blockSize)
+			if pool != nil {
+				shards[idx] = pool.Get(blockSize)
+			} else {
+				shards[idx] = make([]byte, blockSize)
+			}
 		}
-		outputs[i] = shards[idx]
+		outputs = append(outputs, shards[idx])
 		// Copy row for this output
 		copy(decodeMatrix[i*rs.dataShards:], decodeMatrix[idx*rs.dataShards:(idx+1)*rs.dataShards])
 	}
+	scratch.outputs = outputs
 
 	codeSomeShards(decodeMatrix, subShards, outputs, rs.dataShards, len(missingData), blockSize)
 	return nil
@@ -331,11 +370,15 @@ func mul(dst, src []gf, c gf) {
 	}
 }
 
-func invertMatrix(src []gf, k int) error {
-	indxc := make([]int, k)
-	indxr := make([]int, k)
-	ipiv := make([]int, k)
-	idRow := make([]gf, k)
+func invertMatrix(src []gf, k int, scratch *invertScratch) error {
+	if scratch == nil {
+		scratch = &invertScratch{}
+	}
+	scratch.reset(k)
+	indxc := scratch.indxc
+	indxr := scratch.indxr
+	ipiv := scratch.ipiv
+	idRow := scratch.idRow
 
 	for col := 0; col < k; col++ {
 		var irow, icol int = -1, -1
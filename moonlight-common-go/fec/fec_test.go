@@ -0,0 +1,111 @@
+package fec
+
+import (
+	"bytes"
+	"testing"
+)
+
+// audioBlock returns an encoded 4+2 block of shardSize-byte shards, as
+// audio FEC sends them
+func audioBlock(t testing.TB, shardSize int) (*ReedSolomon, [][]byte) {
+	t.Helper()
+
+	rs, err := New(4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shards := make([][]byte, 6)
+	for i := range shards {
+		shards[i] = make([]byte, shardSize)
+		if i < 4 {
+			for j := range shards[i] {
+				shards[i][j] = byte(i*31 + j)
+			}
+		}
+	}
+	if err := rs.Encode(shards); err != nil {
+		t.Fatal(err)
+	}
+	return rs, shards
+}
+
+// lose returns a copy of shards with the data shards in drop missing
+func lose(shards [][]byte, drop ...int) ([][]byte, []bool) {
+	damaged := make([][]byte, len(shards))
+	present := make([]bool, len(shards))
+	copy(damaged, shards)
+	for i := range present {
+		present[i] = true
+	}
+	for _, i := range drop {
+		damaged[i] = nil
+		present[i] = false
+	}
+	return damaged, present
+}
+
+func TestReconstructWithPool(t *testing.T) {
+	rs, shards := audioBlock(t, 200)
+	pool := NewShardPool(4)
+
+	// The same pool serves block after block once recovered shards go back
+	for round := 0; round < 3; round++ {
+		damaged, present := lose(shards, 0, 2)
+		if err := rs.Reconstruct(damaged, present, pool); err != nil {
+			t.Fatal(err)
+		}
+		for _, i := range []int{0, 2} {
+			if !bytes.Equal(damaged[i], shards[i]) {
+				t.Fatalf("round %d: shard %d rebuilt wrong", round, i)
+			}
+			if cap(damaged[i]) != MaxShardSize {
+				t.Errorf("round %d: shard %d wasn't drawn from the pool", round, i)
+			}
+			pool.Put(damaged[i])
+		}
+	}
+}
+
+func TestReconstructPoolDoesNotAllocate(t *testing.T) {
+	rs, shards := audioBlock(t, 200)
+	pool := NewShardPool(4)
+	damaged, present := lose(shards, 1, 3)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		damaged[1], damaged[3] = nil, nil
+		if err := rs.Reconstruct(damaged, present, pool); err != nil {
+			t.Fatal(err)
+		}
+		pool.Put(damaged[1])
+		pool.Put(damaged[3])
+	})
+	if allocs != 0 {
+		t.Fatalf("Reconstruct with a pool made %v allocations, want 0", allocs)
+	}
+}
+
+func benchmarkReconstruct(b *testing.B, pool *ShardPool) {
+	rs, shards := audioBlock(b, 200)
+	damaged, present := lose(shards, 1, 3)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		damaged[1], damaged[3] = nil, nil
+		if err := rs.Reconstruct(damaged, present, pool); err != nil {
+			b.Fatal(err)
+		}
+		if pool != nil {
+			pool.Put(damaged[1])
+			pool.Put(damaged[3])
+		}
+	}
+}
+
+func BenchmarkReconstruct(b *testing.B) {
+	benchmarkReconstruct(b, nil)
+}
+
+func BenchmarkReconstructPool(b *testing.B) {
+	benchmarkReconstruct(b, NewShardPool(4))
+}
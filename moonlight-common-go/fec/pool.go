@@ -0,0 +1,127 @@
+package fec
+
+import "sync"
+
+// MaxShardSize is the largest shard a ShardPool hands out.
+// It covers a full Ethernet MTU, which bounds any audio or video packet.
+const MaxShardSize = 1500
+
+// ShardPool holds pre-allocated shard buffers and decode scratch space so that
+// Reconstruct does not allocate on every call. Audio FEC runs at ~200 blocks
+// per second, so per-call allocations add measurable GC pressure.
+//
+// Shards handed out for recovered data belong to the caller until returned with Put.
+type ShardPool struct {
+	mu   sync.Mutex
+	free [][]byte
+
+	// Decode scratch, reused across Reconstruct calls. Guarded by scratchMu
+	// so a single pool can be shared, though one pool per goroutine avoids contention.
+	scratchMu sync.Mutex
+	scratch   reconstructScratch
+}
+
+// reconstructScratch is the working memory for a single Reconstruct call
+type reconstructScratch struct {
+	missingData     []int
+	availableParity []int
+	parityData      [][]byte
+	decodeMatrix    []gf
+	subShards       [][]byte
+	outputs         [][]byte
+	invert          invertScratch
+}
+
+// invertScratch is the working memory for invertMatrix
+type invertScratch struct {
+	indxc []int
+	indxr []int
+	ipiv  []int
+	idRow []gf
+}
+
+// NewShardPool creates a pool with count pre-allocated shard buffers
+func NewShardPool(count int) *ShardPool {
+	backing := make([][MaxShardSize]byte, count)
+	p := &ShardPool{free: make([][]byte, 0, count)}
+	for i := range backing {
+		p.free = append(p.free, backing[i][:])
+	}
+	return p
+}
+
+// Get returns a shard buffer of the given size. It falls back to allocating
+// when the pool is exhausted or the size exceeds MaxShardSize.
+func (p *ShardPool) Get(size int) []byte {
+	if size > MaxShardSize {
+		return make([]byte, size)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n := len(p.free)
+	if n == 0 {
+		return make([]byte, size, MaxShardSize)
+	}
+	buf := p.free[n-1]
+	p.free = p.free[:n-1]
+	return buf[:size]
+}
+
+// Put returns a shard buffer obtained from Get to the pool
+func (p *ShardPool) Put(buf []byte) {
+	if cap(buf) != MaxShardSize {
+		return // Not ours (oversized fallback allocation)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.free = append(p.free, buf[:MaxShardSize])
+}
+
+// reset sizes the scratch for a codec, growing buffers only when needed
+func (s *reconstructScratch) reset(dataShards int) {
+	s.missingData = s.missingData[:0]
+	s.availableParity = s.availableParity[:0]
+	s.parityData = s.parityData[:0]
+	s.decodeMatrix = growGF(s.decodeMatrix, dataShards*dataShards)
+	s.subShards = growShards(s.subShards, dataShards)
+	s.outputs = s.outputs[:0]
+	s.invert.reset(dataShards)
+}
+
+func (s *invertScratch) reset(k int) {
+	s.indxc = growInts(s.indxc, k)
+	s.indxr = growInts(s.indxr, k)
+	s.ipiv = growInts(s.ipiv, k)
+	s.idRow = growGF(s.idRow, k)
+}
+
+func growInts(b []int, n int) []int {
+	if cap(b) < n {
+		return make([]int, n)
+	}
+	b = b[:n]
+	clear(b)
+	return b
+}
+
+func growGF(b []gf, n int) []gf {
+	if cap(b) < n {
+		return make([]gf, n)
+	}
+	b = b[:n]
+	clear(b)
+	return b
+}
+
+func growShards(b [][]byte, n int) [][]byte {
+	if cap(b) < n {
+		return make([][]byte, n)
+	}
+	b = b[:n]
+	clear(b)
+	return b
+}
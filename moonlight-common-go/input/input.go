@@ -4,6 +4,7 @@ package input
 import (
 	"encoding/binary"
 	"sync"
+	"unicode/utf8"
 
 	"github.com/zalo/moonparty/moonlight-common-go/protocol"
 	"github.com/zalo/moonparty/moonlight-common-go/types"
@@ -21,6 +22,9 @@ const MaxInputPacketSize = 128
 // MaxQueuedInputPackets is the maximum number of queued input packets
 const MaxQueuedInputPackets = 150
 
+// MaxUTF8TextBytes is how much text Sunshine accepts in one UTF-8 text packet
+const MaxUTF8TextBytes = 32
+
 // MouseBatchingIntervalMs is the batching interval for mouse events
 const MouseBatchingIntervalMs = 1
 
@@ -41,10 +45,7 @@ type Stream struct {
 	sendFunc func(channelID uint8, flags uint32, data []byte, moreData bool) error
 
 	// Batched state
-	currentRelMouseState relativeMouseState
-	currentAbsMouseState absoluteMouseState
 	currentGamepadState  [MaxGamepads]*gamepadState
-	gamepadSensorState   [MaxGamepads][MaxMotionEvents]sensorState
 
 	// Virtual mouse position
 	absCurrentPosX float32
@@ -60,18 +61,6 @@ type Stream struct {
 	initialized bool
 }
 
-type relativeMouseState struct {
-	deltaX int
-	deltaY int
-	dirty  bool
-}
-
-type absoluteMouseState struct {
-	x, y          int
-	width, height int
-	dirty         bool
-}
-
 type gamepadState struct {
 	buttonFlags  uint32
 	leftTrigger  uint8
@@ -82,11 +71,6 @@ type gamepadState struct {
 	rightStickY  int16
 }
 
-type sensorState struct {
-	x, y, z float32
-	dirty   bool
-}
-
 // NewStream creates a new input stream
 func NewStream(appVersion [4]int, isSunshine bool, aesKey, aesIV []byte,
 	sendFunc func(channelID uint8, flags uint32, data []byte, moreData bool) error) *Stream {
@@ -128,17 +112,8 @@ func (s *Stream) SendMouseMove(deltaX, deltaY int16) error {
 		return nil
 	}
 
-	s.currentRelMouseState.deltaX += int(deltaX)
-	s.currentRelMouseState.deltaY += int(deltaY)
-
-	if !s.currentRelMouseState.dirty {
-		s.currentRelMouseState.dirty = true
-
-		packet := s.buildRelMouseMovePacket(deltaX, deltaY)
-		return s.sendFunc(protocol.CtrlChannelMouse, protocol.ENetPacketFlagReliable, packet, false)
-	}
-
-	return nil
+	packet := s.buildRelMouseMovePacket(deltaX, deltaY)
+	return s.sendFunc(protocol.CtrlChannelMouse, protocol.ENetPacketFlagReliable, packet, false)
 }
 
 // SendMousePosition sends an absolute mouse position event
@@ -150,23 +125,20 @@ func (s *Stream) SendMousePosition(x, y, refWidth, refHeight int16) error {
 		return ErrNotInitialized
 	}
 
-	s.currentAbsMouseState.x = int(x)
-	s.currentAbsMouseState.y = int(y)
-	s.currentAbsMouseState.width = int(refWidth)
-	s.currentAbsMouseState.height = int(refHeight)
-
-	if !s.currentAbsMouseState.dirty {
-		s.currentAbsMouseState.dirty = true
-
-		packet := s.buildAbsMouseMovePacket(x, y, refWidth, refHeight)
-		return s.sendFunc(protocol.CtrlChannelMouse, protocol.ENetPacketFlagReliable, packet, false)
+	// The packet carries the reference size less one, which the host divides
+	// the position by, so it must be at least 1 and the position within it
+	if refWidth < 2 || refHeight < 2 {
+		return ErrInvalidParameter
 	}
+	x = min(max(x, 0), refWidth-1)
+	y = min(max(y, 0), refHeight-1)
 
 	// Update virtual mouse position
 	s.absCurrentPosX = clampFloat(float32(x)/float32(refWidth-1), 0, 1)
 	s.absCurrentPosY = clampFloat(float32(y)/float32(refHeight-1), 0, 1)
 
-	return nil
+	packet := s.buildAbsMouseMovePacket(x, y, refWidth, refHeight)
+	return s.sendFunc(protocol.CtrlChannelMouse, protocol.ENetPacketFlagReliable, packet, false)
 }
 
 // SendMouseButton sends a mouse button event
@@ -265,6 +237,14 @@ func (s *Stream) SendMultiController(controllerNumber, activeGamepadMask int16,
 		return ErrNotInitialized
 	}
 
+	return s.sendMultiControllerLocked(controllerNumber, activeGamepadMask, buttonFlags,
+		leftTrigger, rightTrigger, leftStickX, leftStickY, rightStickX, rightStickY)
+}
+
+// sendMultiControllerLocked sends a multi-controller state event. Caller must hold s.mu.
+func (s *Stream) sendMultiControllerLocked(controllerNumber, activeGamepadMask int16, buttonFlags int,
+	leftTrigger, rightTrigger uint8, leftStickX, leftStickY, rightStickX, rightStickY int16) error {
+
 	// Fix sign extension bug from old clients
 	if buttonFlags < 0 {
 		buttonFlags &= 0xFFFF
@@ -312,7 +292,24 @@ func (s *Stream) SendControllerArrival(controllerNumber uint8, activeGamepadMask
 	}
 
 	// Also send MC event for compatibility
-	return s.SendMultiController(int16(controllerNumber), int16(activeGamepadMask), 0, 0, 0, 0, 0, 0, 0)
+	return s.sendMultiControllerLocked(int16(controllerNumber), int16(activeGamepadMask), 0, 0, 0, 0, 0, 0, 0)
+}
+
+// SendControllerDeparture tells the host a controller was unplugged. There is
+// no dedicated packet; like moonlight-common-c, an MC event whose active mask
+// no longer includes the controller is what removes it.
+func (s *Stream) SendControllerDeparture(controllerNumber uint8, activeGamepadMask uint16) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.initialized {
+		return ErrNotInitialized
+	}
+
+	controllerNumber %= MaxGamepads
+	activeGamepadMask &^= 1 << controllerNumber
+
+	return s.sendMultiControllerLocked(int16(controllerNumber), int16(activeGamepadMask), 0, 0, 0, 0, 0, 0, 0)
 }
 
 // SendTouch sends a touch event (Sunshine only)
@@ -380,19 +377,9 @@ func (s *Stream) SendControllerMotion(controllerNumber, motionType uint8, x, y,
 
 	controllerNumber %= MaxGamepads
 
-	s.gamepadSensorState[controllerNumber][motionType-1].x = x
-	s.gamepadSensorState[controllerNumber][motionType-1].y = y
-	s.gamepadSensorState[controllerNumber][motionType-1].z = z
-
-	if !s.gamepadSensorState[controllerNumber][motionType-1].dirty {
-		s.gamepadSensorState[controllerNumber][motionType-1].dirty = true
-
-		packet := s.buildControllerMotionPacket(controllerNumber, motionType, x, y, z)
-		channelID := uint8(protocol.CtrlChannelSensorBase + int(controllerNumber))
-		return s.sendFunc(channelID, protocol.ENetPacketFlagReliable, packet, false)
-	}
-
-	return nil
+	packet := s.buildControllerMotionPacket(controllerNumber, motionType, x, y, z)
+	channelID := uint8(protocol.CtrlChannelSensorBase + int(controllerNumber))
+	return s.sendFunc(channelID, protocol.ENetPacketFlagReliable, packet, false)
 }
 
 // SendControllerBattery sends battery status (Sunshine only)
@@ -414,7 +401,8 @@ func (s *Stream) SendControllerBattery(controllerNumber, batteryState, percentag
 	return s.sendFunc(channelID, protocol.ENetPacketFlagReliable, packet, false)
 }
 
-// SendUTF8Text sends UTF-8 text input
+// SendUTF8Text sends UTF-8 text input. Text longer than MaxUTF8TextBytes is
+// split into several packets without breaking up a character.
 func (s *Stream) SendUTF8Text(text string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -423,8 +411,33 @@ func (s *Stream) SendUTF8Text(text string) error {
 		return ErrNotInitialized
 	}
 
-	packet := s.buildUTF8TextPacket(text)
-	return s.sendFunc(protocol.CtrlChannelUTF8, protocol.ENetPacketFlagReliable, packet, false)
+	for len(text) > 0 {
+		n := utf8ChunkLen(text, MaxUTF8TextBytes)
+		packet := s.buildUTF8TextPacket(text[:n])
+		if err := s.sendFunc(protocol.CtrlChannelUTF8, protocol.ENetPacketFlagReliable, packet, false); err != nil {
+			return err
+		}
+		text = text[n:]
+	}
+	return nil
+}
+
+// utf8ChunkLen returns the length of the longest prefix of text that fits in
+// max bytes and ends on a character boundary. A single character longer than
+// max is returned whole.
+func utf8ChunkLen(text string, max int) int {
+	if len(text) <= max {
+		return len(text)
+	}
+	n := max
+	for n > 0 && !utf8.RuneStart(text[n]) {
+		n--
+	}
+	if n == 0 {
+		_, size := utf8.DecodeRuneInString(text)
+		return size
+	}
+	return n
 }
 
 // Helper functions
@@ -714,6 +727,26 @@ const (
 	TouchEventCancel = 4
 )
 
+// Pen tool types (exported)
+const (
+	PenToolUnknown = 0
+	PenToolPen     = 1
+	PenToolEraser  = 2
+)
+
+// Pen buttons, the barrel buttons rather than the tip (exported)
+const (
+	PenButtonPrimary   = 0x01
+	PenButtonSecondary = 0x02
+	PenButtonTertiary  = 0x04
+)
+
+// Pen rotation and tilt for devices that don't report them (exported)
+const (
+	PenRotationUnknown = 0xFFFF
+	PenTiltUnknown     = 0xFF
+)
+
 // Modifier constants (exported)
 const (
 	ModifierShift = 0x01
@@ -0,0 +1,55 @@
+package input
+
+import (
+	"testing"
+
+	"github.com/zalo/moonparty/moonlight-common-go/types"
+)
+
+// sunshineVersion is a Sunshine release with the encrypted control stream
+var sunshineVersion = [4]int{7, 1, 431, 0}
+
+func TestInputChannels(t *testing.T) {
+	tests := []struct {
+		name    string
+		send    func(s *Stream) error
+		channel uint8
+	}{
+		{"keyboard", func(s *Stream) error { return s.SendKeyboard(0x41, types.KeyActionDown, 0, 0) }, 0x02},
+		{"mouse move", func(s *Stream) error { return s.SendMouseMove(1, 1) }, 0x03},
+		{"pen", func(s *Stream) error {
+			return s.SendPen(TouchEventDown, 1, 0, 0.5, 0.5, 1, 0, 0, 0, 0)
+		}, 0x04},
+		{"touch", func(s *Stream) error { return s.SendTouch(TouchEventDown, 1, 0.5, 0.5, 1, 0, 0, 0) }, 0x05},
+		{"utf8 text", func(s *Stream) error { return s.SendUTF8Text("é") }, 0x06},
+		{"gamepad 0", func(s *Stream) error { return s.SendMultiController(0, 1, 0, 0, 0, 0, 0, 0, 0) }, 0x10},
+		{"gamepad 3", func(s *Stream) error { return s.SendMultiController(3, 0xF, 0, 0, 0, 0, 0, 0, 0) }, 0x13},
+		{"gamepad 15", func(s *Stream) error { return s.SendMultiController(15, -1, 0, 0, 0, 0, 0, 0, 0) }, 0x1F},
+		{"battery 2", func(s *Stream) error { return s.SendControllerBattery(2, 1, 50) }, 0x12},
+		{"sensors 0", func(s *Stream) error { return s.SendControllerMotion(0, 1, 0, 0, 0) }, 0x20},
+		{"sensors 5", func(s *Stream) error { return s.SendControllerMotion(5, 2, 0, 0, 0) }, 0x25},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var channels []uint8
+			s := NewStream(sunshineVersion, true, make([]byte, 16), make([]byte, 16),
+				func(channelID uint8, _ uint32, _ []byte, _ bool) error {
+					channels = append(channels, channelID)
+					return nil
+				})
+
+			if err := tt.send(s); err != nil {
+				t.Fatal(err)
+			}
+			if len(channels) == 0 {
+				t.Fatal("nothing sent")
+			}
+			for _, ch := range channels {
+				if ch != tt.channel {
+					t.Fatalf("sent on channel %#x, want %#x", ch, tt.channel)
+				}
+			}
+		})
+	}
+}
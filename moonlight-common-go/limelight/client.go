@@ -4,6 +4,7 @@ package limelight
 import (
 	"context"
 	"fmt"
+	"math/bits"
 	"net"
 	"strconv"
 	"strings"
@@ -13,7 +14,9 @@ import (
 	"github.com/zalo/moonparty/moonlight-common-go/control"
 	"github.com/zalo/moonparty/moonlight-common-go/fec"
 	"github.com/zalo/moonparty/moonlight-common-go/input"
+	"github.com/zalo/moonparty/moonlight-common-go/logging"
 	"github.com/zalo/moonparty/moonlight-common-go/rtsp"
+	"github.com/zalo/moonparty/moonlight-common-go/types"
 	"github.com/zalo/moonparty/moonlight-common-go/video"
 )
 
@@ -26,9 +29,11 @@ type Client struct {
 	ServerInfo ServerInformation
 
 	// Callbacks
-	Decoder   DecoderCallbacks
-	Audio     AudioCallbacks
-	Listener  ConnectionCallbacks
+	Decoder  DecoderCallbacks
+	Audio    AudioCallbacks
+	Listener ConnectionCallbacks
+
+	log logging.Logger
 
 	// Connection state
 	ctx       context.Context
@@ -37,10 +42,10 @@ type Client struct {
 	connected bool
 
 	// Server information
-	appVersion   [4]int
-	isSunshine   bool
-	remoteAddr   *net.UDPAddr
-	localAddr    *net.UDPAddr
+	appVersion [4]int
+	isSunshine bool
+	remoteAddr *net.UDPAddr
+	localAddr  *net.UDPAddr
 
 	// Stream components
 	rtspClient    *rtsp.Client
@@ -50,9 +55,10 @@ type Client struct {
 	inputStream   *input.Stream
 
 	// Negotiated settings
-	videoFormat     VideoFormat
-	opusConfig      *OpusConfig
+	videoFormat         VideoFormat
+	opusConfig          *OpusConfig
 	audioPacketDuration int
+	featureFlags        uint32 // Sunshine extensions the server advertises, types.FF*
 
 	// Ports
 	videoPort   int
@@ -61,6 +67,9 @@ type Client struct {
 
 	// Sunshine ping payload
 	pingPayload string
+
+	// Sunshine's X-SS-Connect-Data, sent in the control stream's connect
+	connectData uint32
 }
 
 // NewClient creates a new Moonlight client
@@ -76,9 +85,16 @@ func NewClient(config StreamConfiguration, serverInfo ServerInformation,
 		Decoder:    decoder,
 		Audio:      audioCallbacks,
 		Listener:   listener,
+		log:        logging.Default(),
 	}
 }
 
+// SetLogger replaces the Logger the client and its streams write to,
+// logging.Default() unless set. Call it before Start.
+func (c *Client) SetLogger(l logging.Logger) {
+	c.log = l
+}
+
 // Start initiates the streaming connection
 func (c *Client) Start(ctx context.Context) error {
 	c.mu.Lock()
@@ -226,16 +242,23 @@ func (c *Client) cleanup() {
 	}
 
 	if c.rtspClient != nil {
-		c.rtspClient.DoTeardown()
+		if _, err := c.rtspClient.DoTeardown(); err != nil {
+			c.log.Warnf("RTSP TEARDOWN failed: %v", err)
+		}
 		c.rtspClient.Close()
 		c.rtspClient = nil
 	}
 }
 
+// rtspPortOffset is the RTSP port relative to the host's base HTTP port
+// (48010 for the default 47989)
+const rtspPortOffset = 21
+
 // doRTSPHandshake performs the RTSP session setup
 // Order matches moonlight-qt: OPTIONS, DESCRIBE, SETUP, ANNOUNCE, PLAY
 func (c *Client) doRTSPHandshake() error {
-	c.rtspClient = rtsp.NewClient(c.remoteAddr.IP.String(), 48010)
+	c.rtspClient = rtsp.NewClient(c.remoteAddr.IP.String(), c.remoteAddr.Port+rtspPortOffset)
+	c.rtspClient.SetLogger(c.log)
 
 	if err := c.rtspClient.Connect(); err != nil {
 		return err
@@ -260,8 +283,7 @@ func (c *Client) doRTSPHandshake() error {
 	}
 
 	// Parse server SDP
-	serverSDP := rtsp.ParseSDP(resp.Body)
-	c.parseServerSDP(serverSDP)
+	c.parseServerSDP(resp.Body)
 
 	// 3. SETUP streams (audio, video, control)
 	ports, err := c.rtspClient.DoSetup()
@@ -273,6 +295,7 @@ func (c *Client) doRTSPHandshake() error {
 	c.audioPort = ports.AudioPort
 	c.controlPort = ports.ControlPort
 	c.pingPayload = ports.PingPayload
+	c.connectData = ports.ConnectData
 
 	// Fallback ports
 	if c.videoPort == 0 {
@@ -286,20 +309,32 @@ func (c *Client) doRTSPHandshake() error {
 	}
 
 	// 4. ANNOUNCE with SDP
-	sdp := rtsp.BuildSDP(
+	sdp := rtsp.NewSDPBuilder(
 		c.appVersion[0]*1000000+c.appVersion[1]*10000+c.appVersion[2]*100+c.appVersion[3],
 		c.Config.Width,
 		c.Config.Height,
 		c.Config.FPS,
 		c.Config.PacketSize,
-		uint32(c.Config.SupportedVideoFormats),
+		uint32(c.videoFormat), // Negotiated from DESCRIBE
 		uint32(c.Config.AudioConfiguration),
 		true, // GCM supported
 		0,    // RI key ID
 		c.Config.RemoteInputAesKey,
 	)
 
-	resp, err = c.rtspClient.DoAnnounce(sdp)
+	sdp.AudioQuality = c.Config.AudioQuality
+	sdp.MinFECPackets = c.Config.MinFECPackets
+	sdp.HDREnabled = c.hdrNegotiated()
+	sdp.ColorSpace = c.Config.ColorSpace
+	sdp.ColorRange = c.Config.ColorRange
+	if sdp.HDREnabled {
+		// HDR is encoded in Rec. 2020, limited range
+		sdp.ColorSpace = types.ColorSpaceRec2020
+		sdp.ColorRange = 0
+	}
+
+	// Older servers reject unknown attributes, so fall back to a minimal SDP
+	resp, err = c.rtspClient.DoAnnounceWithFallback(sdp)
 	if err != nil {
 		return fmt.Errorf("ANNOUNCE failed: %w", err)
 	}
@@ -319,33 +354,56 @@ func (c *Client) doRTSPHandshake() error {
 	return nil
 }
 
-// parseServerSDP extracts settings from the server's SDP response
-func (c *Client) parseServerSDP(sdp map[string]string) {
-	// Default video format
-	c.videoFormat = VideoFormatH264
+// parseServerSDP extracts settings from the server's DESCRIBE response
+func (c *Client) parseServerSDP(body string) {
+	sdp := rtsp.ParseSDP(body)
 
-	// Check for HEVC support
-	if val, ok := sdp["x-nv-video[0].hevcSupport"]; ok && val == "1" {
-		if c.Config.SupportedVideoFormats&VideoFormatH265 != 0 {
-			c.videoFormat = VideoFormatH265
-		}
+	// Sunshine leaves a codec out of DESCRIBE when its encoder can't run,
+	// whatever ServerCodecModeSupport said, so those formats are dropped
+	// before negotiating and the stream falls back to the next best one
+	wanted := c.Config.SupportedVideoFormats
+	offered := wanted
+	if !strings.Contains(body, "sprop-parameter-sets=AAAAAU") && sdp["x-nv-video[0].hevcSupport"] != "1" {
+		offered &^= VideoFormatMaskH265
+	}
+	if !strings.Contains(body, "AV1/90000") && sdp["x-nv-video[0].av1Support"] != "1" {
+		offered &^= VideoFormatMaskAV1
 	}
 
-	// Check for AV1 support
-	if val, ok := sdp["x-nv-video[0].av1Support"]; ok && val == "1" {
-		if c.Config.SupportedVideoFormats&VideoFormatAV1 != 0 {
-			c.videoFormat = VideoFormatAV1
-		}
+	// Video packets no bigger than the server takes, which the ANNOUNCE
+	// asks for and the video stream sizes its buffers by
+	if size := rtsp.NegotiatePacketSize(sdp, c.Config.PacketSize); size != c.Config.PacketSize {
+		c.log.Infof("Server supports video packets up to %d bytes, not %d", size, c.Config.PacketSize)
+		c.Config.PacketSize = size
+	}
+
+	c.featureFlags = rtsp.ServerFeatureFlags(sdp)
+
+	c.videoFormat = negotiateVideoFormat(offered, c.ServerInfo.ServerCodecModeSupport)
+	if best := negotiateVideoFormat(wanted, c.ServerInfo.ServerCodecModeSupport); c.videoFormat != best {
+		c.log.Warnf("Server doesn't offer video format 0x%x, falling back to 0x%x", int(best), int(c.videoFormat))
+	}
+	if c.Config.HDREnabled && !c.videoFormat.Is10Bit() {
+		c.log.Warnf("HDR requested but video format 0x%x isn't 10-bit, streaming SDR", int(c.videoFormat))
 	}
 
-	// Default Opus config
-	c.opusConfig = &OpusConfig{
-		SampleRate:      48000,
-		ChannelCount:    2,
-		Streams:         1,
-		CoupledStreams:  1,
-		ChannelMapping:  []uint8{0, 1},
+	// Opus layout for the channels the server will send. Without surround
+	// attributes it's what was asked for in the ANNOUNCE, stereo by default.
+	audio := c.Config.AudioConfiguration
+	channels := audio.ChannelCount()
+	if val, ok := sdp["x-nv-audio.surround.numChannels"]; ok {
+		if n, err := strconv.Atoi(val); err == nil {
+			channels = n
+		}
+	}
+	if val, ok := sdp["x-nv-audio.surround.channelMask"]; ok {
+		if mask, err := strconv.Atoi(val); err == nil && bits.OnesCount(uint(mask)) != channels {
+			c.log.Warnf("Server channel mask 0x%x doesn't match %d channels, using stereo", mask, channels)
+			channels = 2
+		}
 	}
+	highQuality := audio.IsHighQuality() || c.Config.AudioQuality == 1
+	c.opusConfig = types.SurroundOpusConfig(channels, highQuality)
 
 	// Audio packet duration (default 5ms)
 	c.audioPacketDuration = 5
@@ -358,15 +416,56 @@ func (c *Client) parseServerSDP(sdp map[string]string) {
 	c.opusConfig.SamplesPerFrame = 48 * c.audioPacketDuration
 }
 
+// videoFormatPreference orders the formats negotiateVideoFormat picks from,
+// best first: newer codecs, then 10-bit over 8-bit, then 4:4:4 over 4:2:0
+var videoFormatPreference = []VideoFormat{
+	VideoFormatAV1High10_444, VideoFormatAV1Main10, VideoFormatAV1High8_444, VideoFormatAV1Main8,
+	VideoFormatH265Rext10_444, VideoFormatH265Main10, VideoFormatH265Rext8_444, VideoFormatH265,
+	VideoFormatH264High8_444, VideoFormatH264,
+}
+
+// negotiateVideoFormat picks the best of the supported formats the server's
+// codecModes allow, or H.264 if none is left. A server that reports no codec
+// modes is assumed to encode whatever it's asked for.
+func negotiateVideoFormat(supported VideoFormat, codecModes uint32) VideoFormat {
+	if codecModes != 0 {
+		supported &= types.VideoFormatsForServerCodecModes(codecModes)
+	}
+	for _, format := range videoFormatPreference {
+		if supported&format != 0 {
+			return format
+		}
+	}
+	return VideoFormatH264
+}
+
+// hdrNegotiated reports whether HDR was asked for and the negotiated video
+// format can carry it
+func (c *Client) hdrNegotiated() bool {
+	return c.Config.HDREnabled && c.videoFormat.Is10Bit()
+}
+
 // initControlStream initializes the control stream
 func (c *Client) initControlStream() error {
 	c.controlStream = control.NewStream(c.Config, c.Listener, c.appVersion, c.isSunshine)
+	c.controlStream.SetConnectData(c.connectData)
+	c.controlStream.SetLogger(c.log)
 	return c.controlStream.Start(c.ctx, c.remoteAddr, c.controlPort)
 }
 
 // initVideoStream initializes the video stream
 func (c *Client) initVideoStream() error {
-	c.videoStream = video.NewStream(c.Config, c.Decoder, c.pingPayload)
+	// The decoder is set up for the negotiated format, not every one we'd take
+	config := c.Config
+	config.SupportedVideoFormats = c.videoFormat
+	c.videoStream = video.NewStream(config, c.Decoder, c.pingPayload)
+	c.videoStream.SetLogger(c.log)
+	c.videoStream.SetIDRRequestHandler(c.RequestIDRFrame)
+	c.videoStream.SetRefInvalidationHandler(c.invalidateReferenceFrames)
+	c.videoStream.SetFrameStatsHandler(c.updateFrameStats)
+	c.videoStream.SetTerminationHandler(func(errorCode int) {
+		c.Listener.ConnectionTerminated(errorCode, types.TerminateReasonUnknown)
+	})
 	// Bind to the same port we told the server in RTSP SETUP (client_port=47800)
 	// Using different port than server (47998) to avoid conflicts on localhost
 	localAddr := &net.UDPAddr{IP: net.IPv4zero, Port: 47800}
@@ -465,6 +564,23 @@ func (c *Client) SendScroll(amount int16) error {
 	return c.inputStream.SendScroll(amount)
 }
 
+// SendHighResScroll sends a vertical scroll in wheel units, 120 per notch
+func (c *Client) SendHighResScroll(amount int16) error {
+	if c.inputStream == nil {
+		return fmt.Errorf("not connected")
+	}
+	return c.inputStream.SendHighResScroll(amount)
+}
+
+// SendHScroll sends a horizontal scroll in wheel units, 120 per notch. Only
+// Sunshine supports it; other hosts return input.ErrUnsupported.
+func (c *Client) SendHScroll(amount int16) error {
+	if c.inputStream == nil {
+		return fmt.Errorf("not connected")
+	}
+	return c.inputStream.SendHScroll(amount)
+}
+
 // SendController sends a controller state event
 func (c *Client) SendController(buttonFlags int, leftTrigger, rightTrigger uint8,
 	leftStickX, leftStickY, rightStickX, rightStickY int16) error {
@@ -485,6 +601,61 @@ func (c *Client) SendMultiController(controllerNumber, activeGamepadMask int16,
 		leftTrigger, rightTrigger, leftStickX, leftStickY, rightStickX, rightStickY)
 }
 
+// SendControllerArrival announces a newly connected controller
+func (c *Client) SendControllerArrival(controllerNumber uint8, activeGamepadMask uint16,
+	controllerType uint8, supportedButtons uint32, capabilities uint16) error {
+	if c.inputStream == nil {
+		return fmt.Errorf("not connected")
+	}
+	return c.inputStream.SendControllerArrival(controllerNumber, activeGamepadMask,
+		controllerType, supportedButtons, capabilities)
+}
+
+// SendControllerDeparture announces that a controller was disconnected
+func (c *Client) SendControllerDeparture(controllerNumber uint8, activeGamepadMask uint16) error {
+	if c.inputStream == nil {
+		return fmt.Errorf("not connected")
+	}
+	return c.inputStream.SendControllerDeparture(controllerNumber, activeGamepadMask)
+}
+
+// SendControllerMotion sends a motion sensor sample for a controller
+func (c *Client) SendControllerMotion(controllerNumber, motionType uint8, x, y, z float32) error {
+	if c.inputStream == nil {
+		return fmt.Errorf("not connected")
+	}
+	return c.inputStream.SendControllerMotion(controllerNumber, motionType, x, y, z)
+}
+
+// SendControllerBattery reports a controller's battery state and charge
+// percentage (Sunshine only)
+func (c *Client) SendControllerBattery(controllerNumber, batteryState, percentage uint8) error {
+	if c.inputStream == nil {
+		return fmt.Errorf("not connected")
+	}
+	return c.inputStream.SendControllerBattery(controllerNumber, batteryState, percentage)
+}
+
+// SupportsPen reports whether the server takes pen input: Sunshine, when it
+// advertises pen and touch events
+func (c *Client) SupportsPen() bool {
+	return c.isSunshine && c.featureFlags&types.FFPenTouchEvents != 0
+}
+
+// SendPen sends a pen event, at a position and pressure from 0 to 1. Only
+// servers that SupportsPen take it; others return input.ErrUnsupported.
+func (c *Client) SendPen(eventType, toolType, penButtons uint8, x, y, pressure,
+	contactMajor, contactMinor float32, rotation uint16, tilt uint8) error {
+	if c.inputStream == nil {
+		return fmt.Errorf("not connected")
+	}
+	if !c.SupportsPen() {
+		return input.ErrUnsupported
+	}
+	return c.inputStream.SendPen(eventType, toolType, penButtons, x, y, pressure,
+		contactMajor, contactMinor, rotation, tilt)
+}
+
 // SendUTF8Text sends UTF-8 text input
 func (c *Client) SendUTF8Text(text string) error {
 	if c.inputStream == nil {
@@ -505,7 +676,29 @@ func (c *Client) RequestIDRFrame() {
 	}
 }
 
-// WaitForNextVideoFrame waits for and returns the next video frame
+// invalidateReferenceFrames asks the host to recover from the loss of frames
+// start through end, falling back to an IDR when it can't be asked
+func (c *Client) invalidateReferenceFrames(start, end uint32) {
+	if c.controlStream == nil {
+		return
+	}
+	if err := c.controlStream.InvalidateReferenceFrames(start, end); err != nil {
+		c.log.Warnf("Reference frame invalidation failed, requesting IDR: %v", err)
+		c.RequestIDRFrame()
+	}
+}
+
+// updateFrameStats passes the video stream's account of each frame to the
+// control stream, which tracks the connection status from it
+func (c *Client) updateFrameStats(frameIndex uint32, isGood bool) {
+	if c.controlStream == nil {
+		return
+	}
+	c.controlStream.UpdateFrameStats(frameIndex, isGood)
+}
+
+// WaitForNextVideoFrame waits for and returns the next video frame when the
+// decoder callbacks have CapabilityPullRenderer; see video.Stream.WaitForNextFrame
 func (c *Client) WaitForNextVideoFrame() (*DecodeUnit, bool) {
 	if c.videoStream == nil {
 		return nil, false
@@ -547,6 +740,26 @@ func (c *Client) GetAudioStats() RTPAudioStats {
 	return c.audioStream.GetStats()
 }
 
+// GetAudioConfig returns the Opus layout negotiated with the server, or
+// false before the server's SDP has been read
+func (c *Client) GetAudioConfig() (OpusConfig, bool) {
+	if c.opusConfig == nil {
+		return OpusConfig{}, false
+	}
+	config := *c.opusConfig
+	config.ChannelMapping = append([]uint8(nil), config.ChannelMapping...)
+	return config, true
+}
+
+// IsAudioEncrypted returns whether the audio stream decrypts its packets,
+// which is AudioEncryptionEnabled once audio has started
+func (c *Client) IsAudioEncrypted() bool {
+	if c.audioStream == nil {
+		return c.Config.AudioEncryptionEnabled
+	}
+	return c.audioStream.IsEncrypted()
+}
+
 // Control API
 
 // GetRTTInfo returns estimated round-trip time information
@@ -557,6 +770,15 @@ func (c *Client) GetRTTInfo() (RTTInfo, bool) {
 	return c.controlStream.GetRTTInfo()
 }
 
+// GetFrameLossPercent returns the share of video frames lost over the last
+// few seconds, which decides the connection status
+func (c *Client) GetFrameLossPercent() int {
+	if c.controlStream == nil {
+		return 0
+	}
+	return c.controlStream.LossPercent()
+}
+
 // IsHDREnabled returns whether HDR is currently enabled
 func (c *Client) IsHDREnabled() bool {
 	if c.controlStream == nil {
@@ -578,6 +800,59 @@ func (c *Client) GetNegotiatedVideoFormat() VideoFormat {
 	return c.videoFormat
 }
 
+// ConnectionInfo describes what was negotiated with the host. Key material
+// is deliberately left out so it can be logged or shared in bug reports.
+type ConnectionInfo struct {
+	ServerAppVersion string
+	IsSunshine       bool
+
+	VideoFormat         VideoFormat
+	Width               int
+	Height              int
+	FPS                 int
+	Bitrate             int // In Kbps
+	AudioChannels       int
+	AudioPacketDuration int // In milliseconds
+
+	RTSPPort    int
+	VideoPort   int
+	AudioPort   int
+	ControlPort int
+
+	VideoEncrypted   bool
+	AudioEncrypted   bool
+	ControlEncrypted bool
+}
+
+// GetConnectionInfo returns the negotiated stream settings
+func (c *Client) GetConnectionInfo() ConnectionInfo {
+	info := ConnectionInfo{
+		ServerAppVersion:    c.ServerInfo.ServerInfoAppVersion,
+		IsSunshine:          c.isSunshine,
+		VideoFormat:         c.videoFormat,
+		Width:               c.Config.Width,
+		Height:              c.Config.Height,
+		FPS:                 c.Config.FPS,
+		Bitrate:             c.Config.Bitrate,
+		AudioPacketDuration: c.audioPacketDuration,
+		VideoPort:           c.videoPort,
+		AudioPort:           c.audioPort,
+		ControlPort:         c.controlPort,
+		VideoEncrypted:      c.Config.EncryptionFlags&EncVideo != 0,
+		AudioEncrypted:      c.IsAudioEncrypted(),
+	}
+	if c.opusConfig != nil {
+		info.AudioChannels = c.opusConfig.ChannelCount
+	}
+	if c.remoteAddr != nil {
+		info.RTSPPort = c.remoteAddr.Port + rtspPortOffset
+	}
+	if c.controlStream != nil {
+		info.ControlEncrypted = c.controlStream.IsEncrypted()
+	}
+	return info
+}
+
 // IsConnected returns whether the client is currently connected
 func (c *Client) IsConnected() bool {
 	c.mu.Lock()
@@ -0,0 +1,78 @@
+package limelight
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/zalo/moonparty/moonlight-common-go/types"
+)
+
+func TestParseServerSDPSurround(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		asked    types.AudioConfiguration
+		sdp      string
+		channels int
+		streams  int
+		coupled  int
+	}{
+		{"stereo by default", types.AudioConfigStereo, "", 2, 1, 1},
+		{"5.1", types.AudioConfigSurround51,
+			"a=x-nv-audio.surround.numChannels:6\r\na=x-nv-audio.surround.channelMask:63\r\n", 6, 4, 2},
+		{"7.1", types.AudioConfigSurround71,
+			"a=x-nv-audio.surround.numChannels:8\r\na=x-nv-audio.surround.channelMask:1599\r\n", 8, 5, 3},
+		{"5.1 high quality", types.AudioConfigSurround51Highaudio,
+			"a=x-nv-audio.surround.numChannels:6\r\na=x-nv-audio.surround.channelMask:63\r\n", 6, 6, 0},
+		{"7.1 high quality", types.AudioConfigSurround71Highaudio,
+			"a=x-nv-audio.surround.numChannels:8\r\na=x-nv-audio.surround.channelMask:1599\r\n", 8, 8, 0},
+		{"server sends stereo for 5.1", types.AudioConfigSurround51,
+			"a=x-nv-audio.surround.numChannels:2\r\na=x-nv-audio.surround.channelMask:3\r\n", 2, 1, 1},
+		{"7.1 asked, no attributes", types.AudioConfigSurround71, "", 8, 5, 3},
+		{"mask doesn't match the count", types.AudioConfigSurround51,
+			"a=x-nv-audio.surround.numChannels:6\r\na=x-nv-audio.surround.channelMask:3\r\n", 2, 1, 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewClient(StreamConfiguration{AudioConfiguration: tt.asked}, ServerInformation{}, nil, nil, nil)
+			c.parseServerSDP("v=0\r\n" + tt.sdp)
+
+			got := c.opusConfig
+			if got.ChannelCount != tt.channels || got.Streams != tt.streams || got.CoupledStreams != tt.coupled {
+				t.Fatalf("%d channels in %d streams, %d coupled; want %d in %d, %d coupled",
+					got.ChannelCount, got.Streams, got.CoupledStreams, tt.channels, tt.streams, tt.coupled)
+			}
+
+			// Channels keep Sunshine's order, so the mapping is the identity
+			var mapping []uint8
+			for i := range tt.channels {
+				mapping = append(mapping, uint8(i))
+			}
+			if !slices.Equal(got.ChannelMapping, mapping) {
+				t.Errorf("channel mapping %v, want %v", got.ChannelMapping, mapping)
+			}
+			if got.SampleRate != 48000 || got.SamplesPerFrame != 240 {
+				t.Errorf("%d Hz with %d samples a frame, want 48000 Hz and 240 for 5ms packets",
+					got.SampleRate, got.SamplesPerFrame)
+			}
+		})
+	}
+}
+
+func TestParseServerSDPPacketSize(t *testing.T) {
+	const describe = "v=0\r\n" +
+		"a=x-ss-general.featureFlags:3\r\n" +
+		"a=x-nv-video[0].packetSize:1024\r\n"
+
+	// The video stream sizes its buffers from the negotiated size, so it's
+	// kept in the config
+	c := NewClient(StreamConfiguration{PacketSize: 1392}, ServerInformation{}, nil, nil, nil)
+	c.parseServerSDP(describe)
+	if c.Config.PacketSize != 1024 {
+		t.Errorf("packet size %d after the server advertised 1024, want 1024", c.Config.PacketSize)
+	}
+
+	c = NewClient(StreamConfiguration{PacketSize: 512}, ServerInformation{}, nil, nil, nil)
+	c.parseServerSDP(describe)
+	if c.Config.PacketSize != 512 {
+		t.Errorf("packet size %d, want the 512 asked for, within the server's 1024", c.Config.PacketSize)
+	}
+}
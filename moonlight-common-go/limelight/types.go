@@ -24,6 +24,7 @@ type (
 	HDRMetadata            = types.HDRMetadata
 	Chromaticity           = types.Chromaticity
 	OpusConfig             = types.OpusConfig
+	TerminateReason        = types.TerminateReason
 	DecodeUnit             = types.DecodeUnit
 	BufferDescriptor       = types.BufferDescriptor
 	RTPVideoStats          = types.RTPVideoStats
@@ -66,13 +67,28 @@ const (
 	ErrProtectedContent      = types.ErrProtectedContent
 	ErrFrameConversion       = types.ErrFrameConversion
 
+	// Terminate reasons
+	TerminateReasonUnknown   = types.TerminateReasonUnknown
+	TerminateReasonAppExited = types.TerminateReasonAppExited
+	TerminateReasonTimeout   = types.TerminateReasonTimeout
+	TerminateReasonTakenOver = types.TerminateReasonTakenOver
+
 	// Video formats
-	VideoFormatH264     = types.VideoFormatH264
-	VideoFormatH265     = types.VideoFormatH265
-	VideoFormatAV1      = types.VideoFormatAV1
-	VideoFormatMaskH264 = types.VideoFormatMaskH264
-	VideoFormatMaskH265 = types.VideoFormatMaskH265
-	VideoFormatMaskAV1  = types.VideoFormatMaskAV1
+	VideoFormatH264           = types.VideoFormatH264
+	VideoFormatH264High8_444  = types.VideoFormatH264High8_444
+	VideoFormatH265           = types.VideoFormatH265
+	VideoFormatH265Main10     = types.VideoFormatH265Main10
+	VideoFormatH265Rext8_444  = types.VideoFormatH265Rext8_444
+	VideoFormatH265Rext10_444 = types.VideoFormatH265Rext10_444
+	VideoFormatAV1Main8       = types.VideoFormatAV1Main8
+	VideoFormatAV1Main10      = types.VideoFormatAV1Main10
+	VideoFormatAV1High8_444   = types.VideoFormatAV1High8_444
+	VideoFormatAV1High10_444  = types.VideoFormatAV1High10_444
+	VideoFormatMaskH264       = types.VideoFormatMaskH264
+	VideoFormatMaskH265       = types.VideoFormatMaskH265
+	VideoFormatMaskAV1        = types.VideoFormatMaskAV1
+	VideoFormatMask10Bit      = types.VideoFormatMask10Bit
+	VideoFormatMaskYUV444     = types.VideoFormatMaskYUV444
 
 	// Audio config
 	AudioConfigStereo              = types.AudioConfigStereo
@@ -177,6 +193,10 @@ const (
 	CapabilityDirectSubmit = types.CapabilityDirectSubmit
 	CapabilityPullRenderer = types.CapabilityPullRenderer
 
+	// SubmitDecodeUnit results
+	DrOk      = types.DrOk
+	DrNeedIDR = types.DrNeedIDR
+
 	// Encryption
 	EncVideo     = types.EncVideo
 	EncAudio     = types.EncAudio
@@ -187,7 +207,8 @@ const (
 	FFControllerTouchEvents = types.FFControllerTouchEvents
 
 	// Frame types
-	FrameTypeUnknown = types.FrameTypeUnknown
-	FrameTypeIDR     = types.FrameTypeIDR
-	FrameTypePFrames = types.FrameTypePFrames
+	FrameTypeUnknown        = types.FrameTypeUnknown
+	FrameTypeIDR            = types.FrameTypeIDR
+	FrameTypePFrames        = types.FrameTypePFrames
+	FrameTypeRefInvalidated = types.FrameTypeRefInvalidated
 )
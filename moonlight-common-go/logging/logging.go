@@ -0,0 +1,121 @@
+// Package logging provides leveled logging for the Moonlight streaming protocol.
+package logging
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// Level is the severity of a log message
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return "info"
+	}
+}
+
+// ParseLevel parses a level name: debug, info, warn or error
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", name)
+}
+
+// Logger writes log messages at four levels. Implementations decide which
+// levels they keep.
+type Logger interface {
+	Debugf(format string, args ...any)
+	Infof(format string, args ...any)
+	Warnf(format string, args ...any)
+	Errorf(format string, args ...any)
+}
+
+// stdLogger is a Logger on a standard library logger that drops messages
+// below its level
+type stdLogger struct {
+	out   *log.Logger
+	level Level
+}
+
+// New returns a Logger writing to out the messages at level and above.
+// Messages other than info ones are tagged with their level.
+func New(out *log.Logger, level Level) Logger {
+	return &stdLogger{out: out, level: level}
+}
+
+func (l *stdLogger) Debugf(format string, args ...any) { l.logf(LevelDebug, format, args) }
+func (l *stdLogger) Infof(format string, args ...any)  { l.logf(LevelInfo, format, args) }
+func (l *stdLogger) Warnf(format string, args ...any)  { l.logf(LevelWarn, format, args) }
+func (l *stdLogger) Errorf(format string, args ...any) { l.logf(LevelError, format, args) }
+
+func (l *stdLogger) logf(level Level, format string, args []any) {
+	if level < l.level {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if level != LevelInfo {
+		msg = strings.ToUpper(level.String()) + ": " + msg
+	}
+	l.out.Print(msg)
+}
+
+// loggerBox lets a Logger of any type live in an atomic.Value
+type loggerBox struct {
+	Logger
+}
+
+var defaultLogger atomic.Value
+
+func init() {
+	defaultLogger.Store(loggerBox{New(log.Default(), LevelInfo)})
+}
+
+// Default returns the Logger that new clients and streams start with, and
+// that the package-level functions write to: the standard logger at
+// LevelInfo unless SetDefault replaced it
+func Default() Logger {
+	return defaultLogger.Load().(loggerBox).Logger
+}
+
+// SetDefault replaces the default Logger. Clients and streams created
+// earlier keep the one they started with.
+func SetDefault(l Logger) {
+	defaultLogger.Store(loggerBox{l})
+}
+
+// Debugf logs to the default Logger at LevelDebug
+func Debugf(format string, args ...any) { Default().Debugf(format, args...) }
+
+// Infof logs to the default Logger at LevelInfo
+func Infof(format string, args ...any) { Default().Infof(format, args...) }
+
+// Warnf logs to the default Logger at LevelWarn
+func Warnf(format string, args ...any) { Default().Warnf(format, args...) }
+
+// Errorf logs to the default Logger at LevelError
+func Errorf(format string, args ...any) { Default().Errorf(format, args...) }
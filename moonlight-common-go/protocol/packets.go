@@ -247,18 +247,19 @@ const (
 	ENetPacketFlagNoAllocate = 1 << 2
 )
 
-// Control stream channel IDs
+// Control stream channel IDs, laid out as Sunshine and moonlight-common-c
+// number them
 const (
-	CtrlChannelGeneric    = 0
-	CtrlChannelUrgent     = 1
-	CtrlChannelKeyboard   = 2
-	CtrlChannelMouse      = 3
-	CtrlChannelGamepadBase = 4 // Channels 4-19 for gamepads
-	CtrlChannelSensorBase = 20 // Channels 20-35 for motion sensors
-	CtrlChannelTouch      = 36
-	CtrlChannelPen        = 37
-	CtrlChannelUTF8       = 38
-	CtrlChannelCount      = 39
+	CtrlChannelGeneric     = 0x00
+	CtrlChannelUrgent      = 0x01 // IDR and reference frame invalidation requests
+	CtrlChannelKeyboard    = 0x02
+	CtrlChannelMouse       = 0x03
+	CtrlChannelPen         = 0x04
+	CtrlChannelTouch       = 0x05
+	CtrlChannelUTF8        = 0x06
+	CtrlChannelGamepadBase = 0x10 // 0x10-0x1F for controllers 0-15
+	CtrlChannelSensorBase  = 0x20 // 0x20-0x2F for controllers 0-15's motion sensors
+	CtrlChannelCount       = 0x30
 )
 
 // Control stream packet types (Gen 7 encrypted)
@@ -3,13 +3,16 @@ package rtsp
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
+
+	"github.com/zalo/moonparty/moonlight-common-go/logging"
 )
 
 const (
@@ -27,6 +30,12 @@ type Client struct {
 	sessionID  string
 	serverIP   string
 	serverPort int
+	log        logging.Logger
+
+	// persistentConn is set when the server keeps the connection open
+	// between requests, as learned from the OPTIONS response. Otherwise
+	// every request goes out on a new connection.
+	persistentConn bool
 }
 
 // Response represents an RTSP response
@@ -43,6 +52,7 @@ type StreamPorts struct {
 	AudioPort   int
 	ControlPort int
 	PingPayload string // X-SS-Ping-Payload from Sunshine
+	ConnectData uint32 // X-SS-Connect-Data from Sunshine, for the control stream's ENet connect
 }
 
 // NewClient creates a new RTSP client
@@ -53,12 +63,18 @@ func NewClient(serverIP string, serverPort int) *Client {
 	return &Client{
 		serverIP:   serverIP,
 		serverPort: serverPort,
+		log:        logging.Default(),
 	}
 }
 
+// SetLogger replaces the Logger the client writes to, logging.Default() unless set
+func (c *Client) SetLogger(l logging.Logger) {
+	c.log = l
+}
+
 // Connect establishes the RTSP connection
 func (c *Client) Connect() error {
-	addr := fmt.Sprintf("%s:%d", c.serverIP, c.serverPort)
+	addr := net.JoinHostPort(c.serverIP, strconv.Itoa(c.serverPort))
 	conn, err := net.DialTimeout("tcp", addr, TimeoutSec*time.Second)
 	if err != nil {
 		return fmt.Errorf("RTSP connect failed: %w", err)
@@ -77,9 +93,16 @@ func (c *Client) Close() {
 	}
 }
 
-// DoOptions performs the RTSP OPTIONS request
+// DoOptions performs the RTSP OPTIONS request. The response's Connection
+// header decides whether later requests reuse the connection: only an
+// explicit keep-alive does, as Sunshine closes it after each response.
 func (c *Client) DoOptions() (*Response, error) {
-	return c.doRequest("OPTIONS", "", nil, "")
+	resp, err := c.doRequest("OPTIONS", "", nil, "")
+	if err != nil {
+		return nil, err
+	}
+	c.persistentConn = strings.EqualFold(resp.Header("Connection"), "keep-alive")
+	return resp, nil
 }
 
 // DoAnnounce performs the RTSP ANNOUNCE request
@@ -91,6 +114,36 @@ func (c *Client) DoAnnounce(sdp string) (*Response, error) {
 	return c.doRequest("ANNOUNCE", "", headers, sdp)
 }
 
+// DoAnnounceWithFallback performs the ANNOUNCE, and if the server rejects
+// the SDP, retries with one more optional attribute group removed each time
+// (see SDPFallbackOrder) until it is accepted or the SDP is minimal
+func (c *Client) DoAnnounceWithFallback(b *SDPBuilder) (*Response, error) {
+	resp, err := c.DoAnnounce(b.Build())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, group := range SDPFallbackOrder {
+		if resp.StatusCode == 200 {
+			return resp, nil
+		}
+
+		c.log.Warnf("ANNOUNCE rejected (%d %s), retrying without %s",
+			resp.StatusCode, resp.StatusText, group)
+		b.Without(group)
+
+		resp, err = c.DoAnnounce(b.Build())
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == 200 {
+			c.log.Warnf("ANNOUNCE accepted without %s; the server does not support those attributes", group)
+		}
+	}
+
+	return resp, nil
+}
+
 // DoDescribe performs the RTSP DESCRIBE request
 func (c *Client) DoDescribe() (*Response, error) {
 	headers := map[string]string{
@@ -119,9 +172,9 @@ func (c *Client) DoSetup() (*StreamPorts, error) {
 		return nil, fmt.Errorf("SETUP audio failed: %d %s", resp.StatusCode, resp.StatusText)
 	}
 	// Debug: log all headers from SETUP response
-	log.Printf("SETUP audio response headers:")
+	c.log.Debugf("SETUP audio response headers:")
 	for k, v := range resp.Headers {
-		log.Printf("  %s: %s", k, v)
+		c.log.Debugf("  %s: %s", k, v)
 	}
 	// Parse session ID (format: "DEADBEEFCAFE;timeout = 90")
 	if session := resp.Headers["Session"]; session != "" && c.sessionID == "" {
@@ -132,7 +185,7 @@ func (c *Client) DoSetup() (*StreamPorts, error) {
 	for k, v := range resp.Headers {
 		if strings.EqualFold(k, "X-SS-Ping-Payload") && v != "" {
 			ports.PingPayload = v
-			log.Printf("Found ping payload in audio SETUP: %s (header name: %s)", v, k)
+			c.log.Debugf("Found ping payload in audio SETUP: %s (header name: %s)", v, k)
 			break
 		}
 	}
@@ -151,16 +204,16 @@ func (c *Client) DoSetup() (*StreamPorts, error) {
 		return nil, fmt.Errorf("SETUP video failed: %d %s", resp.StatusCode, resp.StatusText)
 	}
 	// Debug: log all headers from video SETUP response
-	log.Printf("SETUP video response headers:")
+	c.log.Debugf("SETUP video response headers:")
 	for k, v := range resp.Headers {
-		log.Printf("  %s: %s", k, v)
+		c.log.Debugf("  %s: %s", k, v)
 	}
 	// Parse X-SS-Ping-Payload from Sunshine (case-insensitive, may be in any SETUP response)
 	if ports.PingPayload == "" {
 		for k, v := range resp.Headers {
 			if strings.EqualFold(k, "X-SS-Ping-Payload") && v != "" {
 				ports.PingPayload = v
-				log.Printf("Found ping payload in video SETUP: %s (header name: %s)", v, k)
+				c.log.Debugf("Found ping payload in video SETUP: %s (header name: %s)", v, k)
 				break
 			}
 		}
@@ -180,9 +233,10 @@ func (c *Client) DoSetup() (*StreamPorts, error) {
 		return nil, fmt.Errorf("SETUP control failed: %d %s", resp.StatusCode, resp.StatusText)
 	}
 	ports.ControlPort = parseTransportPort(resp.Headers["Transport"])
+	ports.ConnectData = ParseConnectData(resp.Header("X-SS-Connect-Data"))
 
-	log.Printf("RTSP SETUP complete: VideoPort=%d AudioPort=%d ControlPort=%d PingPayload=%q (len=%d)",
-		ports.VideoPort, ports.AudioPort, ports.ControlPort, ports.PingPayload, len(ports.PingPayload))
+	c.log.Debugf("RTSP SETUP complete: VideoPort=%d AudioPort=%d ControlPort=%d PingPayload=%q (len=%d) ConnectData=%#x",
+		ports.VideoPort, ports.AudioPort, ports.ControlPort, ports.PingPayload, len(ports.PingPayload), ports.ConnectData)
 
 	return ports, nil
 }
@@ -198,18 +252,10 @@ func (c *Client) DoTeardown() (*Response, error) {
 }
 
 // doRequest performs an RTSP request and returns the response
-// NOTE: Sunshine closes the connection after each response, so we reconnect for each request
+// NOTE: Sunshine closes the connection after each response, so unless the
+// server said it keeps connections alive we reconnect for each request
 // uri should be empty for ANNOUNCE/DESCRIBE/PLAY, or "streamid=video/0/0" etc. for SETUP
 func (c *Client) doRequest(method, uri string, headers map[string]string, body string) (*Response, error) {
-	// Reconnect for each request (Sunshine closes connection after each response)
-	if c.conn != nil {
-		c.conn.Close()
-		c.conn = nil
-	}
-	if err := c.Connect(); err != nil {
-		return nil, err
-	}
-
 	c.cseq++
 
 	// Build request target
@@ -244,11 +290,38 @@ func (c *Client) doRequest(method, uri string, headers map[string]string, body s
 		req.WriteString(body)
 	}
 
+	if c.conn == nil || !c.persistentConn {
+		if err := c.reconnect(); err != nil {
+			return nil, err
+		}
+		return c.roundTrip(req.String())
+	}
+
+	resp, err := c.roundTrip(req.String())
+	if err != nil && isConnClosed(err) {
+		// The server dropped the kept-alive connection; send again on a new one
+		c.log.Debugf("RTSP connection closed by server, reconnecting for %s", method)
+		if err := c.reconnect(); err != nil {
+			return nil, err
+		}
+		return c.roundTrip(req.String())
+	}
+	return resp, err
+}
+
+// reconnect replaces the connection with a new one
+func (c *Client) reconnect() error {
+	c.Close()
+	return c.Connect()
+}
+
+// roundTrip sends a request on the current connection and reads the response
+func (c *Client) roundTrip(req string) (*Response, error) {
 	// Set timeout
 	c.conn.SetDeadline(time.Now().Add(TimeoutSec * time.Second))
 
 	// Send request
-	_, err := c.conn.Write([]byte(req.String()))
+	_, err := c.conn.Write([]byte(req))
 	if err != nil {
 		return nil, fmt.Errorf("RTSP send failed: %w", err)
 	}
@@ -257,6 +330,23 @@ func (c *Client) doRequest(method, uri string, headers map[string]string, body s
 	return c.readResponse()
 }
 
+// isConnClosed reports whether err means the peer closed the connection
+func isConnClosed(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// Header returns the named response header, matched case-insensitively
+func (r *Response) Header(name string) string {
+	for k, v := range r.Headers {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
+
 // readResponse reads and parses an RTSP response
 func (c *Client) readResponse() (*Response, error) {
 	resp := &Response{
@@ -337,47 +427,8 @@ func parseTransportPort(transport string) int {
 // BuildSDP builds an SDP offer for streaming
 func BuildSDP(clientVersion, clientWidth, clientHeight, fps, packetSize int,
 	videoFormats, audioConfig uint32, gcmSupported bool, riKeyID uint32, riKey []byte) string {
-
-	var sdp strings.Builder
-
-	sdp.WriteString("v=0\r\n")
-	sdp.WriteString("o=- 0 0 IN IP4 0.0.0.0\r\n")
-	sdp.WriteString("s=NVIDIA Streaming Client\r\n")
-
-	// Video parameters
-	sdp.WriteString(fmt.Sprintf("a=x-nv-video[0].clientViewportWd:%d\r\n", clientWidth))
-	sdp.WriteString(fmt.Sprintf("a=x-nv-video[0].clientViewportHt:%d\r\n", clientHeight))
-	sdp.WriteString(fmt.Sprintf("a=x-nv-video[0].maxFPS:%d\r\n", fps))
-	sdp.WriteString("a=x-nv-vqos[0].bw.maximumBitrateKbps:20000\r\n")
-	sdp.WriteString(fmt.Sprintf("a=x-nv-video[0].packetSize:%d\r\n", packetSize))
-	sdp.WriteString("a=x-nv-video[0].rateControlMode:4\r\n")
-	sdp.WriteString("a=x-nv-video[0].timeoutLengthMs:7000\r\n")
-	sdp.WriteString("a=x-nv-video[0].framesWithInvalidRefThreshold:0\r\n")
-	sdp.WriteString("a=x-nv-vqos[0].bitStreamFormat:0\r\n") // 0=H264, 1=HEVC
-	sdp.WriteString("a=x-nv-video[0].encoderCscMode:0\r\n")
-	sdp.WriteString("a=x-nv-video[0].maxNumReferenceFrames:1\r\n")
-	sdp.WriteString("a=x-nv-video[0].videoEncoderSlicesPerFrame:1\r\n")
-
-	// Audio parameters
-	sdp.WriteString("a=x-nv-audio.surround.numChannels:2\r\n")
-	sdp.WriteString("a=x-nv-audio.surround.channelMask:3\r\n")
-	sdp.WriteString("a=x-nv-audio.surround.enable:0\r\n")
-	sdp.WriteString("a=x-nv-audio.surround.AudioQuality:0\r\n")
-	sdp.WriteString("a=x-nv-aqos.packetDuration:5\r\n")
-
-	// General settings
-	sdp.WriteString("a=x-nv-general.useReliableUdp:1\r\n")
-	sdp.WriteString("a=x-nv-vqos[0].fec.minRequiredFecPackets:0\r\n")
-	sdp.WriteString("a=x-nv-general.featureFlags:135\r\n")
-	// ML_FF_FEC_STATUS (0x01) | ML_FF_SESSION_ID_V1 (0x02) = 3
-	sdp.WriteString("a=x-ml-general.featureFlags:3\r\n")
-	// QOS traffic types
-	sdp.WriteString("a=x-nv-vqos[0].qosTrafficType:5\r\n")
-	sdp.WriteString("a=x-nv-aqos.qosTrafficType:4\r\n")
-	// Configured bitrate (0 = use maximumBitrateKbps)
-	sdp.WriteString("a=x-ml-video.configuredBitrateKbps:0\r\n")
-
-	return sdp.String()
+	return NewSDPBuilder(clientVersion, clientWidth, clientHeight, fps, packetSize,
+		videoFormats, audioConfig, gcmSupported, riKeyID, riKey).Build()
 }
 
 // ParseSDP parses an SDP response from the server
@@ -398,3 +449,41 @@ func ParseSDP(sdp string) map[string]string {
 
 	return result
 }
+
+// ParseConnectData reads the X-SS-Connect-Data header Sunshine answers the
+// control SETUP with, a decimal or 0x-prefixed number. The client sends it in
+// the control stream's ENet connect, which tells Sunshine the session the
+// connection belongs to (ML_FF_SESSION_ID_V1). It's 0 when absent.
+func ParseConnectData(value string) uint32 {
+	n, err := strconv.ParseUint(strings.TrimSpace(value), 0, 32)
+	if err != nil {
+		return 0
+	}
+	return uint32(n)
+}
+
+// NegotiatePacketSize returns the video packet size to ask for: requested,
+// or less if the server's DESCRIBE SDP advertises a smaller size it
+// supports
+func NegotiatePacketSize(serverSDP map[string]string, requested int) int {
+	if val, ok := serverSDP["x-nv-video[0].packetSize"]; ok {
+		if max, err := strconv.Atoi(strings.TrimSpace(val)); err == nil && max > 0 && max < requested {
+			return max
+		}
+	}
+	return requested
+}
+
+// ServerFeatureFlags returns the Sunshine extensions (types.FF*) the
+// server's DESCRIBE SDP advertises, none for servers that aren't Sunshine
+func ServerFeatureFlags(serverSDP map[string]string) uint32 {
+	val, ok := serverSDP["x-ss-general.featureFlags"]
+	if !ok {
+		return 0
+	}
+	flags, err := strconv.ParseUint(strings.TrimSpace(val), 10, 32)
+	if err != nil {
+		return 0
+	}
+	return uint32(flags)
+}
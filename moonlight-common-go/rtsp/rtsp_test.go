@@ -0,0 +1,214 @@
+package rtsp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeServer answers every RTSP request with 200 OK. With keepAlive it says
+// so and keeps the connection open for up to perConn requests (0 for no
+// limit); otherwise it closes the connection after each response, as
+// Sunshine does.
+type fakeServer struct {
+	keepAlive bool
+	perConn   int
+	headers   string // Added to every response
+	conns     atomic.Int32
+	requests  atomic.Int32
+}
+
+// start listens on loopback and returns a client for the server
+func (s *fakeServer) start(t *testing.T) *Client {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.conns.Add(1)
+			go s.serve(conn)
+		}
+	}()
+
+	c := NewClient("127.0.0.1", ln.Addr().(*net.TCPAddr).Port)
+	t.Cleanup(c.Close)
+	return c
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	for served := 1; ; served++ {
+		cseq, err := readRequest(r)
+		if err != nil {
+			return
+		}
+		s.requests.Add(1)
+
+		resp := fmt.Sprintf("RTSP/1.0 200 OK\r\nCSeq: %s\r\n%s", cseq, s.headers)
+		if s.keepAlive {
+			resp += "Connection: keep-alive\r\n"
+		}
+		if _, err := io.WriteString(conn, resp+"\r\n"); err != nil {
+			return
+		}
+		if !s.keepAlive || served == s.perConn {
+			return
+		}
+	}
+}
+
+// readRequest reads a request, body and all, and returns its CSeq
+func readRequest(r *bufio.Reader) (string, error) {
+	var cseq string
+	var length int
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		key, value, _ := strings.Cut(line, ":")
+		switch strings.ToLower(key) {
+		case "cseq":
+			cseq = strings.TrimSpace(value)
+		case "content-length":
+			length, _ = strconv.Atoi(strings.TrimSpace(value))
+		}
+	}
+	_, err := io.CopyN(io.Discard, r, int64(length))
+	return cseq, err
+}
+
+// handshake sends OPTIONS and then n ANNOUNCEs, as a stream setup does
+func handshake(t *testing.T, c *Client, n int) {
+	t.Helper()
+
+	if _, err := c.DoOptions(); err != nil {
+		t.Fatalf("OPTIONS: %v", err)
+	}
+	for i := range n {
+		resp, err := c.DoAnnounce("v=0\r\n")
+		if err != nil {
+			t.Fatalf("ANNOUNCE %d: %v", i+1, err)
+		}
+		if resp.StatusCode != 200 || resp.Header("CSeq") != strconv.Itoa(i+2) {
+			t.Fatalf("ANNOUNCE %d answered %d with CSeq %s", i+1, resp.StatusCode, resp.Header("CSeq"))
+		}
+	}
+}
+
+func TestPersistentConnectionReused(t *testing.T) {
+	s := &fakeServer{keepAlive: true}
+	c := s.start(t)
+	handshake(t, c, 4)
+
+	if got := s.conns.Load(); got != 1 {
+		t.Fatalf("5 requests took %d connections to a keep-alive server, want 1", got)
+	}
+}
+
+func TestReconnectPerRequestWithoutKeepAlive(t *testing.T) {
+	s := &fakeServer{}
+	c := s.start(t)
+	handshake(t, c, 4)
+
+	if got := s.conns.Load(); got != 5 {
+		t.Fatalf("5 requests took %d connections to a server closing each, want 5", got)
+	}
+}
+
+func TestPersistentConnectionDroppedReconnects(t *testing.T) {
+	// The server kept the connection alive at first, then drops it
+	s := &fakeServer{keepAlive: true, perConn: 2}
+	c := s.start(t)
+	handshake(t, c, 4)
+
+	if got := s.requests.Load(); got != 5 {
+		t.Errorf("server answered %d requests, want 5", got)
+	}
+	if got := s.conns.Load(); got != 3 {
+		t.Fatalf("5 requests took %d connections, 2 to a connection, want 3", got)
+	}
+}
+
+// describeSDP is the body of a DESCRIBE response from a host that takes
+// video packets of at most 1024 bytes
+const describeSDP = "v=0\r\n" +
+	"o=android 0 14 IN IPv4 192.168.1.10\r\n" +
+	"s=NVIDIA Streaming Client\r\n" +
+	"a=x-ss-general.featureFlags:3\r\n" +
+	"a=x-nv-video[0].packetSize:1024\r\n" +
+	"a=fmtp:97 surround-params=21101\r\n"
+
+func TestNegotiatePacketSize(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		sdp       string
+		requested int
+		want      int
+	}{
+		{"lowered to the server's", describeSDP, 1392, 1024},
+		{"already fits", describeSDP, 512, 512},
+		{"exactly the server's", describeSDP, 1024, 1024},
+		{"nothing advertised", "v=0\r\na=x-ss-general.featureFlags:3\r\n", 1392, 1392},
+		{"not a number", "a=x-nv-video[0].packetSize:big\r\n", 1392, 1392},
+		{"zero", "a=x-nv-video[0].packetSize:0\r\n", 1392, 1392},
+		{"padded", "a=x-nv-video[0].packetSize: 800 \n", 1392, 800},
+	} {
+		if got := NegotiatePacketSize(ParseSDP(tt.sdp), tt.requested); got != tt.want {
+			t.Errorf("%s: asking for %d negotiated %d, want %d", tt.name, tt.requested, got, tt.want)
+		}
+	}
+}
+
+func TestParseConnectData(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  uint32
+	}{
+		{"3735928559", 0xdeadbeef},
+		{"0xdeadbeef", 0xdeadbeef},
+		{" 42 ", 42},
+		{"", 0},
+		{"-1", 0},
+		{"4294967296", 0},
+		{"none", 0},
+	} {
+		if got := ParseConnectData(tt.value); got != tt.want {
+			t.Errorf("ParseConnectData(%q) = %#x, want %#x", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestSetupConnectData(t *testing.T) {
+	s := &fakeServer{headers: "Transport: server_port=47999\r\nX-SS-Connect-Data: 3735928559\r\n"}
+	c := s.start(t)
+
+	ports, err := c.DoSetup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ports.ConnectData != 0xdeadbeef || ports.ControlPort != 47999 {
+		t.Fatalf("SETUP gave connect data %#x and control port %d, want 0xdeadbeef and 47999",
+			ports.ConnectData, ports.ControlPort)
+	}
+}
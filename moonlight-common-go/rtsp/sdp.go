@@ -0,0 +1,159 @@
+package rtsp
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/zalo/moonparty/moonlight-common-go/types"
+)
+
+// SDPAttrGroup is a group of optional SDP attributes that can be left out
+// of the ANNOUNCE for servers that reject attributes they don't recognize
+type SDPAttrGroup string
+
+const (
+	// SDPGroupMoonlight is the x-ml-* Moonlight extension attributes
+	SDPGroupMoonlight SDPAttrGroup = "x-ml-*"
+	// SDPGroupFeatureFlags is x-nv-general.featureFlags
+	SDPGroupFeatureFlags SDPAttrGroup = "x-nv-general.featureFlags"
+	// SDPGroupQoS is the QoS traffic type hints
+	SDPGroupQoS SDPAttrGroup = "qosTrafficType"
+)
+
+// SDPFallbackOrder is the order optional groups are dropped when an
+// ANNOUNCE is rejected, newest and least widely supported first
+var SDPFallbackOrder = []SDPAttrGroup{
+	SDPGroupMoonlight,
+	SDPGroupFeatureFlags,
+	SDPGroupQoS,
+}
+
+// SDPBuilder builds the SDP sent in the RTSP ANNOUNCE
+type SDPBuilder struct {
+	ClientVersion int
+	Width         int
+	Height        int
+	FPS           int
+	PacketSize    int
+	VideoFormats  uint32
+	AudioConfig   uint32
+	GCMSupported  bool
+	RiKeyID       uint32
+	RiKey         []byte
+	AudioQuality  int
+	// MinFECPackets is the minimum number of FEC shards the host sends per
+	// block; 0 lets it adapt to loss
+	MinFECPackets int
+
+	// HDREnabled asks for a 10-bit HDR stream
+	HDREnabled bool
+	// ColorSpace and ColorRange select the encoder's colorimetry; 0 is
+	// Rec. 601 limited range
+	ColorSpace int
+	ColorRange int
+
+	omit map[SDPAttrGroup]bool
+}
+
+// NewSDPBuilder creates a builder with every optional attribute group enabled
+func NewSDPBuilder(clientVersion, width, height, fps, packetSize int,
+	videoFormats, audioConfig uint32, gcmSupported bool, riKeyID uint32, riKey []byte) *SDPBuilder {
+	return &SDPBuilder{
+		ClientVersion: clientVersion,
+		Width:         width,
+		Height:        height,
+		FPS:           fps,
+		PacketSize:    packetSize,
+		VideoFormats:  videoFormats,
+		AudioConfig:   audioConfig,
+		GCMSupported:  gcmSupported,
+		RiKeyID:       riKeyID,
+		RiKey:         riKey,
+		omit:          make(map[SDPAttrGroup]bool),
+	}
+}
+
+// Without omits an optional attribute group
+func (b *SDPBuilder) Without(group SDPAttrGroup) *SDPBuilder {
+	b.omit[group] = true
+	return b
+}
+
+// WithFallbackMode omits every non-essential attribute, producing the
+// minimal SDP that older Sunshine and GFE versions accept
+func (b *SDPBuilder) WithFallbackMode() *SDPBuilder {
+	for _, group := range SDPFallbackOrder {
+		b.omit[group] = true
+	}
+	return b
+}
+
+// Build renders the SDP
+func (b *SDPBuilder) Build() string {
+	var sdp strings.Builder
+
+	sdp.WriteString("v=0\r\n")
+	sdp.WriteString("o=- 0 0 IN IP4 0.0.0.0\r\n")
+	sdp.WriteString("s=NVIDIA Streaming Client\r\n")
+
+	// Video parameters
+	sdp.WriteString(fmt.Sprintf("a=x-nv-video[0].clientViewportWd:%d\r\n", b.Width))
+	sdp.WriteString(fmt.Sprintf("a=x-nv-video[0].clientViewportHt:%d\r\n", b.Height))
+	sdp.WriteString(fmt.Sprintf("a=x-nv-video[0].maxFPS:%d\r\n", b.FPS))
+	sdp.WriteString("a=x-nv-vqos[0].bw.maximumBitrateKbps:20000\r\n")
+	sdp.WriteString(fmt.Sprintf("a=x-nv-video[0].packetSize:%d\r\n", b.PacketSize))
+	sdp.WriteString("a=x-nv-video[0].rateControlMode:4\r\n")
+	sdp.WriteString("a=x-nv-video[0].timeoutLengthMs:7000\r\n")
+	sdp.WriteString("a=x-nv-video[0].framesWithInvalidRefThreshold:0\r\n")
+	sdp.WriteString(fmt.Sprintf("a=x-nv-vqos[0].bitStreamFormat:%d\r\n", types.VideoFormat(b.VideoFormats).BitStreamFormat()))
+	sdp.WriteString(fmt.Sprintf("a=x-nv-video[0].encoderCscMode:%d\r\n", b.ColorSpace<<1|b.ColorRange))
+	if b.HDREnabled {
+		sdp.WriteString("a=x-nv-video[0].dynamicRangeMode:1\r\n")
+	}
+	sdp.WriteString("a=x-nv-video[0].maxNumReferenceFrames:1\r\n")
+	sdp.WriteString("a=x-nv-video[0].videoEncoderSlicesPerFrame:1\r\n")
+
+	// Audio parameters
+	sdp.WriteString(SurroundAttributes(types.AudioConfiguration(b.AudioConfig), b.AudioQuality))
+	sdp.WriteString("a=x-nv-aqos.packetDuration:5\r\n")
+
+	// General settings
+	sdp.WriteString("a=x-nv-general.useReliableUdp:1\r\n")
+	sdp.WriteString(fmt.Sprintf("a=x-nv-vqos[0].fec.minRequiredFecPackets:%d\r\n", b.MinFECPackets))
+	if !b.omit[SDPGroupFeatureFlags] {
+		sdp.WriteString("a=x-nv-general.featureFlags:135\r\n")
+	}
+	if !b.omit[SDPGroupMoonlight] {
+		// ML_FF_FEC_STATUS (0x01) | ML_FF_SESSION_ID_V1 (0x02) = 3; the
+		// session ID comes back as X-SS-Ping-Payload and X-SS-Connect-Data
+		sdp.WriteString("a=x-ml-general.featureFlags:3\r\n")
+	}
+	if !b.omit[SDPGroupQoS] {
+		// QOS traffic types
+		sdp.WriteString("a=x-nv-vqos[0].qosTrafficType:5\r\n")
+		sdp.WriteString("a=x-nv-aqos.qosTrafficType:4\r\n")
+	}
+	if !b.omit[SDPGroupMoonlight] {
+		// Configured bitrate (0 = use maximumBitrateKbps)
+		sdp.WriteString("a=x-ml-video.configuredBitrateKbps:0\r\n")
+	}
+
+	return sdp.String()
+}
+
+// SurroundAttributes renders the x-nv-audio.surround attributes requesting
+// the audio configuration. High quality configurations raise AudioQuality
+// to 1 whatever quality is asked for.
+func SurroundAttributes(audio types.AudioConfiguration, quality int) string {
+	if audio.IsHighQuality() {
+		quality = 1
+	}
+	enable := 0
+	if audio.ChannelCount() > 2 {
+		enable = 1
+	}
+	return fmt.Sprintf("a=x-nv-audio.surround.numChannels:%d\r\n", audio.ChannelCount()) +
+		fmt.Sprintf("a=x-nv-audio.surround.channelMask:%d\r\n", audio.ChannelMask()) +
+		fmt.Sprintf("a=x-nv-audio.surround.enable:%d\r\n", enable) +
+		fmt.Sprintf("a=x-nv-audio.surround.AudioQuality:%d\r\n", quality)
+}
@@ -37,30 +37,144 @@ const (
 	ConnStatusPoor
 )
 
+func (s ConnectionStatus) String() string {
+	if s == ConnStatusPoor {
+		return "poor"
+	}
+	return "okay"
+}
+
 // Error codes
 const (
-	ErrUnsupported             = -5501
-	ErrGracefulTermination     = 0
-	ErrNoVideoTraffic          = -100
-	ErrNoVideoFrame            = -101
-	ErrUnexpectedTermination   = -102
-	ErrProtectedContent        = -103
-	ErrFrameConversion         = -104
+	ErrUnsupported           = -5501
+	ErrGracefulTermination   = 0
+	ErrNoVideoTraffic        = -100
+	ErrNoVideoFrame          = -101
+	ErrUnexpectedTermination = -102
+	ErrProtectedContent      = -103
+	ErrFrameConversion       = -104
+	ErrControlDesync         = -105 // Host control messages stopped decrypting
+)
+
+// TerminateReason is why the host ended the stream, when its Termination
+// packet says
+type TerminateReason int
+
+const (
+	TerminateReasonUnknown   TerminateReason = iota // Not given, or not one we know
+	TerminateReasonAppExited                        // The app quit or the stream was ended on the host
+	TerminateReasonTimeout                          // The host stopped hearing from the client
+	TerminateReasonTakenOver                        // Another client started streaming from the host
 )
 
+func (r TerminateReason) String() string {
+	switch r {
+	case TerminateReasonAppExited:
+		return "app exited"
+	case TerminateReasonTimeout:
+		return "timed out"
+	case TerminateReasonTakenOver:
+		return "taken over by another client"
+	default:
+		return "unknown"
+	}
+}
+
 // Video formats
 type VideoFormat int
 
 const (
-	VideoFormatH264 VideoFormat = 0x0001
-	VideoFormatH265 VideoFormat = 0x0100
-	VideoFormatAV1  VideoFormat = 0x0200
+	VideoFormatH264           VideoFormat = 0x0001 // H.264 High
+	VideoFormatH264High8_444  VideoFormat = 0x0004 // H.264 High 4:4:4 8-bit
+	VideoFormatH265           VideoFormat = 0x0100 // HEVC Main
+	VideoFormatH265Main10     VideoFormat = 0x0200 // HEVC Main10
+	VideoFormatH265Rext8_444  VideoFormat = 0x0400 // HEVC RExt 4:4:4 8-bit
+	VideoFormatH265Rext10_444 VideoFormat = 0x0800 // HEVC RExt 4:4:4 10-bit
+	VideoFormatAV1Main8       VideoFormat = 0x1000 // AV1 Main 8-bit
+	VideoFormatAV1Main10      VideoFormat = 0x2000 // AV1 Main 10-bit
+	VideoFormatAV1High8_444   VideoFormat = 0x4000 // AV1 High 4:4:4 8-bit
+	VideoFormatAV1High10_444  VideoFormat = 0x8000 // AV1 High 4:4:4 10-bit
+
+	VideoFormatMaskH264   = 0x000F
+	VideoFormatMaskH265   = 0x0F00
+	VideoFormatMaskAV1    = 0xF000
+	VideoFormatMask10Bit  = 0xAA00
+	VideoFormatMaskYUV444 = 0xCC04
+)
+
+// BitStreamFormat is the x-nv-vqos[0].bitStreamFormat value requesting the
+// format: 0 for H.264, 1 for HEVC, 2 for AV1. H.264 wins when several
+// formats are set.
+func (f VideoFormat) BitStreamFormat() int {
+	switch {
+	case f&VideoFormatMaskH264 != 0:
+		return 0
+	case f&VideoFormatMaskH265 != 0:
+		return 1
+	case f&VideoFormatMaskAV1 != 0:
+		return 2
+	default:
+		return 0
+	}
+}
+
+// Is10Bit reports whether the format carries 10-bit color, as HDR needs
+func (f VideoFormat) Is10Bit() bool {
+	return f&VideoFormatMask10Bit != 0
+}
+
+// Encoder color spaces, for StreamConfiguration.ColorSpace
+const (
+	ColorSpaceRec601  = 0
+	ColorSpaceRec709  = 1
+	ColorSpaceRec2020 = 2
+)
 
-	VideoFormatMaskH264 = 0x000F
-	VideoFormatMaskH265 = 0x0F00
-	VideoFormatMaskAV1  = 0xF000
+// Server codec mode support flags, as reported in /serverinfo's
+// ServerCodecModeSupport. The AV1 and 4:4:4 flags are Sunshine extensions.
+const (
+	ServerCodecModeH264           = 0x00000001
+	ServerCodecModeHEVC           = 0x00000100
+	ServerCodecModeHEVCMain10     = 0x00000200
+	ServerCodecModeAV1Main8       = 0x00010000
+	ServerCodecModeAV1Main10      = 0x00020000
+	ServerCodecModeH264High8_444  = 0x00040000
+	ServerCodecModeHEVCRext8_444  = 0x00080000
+	ServerCodecModeHEVCRext10_444 = 0x00100000
+	ServerCodecModeAV1High8_444   = 0x00200000
+	ServerCodecModeAV1High10_444  = 0x00400000
 )
 
+// serverCodecModes maps each video format to the server flag advertising it
+var serverCodecModes = []struct {
+	format VideoFormat
+	mode   uint32
+}{
+	{VideoFormatH264, ServerCodecModeH264},
+	{VideoFormatH264High8_444, ServerCodecModeH264High8_444},
+	{VideoFormatH265, ServerCodecModeHEVC},
+	{VideoFormatH265Main10, ServerCodecModeHEVCMain10},
+	{VideoFormatH265Rext8_444, ServerCodecModeHEVCRext8_444},
+	{VideoFormatH265Rext10_444, ServerCodecModeHEVCRext10_444},
+	{VideoFormatAV1Main8, ServerCodecModeAV1Main8},
+	{VideoFormatAV1Main10, ServerCodecModeAV1Main10},
+	{VideoFormatAV1High8_444, ServerCodecModeAV1High8_444},
+	{VideoFormatAV1High10_444, ServerCodecModeAV1High10_444},
+}
+
+// VideoFormatsForServerCodecModes returns the video formats a server
+// advertising codecModes can encode. H.264 is always included, as every
+// server streams it.
+func VideoFormatsForServerCodecModes(codecModes uint32) VideoFormat {
+	formats := VideoFormatH264
+	for _, m := range serverCodecModes {
+		if codecModes&m.mode != 0 {
+			formats |= m.format
+		}
+	}
+	return formats
+}
+
 // Audio configuration
 type AudioConfiguration int
 
@@ -72,6 +186,37 @@ const (
 	AudioConfigSurround71Highaudio AudioConfiguration = 4
 )
 
+// ChannelCount is the number of audio channels in the configuration
+func (a AudioConfiguration) ChannelCount() int {
+	switch a {
+	case AudioConfigSurround51, AudioConfigSurround51Highaudio:
+		return 6
+	case AudioConfigSurround71, AudioConfigSurround71Highaudio:
+		return 8
+	default:
+		return 2
+	}
+}
+
+// ChannelMask is the speaker mask of the configuration, as Sunshine expects
+// it in the SDP
+func (a AudioConfiguration) ChannelMask() int {
+	switch a.ChannelCount() {
+	case 6:
+		return 0x3F // FL FR FC LFE BL BR
+	case 8:
+		return 0x63F // 5.1 plus SL SR
+	default:
+		return 0x3 // FL FR
+	}
+}
+
+// IsHighQuality reports whether the configuration asks for high bitrate
+// surround audio
+func (a AudioConfiguration) IsHighQuality() bool {
+	return a == AudioConfigSurround51Highaudio || a == AudioConfigSurround71Highaudio
+}
+
 // Controller types
 type ControllerType uint8
 
@@ -86,14 +231,14 @@ const (
 type ControllerCapabilities uint16
 
 const (
-	CapAnalogTriggers   ControllerCapabilities = 0x01
-	CapRumble           ControllerCapabilities = 0x02
-	CapTriggerRumble    ControllerCapabilities = 0x04
-	CapTouchpad         ControllerCapabilities = 0x08
-	CapAccelerometer    ControllerCapabilities = 0x10
-	CapGyro             ControllerCapabilities = 0x20
-	CapBattery          ControllerCapabilities = 0x40
-	CapRGB              ControllerCapabilities = 0x80
+	CapAnalogTriggers ControllerCapabilities = 0x01
+	CapRumble         ControllerCapabilities = 0x02
+	CapTriggerRumble  ControllerCapabilities = 0x04
+	CapTouchpad       ControllerCapabilities = 0x08
+	CapAccelerometer  ControllerCapabilities = 0x10
+	CapGyro           ControllerCapabilities = 0x20
+	CapBattery        ControllerCapabilities = 0x40
+	CapRGB            ControllerCapabilities = 0x80
 )
 
 // Button flags
@@ -202,9 +347,19 @@ const (
 	BatteryStateFull        BatteryState = 0x05
 )
 
+// SubmitDecodeUnit results
+const (
+	DrOk      = 0
+	DrNeedIDR = -1 // The decoder dropped the frame and needs a keyframe
+)
+
 // Decoder renderer callbacks capabilities
 const (
+	// CapabilityDirectSubmit has frames submitted from the receive goroutine
+	// as soon as they're assembled
 	CapabilityDirectSubmit = 0x01
+	// CapabilityPullRenderer has the caller pull frames with
+	// WaitForNextFrame instead of having them submitted
 	CapabilityPullRenderer = 0x02
 )
 
@@ -234,6 +389,8 @@ type StreamConfiguration struct {
 	StreamingRemotely     int
 	AudioConfiguration    AudioConfiguration
 	SupportedVideoFormats VideoFormat
+	AudioQuality          int // 0 = normal, 1 = high bitrate Opus from the host
+	MinFECPackets         int // Minimum FEC shards per block; 0 = adaptive
 
 	// Encryption keys (from pairing)
 	RemoteInputAesKey []byte // 16 bytes
@@ -249,6 +406,38 @@ type StreamConfiguration struct {
 	ClientRefreshRateCapHz int
 	EncryptionFlags        uint32
 	AudioEncryptionEnabled bool
+	AudioFECWorkers        int // Audio FEC decode goroutines (default 2)
+
+	// AudioInitialDropMs is how much audio to discard when the stream
+	// starts, so playback doesn't begin behind (default 0, for the lowest
+	// latency). The host may send a burst at first; 500 drops it and plays
+	// steadier from the start.
+	AudioInitialDropMs int
+	// AudioJitterBufferMs is how far behind the audio after it a packet may
+	// arrive and still be played in order rather than concealed (default 0:
+	// only within its FEC block of 4 packets). It's held in whole FEC
+	// blocks, and adds latency only while a packet is late.
+	AudioJitterBufferMs int
+
+	// OpusDecoder, when set, decodes queued audio to PCM for AudioCallbacks
+	// that implement PCMAudioCallbacks. Nil hands them the Opus packets, as
+	// does CapabilityDirectSubmit, which skips the queue.
+	OpusDecoder OpusDecoderFactory
+
+	// VideoQueueHighWatermark is the decode queue depth (of 16) that
+	// triggers an IDR request (default 12)
+	VideoQueueHighWatermark int
+
+	// FirstFrameTimeout is how long to wait for the first complete video
+	// frame after the stream starts (default 10s). Leave headroom for slow
+	// game launches: 5s suits a desktop on a LAN, 30s a game over the
+	// internet.
+	FirstFrameTimeout time.Duration
+	// NoVideoTrafficTimeout is how long video may go silent mid-stream
+	// before the connection is declared dead (default 10s); negative
+	// disables the check. 3-5s detects a dropped LAN host quickly, while
+	// remote links with transient outages want 15-20s.
+	NoVideoTrafficTimeout time.Duration
 }
 
 // ServerInformation contains server details
@@ -287,13 +476,41 @@ type OpusConfig struct {
 	ChannelMapping  []uint8
 }
 
+// SurroundOpusConfig returns the Opus multistream layout Sunshine encodes
+// channelCount channels with. Stereo is one coupled stream. Normal quality
+// 5.1 couples FL/FR and FC/LFE and sends the rear channels mono; 7.1 also
+// couples the rear pair and sends the sides mono. High quality sends every
+// surround channel as its own stream. Channels stay in Sunshine's order
+// (FL FR FC LFE BL BR SL SR), so the mapping is the identity. Counts other
+// than 6 and 8 get stereo.
+func SurroundOpusConfig(channelCount int, highQuality bool) *OpusConfig {
+	config := &OpusConfig{SampleRate: 48000}
+	switch channelCount {
+	case 6:
+		config.ChannelCount, config.Streams, config.CoupledStreams = 6, 4, 2
+	case 8:
+		config.ChannelCount, config.Streams, config.CoupledStreams = 8, 5, 3
+	default:
+		config.ChannelCount, config.Streams, config.CoupledStreams = 2, 1, 1
+	}
+	if highQuality && config.ChannelCount > 2 {
+		config.Streams, config.CoupledStreams = config.ChannelCount, 0
+	}
+
+	config.ChannelMapping = make([]uint8, config.ChannelCount)
+	for i := range config.ChannelMapping {
+		config.ChannelMapping[i] = uint8(i)
+	}
+	return config
+}
+
 // DecodeUnit represents a video decode unit
 type DecodeUnit struct {
 	BufferList         []BufferDescriptor
 	FrameNumber        uint32
 	FrameType          FrameType
-	PresentationTimeMs uint64
-	EnqueueTimeMs      uint64
+	PresentationTimeMs uint64 // From the RTP timestamp, relative to the first frame
+	EnqueueTimeMs      uint64 // Unix time the frame's first packet was received
 }
 
 // BufferDescriptor describes a buffer in a decode unit
@@ -307,20 +524,28 @@ type BufferDescriptor struct {
 type FrameType int
 
 const (
-	FrameTypeUnknown FrameType = iota
-	FrameTypeIDR               // Keyframe
-	FrameTypePFrames           // P-frames only
+	FrameTypeUnknown        FrameType = iota
+	FrameTypeIDR                      // Keyframe
+	FrameTypePFrames                  // P-frames only
+	FrameTypeRefInvalidated           // P-frame sent after reference frame invalidation
 )
 
 // RTPVideoStats contains video stream statistics
 type RTPVideoStats struct {
-	ReceivedPackets      uint32
-	DroppedPackets       uint32
-	RecoveredPackets     uint32
-	TotalFrames          uint32
-	ReceivedFrames       uint32
-	DroppedFrames        uint32
-	RequestedIDRFrames   uint32
+	ReceivedPackets    uint32
+	DroppedPackets     uint32
+	RecoveredPackets   uint32
+	DuplicatePackets   uint32
+	OutOfOrderPackets  uint32 // Arrived after a packet sent later
+	TotalFrames        uint32
+	ReceivedFrames     uint32
+	DroppedFrames      uint32
+	RequestedIDRFrames uint32
+
+	// Reference frame invalidations sent instead of IDR requests, and the
+	// number of frames they covered
+	RefInvalidationRequests uint32
+	InvalidatedFrames       uint32
 
 	SubmittedFrames      uint32
 	NetworkDroppedFrames uint32
@@ -405,6 +630,38 @@ type AudioCallbacks interface {
 	Capabilities() int
 }
 
+// OpusDecoder turns Opus packets into interleaved 16-bit PCM
+type OpusDecoder interface {
+	// Decode decodes one packet into pcm, returning the number of samples
+	// decoded per channel. A nil packet asks for a lost packet to be
+	// concealed.
+	Decode(packet []byte, pcm []int16) (int, error)
+
+	// Close releases the decoder
+	Close() error
+}
+
+// OpusDecoderFactory creates a decoder for the negotiated stream layout:
+// sample rate, channels, coupled streams and channel mapping
+type OpusDecoderFactory func(config *OpusConfig) (OpusDecoder, error)
+
+// PCMAudioCallbacks is implemented by AudioCallbacks that play decoded audio
+// when the stream has an OpusDecoder
+type PCMAudioCallbacks interface {
+	// PlayDecodedSample plays interleaved PCM at the Opus config's sample
+	// rate and channel count. pcm is reused once the call returns.
+	PlayDecodedSample(pcm []int16)
+}
+
+// DualSense adaptive trigger event flags
+const (
+	AdaptiveTriggerRight = 0x04
+	AdaptiveTriggerLeft  = 0x08
+)
+
+// AdaptiveTriggerPayloadSize is the size of each trigger's effect parameter block
+const AdaptiveTriggerPayloadSize = 10
+
 // ConnectionCallbacks interface for connection event handling
 type ConnectionCallbacks interface {
 	// StageStarting is called when a connection stage begins
@@ -419,8 +676,9 @@ type ConnectionCallbacks interface {
 	// ConnectionStarted is called when streaming begins
 	ConnectionStarted()
 
-	// ConnectionTerminated is called when the connection ends
-	ConnectionTerminated(errorCode int)
+	// ConnectionTerminated is called when the connection ends, with the
+	// host's reason if it gave one
+	ConnectionTerminated(errorCode int, reason TerminateReason)
 
 	// ConnectionStatusUpdate reports connection quality changes
 	ConnectionStatusUpdate(status ConnectionStatus)
@@ -439,4 +697,28 @@ type ConnectionCallbacks interface {
 
 	// SetControllerLED sets controller LED color
 	SetControllerLED(controllerNumber uint16, r, g, b uint8)
+
+	// SetAdaptiveTriggers sets DualSense adaptive trigger effects.
+	// eventFlags says which triggers to update (AdaptiveTriggerLeft/Right);
+	// left and right are the raw effect parameter blocks for each trigger.
+	SetAdaptiveTriggers(controllerNumber uint16, eventFlags, typeLeft, typeRight uint8, left, right []byte)
 }
+
+// NopConnectionCallbacks implements ConnectionCallbacks with methods that do
+// nothing. Embed it to implement only the callbacks you need.
+type NopConnectionCallbacks struct{}
+
+func (NopConnectionCallbacks) StageStarting(Stage)                                             {}
+func (NopConnectionCallbacks) StageComplete(Stage)                                             {}
+func (NopConnectionCallbacks) StageFailed(Stage, error)                                        {}
+func (NopConnectionCallbacks) ConnectionStarted()                                              {}
+func (NopConnectionCallbacks) ConnectionTerminated(int, TerminateReason)                       {}
+func (NopConnectionCallbacks) ConnectionStatusUpdate(ConnectionStatus)                         {}
+func (NopConnectionCallbacks) SetHDRMode(bool)                                                 {}
+func (NopConnectionCallbacks) Rumble(uint16, uint16, uint16)                                   {}
+func (NopConnectionCallbacks) RumbleTriggers(uint16, uint16, uint16)                           {}
+func (NopConnectionCallbacks) SetMotionEventState(uint16, MotionType, uint16)                  {}
+func (NopConnectionCallbacks) SetControllerLED(uint16, uint8, uint8, uint8)                    {}
+func (NopConnectionCallbacks) SetAdaptiveTriggers(uint16, uint8, uint8, uint8, []byte, []byte) {}
+
+var _ ConnectionCallbacks = NopConnectionCallbacks{}
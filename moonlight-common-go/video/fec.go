@@ -0,0 +1,172 @@
+package video
+
+import (
+	"time"
+
+	"github.com/zalo/moonparty/moonlight-common-go/fec"
+)
+
+// Sunshine sends each frame as up to four FEC blocks. Every packet's NV
+// header says which block it belongs to and, in fecInfo, its shard index
+// within the block, the block's data shard count and the parity percentage.
+// Data shards come first; Reed-Solomon parity shards over the data after the
+// NV header follow them.
+const maxFECBlocks = 4
+
+// fecShardIndex returns a packet's shard index within its FEC block
+func fecShardIndex(fecInfo uint32) int {
+	return int(fecInfo>>12) & 0x3FF
+}
+
+// fecDataShards returns the number of data shards in a packet's FEC block
+func fecDataShards(fecInfo uint32) int {
+	return int(fecInfo >> 22)
+}
+
+// fecParityShards returns the number of parity shards Sunshine sends for a
+// block, derived from its percentage the way the host rounds it
+func fecParityShards(fecInfo uint32, dataShards int) int {
+	percentage := int(fecInfo>>4) & 0xFF
+	return (dataShards*percentage + 99) / 100
+}
+
+// fecBlockNumber returns which FEC block of the frame a packet belongs to,
+// and the number of the frame's last block
+func fecBlockNumber(multiFecBlocks uint8) (block, last int) {
+	return int(multiFecBlocks>>4) & 0x3, int(multiFecBlocks>>6) & 0x3
+}
+
+// fecBlock collects the shards of one FEC block of a frame
+type fecBlock struct {
+	dataShards   int
+	parityShards int
+	packets      []*RTPPacket // By shard index, nil until received
+	received     int
+}
+
+// missingData returns how many of the block's data shards haven't arrived
+func (b *fecBlock) missingData() int {
+	missing := 0
+	for _, p := range b.packets[:b.dataShards] {
+		if p == nil {
+			missing++
+		}
+	}
+	return missing
+}
+
+// addShard files a packet, its Payload already past the NV header, under its
+// FEC block. It returns false for packets that don't fit the frame's layout
+// or were already received.
+func (f *FrameAssembly) addShard(hdr nvVideoHeader, packet *RTPPacket) bool {
+	dataShards := fecDataShards(hdr.FecInfo)
+	if dataShards == 0 {
+		return false
+	}
+	blockNum, lastBlock := fecBlockNumber(hdr.MultiFecBlocks)
+
+	b := f.blocks[blockNum]
+	if b == nil {
+		parity := fecParityShards(hdr.FecInfo, dataShards)
+		if dataShards+parity > fec.DataShardsMax {
+			return false
+		}
+		b = &fecBlock{
+			dataShards:   dataShards,
+			parityShards: parity,
+			packets:      make([]*RTPPacket, dataShards+parity),
+		}
+		f.blocks[blockNum] = b
+	}
+	f.lastBlock = max(f.lastBlock, lastBlock)
+
+	index := fecShardIndex(hdr.FecInfo)
+	if index >= len(b.packets) || b.packets[index] != nil {
+		return false
+	}
+	b.packets[index] = packet
+	b.received++
+
+	f.ReceivedPackets++
+	f.DataSize += len(packet.Payload)
+	return true
+}
+
+// recoverable reports whether every block of the frame has received enough
+// shards to rebuild its data
+func (f *FrameAssembly) recoverable() bool {
+	for _, b := range f.blocks[:f.lastBlock+1] {
+		if b == nil || b.received < b.dataShards {
+			return false
+		}
+	}
+	return true
+}
+
+// missingData returns how many data shards of the frame's known blocks
+// haven't arrived
+func (f *FrameAssembly) missingData() int {
+	missing := 0
+	for _, b := range f.blocks[:f.lastBlock+1] {
+		if b != nil {
+			missing += b.missingData()
+		}
+	}
+	return missing
+}
+
+// recoverBlockLocked returns a block's data shards in order, rebuilding any
+// that were lost from the parity shards. Called with the depacketizer lock
+// held, which also guards the codec.
+func (s *Stream) recoverBlockLocked(frameIndex uint32, b *fecBlock) ([]*RTPPacket, error) {
+	missing := b.missingData()
+	if missing == 0 {
+		return b.packets[:b.dataShards], nil
+	}
+
+	if s.fecCodec == nil || s.fecCodec.DataShards() != b.dataShards || s.fecCodec.ParityShards() != b.parityShards {
+		rs, err := fec.New(b.dataShards, b.parityShards)
+		if err != nil {
+			return nil, err
+		}
+		s.fecCodec = rs
+	}
+
+	// Shards are coded at one size; a short last data shard is zero padded
+	size := 0
+	for _, p := range b.packets {
+		if p != nil {
+			size = max(size, len(p.Payload))
+		}
+	}
+	shards := make([][]byte, len(b.packets))
+	present := make([]bool, len(b.packets))
+	for i, p := range b.packets {
+		if p == nil {
+			continue
+		}
+		shards[i] = p.Payload
+		if len(p.Payload) < size {
+			shards[i] = make([]byte, size)
+			copy(shards[i], p.Payload)
+		}
+		present[i] = true
+	}
+	if err := s.fecCodec.Reconstruct(shards, present, nil); err != nil {
+		return nil, err
+	}
+
+	packets := make([]*RTPPacket, b.dataShards)
+	now := time.Now()
+	for i := range packets {
+		packets[i] = b.packets[i]
+		if packets[i] == nil {
+			packets[i] = &RTPPacket{Payload: shards[i], RecvTime: now, FrameIndex: frameIndex}
+		}
+	}
+
+	s.queue.mu.Lock()
+	s.queue.stats.RecoveredPackets += uint32(missing)
+	s.queue.mu.Unlock()
+	return packets, nil
+}
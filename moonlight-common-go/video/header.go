@@ -0,0 +1,127 @@
+package video
+
+import (
+	"encoding/binary"
+
+	"github.com/zalo/moonparty/moonlight-common-go/types"
+)
+
+// NV_VIDEO_PACKET, the header in front of every video RTP payload
+const (
+	nvVideoPacketSize = 16
+
+	// Flags in NV_VIDEO_PACKET
+	FlagContainsPicData = 0x1
+	FlagEOF             = 0x2
+	FlagSOF             = 0x4
+)
+
+// Frame header at the start of a frame's first packet
+const (
+	// Sunshine's short header: type 0x01, latency, frame type, last payload length
+	frameHeaderShort     = 0x01
+	frameHeaderShortSize = 8
+	frameHeaderTypeIndex = 3
+
+	// GFE's long header carries no frame type
+	frameHeaderLong     = 0x81
+	frameHeaderLongSize = 41
+)
+
+// Frame types in Sunshine's short frame header
+const (
+	ssFrameTypePFrame       = 1
+	ssFrameTypeIDR          = 2
+	ssFrameTypeIntraRefresh = 4
+	ssFrameTypeRefInvalid   = 5
+)
+
+// nvVideoHeader is the parsed NV_VIDEO_PACKET
+type nvVideoHeader struct {
+	StreamPacketIndex uint32
+	FrameIndex        uint32
+	Flags             uint8
+	MultiFecFlags     uint8
+	MultiFecBlocks    uint8
+	FecInfo           uint32
+}
+
+// parseNVVideoHeader splits an RTP payload into its NV header and the data after it
+func parseNVVideoHeader(payload []byte) (nvVideoHeader, []byte, bool) {
+	if len(payload) < nvVideoPacketSize {
+		return nvVideoHeader{}, nil, false
+	}
+
+	return nvVideoHeader{
+		StreamPacketIndex: binary.LittleEndian.Uint32(payload[0:4]),
+		FrameIndex:        binary.LittleEndian.Uint32(payload[4:8]),
+		Flags:             payload[8],
+		MultiFecFlags:     payload[10],
+		MultiFecBlocks:    payload[11],
+		FecInfo:           binary.LittleEndian.Uint32(payload[12:16]),
+	}, payload[nvVideoPacketSize:], true
+}
+
+// parseFrameHeader reads the frame header from a frame's first packet and
+// returns the frame type along with the bitstream that follows it. Sunshine
+// states the type explicitly; for other hosts it is inferred from the first
+// NAL unit.
+func parseFrameHeader(data []byte) (types.FrameType, []byte) {
+	if len(data) == 0 {
+		return types.FrameTypeUnknown, data
+	}
+
+	switch data[0] {
+	case frameHeaderShort:
+		if len(data) < frameHeaderShortSize {
+			return types.FrameTypeUnknown, nil
+		}
+		return sunshineFrameType(data[frameHeaderTypeIndex]), data[frameHeaderShortSize:]
+	case frameHeaderLong:
+		if len(data) < frameHeaderLongSize {
+			return types.FrameTypeUnknown, nil
+		}
+		data = data[frameHeaderLongSize:]
+	}
+
+	if isKeyframeNAL(data) {
+		return types.FrameTypeIDR, data
+	}
+	return types.FrameTypePFrames, data
+}
+
+// sunshineFrameType maps a Sunshine frame header type to a FrameType
+func sunshineFrameType(t byte) types.FrameType {
+	switch t {
+	case ssFrameTypeIDR:
+		return types.FrameTypeIDR
+	case ssFrameTypeRefInvalid:
+		return types.FrameTypeRefInvalidated
+	case ssFrameTypePFrame, ssFrameTypeIntraRefresh:
+		return types.FrameTypePFrames
+	default:
+		return types.FrameTypeUnknown
+	}
+}
+
+// isKeyframeNAL reports whether the bitstream starts with a parameter set or
+// IDR slice (H.264 SPS/IDR or HEVC VPS/SPS/PPS/IDR)
+func isKeyframeNAL(data []byte) bool {
+	var nal byte
+	switch {
+	case len(data) >= 5 && data[0] == 0 && data[1] == 0 && data[2] == 0 && data[3] == 1:
+		nal = data[4]
+	case len(data) >= 4 && data[0] == 0 && data[1] == 0 && data[2] == 1:
+		nal = data[3]
+	default:
+		return false
+	}
+
+	switch nal {
+	case 0x67, 0x65: // H.264 SPS, IDR slice
+		return true
+	case 0x40, 0x42, 0x44, 0x26, 0x28: // HEVC VPS, SPS, PPS, IDR_W_RADL, IDR_N_LP
+		return true
+	}
+	return false
+}
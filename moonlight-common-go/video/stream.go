@@ -4,13 +4,13 @@ package video
 import (
 	"context"
 	"encoding/binary"
-	"log"
 	"net"
 	"sync"
 	"time"
 
 	"github.com/zalo/moonparty/moonlight-common-go/crypto"
 	"github.com/zalo/moonparty/moonlight-common-go/fec"
+	"github.com/zalo/moonparty/moonlight-common-go/logging"
 	"github.com/zalo/moonparty/moonlight-common-go/protocol"
 	"github.com/zalo/moonparty/moonlight-common-go/types"
 )
@@ -20,10 +20,26 @@ const (
 	RTPQueueDelay = 10 * time.Millisecond
 	// RTPRecvPacketsBuffered is the desired socket buffer size in packets
 	RTPRecvPacketsBuffered = 2048
-	// FirstFrameTimeoutSec is the timeout for receiving the first frame
-	FirstFrameTimeoutSec = 10
+	// DefaultFirstFrameTimeout is the timeout for receiving the first frame
+	DefaultFirstFrameTimeout = 10 * time.Second
+	// DefaultNoVideoTrafficTimeout is how long video may go silent once
+	// streaming before the connection is considered lost
+	DefaultNoVideoTrafficTimeout = 10 * time.Second
 	// UDPRecvPollTimeout is the receive timeout
 	UDPRecvPollTimeout = 100 * time.Millisecond
+	// FrameQueueSize is the capacity of the decode queue
+	FrameQueueSize = 16
+	// DefaultQueueHighWatermark is the queue depth that triggers an IDR request
+	DefaultQueueHighWatermark = 12
+	// QueueLowWatermark is the depth the queue must drain below before the
+	// high watermark can trigger again
+	QueueLowWatermark = 4
+	// MaxRefInvalidationFrames is the longest run of lost frames recovered by
+	// invalidating reference frames; longer losses request a full IDR
+	MaxRefInvalidationFrames = 16
+	// RefInvalidationTimeout is how long to wait for the host's recovery frame
+	// after invalidating reference frames before falling back to an IDR
+	RefInvalidationTimeout = 500 * time.Millisecond
 )
 
 // Stream manages video RTP reception
@@ -33,6 +49,7 @@ type Stream struct {
 	// Configuration
 	config    types.StreamConfiguration
 	callbacks types.DecoderCallbacks
+	log       logging.Logger
 
 	// Networking
 	conn       *net.UDPConn
@@ -40,7 +57,7 @@ type Stream struct {
 	localAddr  *net.UDPAddr
 
 	// RTP state
-	queue       *RTPQueue
+	queue        *RTPQueue
 	depacketizer *Depacketizer
 
 	// FEC
@@ -54,10 +71,21 @@ type Stream struct {
 	pingPayload [16]byte
 	pingSeqNum  uint32
 
+	// Decode queue backpressure
+	highWatermark     int
+	onIDRRequest      func()
+	onRefInvalidation func(start, end uint32)
+	onTerminated      func(errorCode int)
+	onFrameStats      func(frameIndex uint32, isGood bool)
+
+	// Timeouts
+	firstFrameTimeout time.Duration
+	noTrafficTimeout  time.Duration
+
 	// Threads
-	ctx       context.Context
-	cancel    context.CancelFunc
-	wg        sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
 
 	// State
 	receivedData      bool
@@ -73,12 +101,137 @@ type RTPQueue struct {
 	mu sync.Mutex
 
 	currentFrameNumber uint32
-	packets            map[uint16]*RTPPacket
-	lastSeq            uint16
+
+	// Packets that arrived ahead of a gap, by sequence number, waiting for
+	// it to fill or for RTPQueueDelay to pass
+	packets    map[uint16]*RTPPacket
+	nextSeq    uint16 // Next sequence number to pass on
+	highestSeq uint16 // Latest sequence number to arrive
+	haveSeq    bool   // Whether nextSeq is set, i.e. a packet has arrived
+
+	// Recently seen sequence numbers, indexed by seq % recentSeqWindow.
+	// Consecutive sequence numbers land in distinct slots, so this remembers
+	// exactly the last recentSeqWindow packets without any allocation.
+	recentSeqs  [recentSeqWindow]uint16
+	recentValid [recentSeqWindow]bool
 
 	stats types.RTPVideoStats
 }
 
+// recentSeqWindow is how many recent sequence numbers are checked for duplicates
+const recentSeqWindow = 256
+
+// isDuplicate reports whether seq was already seen within the recent window
+// and records it otherwise. Retransmitted copies (e.g. from NACK) would
+// otherwise be appended to the frame twice and corrupt the bitstream.
+func (q *RTPQueue) isDuplicate(seq uint16) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	idx := seq % recentSeqWindow
+	if q.recentValid[idx] && q.recentSeqs[idx] == seq {
+		q.stats.DuplicatePackets++
+		return true
+	}
+
+	q.recentSeqs[idx] = seq
+	q.recentValid[idx] = true
+	return false
+}
+
+// maxQueuedPackets bounds how many packets wait behind a gap; beyond it the
+// gap is given up on at once
+const maxQueuedPackets = 512
+
+// push queues a packet and returns the packets now ready, in sequence
+// order. A packet from behind the next expected one arrived after its gap
+// was given up on; it's passed straight on, since its frame may still be
+// assembling.
+func (q *RTPQueue) push(packet *RTPPacket) []*RTPPacket {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	seq := packet.Header.SequenceNumber
+	if !q.haveSeq {
+		q.nextSeq = seq
+		q.highestSeq = seq
+		q.haveSeq = true
+	}
+	if int16(seq-q.highestSeq) < 0 {
+		q.stats.OutOfOrderPackets++
+	} else {
+		q.highestSeq = seq
+	}
+	if int16(seq-q.nextSeq) < 0 {
+		return []*RTPPacket{packet}
+	}
+
+	q.packets[seq] = packet
+	if len(q.packets) > maxQueuedPackets {
+		first, _ := q.gapLocked()
+		q.nextSeq = first
+	}
+	return q.drainLocked(packet.RecvTime)
+}
+
+// flush returns the packets released by gaps that have now waited longer
+// than RTPQueueDelay
+func (q *RTPQueue) flush(now time.Time) []*RTPPacket {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.drainLocked(now)
+}
+
+// wait returns how long until the oldest queued packet's gap times out, or
+// UDPRecvPollTimeout if nothing is queued
+func (q *RTPQueue) wait(now time.Time) time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.packets) == 0 {
+		return UDPRecvPollTimeout
+	}
+	_, oldest := q.gapLocked()
+	return min(max(oldest.Add(RTPQueueDelay).Sub(now), time.Millisecond), UDPRecvPollTimeout)
+}
+
+// drainLocked removes the packets that can be passed on in order. A gap
+// that has held packets back for RTPQueueDelay is taken as lost and skipped.
+func (q *RTPQueue) drainLocked(now time.Time) []*RTPPacket {
+	var ready []*RTPPacket
+	for len(q.packets) > 0 {
+		if p, ok := q.packets[q.nextSeq]; ok {
+			delete(q.packets, q.nextSeq)
+			q.nextSeq++
+			ready = append(ready, p)
+			continue
+		}
+
+		first, oldest := q.gapLocked()
+		if now.Sub(oldest) < RTPQueueDelay {
+			break
+		}
+		q.nextSeq = first
+	}
+	return ready
+}
+
+// gapLocked returns the first queued sequence number after nextSeq and when
+// the longest-waiting queued packet arrived
+func (q *RTPQueue) gapLocked() (first uint16, oldest time.Time) {
+	distance := -1
+	for seq, p := range q.packets {
+		if d := int(seq - q.nextSeq); distance < 0 || d < distance {
+			distance = d
+			first = seq
+		}
+		if oldest.IsZero() || p.RecvTime.Before(oldest) {
+			oldest = p.RecvTime
+		}
+	}
+	return first, oldest
+}
+
 // RTPPacket represents a received RTP packet
 type RTPPacket struct {
 	Header     protocol.RTPHeader
@@ -92,12 +245,51 @@ type RTPPacket struct {
 type Depacketizer struct {
 	mu sync.Mutex
 
-	currentFrame     *FrameAssembly
-	frameQueue       chan *types.DecodeUnit
-	packetSize       int
+	// Frames being assembled, oldest first; see drainFramesLocked
+	frames     []*FrameAssembly
+	frameQueue chan *types.DecodeUnit
+	packetSize int
+
+	nextFrameNumber uint32
+	haveFrameNumber bool
+	waitingForIDR   bool
+
+	// Dropping frames until the host's recovery frame after a reference
+	// frame invalidation; refInvalStart is the first frame invalidated
+	waitingForRefInval bool
+	refInvalStart      uint32
+	refInvalDeadline   time.Time
+
+	// Set once the queue crosses the high watermark, cleared below the low one
+	highWatermarkTriggered bool
+
+	// RTP timestamp tracking for presentation times. ptsTicks extends the
+	// 32-bit timestamp across wraparound, relative to the first frame.
+	timestampStarted bool
+	lastTimestamp    uint32
+	ptsTicks         int64
+}
+
+// rtpClockRateKHz is the video RTP clock (90 kHz) in ticks per millisecond
+const rtpClockRateKHz = 90
+
+// presentationTimeMs converts a frame's RTP timestamp to milliseconds since
+// the first frame of the stream. Called with the lock held, in frame order.
+func (d *Depacketizer) presentationTimeMs(timestamp uint32) uint64 {
+	if !d.timestampStarted {
+		d.timestampStarted = true
+		d.lastTimestamp = timestamp
+		return 0
+	}
+
+	// Signed difference handles wraparound and slightly reordered frames
+	d.ptsTicks += int64(int32(timestamp - d.lastTimestamp))
+	d.lastTimestamp = timestamp
 
-	nextFrameNumber  uint32
-	waitingForIDR    bool
+	if d.ptsTicks < 0 {
+		return 0
+	}
+	return uint64(d.ptsTicks / rtpClockRateKHz)
 }
 
 // FrameAssembly tracks the assembly of a video frame
@@ -108,7 +300,22 @@ type FrameAssembly struct {
 	ReceivedPackets int
 	Packets         []*RTPPacket
 	DataSize        int
-	StartTime       time.Time
+	StartTime       time.Time // Receive time of the frame's first packet
+	RTPTimestamp    uint32
+
+	// Shards by FEC block; lastBlock is the frame's last block number
+	blocks    [maxFECBlocks]*fecBlock
+	lastBlock int
+
+	// Set once every block has enough shards to be rebuilt
+	complete bool
+
+	// Frames lossStart through lossEnd before this one never arrived. The
+	// loss is reported once this frame's type is known, as a keyframe
+	// needs nothing before it.
+	lossPending bool
+	lossStart   uint32
+	lossEnd     uint32
 }
 
 // NewStream creates a new video stream handler
@@ -117,19 +324,65 @@ func NewStream(config types.StreamConfiguration, callbacks types.DecoderCallback
 	s := &Stream{
 		config:    config,
 		callbacks: callbacks,
+		log:       logging.Default(),
 		encrypted: (config.EncryptionFlags & types.EncVideo) != 0,
 		aesKey:    config.RemoteInputAesKey,
+
+		highWatermark: config.VideoQueueHighWatermark,
+
+		firstFrameTimeout: config.FirstFrameTimeout,
+		noTrafficTimeout:  config.NoVideoTrafficTimeout,
+	}
+	if s.highWatermark <= 0 || s.highWatermark >= FrameQueueSize {
+		s.highWatermark = DefaultQueueHighWatermark
+	}
+	if s.firstFrameTimeout <= 0 {
+		s.firstFrameTimeout = DefaultFirstFrameTimeout
+	}
+	if s.noTrafficTimeout == 0 {
+		s.noTrafficTimeout = DefaultNoVideoTrafficTimeout
 	}
 	// Copy ping payload (X-SS-Ping-Payload is a 16-char hex string sent as ASCII)
 	if len(pingPayload) == 16 {
 		copy(s.pingPayload[:], []byte(pingPayload))
-		log.Printf("Video stream using ping payload: %s (len=%d)", pingPayload, len(pingPayload))
+		s.log.Debugf("Video stream using ping payload: %s (len=%d)", pingPayload, len(pingPayload))
 	} else {
-		log.Printf("Warning: Video stream ping payload empty or invalid length: %d", len(pingPayload))
+		s.log.Warnf("Video stream ping payload empty or invalid length: %d", len(pingPayload))
 	}
 	return s
 }
 
+// SetLogger replaces the Logger the stream writes to, logging.Default() unless set
+func (s *Stream) SetLogger(l logging.Logger) {
+	s.log = l
+}
+
+// SetIDRRequestHandler sets the function that asks the host for a keyframe.
+// The stream calls it when the decode queue backs up.
+func (s *Stream) SetIDRRequestHandler(fn func()) {
+	s.onIDRRequest = fn
+}
+
+// SetRefInvalidationHandler sets the function that asks the host to stop
+// referencing frames start through end. The stream calls it for short
+// network losses; without a handler every loss requests an IDR.
+func (s *Stream) SetRefInvalidationHandler(fn func(start, end uint32)) {
+	s.onRefInvalidation = fn
+}
+
+// SetTerminationHandler sets the function told why the stream gave up, with
+// one of the types.Err* codes, when video never arrives or stops arriving
+func (s *Stream) SetTerminationHandler(fn func(errorCode int)) {
+	s.onTerminated = fn
+}
+
+// SetFrameStatsHandler sets the function told how each frame fared: that it
+// arrived intact, or was lost if isGood is false. The stream calls it with
+// its lock held, so it mustn't block.
+func (s *Stream) SetFrameStatsHandler(fn func(frameIndex uint32, isGood bool)) {
+	s.onFrameStats = fn
+}
+
 // Start begins video stream reception
 func (s *Stream) Start(ctx context.Context, remoteAddr, localAddr *net.UDPAddr, videoPort int) error {
 	s.ctx, s.cancel = context.WithCancel(ctx)
@@ -159,7 +412,7 @@ func (s *Stream) Start(ctx context.Context, remoteAddr, localAddr *net.UDPAddr,
 
 	s.depacketizer = &Depacketizer{
 		packetSize:    s.config.PacketSize,
-		frameQueue:    make(chan *types.DecodeUnit, 16),
+		frameQueue:    make(chan *types.DecodeUnit, FrameQueueSize),
 		waitingForIDR: true,
 	}
 
@@ -175,8 +428,8 @@ func (s *Stream) Start(ctx context.Context, remoteAddr, localAddr *net.UDPAddr,
 	go s.receiveLoop()
 	go s.pingLoop()
 
-	// Start decoder thread if not direct submit
-	if s.callbacks.Capabilities()&(types.CapabilityDirectSubmit|types.CapabilityPullRenderer) == 0 {
+	// Start decoder thread unless frames are submitted directly or pulled
+	if s.callbacks.Capabilities()&types.CapabilityDirectSubmit == 0 && !s.pullMode() {
 		s.wg.Add(1)
 		go s.decoderLoop()
 	}
@@ -184,7 +437,8 @@ func (s *Stream) Start(ctx context.Context, remoteAddr, localAddr *net.UDPAddr,
 	return nil
 }
 
-// Stop halts video stream reception
+// Stop halts video stream reception. A caller blocked in WaitForNextFrame
+// returns false, as does every later call, so a puller can loop until then.
 func (s *Stream) Stop() {
 	if s.cancel != nil {
 		s.cancel()
@@ -218,7 +472,8 @@ func (s *Stream) receiveLoop() {
 	}
 
 	buffer := make([]byte, bufferSize)
-	waitingMs := 0
+	startTime := time.Now()
+	lastDataTime := startTime
 
 	for {
 		select {
@@ -227,34 +482,34 @@ func (s *Stream) receiveLoop() {
 		default:
 		}
 
-		// Set read deadline
-		s.conn.SetReadDeadline(time.Now().Add(UDPRecvPollTimeout))
+		// Wake up in time to give up on a gap holding packets back
+		now := time.Now()
+		s.conn.SetReadDeadline(now.Add(s.queue.wait(now)))
 
 		n, _, err := s.conn.ReadFromUDP(buffer)
 		if err != nil {
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				if !s.receivedData {
-					waitingMs += int(UDPRecvPollTimeout / time.Millisecond)
-					if waitingMs >= FirstFrameTimeoutSec*1000 {
-						// Timeout waiting for video
-						return
-					}
+				now := time.Now()
+				for _, p := range s.queue.flush(now) {
+					s.processPacket(p)
+				}
+				s.flushFrames(now)
+				if s.checkTimeouts(startTime, lastDataTime) {
+					return
 				}
 				continue
 			}
 			return
 		}
 
+		lastDataTime = time.Now()
 		if !s.receivedData {
 			s.receivedData = true
-			s.firstDataTime = time.Now()
+			s.firstDataTime = lastDataTime
 		}
 
-		// Check for full frame timeout
-		if !s.receivedFullFrame {
-			if time.Since(s.firstDataTime) > FirstFrameTimeoutSec*time.Second {
-				return
-			}
+		if s.checkTimeouts(startTime, lastDataTime) {
+			return
 		}
 
 		// Process packet
@@ -263,12 +518,25 @@ func (s *Stream) receiveLoop() {
 			continue
 		}
 
-		s.queue.mu.Lock()
-		s.queue.stats.ReceivedPackets++
-		s.queue.mu.Unlock()
+		s.receivePacket(packet)
+	}
+}
+
+// receivePacket counts a parsed packet and passes it through the reorder
+// queue to frame assembly, unless it's a duplicate
+func (s *Stream) receivePacket(packet *RTPPacket) {
+	s.queue.mu.Lock()
+	s.queue.stats.ReceivedPackets++
+	s.queue.mu.Unlock()
+
+	// Drop retransmitted duplicates before they reach the frame
+	if s.queue.isDuplicate(packet.Header.SequenceNumber) {
+		return
+	}
 
-		// Add to queue/depacketizer
-		s.processPacket(packet)
+	// Reorder, then assemble frames in sequence
+	for _, p := range s.queue.push(packet) {
+		s.processPacket(p)
 	}
 }
 
@@ -312,10 +580,10 @@ func (s *Stream) pingLoop() {
 			n, err := s.conn.WriteToUDP(pingPacket, s.remoteAddr)
 			if firstPing {
 				if useSunshinePing {
-					log.Printf("Video ping (Sunshine) sent to %s: %d bytes, payload=%x, seq=%d, err=%v",
+					s.log.Debugf("Video ping (Sunshine) sent to %s: %d bytes, payload=%x, seq=%d, err=%v",
 						s.remoteAddr, n, pingPacket[:16], s.pingSeqNum, err)
 				} else {
-					log.Printf("Video ping (legacy) sent to %s: %d bytes, err=%v",
+					s.log.Debugf("Video ping (legacy) sent to %s: %d bytes, err=%v",
 						s.remoteAddr, n, err)
 				}
 				firstPing = false
@@ -324,6 +592,32 @@ func (s *Stream) pingLoop() {
 	}
 }
 
+// checkTimeouts reports whether the stream has waited too long for its first
+// frame, or for any traffic once streaming, and if so tells the termination
+// handler why
+func (s *Stream) checkTimeouts(startTime, lastDataTime time.Time) bool {
+	errorCode := 0
+	switch {
+	case !s.receivedData && time.Since(startTime) > s.firstFrameTimeout:
+		s.log.Warnf("No video received within %v", s.firstFrameTimeout)
+		errorCode = types.ErrNoVideoTraffic
+	case !s.receivedFullFrame && time.Since(startTime) > s.firstFrameTimeout:
+		s.log.Warnf("Video received but no complete frame within %v", s.firstFrameTimeout)
+		errorCode = types.ErrNoVideoFrame
+	case s.receivedFullFrame && s.noTrafficTimeout > 0 && time.Since(lastDataTime) > s.noTrafficTimeout:
+		s.log.Warnf("No video received for %v", s.noTrafficTimeout)
+		errorCode = types.ErrNoVideoTraffic
+	default:
+		return false
+	}
+
+	if s.onTerminated != nil {
+		// The handler may stop the stream, which waits for this goroutine
+		go s.onTerminated(errorCode)
+	}
+	return true
+}
+
 // decoderLoop processes completed frames
 func (s *Stream) decoderLoop() {
 	defer s.wg.Done()
@@ -336,10 +630,16 @@ func (s *Stream) decoderLoop() {
 			if unit == nil {
 				return
 			}
-			s.callbacks.SubmitDecodeUnit(unit)
+			ret := s.callbacks.SubmitDecodeUnit(unit)
 			s.queue.mu.Lock()
 			s.queue.stats.SubmittedFrames++
 			s.queue.mu.Unlock()
+
+			if ret == types.DrNeedIDR {
+				s.depacketizer.mu.Lock()
+				s.needIDRLocked()
+				s.depacketizer.mu.Unlock()
+			}
 		}
 	}
 }
@@ -360,6 +660,10 @@ func (s *Stream) parseRTPPacket(data []byte) (*RTPPacket, error) {
 			return nil, err
 		}
 		data = decrypted
+	} else {
+		// The receive buffer is reused, but packets are held until their
+		// FEC block completes
+		data = append([]byte(nil), data...)
 	}
 
 	// Parse RTP header
@@ -370,6 +674,12 @@ func (s *Stream) parseRTPPacket(data []byte) (*RTPPacket, error) {
 	header.SSRC = binary.BigEndian.Uint32(data[8:12])
 
 	payload = data[protocol.RTPHeaderSize:]
+	if header.Header&rtpFlagExtension != 0 {
+		if len(data) < protocol.MaxRTPHeaderSize {
+			return nil, ErrPacketTooSmall
+		}
+		payload = data[protocol.MaxRTPHeaderSize:]
+	}
 
 	return &RTPPacket{
 		Header:   header,
@@ -378,6 +688,9 @@ func (s *Stream) parseRTPPacket(data []byte) (*RTPPacket, error) {
 	}, nil
 }
 
+// rtpFlagExtension marks an RTP header followed by a 4-byte extension
+const rtpFlagExtension = 0x10
+
 // decryptPacket decrypts an encrypted video packet
 func (s *Stream) decryptPacket(data []byte) ([]byte, error) {
 	if len(data) < 28+protocol.RTPHeaderSize { // EncVideoHeader + RTP
@@ -398,68 +711,164 @@ func (s *Stream) decryptPacket(data []byte) ([]byte, error) {
 	return plaintext, nil
 }
 
-// processPacket handles a received RTP packet
+// processPacket handles a received RTP packet. Packets are collected by FEC
+// block until the shard counts in their NV headers say every block of the
+// frame can be rebuilt; see drainFramesLocked and completeFrameLocked.
 func (s *Stream) processPacket(packet *RTPPacket) {
 	s.depacketizer.mu.Lock()
 	defer s.depacketizer.mu.Unlock()
+	d := s.depacketizer
 
 	// Parse NV video header from payload
-	if len(packet.Payload) < 4 {
+	hdr, data, ok := parseNVVideoHeader(packet.Payload)
+	if !ok {
 		return
 	}
-
-	// Extract frame information from NV header
-	frameIndex := binary.LittleEndian.Uint32(packet.Payload[0:4])
+	frameIndex := hdr.FrameIndex
 	packet.FrameIndex = frameIndex
+	packet.Flags = hdr.Flags
 
-	// Check if this is an IDR frame
-	isIDR := (packet.Header.PacketType & 0x80) != 0
+	// Assemble frame
+	frame := d.frameLocked(frameIndex)
+	if frame == nil {
+		// Late packets of a frame already submitted or dropped, such as
+		// parity the frame turned out not to need, are of no use
+		if d.haveFrameNumber && int32(frameIndex-d.nextFrameNumber) < 0 {
+			return
+		}
 
-	// If waiting for IDR, drop non-IDR frames
-	if s.depacketizer.waitingForIDR && !isIDR {
-		return
+		frame = &FrameAssembly{
+			FrameNumber:  frameIndex,
+			Packets:      make([]*RTPPacket, 0),
+			StartTime:    packet.RecvTime,
+			RTPTimestamp: packet.Header.Timestamp,
+			lossPending:  d.haveFrameNumber && frameIndex != d.nextFrameNumber,
+			lossStart:    d.nextFrameNumber,
+			lossEnd:      frameIndex - 1,
+		}
+		d.frames = append(d.frames, frame)
+		d.nextFrameNumber = frameIndex + 1
+		d.haveFrameNumber = true
 	}
 
-	if isIDR {
-		s.depacketizer.waitingForIDR = false
-		s.receivedFullFrame = true
+	// Decoders get the bitstream only, without the NV header
+	packet.Payload = data
 
-		s.queue.mu.Lock()
-		s.queue.stats.ReceivedFrames++
-		s.queue.mu.Unlock()
+	if !frame.complete && frame.addShard(hdr, packet) && frame.recoverable() {
+		frame.complete = true
 	}
+	s.drainFramesLocked(packet.RecvTime)
+}
 
-	// Assemble frame
-	if s.depacketizer.currentFrame == nil || s.depacketizer.currentFrame.FrameNumber != frameIndex {
-		// Start new frame
-		if s.depacketizer.currentFrame != nil {
-			// Submit previous frame if complete
-			s.submitFrame(s.depacketizer.currentFrame)
+// frameLocked returns the frame being assembled with the given index, or nil.
+// Called with the depacketizer lock held.
+func (d *Depacketizer) frameLocked(frameIndex uint32) *FrameAssembly {
+	for _, f := range d.frames {
+		if f.FrameNumber == frameIndex {
+			return f
 		}
+	}
+	return nil
+}
+
+// maxAssemblingFrames bounds how many frames assemble at once; beyond it the
+// oldest incomplete frame is given up on at once
+const maxAssemblingFrames = 8
+
+// drainFramesLocked passes on the frames being assembled, in order, as they
+// complete. A frame still missing packets when the next one starts isn't
+// given up on straight away: packets the RTP queue passes on late, after
+// their gap timed out, may still complete it. It is dropped once a later
+// frame has been arriving for RTPQueueDelay. Called with the depacketizer
+// lock held.
+func (s *Stream) drainFramesLocked(now time.Time) {
+	d := s.depacketizer
+	for len(d.frames) > 0 {
+		frame := d.frames[0]
+		if !frame.complete {
+			if len(d.frames) == 1 ||
+				(len(d.frames) <= maxAssemblingFrames && now.Sub(d.frames[1].StartTime) < RTPQueueDelay) {
+				return
+			}
+		}
+
+		d.frames[0] = nil
+		d.frames = d.frames[1:]
+		if frame.complete {
+			s.completeFrameLocked(frame)
+			continue
+		}
+
+		// The frame lost more shards than FEC could make up for
+		s.queue.mu.Lock()
+		s.queue.stats.DroppedPackets += uint32(frame.missingData())
+		s.queue.mu.Unlock()
 
-		frameType := types.FrameTypePFrames
-		if isIDR {
-			frameType = types.FrameTypeIDR
+		lossStart := frame.FrameNumber
+		if frame.lossPending {
+			lossStart = frame.lossStart
 		}
+		s.frameLossLocked(lossStart, frame.FrameNumber)
+	}
+}
+
+// flushFrames gives up on incomplete frames that have waited long enough
+// while no packets arrive
+func (s *Stream) flushFrames(now time.Time) {
+	s.depacketizer.mu.Lock()
+	defer s.depacketizer.mu.Unlock()
+	s.drainFramesLocked(now)
+}
 
-		s.depacketizer.currentFrame = &FrameAssembly{
-			FrameNumber: frameIndex,
-			FrameType:   frameType,
-			Packets:     make([]*RTPPacket, 0),
-			StartTime:   time.Now(),
+// completeFrameLocked rebuilds a frame whose FEC blocks all have enough
+// shards, then submits it unless it has to be dropped. Called with the
+// depacketizer lock held.
+func (s *Stream) completeFrameLocked(frame *FrameAssembly) {
+	for _, b := range frame.blocks[:frame.lastBlock+1] {
+		packets, err := s.recoverBlockLocked(frame.FrameNumber, b)
+		if err != nil {
+			s.log.Debugf("Video frame %d FEC recovery failed: %v", frame.FrameNumber, err)
+			lossStart := frame.FrameNumber
+			if frame.lossPending {
+				lossStart = frame.lossStart
+			}
+			s.frameLossLocked(lossStart, frame.FrameNumber)
+			return
 		}
+		frame.Packets = append(frame.Packets, packets...)
+	}
+	frame.TotalPackets = len(frame.Packets)
+
+	reassemblyTime := time.Since(frame.StartTime)
+	s.queue.mu.Lock()
+	s.queue.stats.TotalReassemblyTime += uint32(reassemblyTime.Milliseconds())
+	s.queue.mu.Unlock()
+	s.reportFrameLocked(frame.FrameNumber, true)
+
+	// The frame header, and with it the frame type, is in the first data shard
+	first := frame.Packets[0]
+	frame.FrameType, first.Payload = parseFrameHeader(first.Payload)
+
+	// A keyframe needs nothing before it
+	if frame.lossPending && frame.FrameType != types.FrameTypeIDR {
+		s.frameLossLocked(frame.lossStart, frame.lossEnd)
+	}
+
+	if s.dropFrameLocked(frame.FrameType) {
+		return
 	}
 
-	// Add packet to frame
-	s.depacketizer.currentFrame.Packets = append(s.depacketizer.currentFrame.Packets, packet)
-	s.depacketizer.currentFrame.ReceivedPackets++
-	s.depacketizer.currentFrame.DataSize += len(packet.Payload)
+	if frame.FrameType == types.FrameTypeIDR {
+		s.depacketizer.waitingForIDR = false
+		s.depacketizer.waitingForRefInval = false
+		s.receivedFullFrame = true
 
-	// Check if frame is complete (simplified - real impl checks packet markers)
-	if (packet.Header.PacketType & 0x40) != 0 { // End of frame marker
-		s.submitFrame(s.depacketizer.currentFrame)
-		s.depacketizer.currentFrame = nil
+		s.queue.mu.Lock()
+		s.queue.stats.ReceivedFrames++
+		s.queue.mu.Unlock()
 	}
+
+	s.submitFrame(frame)
 }
 
 // submitFrame sends a completed frame to the decoder
@@ -472,8 +881,8 @@ func (s *Stream) submitFrame(frame *FrameAssembly) {
 	unit := &types.DecodeUnit{
 		FrameNumber:        frame.FrameNumber,
 		FrameType:          frame.FrameType,
-		EnqueueTimeMs:      uint64(time.Since(frame.StartTime).Milliseconds()),
-		PresentationTimeMs: uint64(time.Now().UnixMilli()),
+		EnqueueTimeMs:      uint64(frame.StartTime.UnixMilli()),
+		PresentationTimeMs: s.depacketizer.presentationTimeMs(frame.RTPTimestamp),
 	}
 
 	// Collect buffer descriptors
@@ -487,29 +896,187 @@ func (s *Stream) submitFrame(frame *FrameAssembly) {
 
 	// Direct submit or queue
 	if s.callbacks.Capabilities()&types.CapabilityDirectSubmit != 0 {
-		s.callbacks.SubmitDecodeUnit(unit)
+		ret := s.callbacks.SubmitDecodeUnit(unit)
 		s.queue.mu.Lock()
 		s.queue.stats.SubmittedFrames++
 		s.queue.mu.Unlock()
+
+		if ret == types.DrNeedIDR {
+			s.needIDRLocked()
+		}
 	} else {
 		select {
 		case s.depacketizer.frameQueue <- unit:
 		default:
-			// Queue full, drop frame
+			// Queue full, drop frame. Later P-frames reference it, so skip
+			// ahead to the next keyframe rather than feed the decoder garbage.
 			s.queue.mu.Lock()
 			s.queue.stats.DroppedFrames++
 			s.queue.mu.Unlock()
+
+			s.needIDRLocked()
+		}
+		s.checkQueueDepth()
+	}
+}
+
+// dropFrameLocked reports whether a frame of the given type has to be
+// dropped because it may reference frames the decoder doesn't have. Called
+// with the depacketizer lock held at the start of each frame.
+func (s *Stream) dropFrameLocked(frameType types.FrameType) bool {
+	d := s.depacketizer
+
+	// If waiting for IDR, drop the whole frame unless it is one
+	if d.waitingForIDR {
+		return frameType != types.FrameTypeIDR
+	}
+
+	if d.waitingForRefInval {
+		if frameType == types.FrameTypeIDR || frameType == types.FrameTypeRefInvalidated {
+			d.waitingForRefInval = false
+			return false
+		}
+		if time.Now().After(d.refInvalDeadline) {
+			s.log.Infof("Video recovery frame not received after invalidating from frame %d, requesting IDR", d.refInvalStart)
+			d.waitingForRefInval = false
+			s.needIDRLocked()
 		}
+		return true
 	}
+	return false
 }
 
-// WaitForNextFrame waits for and returns the next video frame
+// frameLossLocked handles frames start through end never arriving intact.
+// Short losses ask the host to invalidate just those reference frames, which
+// costs far less than a keyframe; frames are then dropped until the host's
+// recovery frame arrives. Long losses, or a loss that stretches an ongoing
+// recovery too far, request a full IDR. Called with the depacketizer lock
+// held.
+func (s *Stream) frameLossLocked(start, end uint32) {
+	d := s.depacketizer
+
+	s.queue.mu.Lock()
+	s.queue.stats.NetworkDroppedFrames += end - start + 1
+	s.queue.mu.Unlock()
+
+	for i := uint32(0); i < min(end-start+1, maxReportedLostFrames); i++ {
+		s.reportFrameLocked(start+i, false)
+	}
+
+	// An IDR already on its way replaces every lost frame
+	if d.waitingForIDR {
+		return
+	}
+
+	first := start
+	if d.waitingForRefInval {
+		first = d.refInvalStart
+	}
+	if s.onRefInvalidation == nil || end-first+1 > MaxRefInvalidationFrames {
+		s.log.Infof("Video frames %d-%d lost, requesting IDR", first, end)
+		d.waitingForRefInval = false
+		s.needIDRLocked()
+		return
+	}
+
+	d.waitingForRefInval = true
+	d.refInvalStart = first
+	d.refInvalDeadline = time.Now().Add(RefInvalidationTimeout)
+
+	s.queue.mu.Lock()
+	s.queue.stats.RefInvalidationRequests++
+	s.queue.stats.InvalidatedFrames += end - start + 1
+	s.queue.mu.Unlock()
+
+	// The handler goes out over the control stream; don't block packet
+	// processing on it
+	go s.onRefInvalidation(start, end)
+}
+
+// maxReportedLostFrames caps how many frames of one loss are reported to the
+// frame stats handler; a loss that long has the host sending an IDR anyway
+const maxReportedLostFrames = 120
+
+// reportFrameLocked tells the frame stats handler how a frame fared. Called
+// with the depacketizer lock held.
+func (s *Stream) reportFrameLocked(frameIndex uint32, isGood bool) {
+	if s.onFrameStats == nil {
+		return
+	}
+	s.onFrameStats(frameIndex, isGood)
+}
+
+// needIDRLocked drops frames until the next keyframe and asks the host for
+// one, unless a request is already outstanding. Called with the depacketizer
+// lock held.
+func (s *Stream) needIDRLocked() {
+	if s.depacketizer.waitingForIDR {
+		return
+	}
+	s.depacketizer.waitingForIDR = true
+	if s.onIDRRequest != nil {
+		// RequestIDRFrame takes the depacketizer lock we hold
+		go s.onIDRRequest()
+	}
+}
+
+// checkQueueDepth requests an IDR frame once the decode queue backs up past
+// the high watermark, so the decoder gets a fresh reference rather than a
+// mix of stale P-frames. Called with the depacketizer lock held.
+func (s *Stream) checkQueueDepth() {
+	depth := len(s.depacketizer.frameQueue)
+
+	if depth < QueueLowWatermark {
+		s.depacketizer.highWatermarkTriggered = false
+		return
+	}
+
+	if depth > s.highWatermark && !s.depacketizer.highWatermarkTriggered {
+		s.depacketizer.highWatermarkTriggered = true
+		s.log.Infof("Video decode queue at %d/%d frames, requesting IDR", depth, FrameQueueSize)
+		if s.onIDRRequest != nil {
+			// RequestIDRFrame takes the depacketizer lock we hold
+			go s.onIDRRequest()
+		}
+	}
+}
+
+// pullMode reports whether the renderer pulls frames with WaitForNextFrame.
+// Direct submission wins if both capabilities are set.
+func (s *Stream) pullMode() bool {
+	caps := s.callbacks.Capabilities()
+	return caps&types.CapabilityPullRenderer != 0 && caps&types.CapabilityDirectSubmit == 0
+}
+
+// WaitForNextFrame blocks until the next assembled frame is ready and
+// returns it. It's only for renderers with CapabilityPullRenderer, for which
+// no decoder goroutine runs, so the caller is the frame queue's only consumer;
+// otherwise it returns false straight away.
+//
+// A puller that falls behind isn't waited for: once the queue is full new
+// frames are dropped and a keyframe is requested, and the queue backing up
+// past the high watermark requests one too, so the caller resumes at an IDR
+// frame. A caller that can't use a frame it was given should request an IDR
+// frame itself, as SubmitDecodeUnit would by returning DrNeedIDR.
+//
+// It returns false once Stop is called, releasing a caller blocked in it;
+// frames still queued then are discarded.
 func (s *Stream) WaitForNextFrame() (*types.DecodeUnit, bool) {
+	if s.depacketizer == nil || !s.pullMode() {
+		return nil, false
+	}
+
 	select {
 	case <-s.ctx.Done():
 		return nil, false
 	case unit := <-s.depacketizer.frameQueue:
-		return unit, unit != nil
+		if unit == nil || s.ctx.Err() != nil {
+			return nil, false
+		}
+		s.queue.mu.Lock()
+		s.queue.stats.SubmittedFrames++
+		s.queue.mu.Unlock()
+		return unit, true
 	}
 }
 
@@ -517,7 +1084,7 @@ func (s *Stream) WaitForNextFrame() (*types.DecodeUnit, bool) {
 func (s *Stream) RequestIDRFrame() {
 	s.depacketizer.mu.Lock()
 	s.depacketizer.waitingForIDR = true
-	s.depacketizer.currentFrame = nil
+	s.depacketizer.frames = nil
 	s.depacketizer.mu.Unlock()
 
 	s.queue.mu.Lock()
@@ -0,0 +1,534 @@
+package video
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/zalo/moonparty/moonlight-common-go/fec"
+	"github.com/zalo/moonparty/moonlight-common-go/protocol"
+	"github.com/zalo/moonparty/moonlight-common-go/types"
+)
+
+// testShardSize is the bitstream each test packet carries after its NV header
+const testShardSize = 32
+
+// decoded records the frames a stream submits
+type decoded struct {
+	units []*types.DecodeUnit
+}
+
+func (d *decoded) Setup(types.VideoFormat, int, int, int, interface{}, int) error { return nil }
+func (d *decoded) Start()                                                         {}
+func (d *decoded) Stop()                                                          {}
+func (d *decoded) Cleanup()                                                       {}
+func (d *decoded) Capabilities() int                                              { return types.CapabilityDirectSubmit }
+
+func (d *decoded) SubmitDecodeUnit(unit *types.DecodeUnit) int {
+	d.units = append(d.units, unit)
+	return 0
+}
+
+// frames returns the numbers of the frames submitted so far
+func (d *decoded) frames() []uint32 {
+	var numbers []uint32
+	for _, u := range d.units {
+		numbers = append(numbers, u.FrameNumber)
+	}
+	return numbers
+}
+
+// bitstream joins a decode unit's buffers
+func bitstream(u *types.DecodeUnit) []byte {
+	var b []byte
+	for _, buf := range u.BufferList {
+		b = append(b, buf.Data[buf.Offset:buf.Offset+buf.Length]...)
+	}
+	return b
+}
+
+// newTestStream returns a stream ready for processPacket, without sockets or
+// goroutines, submitting frames to the returned recorder
+func newTestStream() (*Stream, *decoded) {
+	rec := &decoded{}
+	s := NewStream(types.StreamConfiguration{}, rec, "")
+	s.queue = &RTPQueue{packets: make(map[uint16]*RTPPacket)}
+	s.depacketizer = &Depacketizer{
+		frameQueue:    make(chan *types.DecodeUnit, FrameQueueSize),
+		waitingForIDR: true,
+	}
+	return s, rec
+}
+
+// videoFrame packetizes a frame as Sunshine does: an 8-byte frame header
+// ahead of data, split into testShardSize shards, dealt out to FEC blocks
+// of blockShards[i] data shards each with fecPercentage parity. The last
+// data shard is left short. It returns each block's packets, data shards
+// first, with the RTP header already stripped.
+func videoFrame(t *testing.T, frameIndex uint32, frameType byte, data []byte, fecPercentage int, blockShards ...int) [][]*RTPPacket {
+	t.Helper()
+
+	payload := append([]byte{frameHeaderShort, 0, 0, frameType, 0, 0, 0, 0}, data...)
+	var chunks [][]byte
+	for len(payload) > 0 {
+		n := min(testShardSize, len(payload))
+		chunks = append(chunks, payload[:n])
+		payload = payload[n:]
+	}
+
+	total := 0
+	for _, n := range blockShards {
+		total += n
+	}
+	if total != len(chunks) {
+		t.Fatalf("%d bytes make %d shards, not the %d the blocks hold", len(data), len(chunks), total)
+	}
+
+	var blocks [][]*RTPPacket
+	last := len(blockShards) - 1
+	for block, dataShards := range blockShards {
+		shards := chunks[:dataShards]
+		chunks = chunks[dataShards:]
+
+		parity := (dataShards*fecPercentage + 99) / 100
+		padded := make([][]byte, dataShards+parity)
+		for i := range padded {
+			padded[i] = make([]byte, testShardSize)
+			if i < dataShards {
+				copy(padded[i], shards[i])
+			}
+		}
+		if parity > 0 {
+			rs, err := fec.New(dataShards, parity)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := rs.Encode(padded); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var packets []*RTPPacket
+		for i := range padded {
+			shard := padded[i]
+			if i < dataShards {
+				shard = shards[i]
+			}
+
+			nv := make([]byte, nvVideoPacketSize, nvVideoPacketSize+len(shard))
+			binary.LittleEndian.PutUint32(nv[4:8], frameIndex)
+			nv[8] = FlagContainsPicData
+			nv[11] = byte(block<<4 | last<<6)
+			binary.LittleEndian.PutUint32(nv[12:16], uint32(i)<<12|uint32(dataShards)<<22|uint32(fecPercentage)<<4)
+			packets = append(packets, &RTPPacket{
+				Header:   protocol.RTPHeader{Timestamp: frameIndex * 1500},
+				Payload:  append(nv, shard...),
+				RecvTime: time.Now(),
+			})
+		}
+		blocks = append(blocks, packets)
+	}
+	return blocks
+}
+
+// send processes every packet of a frame except those whose block and shard
+// index are in drop
+func send(s *Stream, blocks [][]*RTPPacket, drop ...[2]int) {
+	for b, packets := range blocks {
+	next:
+		for i, p := range packets {
+			for _, d := range drop {
+				if d == [2]int{b, i} {
+					continue next
+				}
+			}
+			s.processPacket(p)
+		}
+	}
+}
+
+// testData returns n bytes of recognizable bitstream
+func testData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i*7 + 1)
+	}
+	return data
+}
+
+func TestFrameAssemblyOutOfOrder(t *testing.T) {
+	s, rec := newTestStream()
+	data := testData(5*testShardSize - 8)
+	packets := videoFrame(t, 1, ssFrameTypeIDR, data, 0, 5)[0]
+
+	// Every packet of the frame has to arrive before it's submitted,
+	// whichever comes last
+	for i := len(packets) - 1; i >= 0; i-- {
+		if len(rec.units) != 0 {
+			t.Fatalf("frame submitted with %d of %d packets", len(packets)-1-i, len(packets))
+		}
+		s.processPacket(packets[i])
+	}
+
+	if len(rec.units) != 1 {
+		t.Fatalf("submitted %d frames, want 1", len(rec.units))
+	}
+	if u := rec.units[0]; u.FrameType != types.FrameTypeIDR || !bytes.Equal(bitstream(u), data) {
+		t.Fatalf("submitted frame type %v with %d bytes, want an IDR frame of the %d sent",
+			u.FrameType, len(bitstream(u)), len(data))
+	}
+}
+
+func TestFECRecoversMultipleBlocks(t *testing.T) {
+	s, rec := newTestStream()
+
+	// Three blocks of 4 data shards with 50% parity; the last shard of the
+	// last block is 12 bytes short
+	data := testData(12*testShardSize - 8 - 12)
+	blocks := videoFrame(t, 1, ssFrameTypeIDR, data, 50, 4, 4, 4)
+
+	// Drop a data shard of the first block, both parity shards' worth of
+	// the second, and the short last shard of the third
+	send(s, blocks, [2]int{0, 1}, [2]int{1, 0}, [2]int{1, 3}, [2]int{2, 3})
+
+	if len(rec.units) != 1 {
+		t.Fatalf("submitted %d frames, want 1", len(rec.units))
+	}
+	// The rebuilt short shard comes back at full size, zero padded
+	want := append(append([]byte{}, data...), make([]byte, 12)...)
+	if got := bitstream(rec.units[0]); !bytes.Equal(got, want) {
+		t.Fatalf("rebuilt frame differs from the one sent:\n got % x\nwant % x", got, want)
+	}
+	if got := s.GetStats().RecoveredPackets; got != 4 {
+		t.Errorf("RecoveredPackets = %d, want 4", got)
+	}
+}
+
+func TestFECRecoversShortShardPresent(t *testing.T) {
+	s, rec := newTestStream()
+
+	// The short last shard arrives and is zero padded to rebuild another
+	data := testData(6*testShardSize - 8 - 20)
+	blocks := videoFrame(t, 1, ssFrameTypeIDR, data, 50, 3, 3)
+	send(s, blocks, [2]int{1, 0})
+
+	if len(rec.units) != 1 || !bytes.Equal(bitstream(rec.units[0]), data) {
+		t.Fatalf("submitted %d frames, want the one sent", len(rec.units))
+	}
+}
+
+func TestLossThenRefInvalidationThenRecovery(t *testing.T) {
+	s, rec := newTestStream()
+	invalidated := make(chan [2]uint32, 1)
+	s.SetRefInvalidationHandler(func(start, end uint32) { invalidated <- [2]uint32{start, end} })
+	idrRequested := make(chan struct{}, 1)
+	s.SetIDRRequestHandler(func() { idrRequested <- struct{}{} })
+
+	data := testData(4*testShardSize - 8)
+	send(s, videoFrame(t, 1, ssFrameTypeIDR, data, 50, 4))
+
+	// Frame 2 loses more than its parity can rebuild
+	send(s, videoFrame(t, 2, ssFrameTypePFrame, data, 50, 4), [2]int{0, 0}, [2]int{0, 1}, [2]int{0, 2})
+	// Frame 3 arrives whole, and once it has for RTPQueueDelay frame 2 is
+	// given up on
+	send(s, videoFrame(t, 3, ssFrameTypePFrame, data, 50, 4))
+	s.flushFrames(time.Now().Add(RTPQueueDelay))
+
+	select {
+	case got := <-invalidated:
+		if got != [2]uint32{2, 2} {
+			t.Fatalf("invalidated frames %d-%d, want 2-2", got[0], got[1])
+		}
+	case <-time.After(time.Second):
+		t.Fatal("losing frame 2 invalidated no reference frames")
+	}
+
+	// Frame 3 may reference frame 2, so it waits for the recovery frame
+	// with everything after it
+	send(s, videoFrame(t, 4, ssFrameTypePFrame, data, 50, 4))
+	if got := rec.frames(); len(got) != 1 || got[0] != 1 {
+		t.Fatalf("submitted frames %v while waiting for the recovery frame, want [1]", got)
+	}
+
+	// The host's recovery frame and those after it go through
+	send(s, videoFrame(t, 5, ssFrameTypeRefInvalid, data, 50, 4))
+	send(s, videoFrame(t, 6, ssFrameTypePFrame, data, 50, 4))
+	if got := rec.frames(); len(got) != 3 || got[1] != 5 || got[2] != 6 {
+		t.Fatalf("submitted frames %v, want [1 5 6]", got)
+	}
+	if rec.units[1].FrameType != types.FrameTypeRefInvalidated {
+		t.Errorf("recovery frame submitted as %v", rec.units[1].FrameType)
+	}
+
+	select {
+	case <-idrRequested:
+		t.Error("requested an IDR frame for a loss reference invalidation recovered")
+	default:
+	}
+	stats := s.GetStats()
+	if stats.RefInvalidationRequests != 1 || stats.NetworkDroppedFrames != 1 {
+		t.Errorf("RefInvalidationRequests = %d, NetworkDroppedFrames = %d, want 1 and 1",
+			stats.RefInvalidationRequests, stats.NetworkDroppedFrames)
+	}
+}
+
+func TestRefInvalidationTimesOutToIDR(t *testing.T) {
+	s, rec := newTestStream()
+	s.SetRefInvalidationHandler(func(start, end uint32) {})
+	idrRequested := make(chan struct{}, 1)
+	s.SetIDRRequestHandler(func() { idrRequested <- struct{}{} })
+
+	data := testData(4*testShardSize - 8)
+	send(s, videoFrame(t, 1, ssFrameTypeIDR, data, 0, 4))
+	send(s, videoFrame(t, 2, ssFrameTypePFrame, data, 0, 4), [2]int{0, 0})
+	send(s, videoFrame(t, 3, ssFrameTypePFrame, data, 0, 4))
+	s.flushFrames(time.Now().Add(RTPQueueDelay))
+
+	// No recovery frame comes in time
+	s.depacketizer.mu.Lock()
+	s.depacketizer.refInvalDeadline = time.Now().Add(-time.Millisecond)
+	s.depacketizer.mu.Unlock()
+	send(s, videoFrame(t, 4, ssFrameTypePFrame, data, 0, 4))
+
+	select {
+	case <-idrRequested:
+	case <-time.After(time.Second):
+		t.Fatal("no IDR requested once the recovery frame was overdue")
+	}
+
+	// Only a keyframe goes through after that
+	send(s, videoFrame(t, 5, ssFrameTypePFrame, data, 0, 4))
+	send(s, videoFrame(t, 6, ssFrameTypeIDR, data, 0, 4))
+	if got := rec.frames(); len(got) != 2 || got[1] != 6 {
+		t.Fatalf("submitted frames %v, want [1 6]", got)
+	}
+}
+
+func TestDuplicatePacketsDropped(t *testing.T) {
+	s, rec := newTestStream()
+	data := testData(4*testShardSize - 8)
+
+	var packets []*RTPPacket
+	for _, block := range videoFrame(t, 1, ssFrameTypeIDR, data, 50, 4) {
+		packets = append(packets, block...)
+	}
+	for i, p := range packets {
+		p.Header.SequenceNumber = uint16(100 + i)
+	}
+
+	// A retransmission repeats a packet right away, and another repeats one
+	// the queue has already passed on
+	for _, i := range []int{0, 1, 1, 2, 0, 3, 4, 5} {
+		p := *packets[i]
+		s.receivePacket(&p)
+	}
+
+	if len(rec.units) != 1 || !bytes.Equal(bitstream(rec.units[0]), data) {
+		t.Fatalf("submitted %d frames, want the one sent, intact", len(rec.units))
+	}
+	stats := s.GetStats()
+	if stats.DuplicatePackets != 2 || stats.ReceivedPackets != 8 {
+		t.Errorf("DuplicatePackets = %d, ReceivedPackets = %d, want 2 and 8",
+			stats.DuplicatePackets, stats.ReceivedPackets)
+	}
+}
+
+func TestPresentationTimeFromRTPTimestamp(t *testing.T) {
+	s, rec := newTestStream()
+	data := testData(4*testShardSize - 8)
+	received := time.UnixMilli(1_700_000_000_000)
+
+	// 60 fps at the 90 kHz clock, with the timestamp wrapping after frame 2
+	// and frame 4 late by a millisecond
+	base := uint32(0xffffffff - 2000)
+	for i, ticks := range []uint32{0, 1500, 3000, 4500 + 90} {
+		blocks := videoFrame(t, uint32(i+1), ssFrameTypeIDR, data, 0, 4)
+		for _, p := range blocks[0] {
+			p.Header.Timestamp = base + ticks
+			p.RecvTime = received.Add(time.Duration(i) * 20 * time.Millisecond)
+		}
+		send(s, blocks)
+	}
+
+	if len(rec.units) != 4 {
+		t.Fatalf("submitted %d frames, want 4", len(rec.units))
+	}
+	for i, want := range []uint64{0, 16, 33, 51} {
+		u := rec.units[i]
+		if u.PresentationTimeMs != want {
+			t.Errorf("frame %d: PresentationTimeMs = %d, want %d", u.FrameNumber, u.PresentationTimeMs, want)
+		}
+		if want := uint64(received.UnixMilli()) + uint64(i)*20; u.EnqueueTimeMs != want {
+			t.Errorf("frame %d: EnqueueTimeMs = %d, want %d", u.FrameNumber, u.EnqueueTimeMs, want)
+		}
+	}
+}
+
+// lossyRun streams frames from a simulated host that answers IDR requests
+// with a keyframe five times the size of a P-frame and reference frame
+// invalidations with a P-frame-sized recovery frame. Every lossEvery'th frame
+// loses more packets than FEC rebuilds. It returns the bytes the host sent.
+func lossyRun(t *testing.T, s *Stream, frames, lossEvery int, requests <-chan types.FrameType) int {
+	t.Helper()
+
+	pFrame := testData(4*testShardSize - 8)
+	keyframe := testData(20*testShardSize - 8)
+
+	sent := 0
+	next := types.FrameTypeIDR
+	for i := 1; i <= frames; i++ {
+		var blocks [][]*RTPPacket
+		switch next {
+		case types.FrameTypeIDR:
+			blocks = videoFrame(t, uint32(i), ssFrameTypeIDR, keyframe, 50, 4, 4, 4, 4, 4)
+		case types.FrameTypeRefInvalidated:
+			blocks = videoFrame(t, uint32(i), ssFrameTypeRefInvalid, pFrame, 50, 4)
+		default:
+			blocks = videoFrame(t, uint32(i), ssFrameTypePFrame, pFrame, 50, 4)
+		}
+		next = types.FrameTypePFrames
+
+		for _, packets := range blocks {
+			for _, p := range packets {
+				sent += len(p.Payload)
+			}
+		}
+		if i%lossEvery == 0 {
+			send(s, blocks, [2]int{0, 0}, [2]int{0, 1}, [2]int{0, 2})
+			continue
+		}
+		send(s, blocks)
+		s.flushFrames(time.Now().Add(RTPQueueDelay))
+
+		// The frame after a loss reveals it, and the host hears back
+		// before encoding the next
+		if i%lossEvery == 1 && i > 1 {
+			select {
+			case next = <-requests:
+			case <-time.After(time.Second):
+				t.Fatalf("losing frame %d requested no recovery", i-1)
+			}
+		}
+	}
+	return sent
+}
+
+func TestRefInvalidationSavesBandwidth(t *testing.T) {
+	const frames, lossEvery = 121, 10
+
+	requests := make(chan types.FrameType, 1)
+	idr, _ := newTestStream()
+	idr.SetIDRRequestHandler(func() { requests <- types.FrameTypeIDR })
+	idrBytes := lossyRun(t, idr, frames, lossEvery, requests)
+
+	rfi, rec := newTestStream()
+	rfi.SetIDRRequestHandler(func() { requests <- types.FrameTypeIDR })
+	rfi.SetRefInvalidationHandler(func(start, end uint32) { requests <- types.FrameTypeRefInvalidated })
+	rfiBytes := lossyRun(t, rfi, frames, lossEvery, requests)
+
+	// Each loss costs the lost frame and the one revealing it, and nothing
+	// more: the recovery frames go through
+	losses := uint32(frames / lossEvery)
+	stats := rfi.GetStats()
+	if stats.RequestedIDRFrames != 0 || stats.RefInvalidationRequests != losses {
+		t.Fatalf("requested %d IDRs and %d reference frame invalidations, want 0 and %d",
+			stats.RequestedIDRFrames, stats.RefInvalidationRequests, losses)
+	}
+	if got, want := len(rec.units), frames-2*int(losses); got != want {
+		t.Errorf("submitted %d frames, want %d", got, want)
+	}
+
+	if rfiBytes >= idrBytes {
+		t.Fatalf("host sent %d bytes recovering by invalidation, %d by IDR", rfiBytes, idrBytes)
+	}
+	t.Logf("%d losses in %d frames: %d bytes with invalidation, %d with IDRs, %.0f%% saved",
+		losses, frames, rfiBytes, idrBytes, 100*float64(idrBytes-rfiBytes)/float64(idrBytes))
+}
+
+func TestRTPQueueReorders(t *testing.T) {
+	q := &RTPQueue{packets: make(map[uint16]*RTPPacket)}
+	now := time.Now()
+	push := func(seq uint16) []uint16 {
+		var out []uint16
+		for _, p := range q.push(&RTPPacket{Header: protocol.RTPHeader{SequenceNumber: seq}, RecvTime: now}) {
+			out = append(out, p.Header.SequenceNumber)
+		}
+		return out
+	}
+	flush := func(at time.Time) []uint16 {
+		var out []uint16
+		for _, p := range q.flush(at) {
+			out = append(out, p.Header.SequenceNumber)
+		}
+		return out
+	}
+
+	// Packets wait behind a gap, across the sequence number wrapping, and
+	// go out in order once it fills
+	for _, step := range []struct {
+		seq  uint16
+		want []uint16
+	}{
+		{65534, []uint16{65534}},
+		{0, nil},
+		{1, nil},
+		{65535, []uint16{65535, 0, 1}},
+		{2, []uint16{2}},
+	} {
+		if got := push(step.seq); !slices.Equal(got, step.want) {
+			t.Fatalf("pushing %d released %v, want %v", step.seq, got, step.want)
+		}
+	}
+
+	// A gap that doesn't fill within RTPQueueDelay is given up on
+	if got := push(4); got != nil {
+		t.Fatalf("pushing 4 past a gap released %v", got)
+	}
+	if got := flush(now.Add(RTPQueueDelay / 2)); got != nil {
+		t.Fatalf("released %v before RTPQueueDelay", got)
+	}
+	if got := flush(now.Add(RTPQueueDelay)); !slices.Equal(got, []uint16{4}) {
+		t.Fatalf("released %v after RTPQueueDelay, want [4]", got)
+	}
+
+	// And the lost packet, arriving after all, isn't held back
+	if got := push(3); !slices.Equal(got, []uint16{3}) {
+		t.Fatalf("pushing 3 late released %v, want [3]", got)
+	}
+	if got := q.stats.OutOfOrderPackets; got != 2 {
+		t.Errorf("OutOfOrderPackets = %d, want 2", got)
+	}
+}
+
+func TestReorderedPacketsAssembleInOrder(t *testing.T) {
+	s, rec := newTestStream()
+	first := testData(4*testShardSize - 8)
+	second := testData(4*testShardSize - 16)
+
+	var packets []*RTPPacket
+	packets = append(packets, videoFrame(t, 1, ssFrameTypeIDR, first, 0, 4)[0]...)
+	packets = append(packets, videoFrame(t, 2, ssFrameTypePFrame, second, 0, 4)[0]...)
+	for i, p := range packets {
+		p.Header.SequenceNumber = uint16(i)
+	}
+
+	// Swapped neighbours, and the second frame starting before the first ends
+	for _, i := range []int{1, 0, 4, 3, 2, 6, 5, 7} {
+		s.receivePacket(packets[i])
+	}
+
+	if got := rec.frames(); !slices.Equal(got, []uint32{1, 2}) {
+		t.Fatalf("submitted frames %v, want [1 2]", got)
+	}
+	if !bytes.Equal(bitstream(rec.units[0]), first) {
+		t.Error("first frame assembled out of order")
+	}
+	if !bytes.Equal(bitstream(rec.units[1]), second) {
+		t.Error("second frame assembled out of order")
+	}
+	if got := s.GetStats().OutOfOrderPackets; got != 4 {
+		t.Errorf("OutOfOrderPackets = %d, want 4", got)
+	}
+}
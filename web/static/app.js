@@ -4,14 +4,28 @@ class MoonpartyClient {
     constructor() {
         this.ws = null;
         this.pc = null;
+        this.pendingCandidates = [];
         this.dataChannels = {};
         this.sessionInfo = null;
+        this.waitingRetry = null;
         this.gamepadLoop = null;
         this.gamepads = {};
+        this.gamepadReport = null; // Last gamepad_info sent, as JSON
+        this.gamepadBattery = null; // { level, charging } from setGamepadBattery
+        this.stickCalibration = null; // Sent as calibrate; null keeps the server's default
+        this.motionRates = {}; // Report rate in Hz by motion type the game asked for
+        this.motionSent = {}; // When each motion type was last sent
+        this.motionHandler = null;
+        this.voiceTransceiver = null;
+        this.micTrack = null;
+        this.voiceAudio = {};
 
         this.initElements();
         this.initEventListeners();
         this.connect();
+
+        // Batteries drain without any gamepad event, so check now and then
+        setInterval(() => this.reportGamepad(), 30000);
     }
 
     initElements() {
@@ -20,6 +34,7 @@ class MoonpartyClient {
         this.canvas = document.getElementById('canvas');
         this.loading = document.getElementById('loading');
         this.stats = document.getElementById('stats');
+        this.statQuality = document.getElementById('stat-quality');
 
         // Panel
         this.panel = document.getElementById('panel');
@@ -57,6 +72,7 @@ class MoonpartyClient {
 
         // Actions
         this.fullscreenBtn = document.getElementById('fullscreen-btn');
+        this.voiceBtn = document.getElementById('voice-btn');
         this.disconnectBtn = document.getElementById('disconnect-btn');
 
         // Touch
@@ -80,6 +96,9 @@ class MoonpartyClient {
         // Fullscreen
         this.fullscreenBtn.addEventListener('click', () => this.toggleFullscreen());
 
+        // Voice chat
+        this.voiceBtn.addEventListener('click', () => this.toggleVoice());
+
         // Disconnect
         this.disconnectBtn.addEventListener('click', () => this.disconnect());
 
@@ -103,6 +122,21 @@ class MoonpartyClient {
             }
         });
 
+        // A finger on the video points the host pointer there
+        const videoContainer = document.getElementById('video-container');
+        const onTouch = (e) => {
+            if (!this.captureMouse.checked || !this.canSendMouse()) return;
+            const touch = e.touches[0];
+            if (touch) this.sendMousePosition(touch.clientX, touch.clientY);
+        };
+        videoContainer.addEventListener('touchstart', onTouch, { passive: true });
+        videoContainer.addEventListener('touchmove', onTouch, { passive: true });
+
+        // A pen over the video draws on the host with its pressure and tilt
+        for (const type of ['pointerdown', 'pointermove', 'pointerup', 'pointercancel', 'pointerleave']) {
+            videoContainer.addEventListener(type, (e) => this.onPen(e));
+        }
+
         // Mouse events
         document.addEventListener('mousemove', (e) => this.onMouseMove(e));
         document.addEventListener('mousedown', (e) => this.onMouseButton(e, true));
@@ -113,6 +147,15 @@ class MoonpartyClient {
         document.addEventListener('keydown', (e) => this.onKeyDown(e));
         document.addEventListener('keyup', (e) => this.onKeyUp(e));
 
+        // Pasting types the clipboard on the host
+        document.addEventListener('paste', (e) => this.onPaste(e));
+
+        // Spectators stop receiving video while the tab is hidden
+        document.addEventListener('visibilitychange', () => {
+            if (this.sessionInfo?.role !== 'spectator') return;
+            this.sendMessage(document.hidden ? 'pause_video' : 'resume_video', {});
+        });
+
         // Check for touch device
         if ('ontouchstart' in window) {
             this.touchControls.classList.remove('hidden');
@@ -129,7 +172,33 @@ class MoonpartyClient {
         this.setStatus('connecting', 'Connecting...');
 
         const protocol = location.protocol === 'https:' ? 'wss:' : 'ws:';
-        const wsUrl = `${protocol}//${location.host}/ws`;
+        const params = new URLSearchParams();
+
+        // Reclaim our previous peer (role and slot) after a page refresh
+        const fingerprint = sessionStorage.getItem('moonparty-fingerprint');
+        if (fingerprint) {
+            params.set('fingerprint', fingerprint);
+        }
+
+        // ?mode=input attaches as a controller only, without receiving media
+        if (new URLSearchParams(location.search).get('mode') === 'input') {
+            params.set('mode', 'input');
+        }
+
+        // ?room=name joins (or starts) that room's session instead of the default one
+        const room = new URLSearchParams(location.search).get('room');
+        if (room) {
+            params.set('room', room);
+        }
+
+        // Pass through an access token from the page URL (?token=...)
+        const token = new URLSearchParams(location.search).get('token');
+        if (token) {
+            params.set('token', token);
+        }
+
+        const query = params.toString();
+        const wsUrl = `${protocol}//${location.host}/ws${query ? '?' + query : ''}`;
 
         try {
             this.ws = new WebSocket(wsUrl);
@@ -159,6 +228,9 @@ class MoonpartyClient {
             case 'answer':
                 this.handleAnswer(msg.payload);
                 break;
+            case 'offer':
+                this.handleOffer(msg.payload);
+                break;
             case 'ice_candidate':
                 this.handleICECandidate(msg.payload);
                 break;
@@ -174,11 +246,21 @@ class MoonpartyClient {
             case 'error':
                 this.handleError(msg.payload);
                 break;
+            case 'session_full':
+                this.handleSessionFull(msg.payload);
+                break;
+            case 'fingerprint':
+                sessionStorage.setItem('moonparty-fingerprint', msg.payload.value);
+                break;
+            case 'connection_quality':
+                this.handleConnectionQuality(msg.payload);
+                break;
         }
     }
 
     onWebSocketClose() {
         console.log('WebSocket closed');
+        if (this.waitingRetry) return; // In the waiting room
         this.setStatus('offline', 'Disconnected');
         this.loading.classList.remove('hidden');
         this.disconnectBtn.classList.add('hidden');
@@ -190,6 +272,9 @@ class MoonpartyClient {
     }
 
     handleSessionInfo(info) {
+        // Later session_info messages are roster updates for a session we're
+        // already streaming
+        const update = this.sessionInfo !== null;
         this.sessionInfo = info;
 
         this.sessionSection.classList.remove('hidden');
@@ -200,12 +285,25 @@ class MoonpartyClient {
         this.playersSection.classList.remove('hidden');
         this.updatePlayerList(info.players);
 
-        if (info.is_host) {
-            this.hostControls.classList.remove('hidden');
+        this.hostControls.classList.toggle('hidden', !info.is_host);
+        this.joinGameBtn.classList.toggle('hidden', info.role !== 'spectator');
+
+        if (update) {
+            return;
+        }
+
+        // A new connection starts without our gamepad
+        this.gamepadReport = null;
+        this.reportGamepad();
+        if (this.stickCalibration) {
+            this.sendMessage('calibrate', this.stickCalibration);
         }
 
-        if (info.role === 'spectator') {
-            this.joinGameBtn.classList.remove('hidden');
+        if (info.paused) {
+            this.handleSessionPaused(true);
+        }
+        if (info.restarting) {
+            this.handleStreamRestarting(true);
         }
 
         this.disconnectBtn.classList.remove('hidden');
@@ -216,14 +314,25 @@ class MoonpartyClient {
 
     async initWebRTC() {
         // Get ICE servers
-        const iceResponse = await fetch('/api/ice-servers');
+        const iceHeaders = {};
+        const token = new URLSearchParams(location.search).get('token');
+        if (token) {
+            iceHeaders['Authorization'] = `Bearer ${token}`;
+        }
+        const iceResponse = await fetch('/api/ice-servers', { headers: iceHeaders });
         const iceServers = await iceResponse.json();
 
         this.pc = new RTCPeerConnection({ iceServers });
+        this.pendingCandidates = [];
 
         // Handle incoming tracks
         this.pc.ontrack = (event) => {
             console.log('Track received:', event.track.kind);
+            const stream = event.streams[0];
+            if (stream?.id.startsWith('moonparty-voice-')) {
+                this.playVoice(stream);
+                return;
+            }
             if (event.track.kind === 'video') {
                 this.video.srcObject = event.streams[0];
                 this.loading.classList.add('hidden');
@@ -252,11 +361,18 @@ class MoonpartyClient {
             }
         };
 
+        // Receive the stream's video and audio, then offer a microphone
+        // after them, so the server matches its tracks to the right ones.
+        // Other peers' voices arrive on tracks the server adds later.
+        this.pc.addTransceiver('video', { direction: 'recvonly' });
+        this.pc.addTransceiver('audio', { direction: 'recvonly' });
+        if (!this.sessionInfo.input_only) {
+            this.voiceTransceiver = this.pc.addTransceiver('audio', { direction: 'sendrecv' });
+            this.voiceBtn.classList.remove('hidden');
+        }
+
         // Create offer
-        const offer = await this.pc.createOffer({
-            offerToReceiveVideo: true,
-            offerToReceiveAudio: true
-        });
+        const offer = await this.pc.createOffer();
         await this.pc.setLocalDescription(offer);
 
         this.sendMessage('offer', { sdp: offer.sdp });
@@ -270,20 +386,65 @@ class MoonpartyClient {
             sdp: payload.sdp
         });
         await this.pc.setRemoteDescription(answer);
+        await this.flushICECandidates();
+    }
+
+    async handleOffer(payload) {
+        if (!this.pc) return;
+
+        // Server-initiated renegotiation, e.g. after a video codec change
+        await this.pc.setRemoteDescription(new RTCSessionDescription({
+            type: 'offer',
+            sdp: payload.sdp
+        }));
+        const answer = await this.pc.createAnswer();
+        await this.pc.setLocalDescription(answer);
+
+        this.sendMessage('answer', { sdp: answer.sdp });
     }
 
     async handleICECandidate(payload) {
         if (!this.pc) return;
 
+        // The server trickles candidates right behind its answer; hold any
+        // that beat the answer until it's applied
+        if (!this.pc.remoteDescription) {
+            this.pendingCandidates.push(payload.candidate);
+            return;
+        }
+        await this.addICECandidate(payload.candidate);
+    }
+
+    async flushICECandidates() {
+        const pending = this.pendingCandidates;
+        this.pendingCandidates = [];
+        for (const candidate of pending) {
+            await this.addICECandidate(candidate);
+        }
+    }
+
+    async addICECandidate(candidate) {
         try {
-            const candidate = JSON.parse(payload.candidate);
-            await this.pc.addIceCandidate(candidate);
+            // An empty candidate marks the end of the server's candidates
+            await this.pc.addIceCandidate(candidate ? JSON.parse(candidate) : null);
         } catch (err) {
             console.error('Failed to add ICE candidate:', err);
         }
     }
 
+    handleSessionFull(payload) {
+        // Wait for a spectator to leave, trying again until there's room
+        this.setStatus('connecting',
+            `Session full (${payload.spectators}/${payload.max_spectators} watching), waiting for a place...`);
+        this.waitingRetry = setTimeout(() => {
+            this.waitingRetry = null;
+            this.connect();
+        }, payload.retry_after_sec * 1000);
+    }
+
     handlePlayerSlot(payload) {
+        this.joinGameBtn.textContent = 'Join Game';
+        this.joinGameBtn.disabled = false;
         this.sessionInfo.slot = payload.slot;
         this.sessionInfo.role = 'player';
         this.slotText.textContent = `Player ${payload.slot + 1}`;
@@ -293,15 +454,25 @@ class MoonpartyClient {
 
     handlePeerJoined(payload) {
         console.log('Peer joined:', payload);
+        this.sessionInfo.input_owner = payload.input_owner;
         this.updatePlayerList(payload.players);
     }
 
     handlePeerLeft(payload) {
         console.log('Peer left:', payload);
+        // The keyboard and mouse go back to the host if their owner left
+        this.sessionInfo.input_owner = payload.input_owner;
         this.updatePlayerList(payload.players);
     }
 
     handleError(payload) {
+        if (payload.code === 'slots_full') {
+            this.joinGameBtn.textContent =
+                `Queued #${payload.queue_position} (${payload.players}/${payload.max_players} players)`;
+            this.joinGameBtn.disabled = true;
+            return;
+        }
+
         console.error('Server error:', payload.error);
         alert('Error: ' + payload.error);
     }
@@ -318,6 +489,8 @@ class MoonpartyClient {
                 <span class="player-slot">${player.player_slot + 1}</span>
                 <span class="player-name">${player.name}</span>
                 ${player.role === 'host' ? '<span class="player-host">Host</span>' : ''}
+                ${player.id === this.sessionInfo?.input_owner ? '<span class="player-host">🖱️</span>' : ''}
+                ${player.reconnecting ? '<span class="player-reconnecting">reconnecting...</span>' : ''}
             `;
             this.playerList.appendChild(li);
         });
@@ -331,18 +504,27 @@ class MoonpartyClient {
     updateKeyboardToggles(players) {
         this.playerKeyboardToggles.innerHTML = '';
 
-        players.filter(p => p.role !== 'host').forEach(player => {
+        // Only one peer drives the cursor at a time; the host hands it over
+        players.forEach(player => {
+            const isHost = player.role === 'host';
+            const owner = player.id === this.sessionInfo.input_owner;
             const div = document.createElement('div');
             div.className = 'keyboard-toggle';
             div.innerHTML = `
                 <span>P${player.player_slot + 1}: ${player.name}</span>
-                <input type="checkbox" ${player.keyboard_enabled ? 'checked' : ''}
-                       data-peer-id="${player.id}">
+                ${isHost ? '' : `<input type="checkbox" ${player.keyboard_enabled ? 'checked' : ''}
+                       data-peer-id="${player.id}">`}
+                <button class="secondary" ${owner ? 'disabled' : ''}>
+                    ${owner ? 'Has mouse' : isHost ? 'Take mouse' : 'Give mouse'}
+                </button>
             `;
 
-            div.querySelector('input').addEventListener('change', (e) => {
+            div.querySelector('input')?.addEventListener('change', (e) => {
                 this.togglePlayerKeyboard(player.id, e.target.checked);
             });
+            div.querySelector('button').addEventListener('click', () => {
+                this.sendMessage('set_input_owner', { peer_id: player.id });
+            });
 
             this.playerKeyboardToggles.appendChild(div);
         });
@@ -355,11 +537,19 @@ class MoonpartyClient {
     togglePlayerKeyboard(peerId, enabled) {
         fetch('/api/player/keyboard', {
             method: 'POST',
-            headers: { 'Content-Type': 'application/json' },
+            headers: this.authHeaders({ 'Content-Type': 'application/json' }),
             body: JSON.stringify({ peer_id: peerId, enabled })
         });
     }
 
+    authHeaders(headers = {}) {
+        const token = new URLSearchParams(location.search).get('token');
+        if (token) {
+            headers['Authorization'] = `Bearer ${token}`;
+        }
+        return headers;
+    }
+
     sendMessage(type, payload) {
         if (this.ws && this.ws.readyState === WebSocket.OPEN) {
             this.ws.send(JSON.stringify({ type, payload }));
@@ -418,8 +608,14 @@ class MoonpartyClient {
 
     onMouseMove(event) {
         if (!this.captureMouse.checked) return;
-        if (!document.pointerLockElement) return;
         if (!this.canSendMouse()) return;
+        if (this.penOverVideo) return; // The pen moves the host pointer itself
+
+        // Without pointer lock the host pointer follows ours over the video
+        if (!document.pointerLockElement) {
+            this.sendMousePosition(event.clientX, event.clientY);
+            return;
+        }
 
         this.sendInput('mouse_rel', new Uint8Array([
             ...this.encodeInt16(event.movementX),
@@ -427,6 +623,101 @@ class MoonpartyClient {
         ]));
     }
 
+    // sendMousePosition moves the host pointer to a page position over the
+    // video, sent as fractions of the picture plus the size it's shown at
+    sendMousePosition(clientX, clientY) {
+        const rect = this.videoContentRect();
+        if (!rect) return;
+
+        const x = (clientX - rect.left) / rect.width;
+        const y = (clientY - rect.top) / rect.height;
+        if (x < 0 || x > 1 || y < 0 || y > 1) return;
+
+        this.sendInput('mouse_abs', new Uint8Array([
+            ...this.encodeInt16(Math.round(x * 0xFFFF)),
+            ...this.encodeInt16(Math.round(y * 0xFFFF)),
+            ...this.encodeInt16(Math.round(rect.width)),
+            ...this.encodeInt16(Math.round(rect.height))
+        ]));
+    }
+
+    // onPen sends a pen's pointer events over the video: where it is, how
+    // hard it presses, which way it leans and which barrel buttons are held
+    onPen(event) {
+        if (event.pointerType !== 'pen') return;
+        this.penOverVideo = event.type !== 'pointerleave';
+        if (!this.penOverVideo) return;
+        if (!this.captureMouse.checked || !this.canSendMouse()) return;
+
+        // Sunshine's touch event types: hover, down, up, move, cancel
+        const eventType = { pointerdown: 1, pointerup: 2, pointercancel: 4 }[event.type] ??
+                          (event.buttons & 1 ? 3 : 0);
+
+        const rect = this.videoContentRect();
+        if (!rect) return;
+        const x = (event.clientX - rect.left) / rect.width;
+        const y = (event.clientY - rect.top) / rect.height;
+        // A stroke dragged off the picture carries on along its edge
+        if ((eventType === 0 || eventType === 1) && (x < 0 || x > 1 || y < 0 || y > 1)) return;
+        const clamp = (v) => Math.max(0, Math.min(1, v));
+
+        event.preventDefault();
+
+        // The eraser end presses button 5; the barrel buttons are 2 and 3
+        const toolType = event.buttons & 32 || event.button === 5 ? 2 : 1;
+        const buttons = (event.buttons & 2 ? 0x01 : 0) | (event.buttons & 4 ? 0x02 : 0);
+        const { tilt, rotation } = this.penAngles(event);
+
+        this.sendInput('pen', new Uint8Array([
+            eventType,
+            toolType,
+            buttons,
+            ...this.encodeInt16(Math.round(clamp(x) * 0xFFFF)),
+            ...this.encodeInt16(Math.round(clamp(y) * 0xFFFF)),
+            ...this.encodeInt16(Math.round(clamp(event.pressure) * 0xFFFF)),
+            ...this.encodeInt16(rotation),
+            tilt
+        ]));
+    }
+
+    // penAngles returns how far a pen leans from upright and which way, in
+    // degrees clockwise from up, from its altitude and azimuth or, in
+    // browsers without those, its tilt along each axis
+    penAngles(event) {
+        let { altitudeAngle: altitude, azimuthAngle: azimuth } = event;
+        if (altitude === undefined) {
+            const tanX = Math.tan(event.tiltX * Math.PI / 180);
+            const tanY = Math.tan(event.tiltY * Math.PI / 180);
+            altitude = Math.atan(1 / Math.hypot(tanX, tanY));
+            azimuth = Math.atan2(tanY, tanX);
+        }
+
+        const tilt = Math.round(90 - altitude * 180 / Math.PI);
+        if (tilt <= 0) return { tilt: 0, rotation: 0xFFFF }; // Upright leans no way
+
+        // Azimuth runs clockwise from the right
+        const rotation = Math.round(azimuth * 180 / Math.PI + 90);
+        return { tilt: Math.min(tilt, 90), rotation: ((rotation % 360) + 360) % 360 };
+    }
+
+    // videoContentRect is where the picture is drawn inside the video
+    // element, which letterboxes it to keep its aspect ratio
+    videoContentRect() {
+        const box = this.video.getBoundingClientRect();
+        const { videoWidth, videoHeight } = this.video;
+        if (!videoWidth || !videoHeight || !box.width || !box.height) return null;
+
+        const scale = Math.min(box.width / videoWidth, box.height / videoHeight);
+        const width = videoWidth * scale;
+        const height = videoHeight * scale;
+        return {
+            left: box.left + (box.width - width) / 2,
+            top: box.top + (box.height - height) / 2,
+            width,
+            height
+        };
+    }
+
     onMouseButton(event, down) {
         if (!this.captureMouse.checked) return;
         if (!document.pointerLockElement) return;
@@ -444,9 +735,23 @@ class MoonpartyClient {
         if (!document.pointerLockElement) return;
         if (!this.canSendMouse()) return;
 
-        this.sendInput('mouse', new Uint8Array([
-            0x02, // Scroll action
-            ...this.encodeInt16(Math.sign(event.deltaY) * -120)
+        // Wheel units are 120 per notch, up and right positive. Trackpads
+        // report small pixel deltas, which pass through as fine scrolls.
+        const scale = event.deltaMode === WheelEvent.DOM_DELTA_LINE ? 40 :
+                      event.deltaMode === WheelEvent.DOM_DELTA_PAGE ? 120 * 3 : 1.2;
+        this.sendScroll(0, -event.deltaY * scale);
+        this.sendScroll(1, event.deltaX * scale);
+    }
+
+    // sendScroll sends a scroll on an axis (0 vertical, 1 horizontal) in
+    // wheel units
+    sendScroll(axis, amount) {
+        amount = Math.max(-32768, Math.min(32767, Math.round(amount)));
+        if (amount === 0) return;
+
+        this.sendInput('scroll', new Uint8Array([
+            axis,
+            ...this.encodeInt16(amount)
         ]));
     }
 
@@ -458,9 +763,9 @@ class MoonpartyClient {
     }
 
     canSendKeyboard() {
+        // Only the peer the host handed the keyboard and mouse to
         if (!this.sessionInfo) return false;
-        return this.sessionInfo.role === 'host' ||
-               (this.sessionInfo.role === 'player' && this.sessionInfo.keyboard_enabled);
+        return this.sessionInfo.input_owner === this.sessionInfo.peer_id;
     }
 
     canSendMouse() {
@@ -483,6 +788,7 @@ class MoonpartyClient {
         if (!this.gamepadLoop) {
             this.startGamepadLoop();
         }
+        this.reportGamepad();
     }
 
     onGamepadDisconnected(event) {
@@ -494,6 +800,36 @@ class MoonpartyClient {
             this.gamepadStatus.classList.remove('connected');
             this.stopGamepadLoop();
         }
+        this.reportGamepad();
+    }
+
+    // Tell the server which gamepad we hold, so games see our player slot as
+    // that kind of controller (PlayStation prompts for a DualSense)
+    reportGamepad() {
+        if (!this.sessionInfo || this.ws?.readyState !== WebSocket.OPEN) return;
+
+        const gamepad = navigator.getGamepads().find((g) => g);
+        const info = { id: gamepad?.id ?? '', battery: gamepad ? this.gamepadBattery : null };
+        const report = JSON.stringify(info);
+        if (report === this.gamepadReport) return;
+
+        this.gamepadReport = report;
+        this.sendMessage('gamepad_info', info);
+    }
+
+    // Correct drifting or inverted sticks: { deadzone, saturation } as
+    // fractions of full travel and invert_left_x/_y, invert_right_x/_y.
+    // The server applies it to our gamepad input from then on.
+    setStickCalibration(calibration) {
+        this.stickCalibration = calibration;
+        this.sendMessage('calibrate', calibration);
+    }
+
+    // The Gamepad API can't read batteries; WebHID integrations that can
+    // report them here, as a level from 0 to 1 and whether it's charging
+    setGamepadBattery(level, charging) {
+        this.gamepadBattery = { level, charging };
+        this.reportGamepad();
     }
 
     startGamepadLoop() {
@@ -694,8 +1030,68 @@ class MoonpartyClient {
         }
     }
 
+    // Voice chat
+
+    async toggleVoice() {
+        if (!this.voiceTransceiver) return;
+
+        // The first click asks for the microphone; later ones mute and unmute it
+        if (!this.micTrack) {
+            try {
+                const media = await navigator.mediaDevices.getUserMedia({
+                    audio: { echoCancellation: true, noiseSuppression: true }
+                });
+                this.micTrack = media.getAudioTracks()[0];
+            } catch (err) {
+                console.error('Microphone unavailable:', err);
+                alert('Microphone unavailable: ' + err.message);
+                return;
+            }
+            await this.voiceTransceiver.sender.replaceTrack(this.micTrack);
+        } else {
+            this.micTrack.enabled = !this.micTrack.enabled;
+        }
+
+        const muted = !this.micTrack.enabled;
+        this.sendMessage('voice_toggle', { muted });
+        this.voiceBtn.textContent = muted ? 'Unmute Voice' : 'Mute Voice';
+    }
+
+    playVoice(stream) {
+        if (this.voiceAudio[stream.id]) return;
+
+        const audio = new Audio();
+        audio.srcObject = stream;
+        audio.play().catch((err) => console.warn('Voice playback blocked:', err));
+        this.voiceAudio[stream.id] = audio;
+
+        // The server removes a voice when its speaker leaves
+        stream.onremovetrack = () => {
+            if (stream.getTracks().length > 0) return;
+            audio.srcObject = null;
+            delete this.voiceAudio[stream.id];
+        };
+    }
+
+    stopVoice() {
+        if (this.micTrack) {
+            this.micTrack.stop();
+            this.micTrack = null;
+        }
+        for (const audio of Object.values(this.voiceAudio)) {
+            audio.srcObject = null;
+        }
+        this.voiceAudio = {};
+        this.voiceTransceiver = null;
+        this.voiceBtn.textContent = 'Enable Voice';
+        this.voiceBtn.classList.add('hidden');
+    }
+
     disconnect() {
+        clearTimeout(this.waitingRetry);
+        this.waitingRetry = null;
         this.sendMessage('leave', {});
+        this.stopVoice();
 
         if (this.pc) {
             this.pc.close();
@@ -718,17 +1114,158 @@ class MoonpartyClient {
         this.joinGameBtn.classList.add('hidden');
         this.loading.classList.remove('hidden');
         this.stats.classList.add('hidden');
+        this.statQuality.classList.add('hidden');
         this.setStatus('offline', 'Disconnected');
 
         // Reconnect after a delay
         setTimeout(() => this.connect(), 2000);
     }
 
+    sendChat(text) {
+        const channel = this.dataChannels['chat'];
+        if (channel && channel.readyState === 'open') {
+            channel.send(text);
+        }
+    }
+
+    onPaste(e) {
+        if (!this.canSendKeyboard()) return;
+        const text = e.clipboardData?.getData('text/plain');
+        if (!text) return;
+        e.preventDefault();
+        this.sendClipboard(text);
+    }
+
+    sendClipboard(text) {
+        const channel = this.dataChannels['clipboard'];
+        if (!channel || channel.readyState !== 'open') return;
+
+        // Chunk by code point so surrogate pairs stay together
+        const chars = Array.from(text);
+        const size = 2048;
+        const total = Math.max(1, Math.ceil(chars.length / size));
+        const id = (this.clipboardId = ((this.clipboardId || 0) + 1) >>> 0);
+        for (let seq = 0; seq < total; seq++) {
+            const chunk = chars.slice(seq * size, (seq + 1) * size).join('');
+            channel.send(JSON.stringify({ id, seq, total, text: chunk }));
+        }
+    }
+
+    onRumble(rumble) {
+        // Rumble is addressed to our player slot, so every local pad plays it.
+        // It lasts until the next event; browsers cap an effect at 5 seconds.
+        for (const gamepad of navigator.getGamepads()) {
+            const actuator = gamepad?.vibrationActuator;
+            if (!actuator) continue;
+            if (!rumble.low_freq && !rumble.high_freq) {
+                actuator.reset?.();
+                continue;
+            }
+            actuator.playEffect('dual-rumble', {
+                duration: 5000,
+                strongMagnitude: rumble.low_freq / 0xFFFF,
+                weakMagnitude: rumble.high_freq / 0xFFFF,
+            }).catch(() => {});
+        }
+    }
+
+    onMotionEvent(event) {
+        // The game wants the accelerometer (1) or gyro (2) reported at a
+        // rate, or no longer reported when it's 0. The device's own motion
+        // sensors stand in for the controller's.
+        if (event.report_rate_hz > 0) {
+            this.motionRates[event.motion_type] = event.report_rate_hz;
+        } else {
+            delete this.motionRates[event.motion_type];
+        }
+
+        const wanted = Object.keys(this.motionRates).length > 0;
+        if (wanted && !this.motionHandler && 'DeviceMotionEvent' in window) {
+            this.motionHandler = (e) => this.onDeviceMotion(e);
+            // iOS only reports motion once permitted, which takes a user
+            // gesture; without one the request fails and nothing is sent
+            const permission = DeviceMotionEvent.requestPermission?.() ?? Promise.resolve('granted');
+            permission.then((state) => {
+                if (state === 'granted' && this.motionHandler) {
+                    window.addEventListener('devicemotion', this.motionHandler);
+                }
+            }).catch(() => {});
+        } else if (!wanted && this.motionHandler) {
+            window.removeEventListener('devicemotion', this.motionHandler);
+            this.motionHandler = null;
+        }
+    }
+
+    onDeviceMotion(event) {
+        // Acceleration is in m/s^2 and rotation in degrees per second, the
+        // units Sunshine takes
+        const accel = event.accelerationIncludingGravity;
+        const gyro = event.rotationRate;
+        if (accel) this.sendMotion(1, accel.x, accel.y, accel.z);
+        if (gyro) this.sendMotion(2, gyro.beta, gyro.gamma, gyro.alpha);
+    }
+
+    sendMotion(motionType, x, y, z) {
+        const rate = this.motionRates[motionType];
+        if (!rate) return;
+
+        // Browsers report faster than most games ask for
+        const now = performance.now();
+        if (now - (this.motionSent[motionType] ?? 0) < 1000 / rate) return;
+        this.motionSent[motionType] = now;
+
+        const data = new DataView(new ArrayBuffer(13));
+        data.setUint8(0, motionType);
+        data.setFloat32(1, x ?? 0, true);
+        data.setFloat32(5, y ?? 0, true);
+        data.setFloat32(9, z ?? 0, true);
+        this.sendInput('motion', new Uint8Array(data.buffer));
+    }
+
     onDataChannelMessage(label, data) {
         // Handle incoming data channel messages (stats, etc.)
+        if (label === 'chat') {
+            const msg = JSON.parse(data);
+            console.log(`[chat] ${msg.from}: ${msg.text}`);
+            return;
+        }
+        if (label === 'rumble') {
+            this.onRumble(JSON.parse(data));
+            return;
+        }
         if (label === 'control') {
             try {
                 const msg = JSON.parse(data);
+                if (msg.type === 'stats') {
+                    this.handleConnectionStats(msg.stats, msg.host_rtt_ms);
+                    return;
+                }
+                if (msg.type === 'player_slot') {
+                    this.handlePlayerSlot(msg);
+                    return;
+                }
+                if (msg.type === 'session_paused') {
+                    this.handleSessionPaused(msg.paused);
+                    return;
+                }
+                if (msg.type === 'stream_restarting') {
+                    this.handleStreamRestarting(msg.restarting);
+                    return;
+                }
+                if (msg.type === 'adaptive_triggers') {
+                    // Applied by WebHID DualSense integrations; no-op otherwise
+                    this.onAdaptiveTriggers?.(msg.payload);
+                    return;
+                }
+                if (msg.type === 'motion_event') {
+                    this.onMotionEvent(msg.payload);
+                    return;
+                }
+                if (msg.type === 'controller_led') {
+                    // Light bar color (WebHID)
+                    this.onControllerLED?.(msg.payload);
+                    return;
+                }
                 console.log('Control message:', msg);
             } catch (e) {
                 // Binary data
@@ -736,6 +1273,50 @@ class MoonpartyClient {
         }
     }
 
+    handleSessionPaused(paused) {
+        // The host dropped; the stream keeps running but input is held
+        if (paused) {
+            this.setStatus('connecting', 'Host reconnecting...');
+        } else {
+            this.setStatus('online', 'Connected');
+        }
+    }
+
+    handleStreamRestarting(restarting) {
+        // Sunshine dropped the stream; the server is starting it again and
+        // the picture stays frozen until it's back
+        if (restarting) {
+            this.setStatus('connecting', 'Stream restarting...');
+        } else {
+            this.setStatus('online', 'Connected');
+        }
+    }
+
+    handleConnectionStats(stats, hostRttMs) {
+        // Server-side view of this peer's connection health. Latency counts
+        // both hops: browser to server and server to Sunshine.
+        this.stats.classList.remove('hidden');
+        const latency = document.getElementById('stat-latency');
+        latency.textContent = `${Math.round(stats.rtt_ms + (hostRttMs || 0))} ms`;
+        latency.title = hostRttMs
+            ? `${Math.round(stats.rtt_ms)} ms to server + ${hostRttMs} ms to host`
+            : '';
+        if (stats.fraction_lost > 0.05) {
+            console.warn(`High packet loss: ${(stats.fraction_lost * 100).toFixed(1)}%, jitter ${stats.jitter_ms.toFixed(1)} ms`);
+        }
+    }
+
+    handleConnectionQuality(quality) {
+        // The server is losing frames from Sunshine, so everyone watching
+        // sees the same stutter whatever their own connection
+        this.statQuality.classList.toggle('hidden', !quality.poor);
+        this.statQuality.textContent = `Poor connection (${quality.loss_percent}% loss)`;
+        this.statQuality.title = quality.poor ? 'Frames are being lost between the host and the server' : '';
+        if (quality.poor) {
+            this.stats.classList.remove('hidden');
+        }
+    }
+
     startKeyboardCapture() {
         // Request keyboard lock for fullscreen (if supported)
         if (document.fullscreenElement && navigator.keyboard?.lock) {